@@ -7,10 +7,9 @@ git clone https://github.com/adjackura/caaos.git
 git clone https://kernel.googlesource.com/pub/scm/linux/kernel/git/torvalds/linux
 cp caaos/linux/.config linux/.config
 
-wget https://dl.google.com/go/go1.11.1.linux-amd64.tar.gz
-tar -C /usr/local -xzf go1.11.1.linux-amd64.tar.gz
+wget https://dl.google.com/go/go1.25.0.linux-amd64.tar.gz
+tar -C /usr/local -xzf go1.25.0.linux-amd64.tar.gz
 export PATH=$PATH:/usr/local/go/bin
-export GOPATH=$(go env GOPATH)
 
 # Setup the disk
 parted -s /dev/sdb mklabel gpt mkpart ESP fat32 1MiB 551MiB set 1 esp on mkpart primary ext4 551MiB 100%
@@ -39,21 +38,52 @@ refind-install --usedefault /dev/sdb1
 cp -r caaos/EFI /mnt/sdb1
 
 # Build init
-go get -d -u github.com/adjackura/caaos/init
-CGO_ENABLED=0 go build -ldflags '-s -w' -o /mnt/sdb2/sbin/init github.com/adjackura/caaos/init
+CGO_ENABLED=0 go -C caaos build -ldflags '-s -w' -o /mnt/sdb2/sbin/init ./init
 
 # Build caaos
-go get -d -u github.com/adjackura/caaos/services/caaos
-go build -tags 'netgo osusergo' -buildmode pie -ldflags '-s -w -extldflags "-static"' -o /mnt/sdb2/bin/caaos github.com/adjackura/caaos/services/caaos
+go -C caaos build -tags 'netgo osusergo' -buildmode pie -ldflags "-s -w -X main.version=$(git -C caaos describe --always) -extldflags '-static'" -o /mnt/sdb2/bin/caaos ./services/caaos
 
-# Build containerd
-go get -d -u github.com/containerd/containerd
-make -C $GOPATH/src/github.com/containerd/containerd EXTRA_FLAGS="-buildmode pie" EXTRA_LDFLAGS='-s -w -extldflags "-fno-PIC -static"' BUILDTAGS="no_cri no_btrfs netgo osusergo static_build"
-cp $GOPATH/src/github.com/containerd/containerd/bin/ctr /mnt/sdb2/bin/ctr
-cp $GOPATH/src/github.com/containerd/containerd/bin/containerd /mnt/sdb2/bin/containerd
-cp $GOPATH/src/github.com/containerd/containerd/bin/containerd-shim /mnt/sdb2/bin/containerd-shim
+# Build caaosctl
+CGO_ENABLED=0 go -C caaos build -ldflags '-s -w' -o /mnt/sdb2/bin/caaosctl ./caaosctl
+
+# Build containerd, the version caaos is built against in go.mod
+git clone --depth 1 --branch $(go -C caaos list -m -f '{{.Version}}' github.com/containerd/containerd) https://github.com/containerd/containerd.git
+make -C containerd EXTRA_FLAGS="-buildmode pie" EXTRA_LDFLAGS='-s -w -extldflags "-fno-PIC -static"' BUILDTAGS="no_cri no_btrfs netgo osusergo static_build"
+cp containerd/bin/ctr /mnt/sdb2/bin/ctr
+cp containerd/bin/containerd /mnt/sdb2/bin/containerd
+cp containerd/bin/containerd-shim-runc-v2 /mnt/sdb2/bin/containerd-shim-runc-v2
+
+# Build CNI plugins
+mkdir -p /mnt/sdb2/opt/cni/bin
+for plugin in main/bridge main/loopback ipam/host-local meta/portmap; do
+  GOBIN=/mnt/sdb2/opt/cni/bin CGO_ENABLED=0 go install -ldflags '-s -w' github.com/containernetworking/plugins/plugins/$plugin@v1.4.1
+done
 
 # Build runc
-go get -d -u github.com/opencontainers/runc
-make -C $GOPATH/src/github.com/opencontainers/runc static
-cp $GOPATH/src/github.com/opencontainers/runc/runc /mnt/sdb2/bin/runc
+git clone --depth 1 --branch v1.1.15 https://github.com/opencontainers/runc.git
+make -C runc static
+cp runc/runc /mnt/sdb2/bin/runc
+
+# Build gcsfuse for gcsfuse mounts
+GOBIN=/mnt/sdb2/bin CGO_ENABLED=0 go install -ldflags '-s -w' github.com/googlecloudplatform/gcsfuse/v2@v2.4.0
+
+# Build CRIU for checkpoint and restore, it is dynamically linked so its
+# libraries are copied too
+apt-get -y install libprotobuf-dev libprotobuf-c-dev protobuf-c-compiler protobuf-compiler python3-protobuf libcap-dev libnl-3-dev libnet-dev libaio-dev libgnutls28-dev
+git clone --depth 1 https://github.com/checkpoint-restore/criu.git
+make -C criu criu
+cp criu/criu/criu /mnt/sdb2/bin/criu
+for lib in $(ldd criu/criu/criu | grep -o '/[^ ]*'); do
+  mkdir -p /mnt/sdb2$(dirname $lib)
+  cp -L $lib /mnt/sdb2$lib
+done
+
+# Copy mkfs for formatting additional disks
+apt-get -y install e2fsprogs xfsprogs
+for bin in /sbin/mkfs.ext4 /sbin/mkfs.xfs; do
+  cp -L $bin /mnt/sdb2/bin/
+  for lib in $(ldd $bin | grep -o '/[^ ]*'); do
+    mkdir -p /mnt/sdb2$(dirname $lib)
+    cp -L $lib /mnt/sdb2$lib
+  done
+done
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// post sends a POST for path and copies the response to stdout.
+func post(path string) error {
+	resp, err := newClient().Post(baseURL()+path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func checkpoint(args []string) error {
+	fs := flag.NewFlagSet("checkpoint", flag.ExitOnError)
+	leaveRunning := fs.Bool("leave-running", false, "keep the container running after the checkpoint")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("checkpoint requires a container name and a gs:// URL")
+	}
+	q := url.Values{"dest": {fs.Arg(1)}}
+	if *leaveRunning {
+		q.Set("leave-running", "true")
+	}
+	return post("/v1/checkpoint/" + url.PathEscape(fs.Arg(0)) + "?" + q.Encode())
+}
+
+func restore(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("restore requires a container name and a gs:// URL")
+	}
+	q := url.Values{"src": {args[1]}}
+	return post("/v1/restore/" + url.PathEscape(args[0]) + "?" + q.Encode())
+}
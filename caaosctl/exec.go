@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Frame types sent by the agent, see services/caaos/exec.go.
+const (
+	execStdout byte = 1
+	execStderr byte = 2
+	execExit   byte = 3
+)
+
+// makeRaw puts the terminal on fd into raw mode and returns a function
+// restoring it.
+func makeRaw(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, unix.TCSETS, old) }, nil
+}
+
+// execCmd runs a command in a container and returns its exit code.
+func execCmd(args []string) (int, error) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	tty := fs.Bool("t", false, "allocate a TTY")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return 0, fmt.Errorf("exec requires a container name")
+	}
+
+	q := url.Values{"arg": fs.Args()[1:]}
+	if *tty {
+		q.Set("tty", "true")
+		if ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ); err == nil {
+			q.Set("rows", strconv.Itoa(int(ws.Row)))
+			q.Set("cols", strconv.Itoa(int(ws.Col)))
+		}
+	}
+	req, err := http.NewRequest("POST", baseURL()+"/v1/exec/"+url.PathEscape(fs.Arg(0))+"?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "caaos-exec")
+	if err := authorize(req); err != nil {
+		return 0, err
+	}
+
+	conn, err := dial(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := req.Write(conn); err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if *tty {
+		restore, err := makeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return 0, err
+		}
+		defer restore()
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return 0, fmt.Errorf("connection closed before the command exited: %v", err)
+		}
+		b := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(br, b); err != nil {
+			return 0, err
+		}
+		switch hdr[0] {
+		case execStdout:
+			os.Stdout.Write(b)
+		case execStderr:
+			os.Stderr.Write(b)
+		case execExit:
+			return int(binary.BigEndian.Uint32(b)), nil
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runRecord matches the agent's history records.
+type runRecord struct {
+	Name      string    `json:"name"`
+	Image     string    `json:"image"`
+	Kind      string    `json:"kind"`
+	StartTime time.Time `json:"start-time"`
+	Duration  float64   `json:"duration-seconds"`
+	ExitCode  uint32    `json:"exit-code"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error"`
+	LogTail   []string  `json:"log-tail"`
+}
+
+func getJSON(path string, v interface{}) error {
+	resp, err := newClient().Get(baseURL() + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// history lists the containers with recorded runs, or the runs of one
+// container, newest first.
+func history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "print the last lines of output of each run")
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+		var names []string
+		if err := getJSON("/v1/history/", &names); err != nil {
+			return err
+		}
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("history takes at most one container name")
+	}
+
+	var runs []runRecord
+	if err := getJSON("/v1/history/"+url.PathEscape(fs.Arg(0)), &runs); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tDURATION\tEXIT\tRESULT\tIMAGE\tERROR")
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		d := time.Duration(r.Duration * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", r.StartTime.Local().Format(time.RFC3339), d, r.ExitCode, r.Result, r.Image, r.Error)
+		if *verbose {
+			tw.Flush()
+			for _, l := range r.LogTail {
+				fmt.Println("    " + l)
+			}
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,139 @@
+// caaosctl talks to the caaos agent over its control socket.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var socket = flag.String("socket", "/run/caaos/caaos.sock", "path to the caaos control socket")
+
+const usage = `Usage: caaosctl [-socket path | -address host:port [-token-file path] [-tls-ca file]
+                [-tls-cert file -tls-key file]] <command> [args]
+
+Commands:
+  logs [-f] <name>                 print the buffered output of a container, -f follows new output
+  events [name]                    stream lifecycle events of the containers, or of one
+                                   container, as server-sent events
+  exec [-t] <name> [command...]    run a command in a running container, -t allocates a TTY,
+                                   the command defaults to /bin/sh
+  history [-v] [name]              list containers with recorded runs, or the runs of a job or
+                                   scheduled container, -v prints the end of each run's output
+  checkpoint [-leave-running] <name> <gs://bucket/object>
+                                   checkpoint a running container to Cloud Storage and stop it,
+                                   -leave-running keeps it running
+  restore <name> <gs://bucket/object>
+                                   restore a container from a checkpoint, restarting it if it
+                                   is running
+  stats [-no-stream]               show CPU, memory, network and block IO usage of the running
+                                   containers, refreshed every second
+  validate [file]                  check a spec, or attributes as user data, read from file or
+                                   stdin: resolve its images and print the OCI specs the
+                                   containers would run with, without running them
+`
+
+func newClient() *http.Client {
+	return &http.Client{
+		Transport: authTransport{&http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial(ctx)
+			},
+			// TLS is set up by dial.
+			DialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial(ctx)
+			},
+		}},
+	}
+}
+
+// get copies the response for path to stdout.
+func get(path string) error {
+	resp, err := newClient().Get(baseURL() + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func logs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "follow new output")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("logs requires a container name")
+	}
+	path := "/v1/logs/" + url.PathEscape(fs.Arg(0))
+	if *follow {
+		path += "?follow=true"
+	}
+	return get(path)
+}
+
+func events(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("events takes at most one container name")
+	}
+	path := "/v1/events"
+	if len(args) == 1 {
+		path += "?container=" + url.QueryEscape(args[0])
+	}
+	return get(path)
+}
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "logs":
+		err = logs(args)
+	case "events":
+		err = events(args)
+	case "history":
+		err = history(args)
+	case "checkpoint":
+		err = checkpoint(args)
+	case "restore":
+		err = restore(args)
+	case "stats":
+		err = stats(args)
+	case "exec":
+		var code int
+		code, err = execCmd(args)
+		if err == nil {
+			os.Exit(code)
+		}
+	case "validate":
+		var code int
+		code, err = validate(args)
+		if err == nil {
+			os.Exit(code)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "caaosctl:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	address   = flag.String("address", "", "host:port of the agent's control API served over TCP, used instead of -socket")
+	tokenFile = flag.String("token-file", "/run/caaos/control-token", "file with the bearer token for -address, $CAAOS_TOKEN takes precedence")
+	tlsCA     = flag.String("tls-ca", "", "PEM CA bundle to verify the agent's certificate, setting any -tls flag connects with TLS")
+	tlsCert   = flag.String("tls-cert", "", "PEM client certificate for agents requiring mTLS")
+	tlsKey    = flag.String("tls-key", "", "PEM private key of -tls-cert")
+)
+
+// useTLS reports whether -address is connected to with TLS.
+func useTLS() bool {
+	return *tlsCA != "" || *tlsCert != "" || *tlsKey != ""
+}
+
+// baseURL is the URL requests for API paths are made relative to.
+func baseURL() string {
+	switch {
+	case *address == "":
+		return "http://caaos"
+	case useTLS():
+		return "https://" + *address
+	}
+	return "http://" + *address
+}
+
+func tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(*address)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{ServerName: host}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *tlsCA)
+		}
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// dial connects to the agent's control socket, or to -address.
+func dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	if *address == "" {
+		return d.DialContext(ctx, "unix", *socket)
+	}
+	if !useTLS() {
+		return d.DialContext(ctx, "tcp", *address)
+	}
+	cfg, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	td := &tls.Dialer{NetDialer: &d, Config: cfg}
+	return td.DialContext(ctx, "tcp", *address)
+}
+
+// authorize adds the control token to requests sent to -address.
+func authorize(req *http.Request) error {
+	if *address == "" {
+		return nil
+	}
+	token := os.Getenv("CAAOS_TOKEN")
+	if token == "" {
+		b, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading control token: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// authTransport authorizes each request before sending it.
+type authTransport struct {
+	http.RoundTripper
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if err := authorize(req); err != nil {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
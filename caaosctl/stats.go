@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// containerStats matches the agent's stats samples.
+type containerStats struct {
+	Name            string  `json:"name"`
+	CPUPercent      float64 `json:"cpu-percent"`
+	MemoryBytes     uint64  `json:"memory-bytes"`
+	MemoryLimit     uint64  `json:"memory-limit-bytes"`
+	NetRxBytes      *uint64 `json:"net-rx-bytes"`
+	NetTxBytes      *uint64 `json:"net-tx-bytes"`
+	BlockReadBytes  uint64  `json:"block-read-bytes"`
+	BlockWriteBytes uint64  `json:"block-write-bytes"`
+	Pids            uint64  `json:"pids"`
+}
+
+// stats prints the usage of the running containers, refreshed every second
+// until interrupted unless -no-stream is set.
+func stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	noStream := fs.Bool("no-stream", false, "print one sample and exit")
+	fs.Parse(args)
+	path := "/v1/stats"
+	if !*noStream {
+		path += "?stream=true"
+	}
+	resp, err := newClient().Get(baseURL() + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var sample []containerStats
+		if err := dec.Decode(&sample); err != nil {
+			if *noStream {
+				return err
+			}
+			return fmt.Errorf("stats stream ended: %v", err)
+		}
+		if !*noStream {
+			// Clear the screen like top.
+			fmt.Print("\033[2J\033[H")
+		}
+		printStats(sample)
+		if *noStream {
+			return nil
+		}
+	}
+}
+
+func printStats(sample []containerStats) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tBLOCK I/O\tPIDS")
+	for _, s := range sample {
+		limit, memPercent := "-", "-"
+		if s.MemoryLimit > 0 {
+			limit = humanBytes(s.MemoryLimit)
+			memPercent = fmt.Sprintf("%.2f%%", float64(s.MemoryBytes)/float64(s.MemoryLimit)*100)
+		}
+		netIO := "-"
+		if s.NetRxBytes != nil && s.NetTxBytes != nil {
+			netIO = humanBytes(*s.NetRxBytes) + " / " + humanBytes(*s.NetTxBytes)
+		}
+		fmt.Fprintf(tw, "%s\t%.2f%%\t%s / %s\t%s\t%s\t%s / %s\t%d\n", s.Name, s.CPUPercent,
+			humanBytes(s.MemoryBytes), limit, memPercent, netIO,
+			humanBytes(s.BlockReadBytes), humanBytes(s.BlockWriteBytes), s.Pids)
+	}
+	tw.Flush()
+}
+
+// humanBytes formats n with a binary unit, e.g. 1.5MiB.
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// validate sends a spec, read from a file or stdin, to the agent to be
+// checked without running it. It returns 1 if the spec is invalid.
+func validate(args []string) (int, error) {
+	var b []byte
+	var err error
+	switch len(args) {
+	case 0:
+		b, err = ioutil.ReadAll(os.Stdin)
+	case 1:
+		b, err = ioutil.ReadFile(args[0])
+	default:
+		return 0, fmt.Errorf("validate takes at most one file")
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp, err := newClient().Post(baseURL()+"/v1/spec?dry-run=true", "application/yaml", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return 0, err
+	case http.StatusUnprocessableEntity:
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return 1, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
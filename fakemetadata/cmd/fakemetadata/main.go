@@ -0,0 +1,42 @@
+// fakemetadata serves a fake GCE metadata server for running caaos outside
+// of GCE, pointed at it with -metadata-provider gce -metadata-endpoint.
+// Attributes are changed through /fake/, see e2e.sh.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/adjackura/caaos/fakemetadata"
+)
+
+var (
+	address    = flag.String("address", "127.0.0.1:8080", "address to serve on")
+	attributes = flag.String("attributes", "", `JSON file with the initial attributes, {"instance": {...}, "project": {...}}`)
+	projectID  = flag.String("project-id", "fake-project", "project/project-id")
+	instanceID = flag.String("instance-id", "1", "instance/id")
+	zone       = flag.String("zone", "projects/1/zones/fake-zone-a", "instance/zone")
+)
+
+func main() {
+	flag.Parse()
+	var a fakemetadata.Attributes
+	if *attributes != "" {
+		b, err := ioutil.ReadFile(*attributes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &a); err != nil {
+			log.Fatalf("Error parsing %s: %v", *attributes, err)
+		}
+	}
+	s := fakemetadata.New(a)
+	s.SetValue("project/project-id", *projectID)
+	s.SetValue("instance/id", *instanceID)
+	s.SetValue("instance/zone", *zone)
+	log.Printf("serving fake metadata on %s", *address)
+	log.Fatal(http.ListenAndServe(*address, s))
+}
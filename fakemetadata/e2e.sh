@@ -0,0 +1,74 @@
+#! /bin/bash
+# Runs caaos against the fake metadata server and a real containerd, checks
+# that a container is started, replaced when the spec changes and stopped
+# when it is removed. Needs root and containerd listening on
+# $CONTAINERD_ADDRESS.
+
+set -euo pipefail
+
+CONTAINERD_ADDRESS=${CONTAINERD_ADDRESS:-/run/containerd/containerd.sock}
+NAMESPACE=${NAMESPACE:-caaos-e2e}
+PORT=${PORT:-18080}
+IMAGE=${IMAGE:-docker.io/library/busybox:latest}
+TIMEOUT=${TIMEOUT:-120}
+
+dir=$(mktemp -d)
+fake=http://127.0.0.1:$PORT
+pids=()
+cleanup() {
+	for pid in "${pids[@]}"; do
+		kill "$pid" 2>/dev/null || true
+		wait "$pid" 2>/dev/null || true
+	done
+	rm -rf "$dir"
+}
+trap cleanup EXIT
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+go build -o "$dir/fakemetadata" "$root/fakemetadata/cmd/fakemetadata"
+go build -o "$dir/caaos" "$root/services/caaos"
+
+"$dir/fakemetadata" -address "127.0.0.1:$PORT" &
+pids+=($!)
+
+"$dir/caaos" -metadata-provider gce -metadata-endpoint "$fake" \
+	-containerd-address "$CONTAINERD_ADDRESS" -namespace "$NAMESPACE" \
+	-health-address "" -audit-log "" -log-format text \
+	-boot-network-timeout 0 -boot-dns-timeout 0 -boot-clock-timeout 0 \
+	>"$dir/caaos.log" 2>&1 &
+pids+=($!)
+
+fail() {
+	echo "FAIL: $*"
+	echo "--- caaos log"
+	cat "$dir/caaos.log"
+	exit 1
+}
+
+set_spec() {
+	curl -sf -X PUT --data-binary "$1" "$fake/fake/instance/attributes/caaos-spec"
+}
+
+# wait_for <description> <jq filter on the guest attributes>
+wait_for() {
+	for _ in $(seq "$TIMEOUT"); do
+		if curl -sf "$fake/fake/guest-attributes" | jq -e "$2" >/dev/null 2>&1; then
+			echo "ok: $1"
+			return
+		fi
+		sleep 1
+	done
+	fail "timed out waiting for $1"
+}
+
+set_spec "{\"containers\": [{\"name\": \"e2e\", \"image\": \"$IMAGE\", \"command\": [\"sleep\", \"3600\"]}]}"
+wait_for "container running" '.["caaos/status-e2e"] | fromjson | .state == "running"'
+first=$(curl -sf "$fake/fake/guest-attributes" | jq -r '.["caaos/status-e2e"] | fromjson | .id')
+
+set_spec "{\"containers\": [{\"name\": \"e2e\", \"image\": \"$IMAGE\", \"command\": [\"sleep\", \"3601\"]}]}"
+wait_for "container replaced" ".[\"caaos/status-e2e\"] | fromjson | .state == \"running\" and .id != \"$first\""
+
+curl -sf -X DELETE "$fake/fake/instance/attributes/caaos-spec"
+wait_for "container stopped" '.["caaos/status-e2e"] | fromjson | .state != "running"'
+
+echo PASS
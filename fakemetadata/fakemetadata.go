@@ -0,0 +1,333 @@
+// Package fakemetadata is a fake GCE metadata server for running caaos
+// outside of GCE, pointed at it with -metadata-provider gce
+// -metadata-endpoint. Tests serve it with httptest.NewServer and change it
+// with its methods, the fakemetadata command serves it on an address and
+// changes it through /fake/, see e2e.sh.
+package fakemetadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metadataPrefix = "/computeMetadata/v1/"
+
+// maxHang caps timeout_sec of wait_for_change requests, as the real server
+// does.
+const maxHang = 5 * time.Minute
+
+// Attributes are the instance and project attributes served.
+type Attributes struct {
+	Instance map[string]string `json:"instance"`
+	Project  map[string]string `json:"project"`
+}
+
+// Server is the fake metadata server.
+type Server struct {
+	mx        sync.Mutex
+	attrs     Attributes
+	values    map[string]string
+	guest     map[string]string
+	failUntil time.Time
+	// changed is closed and replaced on every change, waking hanging
+	// GETs.
+	changed chan struct{}
+}
+
+// New returns a server serving a, copied so that the caller's maps are
+// left as they are. Other values are those of an instance 1 in
+// fake-project, see SetValue.
+func New(a Attributes) *Server {
+	s := &Server{
+		attrs: Attributes{Instance: map[string]string{}, Project: map[string]string{}},
+		values: map[string]string{
+			"project/project-id": "fake-project",
+			"instance/id":        "1",
+			"instance/zone":      "projects/1/zones/fake-zone-a",
+			"instance/preempted": "FALSE",
+			// The agent only looks at the value, not its format.
+			"instance/maintenance-event": "NONE",
+		},
+		guest:   map[string]string{},
+		changed: make(chan struct{}),
+	}
+	for k, v := range a.Instance {
+		s.attrs.Instance[k] = v
+	}
+	for k, v := range a.Project {
+		s.attrs.Project[k] = v
+	}
+	return s
+}
+
+// target returns the map holding path, "instance/attributes/<key>",
+// "project/attributes/<key>" or "values/<path>", and the key in it, s.mx
+// must be held.
+func (s *Server) target(path string) (map[string]string, string, error) {
+	var m map[string]string
+	var key string
+	switch {
+	case strings.HasPrefix(path, "instance/attributes/"):
+		m, key = s.attrs.Instance, strings.TrimPrefix(path, "instance/attributes/")
+	case strings.HasPrefix(path, "project/attributes/"):
+		m, key = s.attrs.Project, strings.TrimPrefix(path, "project/attributes/")
+	case strings.HasPrefix(path, "values/"):
+		m, key = s.values, strings.TrimPrefix(path, "values/")
+	}
+	if m == nil || key == "" {
+		return nil, "", fmt.Errorf("unknown path %q", path)
+	}
+	return m, key, nil
+}
+
+// Set sets the attribute or value at path, "instance/attributes/<key>",
+// "project/attributes/<key>" or "values/<path>", waking hanging GETs.
+func (s *Server) Set(path, value string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	m, key, err := s.target(path)
+	if err != nil {
+		return err
+	}
+	m[key] = value
+	s.notify()
+	return nil
+}
+
+// Delete removes the attribute or value at path, see Set.
+func (s *Server) Delete(path string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	m, key, err := s.target(path)
+	if err != nil {
+		return err
+	}
+	delete(m, key)
+	s.notify()
+	return nil
+}
+
+// SetValue sets a value other than an attribute, e.g. instance/preempted.
+func (s *Server) SetValue(path, value string) {
+	s.Set("values/"+path, value)
+}
+
+// GuestAttributes returns the guest attributes written, keyed by
+// namespace/key.
+func (s *Server) GuestAttributes() map[string]string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	guest := make(map[string]string, len(s.guest))
+	for k, v := range s.guest {
+		guest[k] = v
+	}
+	return guest
+}
+
+// Fail makes metadata requests, including hanging GETs, fail with 503 for
+// d.
+func (s *Server) Fail(d time.Duration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.failUntil = time.Now().Add(d)
+	s.notify()
+}
+
+// failing reports whether requests fail, s.mx must be held.
+func (s *Server) failing() bool {
+	return time.Now().Before(s.failUntil)
+}
+
+// notify wakes hanging GETs, s.mx must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// value returns the value at path, or the recursive listing for the root,
+// s.mx must be held.
+func (s *Server) value(path string) (string, bool) {
+	switch path {
+	case "":
+		b, _ := json.Marshal(map[string]interface{}{
+			"instance": map[string]interface{}{"attributes": s.attrs.Instance},
+			"project":  map[string]interface{}{"attributes": s.attrs.Project},
+		})
+		return string(b), true
+	case "instance/attributes/":
+		return keys(s.attrs.Instance), true
+	case "project/attributes/":
+		return keys(s.attrs.Project), true
+	}
+	if k := strings.TrimPrefix(path, "instance/attributes/"); k != path {
+		v, ok := s.attrs.Instance[k]
+		return v, ok
+	}
+	if k := strings.TrimPrefix(path, "project/attributes/"); k != path {
+		v, ok := s.attrs.Project[k]
+		return v, ok
+	}
+	if k := strings.TrimPrefix(path, "instance/guest-attributes/"); k != path {
+		v, ok := s.guest[k]
+		return v, ok
+	}
+	v, ok := s.values[path]
+	return v, ok
+}
+
+func keys(m map[string]string) string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return strings.Join(ks, "\n")
+}
+
+func etag(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/fake/"):
+		s.serveFake(w, r)
+	case r.URL.Path == "/computeMetadata/v1" || strings.HasPrefix(r.URL.Path, metadataPrefix):
+		s.serveMetadata(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveMetadata serves GETs with wait_for_change, last_etag and
+// timeout_sec, and PUTs of guest attributes.
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Metadata-Flavor", "Google")
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1"), "/")
+
+	if r.Method == "PUT" {
+		k := strings.TrimPrefix(path, "instance/guest-attributes/")
+		if k == path || strings.Count(k, "/") != 1 {
+			http.Error(w, "only guest attributes can be written", http.StatusForbidden)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		if s.failing() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.guest[k] = string(b)
+		s.notify()
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	wait := q.Get("wait_for_change") == "true"
+	hang := maxHang
+	if t, err := strconv.Atoi(q.Get("timeout_sec")); err == nil && t > 0 && time.Duration(t)*time.Second < hang {
+		hang = time.Duration(t) * time.Second
+	}
+	timeout := time.After(hang)
+	for {
+		s.mx.Lock()
+		failing := s.failing()
+		v, ok := s.value(path)
+		changed := s.changed
+		s.mx.Unlock()
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		tag := etag(v)
+		// A last_etag of NONE, or any other that doesn't match, returns
+		// right away.
+		if !wait || q.Get("last_etag") != tag {
+			w.Header().Set("ETag", tag)
+			if path == "" || q.Get("alt") == "json" {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			w.Write([]byte(v))
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			w.Header().Set("ETag", tag)
+			w.Write([]byte(v))
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveFake changes the server's state:
+//
+//	PUT/DELETE /fake/{instance,project}/attributes/<key>
+//	PUT /fake/values/<path>             any other value, e.g. instance/preempted
+//	GET /fake/guest-attributes          all guest attributes as JSON
+//	POST /fake/fail?for=<duration>      return 503s, e.g. to test offline-fallback
+func (s *Server) serveFake(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/fake/")
+	switch {
+	case path == "guest-attributes" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.GuestAttributes())
+		return
+	case path == "fail" && r.Method == "POST":
+		d, err := time.ParseDuration(r.URL.Query().Get("for"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Fail(d)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "PUT":
+		var b []byte
+		if b, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = s.Set(path, string(b))
+	case "DELETE":
+		err = s.Delete(path)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
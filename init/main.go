@@ -78,6 +78,23 @@ func cgroupList() []string {
 	return list
 }
 
+// unifiedCgroups reports whether the kernel command line asks for the
+// cgroup v2 unified hierarchy, with cgroup_no_v1=all or the systemd
+// parameter.
+func unifiedCgroups() bool {
+	b, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		logger.Printf("cannot read /proc/cmdline: %v", err)
+		return false
+	}
+	for _, arg := range strings.Fields(string(b)) {
+		if arg == "cgroup_no_v1=all" || arg == "systemd.unified_cgroup_hierarchy=1" {
+			return true
+		}
+	}
+	return false
+}
+
 func write(path string, value string) {
 	err := ioutil.WriteFile(path, []byte(value), 0600)
 	if err != nil {
@@ -125,7 +142,16 @@ func mounts() {
 	// sysfs
 	mkdir("/sys", 0755)
 	mount("sysfs", "/sys", "sysfs", noexec|nosuid|nodev, "")
+	// Secure Boot state and the TPM event log, used by caaos's integrity gate
+	if _, err := os.Stat("/sys/firmware/efi/efivars"); err == nil {
+		mount("efivarfs", "/sys/firmware/efi/efivars", "efivarfs", readonly|noexec|nosuid|nodev, "")
+	}
+	mount("securityfs", "/sys/kernel/security", "securityfs", noexec|nosuid|nodev, "")
 
+	if unifiedCgroups() {
+		mountCgroup2()
+		return
+	}
 	// mount cgroup root tmpfs
 	mount("cgroup_root", "/sys/fs/cgroup", "tmpfs", nodev|noexec|nosuid, "mode=755,size=10m")
 	// mount cgroups filesystems for all enabled cgroups
@@ -139,10 +165,28 @@ func mounts() {
 	write("/sys/fs/cgroup/memory/memory.use_hierarchy", "1")
 }
 
+// mountCgroup2 mounts the cgroup v2 unified hierarchy and enables all of
+// its controllers for the containers' cgroups.
+func mountCgroup2() {
+	mount("cgroup2", "/sys/fs/cgroup", "cgroup2", noexec|nosuid|nodev, "nsdelegate")
+	b, err := ioutil.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil {
+		logger.Printf("cannot read cgroup controllers: %v", err)
+		return
+	}
+	var enable []string
+	for _, c := range strings.Fields(string(b)) {
+		enable = append(enable, "+"+c)
+	}
+	write("/sys/fs/cgroup/cgroup.subtree_control", strings.Join(enable, " "))
+}
+
 type systemService struct {
 	name, desc, path string
 	args             []string
 	running          bool
+	cmd              *exec.Cmd
+	exited           chan struct{}
 	mx               sync.RWMutex
 }
 
@@ -162,10 +206,24 @@ func (s *systemService) start() error {
 		logger.Fatalln(err)
 	}
 
+	exited := make(chan struct{})
+	s.mx.Lock()
+	s.cmd = cmd
+	s.exited = exited
+	s.running = true
+	s.mx.Unlock()
+
 	go func() {
 		if err := cmd.Wait(); err != nil {
 			logger.Println(err)
 		}
+		s.mx.Lock()
+		s.running = false
+		s.mx.Unlock()
+		close(exited)
+		if isShuttingDown() {
+			return
+		}
 		s.start()
 	}()
 	return nil
@@ -230,5 +288,5 @@ func main() {
 		systemServices[k].start()
 	}
 
-	select {}
+	handleShutdown(keys)
 }
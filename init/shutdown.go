@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// stopTimeout is how long each service is given to exit after SIGTERM
+	// before it is killed.
+	stopTimeout = 60 * time.Second
+
+	evKey    = 0x01
+	keyPower = 116
+)
+
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// stop sends SIGTERM to the service and waits for it to exit, sending
+// SIGKILL if it does not exit within stopTimeout.
+func (s *systemService) stop() {
+	s.mx.RLock()
+	cmd, exited, running := s.cmd, s.exited, s.running
+	s.mx.RUnlock()
+	if !running || cmd == nil || cmd.Process == nil {
+		return
+	}
+
+	logger.Println("Stopping", s.name)
+	if err := cmd.Process.Signal(unix.SIGTERM); err != nil {
+		logger.Printf("error signaling %s: %v", s.name, err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		logger.Printf("%s did not exit after %s, killing", s.name, stopTimeout)
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// powerButtonDevice finds the evdev node for the ACPI power button.
+func powerButtonDevice() string {
+	f, err := os.Open("/proc/bus/input/devices")
+	if err != nil {
+		logger.Printf("cannot open /proc/bus/input/devices: %v", err)
+		return ""
+	}
+	defer f.Close()
+
+	var isPower bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			isPower = false
+		case strings.HasPrefix(line, "N: "):
+			isPower = strings.Contains(line, `Name="Power Button"`)
+		case isPower && strings.HasPrefix(line, "H: Handlers="):
+			for _, h := range strings.Fields(strings.TrimPrefix(line, "H: Handlers=")) {
+				if strings.HasPrefix(h, "event") {
+					return filepath.Join("/dev/input", h)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// watchPowerButton calls fn when the ACPI power button is pressed, this is
+// how GCE asks the guest to shut down when the instance is stopped.
+func watchPowerButton(fn func()) {
+	dev := powerButtonDevice()
+	if dev == "" {
+		logger.Println("no power button found")
+		return
+	}
+	f, err := os.Open(dev)
+	if err != nil {
+		logger.Printf("cannot open power button %s: %v", dev, err)
+		return
+	}
+	defer f.Close()
+
+	// struct input_event: struct timeval, __u16 type, __u16 code, __s32 value
+	var ev struct {
+		Sec, Usec  int64
+		Type, Code uint16
+		Value      int32
+	}
+	for {
+		if err := binary.Read(f, binary.LittleEndian, &ev); err != nil {
+			logger.Printf("error reading power button %s: %v", dev, err)
+			return
+		}
+		if ev.Type == evKey && ev.Code == keyPower && ev.Value == 1 {
+			fn()
+			return
+		}
+	}
+}
+
+// handleShutdown waits for SIGTERM, SIGINT (sent by the kernel on
+// ctrl-alt-del) or a power button press, then stops services in the reverse
+// order they were started and powers off.
+func handleShutdown(keys []string) {
+	// Have the kernel send SIGINT rather than rebooting immediately.
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_CAD_OFF); err != nil {
+		logger.Printf("error disabling ctrl-alt-del: %v", err)
+	}
+
+	reason := make(chan string, 1)
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, unix.SIGTERM, unix.SIGINT)
+	go func() {
+		reason <- (<-sigC).String()
+	}()
+	go watchPowerButton(func() {
+		reason <- "power button"
+	})
+
+	logger.Printf("Shutting down (%s)", <-reason)
+	atomic.StoreInt32(&shuttingDown, 1)
+	for i := len(keys) - 1; i >= 0; i-- {
+		systemServices[keys[i]].stop()
+	}
+
+	logger.Println("Powering off")
+	unix.Sync()
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
+		logger.Printf("error powering off: %v", err)
+	}
+	select {}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/platforms"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// isArchiveImage reports whether image is the URL of an OCI or Docker image
+// archive, gs://bucket/object or an HTTP(S) URL, rather than a reference.
+func isArchiveImage(image string) bool {
+	return strings.HasPrefix(image, "gs://") || strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "http://")
+}
+
+func validateArchiveURL(image string) error {
+	if strings.HasPrefix(image, "gs://") {
+		_, _, err := parseGCSURL(image)
+		return err
+	}
+	u, err := url.Parse(image)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%q is not a valid URL", image)
+	}
+	return nil
+}
+
+// importArchive downloads the image archive at the URL c.Image and imports
+// it into the image store under that name, so that it is only downloaded
+// again if the pull policy is always. Names in the archive are ignored, they
+// could replace images pulled from a registry.
+func (r *runner) importArchive(ctx context.Context, logger *Logger, c ContainerSpec) (_ containerd.Image, err error) {
+	deadline := r.pullDeadline
+	if deadline == 0 {
+		deadline = defaultPullDeadline
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	ctx, span := startSpan(ctx, "image.import", attribute.String("image", c.Image))
+	defer func() { endSpan(span, err) }()
+
+	opts := []containerd.ImportOpt{
+		containerd.WithIndexName(c.Image),
+		containerd.WithImageRefTranslator(func(string) string { return "" }),
+	}
+	if c.Platform != "" {
+		p, err := platforms.Parse(c.Platform)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, containerd.WithImportPlatform(platforms.Only(p)))
+	}
+
+	logger.Info("downloading image archive", c.Image)
+	start := time.Now()
+	body, err := downloadArchive(ctx, c.Image)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if _, err := r.imagePuller().Import(ctx, body, opts...); err != nil {
+		return nil, fmt.Errorf("error importing %s: %v", c.Image, err)
+	}
+	d := time.Since(start)
+	logger.With("event", "pulled", "duration_seconds", d.Seconds()).Infof("imported image archive %s in %s", c.Image, d.Round(time.Millisecond))
+
+	img, err := r.localImage(ctx, c.Image, c.Platform)
+	if err != nil {
+		return nil, err
+	}
+	return img, unpack(ctx, img, r.snapshotter)
+}
+
+// downloadArchive returns the body of the image archive at u, read from GCS
+// with the service account's credentials for gs:// URLs.
+func downloadArchive(ctx context.Context, u string) (io.ReadCloser, error) {
+	if strings.HasPrefix(u, "gs://") {
+		return downloadGCS(ctx, u)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Audited actions.
+const (
+	auditSpecReceived = "spec-received"
+	auditImagePulled  = "image-pulled"
+	auditStarted      = "container-started"
+	auditStopped      = "container-stopped"
+	auditDenied       = "policy-denied"
+	auditShutdown     = "shutdown"
+)
+
+// fsAppendFL is FS_APPEND_FL, files with it set can only be appended to,
+// even by root, until it is cleared.
+const fsAppendFL = 0x20
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Container string    `json:"container,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	SpecHash  string    `json:"spec-hash,omitempty"`
+	ExitCode  *uint32   `json:"exit-code,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// auditLog records the agent's decisions for compliance review, to an
+// append-only file and, if audit-cloud-logging is set, to Cloud Logging
+// under the caaos-audit log name.
+type auditLog struct {
+	mx    sync.Mutex
+	f     *os.File
+	cloud *cloudLogSink
+}
+
+var audit = &auditLog{}
+
+// open opens the audit file at path, creating it if needed. The file is
+// marked append-only where the filesystem supports it.
+func (a *auditLog) open(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if flags, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS); err == nil && flags&fsAppendFL == 0 {
+		flags |= fsAppendFL
+		if err := unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, flags); err != nil {
+			logger.Debug("audit log can't be made append-only:", err)
+		}
+	}
+	a.mx.Lock()
+	a.f = f
+	a.mx.Unlock()
+	return nil
+}
+
+// configure starts or stops sending records to Cloud Logging.
+func (a *auditLog) configure(ctx context.Context, cloud bool) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if cloud == (a.cloud != nil) {
+		return
+	}
+	if !cloud {
+		a.cloud.Close()
+		a.cloud = nil
+		return
+	}
+	cl, err := newCloudLogSink(detach(ctx), cloudAuditLogName)
+	if err != nil {
+		logger.Error("Error setting up Cloud Logging for the audit log:", err)
+		return
+	}
+	a.cloud = cl
+}
+
+func (a *auditLog) record(r auditRecord) {
+	r.Time = time.Now().UTC()
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if a.f != nil {
+		b, err := json.Marshal(r)
+		if err == nil {
+			_, err = a.f.Write(append(b, '\n'))
+		}
+		if err != nil {
+			logger.Error("Error writing audit log:", err)
+		}
+	}
+	if a.cloud != nil {
+		severity := "NOTICE"
+		if r.Action == auditDenied {
+			severity = "WARNING"
+		}
+		labels := map[string]string{"action": r.Action}
+		if r.Container != "" {
+			labels["container"] = r.Container
+		}
+		a.cloud.add(map[string]interface{}{
+			"timestamp":   r.Time.Format(time.RFC3339Nano),
+			"severity":    severity,
+			"labels":      labels,
+			"jsonPayload": r,
+		})
+	}
+}
+
+// close flushes records to Cloud Logging and syncs the file.
+func (a *auditLog) close() {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if a.cloud != nil {
+		a.cloud.Close()
+		a.cloud = nil
+	}
+	if a.f != nil {
+		a.f.Sync()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+const (
+	tokenUsername = "oauth2accesstoken"
+)
+
+// registryCredential is a static credential from the registry-auth attribute.
+type registryCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type tokenJSON struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// tokenSource caches the default service account token from the metadata
+// server.
+type tokenSource struct {
+	mx     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+var saToken = &tokenSource{}
+
+func (t *tokenSource) get(ctx context.Context) (string, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	// Refresh a little early so the token doesn't expire mid pull.
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	req, err := http.NewRequest("GET", metadataBase+"instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	req = req.WithContext(ctx)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching service account token: %s", resp.Status)
+	}
+
+	var tok tokenJSON
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	t.token = tok.AccessToken
+	t.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// isGoogleRegistry reports whether host is a GCR or Artifact Registry host
+// that accepts service account tokens.
+func isGoogleRegistry(host string) bool {
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+// parseRegistryAuth parses the registry-auth attribute, a JSON object
+// mapping registry hosts to credentials.
+func parseRegistryAuth(s string) (map[string]registryCredential, error) {
+	creds := map[string]registryCredential{}
+	if s == "" {
+		return creds, nil
+	}
+	if err := json.Unmarshal([]byte(s), &creds); err != nil {
+		return nil, fmt.Errorf("error parsing registry-auth: %v", err)
+	}
+	return creds, nil
+}
+
+// newResolver returns a docker resolver that uses static credentials when
+// available and falls back to the default service account token for Google
+// registries. rc configures mirrors and TLS per registry.
+func newResolver(ctx context.Context, creds map[string]registryCredential, rc *registryConfig) remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: rc.registryHosts(func(host string) (string, string, error) {
+			if c, ok := creds[host]; ok {
+				return c.Username, c.Password, nil
+			}
+			if !isGoogleRegistry(host) {
+				return "", "", nil
+			}
+			tok, err := saToken.get(ctx)
+			if err != nil {
+				logger.Errorf("Error getting service account token for %s: %v", host, err)
+				return "", "", nil
+			}
+			return tokenUsername, tok, nil
+		}),
+	})
+}
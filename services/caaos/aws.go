@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	awsTokenTTL     = 6 * time.Hour
+	awsPollInterval = 30 * time.Second
+)
+
+// awsProvider reads attributes from the EC2 instance metadata service
+// using IMDSv2 session tokens. Instance tags (when tags in metadata are
+// enabled) are used as attributes, user-data overrides them and is either a
+// JSON object of attributes or, if not, used as the caaos-spec attribute.
+// IMDS has no hanging GET so it is polled.
+type awsProvider struct {
+	client      *http.Client
+	token       string
+	tokenExpiry time.Time
+	poller
+}
+
+func newAWSProvider() *awsProvider {
+	return &awsProvider{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *awsProvider) Name() string { return "aws" }
+
+// onAWS probes the EC2 instance metadata service.
+func onAWS(ctx context.Context) bool {
+	p := &awsProvider{client: &http.Client{Timeout: probeTimeout}}
+	_, err := p.getToken(ctx)
+	return err == nil
+}
+
+func (p *awsProvider) getToken(ctx context.Context) (string, error) {
+	if p.token != "" && time.Now().Add(time.Minute).Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+	req, err := http.NewRequest("PUT", imdsBase+"latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(awsTokenTTL.Seconds())))
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting IMDSv2 token: %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	p.token = string(b)
+	p.tokenExpiry = time.Now().Add(awsTokenTTL)
+	return p.token, nil
+}
+
+// get returns the value at path, a 404 returns an empty value.
+func (p *awsProvider) get(ctx context.Context, path string) ([]byte, error) {
+	tok, err := p.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", imdsBase+"latest/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", tok)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, nil
+	case http.StatusUnauthorized:
+		p.token = ""
+	}
+	return nil, fmt.Errorf("error getting %s: %s", path, resp.Status)
+}
+
+func (p *awsProvider) attributes(ctx context.Context) (map[string]string, error) {
+	attrs := map[string]string{}
+
+	tags, err := p.get(ctx, "meta-data/tags/instance")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Fields(string(tags)) {
+		v, err := p.get(ctx, "meta-data/tags/instance/"+key)
+		if err != nil {
+			return nil, err
+		}
+		attrs[key] = string(v)
+	}
+
+	ud, err := p.get(ctx, "user-data")
+	if err != nil {
+		return nil, err
+	}
+	mergeUserData(attrs, ud)
+	return attrs, nil
+}
+
+// Watch polls IMDS until the attributes differ from the last ones returned.
+func (p *awsProvider) Watch(ctx context.Context) (*attributesJSON, error) {
+	return p.poll(ctx, every(awsPollInterval), p.attributes)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	azureComputePath  = "metadata/instance/compute?api-version=2021-02-01"
+	azurePollInterval = 30 * time.Second
+)
+
+// azureProvider reads attributes from the Azure Instance Metadata Service.
+// VM tags are used as attributes, user data overrides them and is either a
+// JSON object of attributes or, if not, used as the caaos-spec attribute.
+// IMDS has no hanging GET so it is polled.
+type azureProvider struct {
+	client *http.Client
+	poller
+}
+
+type azureCompute struct {
+	TagsList []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"tagsList"`
+	// UserData is base64 encoded.
+	UserData string `json:"userData"`
+}
+
+func newAzureProvider() *azureProvider {
+	return &azureProvider{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *azureProvider) Name() string { return "azure" }
+
+// onAzure probes the Azure Instance Metadata Service.
+func onAzure(ctx context.Context) bool {
+	p := &azureProvider{client: &http.Client{Timeout: probeTimeout}}
+	_, err := p.compute(ctx)
+	return err == nil
+}
+
+func (p *azureProvider) compute(ctx context.Context) (*azureCompute, error) {
+	req, err := http.NewRequest("GET", imdsBase+azureComputePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting instance metadata: %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var c azureCompute
+	return &c, json.Unmarshal(b, &c)
+}
+
+func (p *azureProvider) attributes(ctx context.Context) (map[string]string, error) {
+	c, err := p.compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]string{}
+	for _, t := range c.TagsList {
+		attrs[t.Name] = t.Value
+	}
+
+	ud, err := base64.StdEncoding.DecodeString(c.UserData)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding user data: %v", err)
+	}
+	mergeUserData(attrs, ud)
+	return attrs, nil
+}
+
+// Watch polls IMDS until the attributes differ from the last ones returned.
+func (p *azureProvider) Watch(ctx context.Context) (*attributesJSON, error) {
+	return p.poll(ctx, every(azurePollInterval), p.attributes)
+}
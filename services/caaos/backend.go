@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// ImagePuller gets images into the image store.
+type ImagePuller interface {
+	// Image returns ref from the image store. For multi-arch images the
+	// variant for platform is used, or the host's if platform is empty.
+	Image(ctx context.Context, ref, platform string) (containerd.Image, error)
+	Pull(ctx context.Context, ref string, opts ...containerd.RemoteOpt) (containerd.Image, error)
+	// Import imports the images in an OCI or Docker archive.
+	Import(ctx context.Context, r io.Reader, opts ...containerd.ImportOpt) ([]images.Image, error)
+	// WithLease returns a context holding a lease on the content pulled
+	// with it until the returned function is called.
+	WithLease(ctx context.Context) (context.Context, func(context.Context) error, error)
+	ContentStore() content.Store
+}
+
+// ContainerRunner creates and loads containers and their snapshots, it is
+// implemented by *containerd.Client.
+type ContainerRunner interface {
+	NewContainer(ctx context.Context, id string, opts ...containerd.NewContainerOpts) (containerd.Container, error)
+	LoadContainer(ctx context.Context, id string) (containerd.Container, error)
+	SnapshotService(snapshotter string) snapshots.Snapshotter
+}
+
+// TaskSupervisor tells the supervisor of a task about its exit and OOM
+// kills.
+type TaskSupervisor interface {
+	// Exit returns a channel that receives the exit status of task and a
+	// function to stop waiting.
+	Exit(ctx context.Context, task containerd.Task) (<-chan containerd.ExitStatus, func())
+	// OOM returns a channel that receives the OOM kills of container id and
+	// a function to unsubscribe.
+	OOM(id string) (<-chan struct{}, func())
+}
+
+// runEnv is the agent state the run logic records containers in and the
+// host setup it calls, the agent's globals unless replaced, such as with
+// fakes.
+type runEnv struct {
+	state       *stateStore
+	running     *taskRegistry
+	audit       *auditLog
+	lifecycle   *eventBus
+	checkpoints *checkpointState
+	boot        *bootReport
+
+	// accessSecret reads a Secret Manager secret version, with the
+	// service account's token by default. Secret files are written under
+	// secretsDir.
+	accessSecret func(ctx context.Context, name string) ([]byte, error)
+	secretsDir   string
+	// setupNetwork and removeNetwork attach bridge containers to and
+	// detach them from the CNI network.
+	setupNetwork  func(ctx context.Context, id string, pid uint32, ports []PortSpec) (string, error)
+	removeNetwork func(ctx context.Context, id string, pid uint32, ports []PortSpec) error
+}
+
+var agentEnv = &runEnv{
+	state:         persisted,
+	running:       running,
+	audit:         audit,
+	lifecycle:     lifecycle,
+	checkpoints:   checkpoints,
+	boot:          boot,
+	accessSecret:  accessSecret,
+	secretsDir:    secretsDir,
+	setupNetwork:  setupNetwork,
+	removeNetwork: removeNetwork,
+}
+
+// environment returns the runner's runEnv, the agent's unless set.
+func (r *runner) environment() *runEnv {
+	if r.env != nil {
+		return r.env
+	}
+	return agentEnv
+}
+
+// imagePuller, containerRunner and taskSupervisor return the runner's
+// implementations, backed by its containerd client unless set.
+func (r *runner) imagePuller() ImagePuller {
+	if r.images != nil {
+		return r.images
+	}
+	return containerdImages{r.client}
+}
+
+func (r *runner) containerRunner() ContainerRunner {
+	if r.containers != nil {
+		return r.containers
+	}
+	return r.client
+}
+
+func (r *runner) taskSupervisor() TaskSupervisor {
+	if r.tasks != nil {
+		return r.tasks
+	}
+	return eventSupervisor{}
+}
+
+// containerdImages is the ImagePuller of a containerd client.
+type containerdImages struct {
+	client *containerd.Client
+}
+
+func (i containerdImages) Image(ctx context.Context, ref, platform string) (containerd.Image, error) {
+	img, err := i.client.GetImage(ctx, ref)
+	if err != nil || platform == "" {
+		return img, err
+	}
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return nil, err
+	}
+	return containerd.NewImageWithPlatform(i.client, img.Metadata(), platforms.Only(p)), nil
+}
+
+func (i containerdImages) Pull(ctx context.Context, ref string, opts ...containerd.RemoteOpt) (containerd.Image, error) {
+	return i.client.Pull(ctx, ref, opts...)
+}
+
+func (i containerdImages) Import(ctx context.Context, r io.Reader, opts ...containerd.ImportOpt) ([]images.Image, error) {
+	return i.client.Import(ctx, r, opts...)
+}
+
+func (i containerdImages) WithLease(ctx context.Context) (context.Context, func(context.Context) error, error) {
+	return i.client.WithLease(ctx)
+}
+
+func (i containerdImages) ContentStore() content.Store {
+	return i.client.ContentStore()
+}
+
+// eventSupervisor is the TaskSupervisor fed by containerd's event stream,
+// see exitMonitor and oomMonitor.
+type eventSupervisor struct{}
+
+func (eventSupervisor) Exit(ctx context.Context, task containerd.Task) (<-chan containerd.ExitStatus, func()) {
+	return exits.subscribe(ctx, task)
+}
+
+func (eventSupervisor) OOM(id string) (<-chan struct{}, func()) {
+	return ooms.subscribe(id)
+}
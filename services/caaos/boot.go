@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	phaseAgentStart = "agent-start"
+	phaseMetadata   = "metadata-received"
+	phaseGates      = "boot-gates-open"
+	phasePulled     = "pull-complete"
+	phaseRunning    = "task-running"
+	phaseHealthy    = "health-check-pass"
+)
+
+// bootReport records when each phase of getting the first spec running
+// finished so that cold start latency can be tuned.
+type bootReport struct {
+	mx         sync.Mutex
+	start      time.Time
+	enabled    bool
+	published  bool
+	kernelBoot time.Time
+	phases     []bootPhase
+	containers map[string]map[string]float64
+	watch      sync.Once
+}
+
+type bootPhase struct {
+	Phase string    `json:"phase"`
+	Time  time.Time `json:"time"`
+	// Seconds is the time since the kernel booted, or since the agent
+	// started if that is unknown.
+	Seconds float64 `json:"seconds"`
+}
+
+var boot = &bootReport{start: time.Now()}
+
+// enable starts recording, the agent start is taken as the time the
+// process started.
+func (b *bootReport) enable() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.enabled = true
+	b.kernelBoot = b.start
+	if up, err := uptime(); err == nil {
+		b.kernelBoot = time.Now().Add(-up)
+	} else {
+		logger.Warn("Error reading uptime, boot report is relative to agent start:", err)
+	}
+	b.containers = map[string]map[string]float64{}
+	b.markAt(phaseAgentStart, b.start)
+}
+
+func uptime() (time.Duration, error) {
+	b, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	f := strings.Fields(string(b))
+	if len(f) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/uptime contents %q", b)
+	}
+	s, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(s * float64(time.Second)), nil
+}
+
+// markAt records phase at t unless it was already recorded, b.mx must be
+// held.
+func (b *bootReport) markAt(phase string, t time.Time) {
+	if !b.enabled || b.published {
+		return
+	}
+	for _, p := range b.phases {
+		if p.Phase == phase {
+			return
+		}
+	}
+	b.phases = append(b.phases, bootPhase{Phase: phase, Time: t, Seconds: t.Sub(b.kernelBoot).Seconds()})
+}
+
+func (b *bootReport) mark(phase string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.markAt(phase, time.Now())
+}
+
+// container records a phase of a single container.
+func (b *bootReport) container(name, phase string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if !b.enabled || b.published {
+		return
+	}
+	if b.containers[name] == nil {
+		b.containers[name] = map[string]float64{}
+	}
+	if _, ok := b.containers[name][phase]; !ok {
+		b.containers[name][phase] = time.Since(b.kernelBoot).Seconds()
+	}
+}
+
+// watchDeployment publishes the report once the first deployment's
+// containers are running and healthy, or once they exit.
+func (b *bootReport) watchDeployment(ctx context.Context, d *deployment) {
+	b.mx.Lock()
+	enabled := b.enabled
+	b.mx.Unlock()
+	if !enabled {
+		return
+	}
+	b.watch.Do(func() {
+		go func() {
+			select {
+			case <-d.ready:
+				b.mx.Lock()
+				// Pulls finish in any order, the phase ends with the last.
+				var last float64
+				for _, c := range d.spec.Containers {
+					if s, ok := b.containers[c.Name][phasePulled]; ok && s > last {
+						last = s
+					}
+				}
+				if last > 0 {
+					b.markAt(phasePulled, b.kernelBoot.Add(time.Duration(last*float64(time.Second))))
+				}
+				b.markAt(phaseRunning, time.Now())
+				b.mx.Unlock()
+				select {
+				case <-d.healthy:
+					b.mark(phaseHealthy)
+				case <-d.done:
+				case <-ctx.Done():
+				}
+			case <-d.done:
+			case <-ctx.Done():
+			}
+			b.publish(ctx)
+		}()
+	})
+}
+
+// publish writes the report to the serial console and the boot-report
+// guest attribute.
+func (b *bootReport) publish(ctx context.Context) {
+	b.mx.Lock()
+	b.published = true
+	r, err := json.Marshal(struct {
+		KernelBoot time.Time                     `json:"kernel-boot"`
+		Phases     []bootPhase                   `json:"phases"`
+		Containers map[string]map[string]float64 `json:"containers,omitempty"`
+	}{b.kernelBoot, b.phases, b.containers})
+	b.mx.Unlock()
+	if err != nil {
+		logger.Error("Error encoding boot report:", err)
+		return
+	}
+	consoleMx.Lock()
+	fmt.Fprintf(os.Stdout, "caaos boot report: %s\n", r)
+	consoleMx.Unlock()
+	logger.With("event", "boot-report").Info("published boot report")
+	if err := setGuestAttribute(ctx, "boot-report", string(r)); err != nil {
+		logger.Error("Error publishing boot report:", err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/api/types/runc/options"
+)
+
+// checkpointDir holds CRIU images while they are uploaded or downloaded.
+const checkpointDir = "/var/lib/caaos/checkpoints"
+
+const storageURL = "https://storage.googleapis.com/"
+
+// checkpointState tracks containers that were checkpointed and stopped,
+// which are not restarted, and containers waiting to be restored, which are
+// restored from the CRIU images in a directory the next time they start.
+type checkpointState struct {
+	mx           sync.Mutex
+	checkpointed map[string]bool
+	restores     map[string]string
+}
+
+var checkpoints = &checkpointState{checkpointed: map[string]bool{}, restores: map[string]string{}}
+
+func (s *checkpointState) setCheckpointed(name string, v bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if v {
+		s.checkpointed[name] = true
+	} else {
+		delete(s.checkpointed, name)
+	}
+}
+
+// takeCheckpointed reports whether name exited because it was checkpointed.
+func (s *checkpointState) takeCheckpointed(name string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	v := s.checkpointed[name]
+	delete(s.checkpointed, name)
+	return v
+}
+
+func (s *checkpointState) setRestore(name, dir string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if old, ok := s.restores[name]; ok {
+		os.RemoveAll(old)
+	}
+	s.restores[name] = dir
+}
+
+func (s *checkpointState) hasRestore(name string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	_, ok := s.restores[name]
+	return ok
+}
+
+// takeRestore returns the directory to restore name from, the caller
+// removes it.
+func (s *checkpointState) takeRestore(name string) (string, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	dir, ok := s.restores[name]
+	delete(s.restores, name)
+	return dir, ok
+}
+
+// withCheckpointExit stops the task once it has been checkpointed.
+func withCheckpointExit(r *containerd.CheckpointTaskInfo) error {
+	if r.Options == nil {
+		r.Options = &options.CheckpointOptions{}
+	}
+	opts, ok := r.Options.(*options.CheckpointOptions)
+	if !ok {
+		return errors.New("checkpoints need the runc v2 shim")
+	}
+	opts.Exit = true
+	return nil
+}
+
+// handleCheckpoint serves POST /v1/checkpoint/<name>?dest=gs://bucket/object
+// [&leave-running=true], checkpointing the container with CRIU and uploading
+// the images to Cloud Storage. Unless leave-running is set the container is
+// stopped and not restarted. If the upload of a stopped container's
+// checkpoint fails the images are kept in checkpointDir.
+func handleCheckpoint(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/v1/checkpoint/")
+		target, ok := running.get(name)
+		if !ok {
+			http.Error(w, "container "+name+" is not running", http.StatusNotFound)
+			return
+		}
+		ctx := target.context(ctx)
+		dest := r.URL.Query().Get("dest")
+		if _, _, err := parseGCSURL(dest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		exit := r.URL.Query().Get("leave-running") != "true"
+
+		if err := os.MkdirAll(checkpointDir, 0700); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dir, err := ioutil.TempDir(checkpointDir, name+"-")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		keep := false
+		defer func() {
+			if !keep {
+				os.RemoveAll(dir)
+			}
+		}()
+
+		clogger := containerLogger(name).With("event", "checkpoint")
+		opts := []containerd.CheckpointTaskOpts{containerd.WithCheckpointImagePath(dir)}
+		if exit {
+			opts = append(opts, withCheckpointExit)
+			checkpoints.setCheckpointed(name, true)
+		}
+		if _, err := target.task.Checkpoint(ctx, opts...); err != nil {
+			checkpoints.setCheckpointed(name, false)
+			clogger.Error("Error checkpointing container:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		clogger.Infof("checkpointed container, uploading to %s", dest)
+
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(tarDir(pw, dir)) }()
+		if err := uploadGCS(ctx, dest, pr); err != nil {
+			pr.CloseWithError(err)
+			if exit {
+				keep = true
+				err = fmt.Errorf("%v, the checkpoint is kept in %s", err, dir)
+			}
+			clogger.Error("Error uploading checkpoint:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		clogger.Info("uploaded checkpoint to", dest)
+		fmt.Fprintf(w, "checkpointed %s to %s\n", name, dest)
+	}
+}
+
+// handleRestore serves POST /v1/restore/<name>?src=gs://bucket/object,
+// downloading a checkpoint made by handleCheckpoint. The container is
+// restored from it the next time it starts, if it is running it is stopped
+// and restarted straight away. The container must run the same image with
+// host networking, changes to its root filesystem are not restored.
+func handleRestore(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/v1/restore/")
+		if !validName(name) {
+			http.Error(w, "invalid container name", http.StatusBadRequest)
+			return
+		}
+		src := r.URL.Query().Get("src")
+		if _, _, err := parseGCSURL(src); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := os.MkdirAll(checkpointDir, 0700); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dir, err := ioutil.TempDir(checkpointDir, name+"-restore-")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		clogger := containerLogger(name).With("event", "restore")
+		if err := downloadCheckpoint(ctx, src, dir); err != nil {
+			os.RemoveAll(dir)
+			clogger.Error("Error downloading checkpoint:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		checkpoints.setRestore(name, dir)
+		clogger.Info("downloaded checkpoint from", src)
+
+		if target, ok := running.get(name); ok {
+			clogger.Info("stopping container to restore it")
+			if err := target.task.Kill(target.context(ctx), syscall.SIGKILL); err != nil {
+				clogger.Error("Error stopping container:", err)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%s will be restored from %s\n", name, src)
+	}
+}
+
+func downloadCheckpoint(ctx context.Context, src, dir string) error {
+	body, err := downloadGCS(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return untarDir(body, dir)
+}
+
+// tarDir writes the regular files in dir to w as a gzipped tarball.
+func tarDir(w io.Writer, dir string) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// untarDir extracts the regular files in a tarball written by tarDir to
+// dir.
+func untarDir(r io.Reader, dir string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name %q in checkpoint", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseGCSURL splits gs://bucket/object.
+func parseGCSURL(u string) (string, string, error) {
+	if !strings.HasPrefix(u, "gs://") {
+		return "", "", fmt.Errorf("%q is not a gs://bucket/object URL", u)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q is not a gs://bucket/object URL", u)
+	}
+	return parts[0], parts[1], nil
+}
+
+func uploadGCS(ctx context.Context, u string, body io.Reader) error {
+	bucket, object, err := parseGCSURL(u)
+	if err != nil {
+		return err
+	}
+	tok, err := saToken.get(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", storageURL+"upload/storage/v1/b/"+url.PathEscape(bucket)+"/o?uploadType=media&name="+url.QueryEscape(object), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/gzip")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error uploading %s: %s", u, resp.Status)
+	}
+	return nil
+}
+
+func downloadGCS(ctx context.Context, u string) (io.ReadCloser, error) {
+	bucket, object, err := parseGCSURL(u)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := saToken.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", storageURL+"storage/v1/b/"+url.PathEscape(bucket)+"/o/"+url.PathEscape(object)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
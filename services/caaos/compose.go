@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/google/shlex"
+)
+
+// composeVolumeDir is where named compose volumes are created on the host.
+const composeVolumeDir = "/var/lib/caaos/volumes"
+
+// composeFile is the subset of the Compose file format caaos understands.
+type composeFile struct {
+	Services map[string]composeService `json:"services"`
+	Networks map[string]interface{}    `json:"networks"`
+	Volumes  map[string]interface{}    `json:"volumes"`
+}
+
+type composeService struct {
+	Image       string                `json:"image"`
+	Command     stringOrList          `json:"command"`
+	Entrypoint  stringOrList          `json:"entrypoint"`
+	Environment json.RawMessage       `json:"environment"`
+	Volumes     []json.RawMessage     `json:"volumes"`
+	Ports       []json.RawMessage     `json:"ports"`
+	DependsOn   json.RawMessage       `json:"depends_on"`
+	Restart     string                `json:"restart"`
+	Privileged  bool                  `json:"privileged"`
+	CapAdd      []string              `json:"cap_add"`
+	CapDrop     []string              `json:"cap_drop"`
+	Networks    json.RawMessage       `json:"networks"`
+	NetworkMode string                `json:"network_mode"`
+	User        string                `json:"user"`
+	ReadOnly    bool                  `json:"read_only"`
+	Tmpfs       stringOrList          `json:"tmpfs"`
+	GroupAdd    []string              `json:"group_add"`
+	Ulimits     map[string]UlimitSpec `json:"ulimits"`
+	Sysctls     json.RawMessage       `json:"sysctls"`
+	Devices     []string              `json:"devices"`
+	Hostname    string                `json:"hostname"`
+	DNS         stringOrList          `json:"dns"`
+	DNSSearch   stringOrList          `json:"dns_search"`
+	DNSOpt      []string              `json:"dns_opt"`
+	ExtraHosts  []string              `json:"extra_hosts"`
+	Platform    string                `json:"platform"`
+	Logging     *LoggingSpec          `json:"logging"`
+}
+
+// stringOrList is a Compose field that may be a string, which is split like
+// a shell would, or a list.
+type stringOrList []string
+
+func (s *stringOrList) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		l, err := shlex.Split(str)
+		*s = l
+		return err
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*s = l
+	return nil
+}
+
+// parseCompose translates a Compose file into a spec. All services run on
+// the host network, so networks are ignored.
+func parseCompose(data string) (*Spec, error) {
+	j, err := yaml.YAMLToJSON([]byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing caaos-compose: %v", err)
+	}
+	var cf composeFile
+	if err := json.Unmarshal(j, &cf); err != nil {
+		return nil, fmt.Errorf("error parsing caaos-compose: %v", err)
+	}
+	if len(cf.Networks) > 0 {
+		logger.Warn("caaos-compose: networks are not supported, all services use the host network")
+	}
+
+	var names []string
+	for name := range cf.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	spec := &Spec{}
+	for _, name := range names {
+		c, err := cf.Services[name].containerSpec(name, cf.Volumes)
+		if err != nil {
+			return nil, fmt.Errorf("caaos-compose: service %q: %v", name, err)
+		}
+		spec.Containers = append(spec.Containers, c)
+	}
+	return spec, nil
+}
+
+func (svc composeService) containerSpec(name string, volumes map[string]interface{}) (ContainerSpec, error) {
+	c := ContainerSpec{
+		Name:   name,
+		Image:  svc.Image,
+		User:   svc.User,
+		Groups: svc.GroupAdd,
+
+		ReadOnlyRootfs: svc.ReadOnly,
+		Tmpfs:          svc.Tmpfs,
+		Ulimits:        svc.Ulimits,
+		Devices:        svc.Devices,
+		Hostname:       svc.Hostname,
+		Platform:       svc.Platform,
+		Logging:        svc.Logging,
+		ExtraHosts:     svc.ExtraHosts,
+	}
+	if len(svc.DNS) > 0 || len(svc.DNSSearch) > 0 || len(svc.DNSOpt) > 0 {
+		c.DNS = &DNSSpec{Servers: svc.DNS, Search: svc.DNSSearch, Options: svc.DNSOpt}
+	}
+	if len(svc.Entrypoint) > 0 {
+		c.Args = append(append([]string{}, svc.Entrypoint...), svc.Command...)
+	} else {
+		c.Command = svc.Command
+	}
+	if svc.NetworkMode != "" && svc.NetworkMode != "host" {
+		logger.Warnf("caaos-compose: service %q: network_mode %q is not supported, using the host network", name, svc.NetworkMode)
+	}
+
+	var err error
+	if c.Env, err = composeEnv(svc.Environment); err != nil {
+		return c, fmt.Errorf("environment: %v", err)
+	}
+	// sysctls take the same map or KEY=VALUE list forms as environment.
+	if c.Sysctls, err = composeEnv(svc.Sysctls); err != nil {
+		return c, fmt.Errorf("sysctls: %v", err)
+	}
+	if c.DependsOn, err = composeDependsOn(svc.DependsOn); err != nil {
+		return c, fmt.Errorf("depends_on: %v", err)
+	}
+	if c.RestartPolicy, err = composeRestart(svc.Restart); err != nil {
+		return c, err
+	}
+	for _, v := range svc.Volumes {
+		m, err := composeVolume(v, volumes)
+		if err != nil {
+			return c, fmt.Errorf("volumes: %v", err)
+		}
+		c.Mounts = append(c.Mounts, m)
+	}
+	for _, p := range svc.Ports {
+		port, err := composePort(p)
+		if err != nil {
+			return c, fmt.Errorf("ports: %v", err)
+		}
+		c.Ports = append(c.Ports, port)
+	}
+	if svc.Privileged || len(svc.CapAdd) > 0 || len(svc.CapDrop) > 0 {
+		c.Security = &SecuritySpec{Privileged: svc.Privileged, CapAdd: svc.CapAdd, CapDrop: svc.CapDrop}
+	}
+	return c, nil
+}
+
+// composeEnv accepts either a map or a list of KEY=VAL. Entries without a
+// value are ignored as there is no host environment to take them from.
+func composeEnv(raw json.RawMessage) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	env := map[string]string{}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err == nil {
+		for k, v := range m {
+			if v != nil {
+				env[k] = fmt.Sprint(v)
+			}
+		}
+		return env, nil
+	}
+	var l []string
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return nil, err
+	}
+	for _, e := range l {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env, nil
+}
+
+// composeDependsOn accepts either a list of services or the long map form,
+// conditions are treated as service_started.
+func composeDependsOn(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var l []string
+	if err := json.Unmarshal(raw, &l); err == nil {
+		return l, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	for k := range m {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l, nil
+}
+
+func composeRestart(s string) (string, error) {
+	switch {
+	case s == "" || s == "no":
+		return restartNever, nil
+	case s == "always" || s == "unless-stopped":
+		return restartAlways, nil
+	case strings.HasPrefix(s, restartOnFailure):
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown restart policy %q", s)
+}
+
+// composeVolume accepts the short "source:target[:mode]" syntax and the long
+// syntax. Named volumes are created under composeVolumeDir.
+func composeVolume(raw json.RawMessage, volumes map[string]interface{}) (MountSpec, error) {
+	var short string
+	if err := json.Unmarshal(raw, &short); err == nil {
+		parts := strings.Split(short, ":")
+		switch len(parts) {
+		case 1:
+			// An anonymous volume, back it with a tmpfs.
+			return MountSpec{Type: "tmpfs", Destination: parts[0]}, nil
+		case 2, 3:
+			m := bindOrVolume(parts[0], parts[1], volumes)
+			if len(parts) == 3 && parts[2] == "ro" {
+				m.Options = []string{"rbind", "ro"}
+			}
+			return m, nil
+		}
+		return MountSpec{}, fmt.Errorf("invalid volume %q", short)
+	}
+
+	var long struct {
+		Type     string `json:"type"`
+		Source   string `json:"source"`
+		Target   string `json:"target"`
+		ReadOnly bool   `json:"read_only"`
+	}
+	if err := json.Unmarshal(raw, &long); err != nil {
+		return MountSpec{}, err
+	}
+	if long.Type == "tmpfs" {
+		return MountSpec{Type: "tmpfs", Destination: long.Target}, nil
+	}
+	m := bindOrVolume(long.Source, long.Target, volumes)
+	if long.ReadOnly {
+		m.Options = []string{"rbind", "ro"}
+	}
+	return m, nil
+}
+
+func bindOrVolume(source, target string, volumes map[string]interface{}) MountSpec {
+	if _, ok := volumes[source]; ok || !strings.HasPrefix(source, "/") {
+		source = filepath.Join(composeVolumeDir, source)
+	}
+	return MountSpec{Source: source, Destination: target, Create: true}
+}
+
+// composePort accepts "port", "host:container[/proto]" or the long syntax.
+// Containers use the host network so the container port is what's
+// published.
+func composePort(raw json.RawMessage) (PortSpec, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var n int
+		if err := json.Unmarshal(raw, &n); err == nil {
+			return PortSpec{Port: n}, nil
+		}
+		var long struct {
+			Target    int    `json:"target"`
+			Published int    `json:"published"`
+			Protocol  string `json:"protocol"`
+		}
+		if err := json.Unmarshal(raw, &long); err != nil {
+			return PortSpec{}, err
+		}
+		return PortSpec{Port: long.Target, Protocol: long.Protocol}, nil
+	}
+
+	var p PortSpec
+	if i := strings.Index(s, "/"); i >= 0 {
+		p.Protocol = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ":")
+	port, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return p, fmt.Errorf("invalid port %q", s)
+	}
+	if len(parts) > 1 && parts[len(parts)-2] != parts[len(parts)-1] {
+		logger.Warnf("caaos-compose: port mapping %q is not supported on the host network, using %d", s, port)
+	}
+	p.Port = port
+	return p, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// controlSocket is the unix socket serving the local control API used by
+// caaosctl. Only root can connect unless the spec grants other users access
+// to a namespace.
+const controlSocket = "/run/caaos/caaos.sock"
+
+// serveControl serves h on the control socket until ctx is canceled.
+func serveControl(ctx context.Context, path string, h http.Handler) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, tenants.socketMode()); err != nil {
+		l.Close()
+		return err
+	}
+	srv := &http.Server{Handler: h, ConnContext: withPeer}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// validName reports whether name is safe to use as a file name.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// handleLogs serves GET /v1/logs/<name>[?follow=true] from the ring sink.
+func handleLogs(ring *ringSink) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/v1/logs/")
+		if !validName(name) {
+			http.Error(w, "invalid container name", http.StatusBadRequest)
+			return
+		}
+		follow := r.URL.Query().Get("follow") == "true"
+		b, c, cancel, err := ring.read(name, follow)
+		if os.IsNotExist(err) {
+			http.Error(w, "no logs for container "+name, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(b)
+		if c == nil {
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case e := <-c:
+				if _, err := w.Write([]byte(formatLogEntry(e))); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
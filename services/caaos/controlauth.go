@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// controlTokenFile holds the bearer token required by the control API
+// when it is served over TCP. It is generated once per boot.
+const controlTokenFile = "/run/caaos/control-token"
+
+// controlToken returns the token in controlTokenFile, generating it if the
+// file does not exist yet.
+func controlToken() (string, error) {
+	if b, err := ioutil.ReadFile(controlTokenFile); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		return strings.TrimSpace(string(b)), nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := os.MkdirAll(filepath.Dir(controlTokenFile), 0755); err != nil {
+		return "", err
+	}
+	tmp := controlTokenFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, os.Rename(tmp, controlTokenFile)
+}
+
+// requireToken refuses requests without "Authorization: Bearer <token>".
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="caaos"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// controlTLSConfig returns the TLS configuration for the control API's TCP
+// listener, nil if no certificate is set. With a client CA, clients must
+// present a certificate it signed.
+func controlTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("-control-client-ca requires -control-tls-cert and -control-tls-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serveControlTCP serves h on addr until ctx is canceled, requiring the
+// control token on every request and TLS if cfg is set.
+func serveControlTCP(ctx context.Context, addr string, cfg *tls.Config, h http.Handler) error {
+	token, err := controlToken()
+	if err != nil {
+		return fmt.Errorf("error creating control token: %v", err)
+	}
+	if *controlTokenAttrFlag {
+		if err := setGuestAttribute(ctx, "control-token", token); err != nil {
+			logger.Error("Error publishing control token:", err)
+		}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if cfg != nil {
+		l = tls.NewListener(l, cfg)
+	} else if host, _, _ := net.SplitHostPort(addr); !isLoopback(host) {
+		logger.Warnf("Serving the control API on %s without TLS, the token is sent in the clear", addr)
+	}
+	logger.Info("serving control API on", addr)
+	srv := &http.Server{Handler: requireToken(token, h)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultCrashLoopFailures = 5
+	defaultCrashLoopWindow   = 10 * time.Minute
+)
+
+// CrashLoopSpec stops restarting a container that keeps failing.
+type CrashLoopSpec struct {
+	// Failures is the number of non zero exits within Window after which
+	// the container is no longer restarted, 0 uses the default and a
+	// negative value disables the breaker.
+	Failures int `json:"failures"`
+	// Window is a duration such as "10m".
+	Window string `json:"window"`
+	// Action is run once the container is in a crash loop, it takes the
+	// same values as on-exit, e.g. "run-container:<image>" to collect
+	// diagnostics or "poweroff".
+	Action string `json:"action"`
+}
+
+func (s *CrashLoopSpec) validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.Window != "" {
+		if _, err := time.ParseDuration(s.Window); err != nil {
+			return err
+		}
+	}
+	if err := validateOnExit(s.Action); err != nil {
+		return fmt.Errorf("action: %v", err)
+	}
+	return nil
+}
+
+// crashLoop counts the recent failures of a container.
+type crashLoop struct {
+	failures int
+	window   time.Duration
+	times    []time.Time
+}
+
+func newCrashLoop(s *CrashLoopSpec) *crashLoop {
+	l := &crashLoop{failures: defaultCrashLoopFailures, window: defaultCrashLoopWindow}
+	if s == nil {
+		return l
+	}
+	if s.Failures != 0 {
+		l.failures = s.Failures
+	}
+	l.window = durationOr(s.Window, defaultCrashLoopWindow)
+	return l
+}
+
+// failed records a failure and reports whether the container is now in a
+// crash loop.
+func (l *crashLoop) failed(now time.Time) bool {
+	if l.failures < 0 {
+		return false
+	}
+	l.times = append(l.times, now)
+	for len(l.times) > 0 && now.Sub(l.times[0]) > l.window {
+		l.times = l.times[1:]
+	}
+	return len(l.times) >= l.failures
+}
+
+// crashLooping marks c as crash looping and runs the crash loop action.
+func (r *runner) crashLooping(ctx context.Context, logger *Logger, c ContainerSpec, l *crashLoop) {
+	err := fmt.Errorf("container failed %d times in %s, not restarting", len(l.times), l.window)
+	logger.With("event", "crash-loop").Error(err)
+	st, ok := agent.container(c.Name)
+	if !ok {
+		st = containerStatus{Name: c.Name, Image: c.Image, StartTime: time.Now()}
+	}
+	st.State = stateCrashLoop
+	st.Error = err.Error()
+	st.publish(ctx, logger)
+
+	if c.CrashLoop != nil {
+		r.runExitAction(ctx, logger, c, c.CrashLoop.Action, "-crash-loop")
+	}
+}
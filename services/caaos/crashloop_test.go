@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCrashLoopSpecValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		spec    *CrashLoopSpec
+		wantErr bool
+	}{
+		{"unset", nil, false},
+		{"defaults", &CrashLoopSpec{}, false},
+		{"window and action", &CrashLoopSpec{Failures: 3, Window: "5m", Action: onExitPoweroff}, false},
+		{"run container", &CrashLoopSpec{Action: onExitRunContainer + "gcr.io/p/diag"}, false},
+		{"bad window", &CrashLoopSpec{Window: "5 minutes"}, true},
+		{"bad action", &CrashLoopSpec{Action: "explode"}, true},
+		{"run container without image", &CrashLoopSpec{Action: onExitRunContainer}, true},
+	} {
+		if err := tc.spec.validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: validate = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	for _, tc := range []struct {
+		name string
+		spec *CrashLoopSpec
+		// failures are the times of the failures, the last one must put
+		// the container in a crash loop and none before it.
+		failures []time.Time
+		never    bool
+	}{
+		{"default", nil, []time.Time{at(0), at(time.Minute), at(2 * time.Minute), at(3 * time.Minute), at(4 * time.Minute)}, false},
+		{"custom", &CrashLoopSpec{Failures: 2, Window: "1m"}, []time.Time{at(0), at(30 * time.Second)}, false},
+		// Failures older than the window are forgotten.
+		{"spread out", &CrashLoopSpec{Failures: 2, Window: "1m"}, []time.Time{at(0), at(2 * time.Minute), at(5 * time.Minute), at(5*time.Minute + time.Second)}, false},
+		{"invalid window uses the default", &CrashLoopSpec{Failures: 2, Window: "x"}, []time.Time{at(0), at(9 * time.Minute)}, false},
+		{"disabled", &CrashLoopSpec{Failures: -1}, []time.Time{at(0), at(time.Second), at(2 * time.Second), at(3 * time.Second), at(4 * time.Second), at(5 * time.Second)}, true},
+	} {
+		l := newCrashLoop(tc.spec)
+		for i, now := range tc.failures {
+			want := !tc.never && i == len(tc.failures)-1
+			if got := l.failed(now); got != want {
+				t.Errorf("%s: failure %d at %s: crash loop %v, want %v", tc.name, i+1, now.Sub(start), got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// updateStopFirst stops the running containers before starting the
+	// containers from the new spec.
+	updateStopFirst = "stop-first"
+	// updateStartFirst starts the containers from the new spec and stops the
+	// running containers once they have all started. If the new containers
+	// exit before that the running containers are kept.
+	updateStartFirst = "start-first"
+	// updateBlueGreen is like updateStartFirst but waits for the new
+	// containers to pass their health checks, if any check fails the new
+	// containers are stopped and the running containers are kept.
+	updateBlueGreen = "blue-green"
+	// updateCanary is like updateBlueGreen but the new containers must also
+	// stay healthy for the canary period before the running containers are
+	// stopped.
+	updateCanary = "canary"
+
+	defaultCanaryPeriod = 5 * time.Minute
+
+	rolloutComplete   = "complete"
+	rolloutRolledBack = "rolled-back"
+)
+
+func parseUpdateStrategy(s string) (string, error) {
+	switch s {
+	case "", updateStopFirst:
+		return updateStopFirst, nil
+	case updateStartFirst, updateBlueGreen, updateCanary:
+		return s, nil
+	}
+	return updateStopFirst, fmt.Errorf("unknown update strategy %q", s)
+}
+
+// deployment is a spec running in the background.
+type deployment struct {
+	md     *attributesJSON
+	spec   *Spec
+	cancel context.CancelFunc
+	// done is closed once all containers have exited.
+	done chan struct{}
+	// ready is closed once all non scheduled containers have started.
+	ready chan struct{}
+	// healthy is closed once all non scheduled containers are healthy.
+	healthy chan struct{}
+	health  *healthSignals
+}
+
+// deploy runs spec with r in the background until all containers exit or
+// the deployment is stopped.
+func deploy(ctx context.Context, r *runner, spec *Spec, md *attributesJSON, cl *cloudLogSink) *deployment {
+	ctx, cancel := context.WithCancel(ctx)
+	d := &deployment{
+		md:      md,
+		spec:    spec,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		ready:   make(chan struct{}),
+		healthy: make(chan struct{}),
+		health:  newHealthSignals(spec),
+	}
+	r.ready = d.ready
+	r.healthy = d.healthy
+	r.health = d.health
+	publishPorts(ctx, spec)
+	// The deploy span ends once the containers are running, container
+	// spans are its children.
+	sctx, span := startSpan(ctx, "deploy", attribute.Int("containers", len(spec.Containers)))
+	go func() {
+		select {
+		case <-d.ready:
+			endSpan(span, nil)
+		case <-d.done:
+			endSpan(span, errors.New("containers exited before becoming ready"))
+		}
+	}()
+	go func() {
+		defer close(d.done)
+		defer cancel()
+		r.runSpec(sctx, spec)
+		if cl != nil {
+			cl.Close()
+		}
+	}()
+	return d
+}
+
+// stop stops all containers and waits for them to exit.
+func (d *deployment) stop() {
+	d.cancel()
+	<-d.done
+}
+
+// await waits until d is ready to replace the running containers using the
+// given strategy.
+func (d *deployment) await(ctx context.Context, strategy string, canaryPeriod time.Duration) error {
+	wait := d.healthy
+	if strategy == updateStartFirst {
+		wait = d.ready
+	}
+	select {
+	case <-wait:
+	case err := <-d.health.failed:
+		return err
+	case <-d.done:
+		return errors.New("containers exited before becoming ready")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if strategy != updateCanary {
+		return nil
+	}
+	logger.Infof("New containers are healthy, watching them for %s", canaryPeriod)
+	select {
+	case <-time.After(canaryPeriod):
+		return nil
+	case err := <-d.health.failed:
+		return err
+	case <-d.done:
+		return errors.New("containers exited during the canary period")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *deployment) images() []string {
+	var images []string
+	for _, c := range d.spec.Containers {
+		images = append(images, c.Image)
+	}
+	return images
+}
+
+// rolloutStatus is published to the guest attribute caaos/rollout after a
+// rollout using a start first strategy.
+type rolloutStatus struct {
+	State          string    `json:"state"`
+	Strategy       string    `json:"strategy"`
+	Images         []string  `json:"images"`
+	PreviousImages []string  `json:"previous-images"`
+	Error          string    `json:"error,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+func (s *rolloutStatus) publish(ctx context.Context) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		logger.Error("Error encoding rollout status:", err)
+		return
+	}
+	if err := setGuestAttribute(ctx, "rollout", string(b)); err != nil {
+		logger.Error("Error publishing rollout status:", err)
+	}
+}
+
+// rollout starts next alongside cur and stops cur once next is ready. If
+// next fails, or ctx is canceled, it is stopped and cur is returned.
+func rollout(ctx context.Context, cur, next *deployment, strategy string, canaryPeriod time.Duration) *deployment {
+	logger.Infof("Spec changed, starting new containers before stopping the running ones (%s)", strategy)
+	st := &rolloutStatus{Strategy: strategy, Images: next.images(), PreviousImages: cur.images()}
+	err := next.await(ctx, strategy, canaryPeriod)
+	if ctx.Err() != nil {
+		next.stop()
+		return cur
+	}
+	st.Time = time.Now()
+	if err != nil {
+		logger.With("event", "rollback").Error("Rollout failed, keeping the previous containers:", err)
+		next.stop()
+		st.State = rolloutRolledBack
+		st.Error = err.Error()
+		st.publish(ctx)
+		return cur
+	}
+	logger.With("event", "rollout").Info("New containers are ready, stopping previous containers")
+	cur.stop()
+	st.State = rolloutComplete
+	st.publish(ctx)
+	return next
+}
+
+// pendingRollout is a rollout running in the background, so that the main
+// loop keeps handling metadata updates and shutdowns while new containers
+// become ready.
+type pendingRollout struct {
+	next   *deployment
+	md     *attributesJSON
+	hash   string
+	mdHash string
+	cancel context.CancelFunc
+	// result receives the deployment left running once the rollout is
+	// done.
+	result chan *deployment
+}
+
+// startRollout runs rollout in the background. Canceling it stops next and
+// keeps cur.
+func startRollout(ctx context.Context, cur, next *deployment, strategy string, canaryPeriod time.Duration) *pendingRollout {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &pendingRollout{next: next, md: next.md, cancel: cancel, result: make(chan *deployment, 1)}
+	go func() {
+		defer cancel()
+		p.result <- rollout(ctx, cur, next, strategy, canaryPeriod)
+	}()
+	return p
+}
+
+// deployer keeps the containers of the applied spec running, replacing
+// them when the spec changes.
+type deployer struct {
+	env *runEnv
+	// newRunner returns the runner for spec, whose hash is hash, with the
+	// settings of md.
+	newRunner func(ctx context.Context, md *attributesJSON, spec *Spec, hash string) (*runner, *cloudLogSink, error)
+	// cache, if set, caches md once its spec is applied, see cacheSpec.
+	cache func(md *attributesJSON)
+
+	cur     *deployment
+	curDone <-chan struct{}
+	// applied is the hash of the spec last deployed, metadata changes that
+	// leave the spec as it is don't restart the containers. appliedMD is
+	// the hash of the metadata it was deployed from.
+	applied   string
+	appliedMD string
+	// pending is the rollout in progress, cur keeps the running containers
+	// until it completes and its result is sent on rolloutC.
+	pending  *pendingRollout
+	rolloutC <-chan *deployment
+}
+
+// setApplied records the spec of md, whose hashes are hash and mdHash, as
+// applied.
+func (d *deployer) setApplied(md *attributesJSON, hash, mdHash string) {
+	d.applied, d.appliedMD = hash, mdHash
+	d.env.state.setSpecHash(hash)
+	if !md.offline && d.cache != nil {
+		d.cache(md)
+	}
+}
+
+// finished returns the current deployment once curDone is closed, it is
+// no longer current.
+func (d *deployer) finished() *deployment {
+	cur := d.cur
+	d.cur, d.curDone = nil, nil
+	return cur
+}
+
+// finishRollout makes the deployment left running by the pending rollout
+// current. Its spec is only recorded as applied if the new containers
+// replaced the running ones.
+func (d *deployer) finishRollout(next *deployment) {
+	p := d.pending
+	d.pending, d.rolloutC = nil, nil
+	if next == p.next {
+		d.setApplied(p.md, p.hash, p.mdHash)
+	} else if d.cur == nil {
+		// The previous containers finished during the rollout.
+		return
+	}
+	d.cur, d.curDone = next, next.done
+}
+
+// abortRollout stops the new containers of the pending rollout, unless it
+// already completed.
+func (d *deployer) abortRollout() {
+	if d.pending == nil {
+		return
+	}
+	d.pending.cancel()
+	d.finishRollout(<-d.pending.result)
+}
+
+// stop stops all containers, the next spec is deployed even if it is the
+// one last applied.
+func (d *deployer) stop() {
+	d.abortRollout()
+	if d.cur != nil {
+		d.cur.stop()
+		d.cur, d.curDone = nil, nil
+	}
+	d.applied = ""
+}
+
+// apply deploys spec, read from md, unless it is already running or being
+// rolled out.
+func (d *deployer) apply(ctx context.Context, md *attributesJSON, spec *Spec) {
+	hash := specHash(spec)
+	if d.pending != nil && hash != d.pending.hash {
+		logger.Info("Spec changed during a rollout, abandoning it")
+		d.abortRollout()
+	}
+	if d.pending != nil {
+		logger.With("event", "unchanged").Info("Metadata changed but the container spec is the one being rolled out")
+		publishValidation(ctx, nil)
+		return
+	}
+	if hash == d.applied {
+		logger.With("event", "unchanged").Info("Metadata changed but the container spec is the same, keeping containers")
+		publishValidation(ctx, nil)
+		if !md.offline && d.cache != nil {
+			d.cache(md)
+		}
+		return
+	}
+	d.env.audit.record(auditRecord{Action: auditSpecReceived, SpecHash: hash, Detail: fmt.Sprintf("%d containers", len(spec.InitContainers)+len(spec.Containers))})
+	strategy, err := parseUpdateStrategy(md.UpdateStrategy)
+	if err != nil {
+		logger.Error("Error parsing update-strategy:", err)
+	}
+	r, cl, err := d.newRunner(ctx, md, spec, hash)
+	if err != nil {
+		logger.Error("Error configuring containers, refusing to run them:", err)
+		publishValidation(ctx, err)
+		return
+	}
+	publishValidation(ctx, nil)
+
+	if d.cur == nil || strategy == updateStopFirst {
+		if d.cur != nil {
+			logger.Info("Spec changed, stopping containers")
+			d.cur.stop()
+		}
+		d.setApplied(md, hash, metadataHash(md))
+		d.cur = deploy(ctx, r, spec, md, cl)
+		d.curDone = d.cur.done
+		d.env.boot.watchDeployment(ctx, d.cur)
+		return
+	}
+
+	canaryPeriod := defaultCanaryPeriod
+	if md.CanaryPeriod != "" {
+		if canaryPeriod, err = time.ParseDuration(md.CanaryPeriod); err != nil {
+			logger.Error("Error parsing canary-period:", err)
+			canaryPeriod = defaultCanaryPeriod
+		}
+	}
+	d.pending = startRollout(ctx, d.cur, deploy(ctx, r, spec, md, cl), strategy, canaryPeriod)
+	d.pending.hash, d.pending.mdHash = hash, metadataHash(md)
+	d.rolloutC = d.pending.result
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adjackura/caaos/fakemetadata"
+)
+
+func appSpec(tag string) string {
+	return fmt.Sprintf(`{"containers":[{"name":"app","image":"gcr.io/p/app:%s","pull-policy":%q}]}`, tag, pullIfNotPresent)
+}
+
+// metadataServer serves s to the agent's metadata client.
+func metadataServer(t *testing.T, s *fakemetadata.Server) {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	oldBase, oldIMDS := metadataBase, imdsBase
+	setMetadataEndpoint(srv.URL)
+	t.Cleanup(func() { metadataBase, imdsBase = oldBase, oldIMDS })
+}
+
+// runDeployer feeds the watcher's updates to dep as the agent's main loop
+// does, sending each update on handled once it is applied.
+func runDeployer(ctx context.Context, w *Watcher, dep *deployer, handled chan<- *attributesJSON) {
+	defer dep.stop()
+	for {
+		var md *attributesJSON
+		select {
+		case <-ctx.Done():
+			return
+		case <-dep.curDone:
+			dep.finished()
+			continue
+		case d := <-dep.rolloutC:
+			dep.finishRollout(d)
+			continue
+		case md = <-w.Updates():
+		}
+		spec, err := md.spec()
+		switch {
+		case err != nil:
+			publishValidation(ctx, err)
+		case spec == nil || len(spec.Containers) == 0:
+			dep.stop()
+		default:
+			dep.apply(ctx, md, spec)
+		}
+		handled <- md
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func guestStatus(s *fakemetadata.Server, name string) containerStatus {
+	var st containerStatus
+	json.Unmarshal([]byte(s.GuestAttributes()[guestNamespace+"/status-"+name]), &st)
+	return st
+}
+
+func TestDeployerFollowsMetadata(t *testing.T) {
+	env := testEnv(t)
+	s := fakemetadata.New(fakemetadata.Attributes{Instance: map[string]string{"caaos-spec": appSpec("1")}})
+	metadataServer(t, s)
+	b := &fakeBackend{newTask: func() *fakeTask { return &fakeTask{pid: 42} }}
+	dep := &deployer{
+		env: env,
+		newRunner: func(_ context.Context, _ *attributesJSON, _ *Spec, hash string) (*runner, *cloudLogSink, error) {
+			r := testRunner(env, b)
+			r.specHash = hash
+			return r, nil, nil
+		},
+	}
+	errs := make(chan error, 100)
+	w := newWatcher(&gceProvider{}, watcherConfig{
+		backoff:    time.Millisecond,
+		maxBackoff: 10 * time.Millisecond,
+		onError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	w.Start(ctx)
+	handled := make(chan *attributesJSON)
+	stopped := make(chan struct{})
+	go func() {
+		runDeployer(ctx, w, dep, handled)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		w.Stop()
+		<-stopped
+	}()
+	next := func() *attributesJSON {
+		t.Helper()
+		select {
+		case md := <-handled:
+			return md
+		case <-time.After(5 * time.Second):
+			t.Fatal("no metadata update handled")
+			return nil
+		}
+	}
+	running := func(image string) func() bool {
+		return func() bool {
+			st := guestStatus(s, "app")
+			return st.State == stateRunning && st.Image == image
+		}
+	}
+
+	next()
+	waitFor(t, "app:1 to run", running("gcr.io/p/app:1"))
+	first := b.created()
+	if len(first) != 1 {
+		t.Fatalf("%d containers created, want 1", len(first))
+	}
+
+	// A new spec replaces the running container.
+	s.Set("instance/attributes/caaos-spec", appSpec("2"))
+	next()
+	waitFor(t, "app:2 to run", running("gcr.io/p/app:2"))
+	if created := b.created(); len(created) != 2 {
+		t.Fatalf("%d containers created, want 2", len(created))
+	}
+	if len(first[0].task.killed()) == 0 || !first[0].deleted {
+		t.Error("app:1 was not stopped and deleted")
+	}
+
+	// Metadata errors are retried, other changes keep the containers.
+	s.Fail(100 * time.Millisecond)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watcher did not see the metadata server failing")
+	}
+	s.Set("instance/attributes/caaos-log-level", "debug")
+	if md := next(); md.LogLevel != "debug" {
+		t.Errorf("caaos-log-level = %q, want debug", md.LogLevel)
+	}
+	if created := b.created(); len(created) != 2 {
+		t.Errorf("%d containers created after an unchanged spec, want 2", len(created))
+	}
+
+	// Removing the spec stops the containers.
+	s.Delete("instance/attributes/caaos-spec")
+	next()
+	waitFor(t, "app:2 to exit", func() bool { return guestStatus(s, "app").State == stateExited })
+	second := b.created()[1]
+	if len(second.task.killed()) == 0 || !second.deleted {
+		t.Error("app:2 was not stopped and deleted")
+	}
+	if n := len(env.state.st.Containers); n != 0 {
+		t.Errorf("%d containers left in the state file", n)
+	}
+}
+
+func TestParseUpdateStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", updateStopFirst, false},
+		{updateStopFirst, updateStopFirst, false},
+		{updateStartFirst, updateStartFirst, false},
+		{updateBlueGreen, updateBlueGreen, false},
+		{updateCanary, updateCanary, false},
+		// Unknown strategies fall back to stopping first.
+		{"rolling", updateStopFirst, true},
+	} {
+		got, err := parseUpdateStrategy(tc.in)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("parseUpdateStrategy(%q) = %q, %v, want %q, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+// fakeDeployment returns a deployment of image whose containers run until
+// it is stopped.
+func fakeDeployment(image string) *deployment {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &deployment{
+		spec:    &Spec{Containers: []ContainerSpec{{Name: "app", Image: image}}},
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		ready:   make(chan struct{}),
+		healthy: make(chan struct{}),
+		health:  &healthSignals{failed: make(chan error, 1)},
+	}
+	go func() {
+		<-ctx.Done()
+		close(d.done)
+	}()
+	return d
+}
+
+func stopped(d *deployment) bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestRollout(t *testing.T) {
+	unhealthy := errors.New("app is unhealthy")
+	for _, tc := range []struct {
+		name     string
+		strategy string
+		canary   time.Duration
+		// events happen to the new deployment while it rolls out.
+		events   func(next *deployment, cancel func())
+		wantNext bool
+		// wantState is the rollout status published, none if empty.
+		wantState string
+	}{
+		{"start-first ready", updateStartFirst, 0, func(next *deployment, _ func()) {
+			close(next.ready)
+		}, true, rolloutComplete},
+		{"start-first exits", updateStartFirst, 0, func(next *deployment, _ func()) {
+			next.cancel()
+		}, false, rolloutRolledBack},
+		{"blue-green healthy", updateBlueGreen, 0, func(next *deployment, _ func()) {
+			close(next.ready)
+			close(next.healthy)
+		}, true, rolloutComplete},
+		{"blue-green unhealthy", updateBlueGreen, 0, func(next *deployment, _ func()) {
+			close(next.ready)
+			next.health.failed <- unhealthy
+		}, false, rolloutRolledBack},
+		{"canary healthy", updateCanary, 10 * time.Millisecond, func(next *deployment, _ func()) {
+			close(next.healthy)
+		}, true, rolloutComplete},
+		{"canary unhealthy during the canary period", updateCanary, time.Minute, func(next *deployment, _ func()) {
+			close(next.healthy)
+			time.Sleep(20 * time.Millisecond)
+			next.health.failed <- unhealthy
+		}, false, rolloutRolledBack},
+		{"canceled", updateBlueGreen, 0, func(_ *deployment, cancel func()) {
+			cancel()
+		}, false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := fakemetadata.New(fakemetadata.Attributes{})
+			metadataServer(t, s)
+			cur, next := fakeDeployment("gcr.io/p/app:1"), fakeDeployment("gcr.io/p/app:2")
+			defer cur.stop()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go tc.events(next, cancel)
+
+			got := rollout(ctx, cur, next, tc.strategy, tc.canary)
+			want, old := cur, next
+			if tc.wantNext {
+				want, old = next, cur
+			}
+			if got != want {
+				t.Errorf("rollout kept the new containers %v, want %v", got == next, tc.wantNext)
+			}
+			if !stopped(old) || stopped(want) {
+				t.Errorf("new containers stopped %v and previous stopped %v", stopped(next), stopped(cur))
+			}
+			var st rolloutStatus
+			if b, ok := s.GuestAttributes()[guestNamespace+"/rollout"]; ok {
+				json.Unmarshal([]byte(b), &st)
+			}
+			if st.State != tc.wantState || (st.State != "" && st.Strategy != tc.strategy) {
+				t.Errorf("rollout status = %+v, want state %q", st, tc.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/oci"
+)
+
+const defaultDevicePermissions = "rwm"
+
+// parseDevice parses a device in the Docker form
+// "host-path[:container-path[:permissions]]", permissions is a combination
+// of r (read), w (write) and m (mknod).
+func parseDevice(s string) (host, container, perms string, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return "", "", "", fmt.Errorf("invalid device %q", s)
+	}
+	host, container, perms = parts[0], parts[0], defaultDevicePermissions
+	if len(parts) > 1 && parts[1] != "" {
+		container = parts[1]
+	}
+	if len(parts) > 2 {
+		perms = parts[2]
+	}
+	if !filepath.IsAbs(host) || !filepath.IsAbs(container) {
+		return "", "", "", fmt.Errorf("device %q: paths must be absolute", s)
+	}
+	if perms == "" || strings.Trim(perms, "rwm") != "" {
+		return "", "", "", fmt.Errorf("device %q: invalid permissions %q", s, perms)
+	}
+	return host, container, perms, nil
+}
+
+// withDevices exposes host devices in the container and allows access to
+// them in the device cgroup. A directory adds all devices under it.
+func withDevices(devices []string) []oci.SpecOpts {
+	var opts []oci.SpecOpts
+	for _, d := range devices {
+		host, container, perms, err := parseDevice(d)
+		if err != nil {
+			// Already rejected by validation.
+			continue
+		}
+		opts = append(opts, oci.WithDevices(host, container, perms))
+	}
+	return opts
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// diskMountDir is where disks are mounted unless they set a mount path.
+	diskMountDir       = "/mnt/disks"
+	defaultDiskTimeout = 5 * time.Minute
+
+	// mountDisk is the mount type referring to a disk of the spec by name.
+	mountDisk = "disk"
+)
+
+// DiskSpec is an additional disk that is mounted on the host before any
+// containers start. Containers use it with a mount of type "disk" whose
+// source is the disk's name, or by bind mounting its mount path.
+type DiskSpec struct {
+	// Name is the disk's device name, set when it is attached to the VM.
+	Name string `json:"name"`
+	// Device is the path of the block device, by default the disk is found
+	// by its device name.
+	Device string `json:"device"`
+	// MountPath defaults to /mnt/disks/<name>.
+	MountPath string `json:"mount-path"`
+	// Format is "ext4" or "xfs" to format the disk if it is blank. Disks
+	// that already hold a filesystem are never formatted.
+	Format  string   `json:"format"`
+	Options []string `json:"options"`
+	// Timeout is how long to wait for the disk to be attached.
+	Timeout string `json:"timeout"`
+}
+
+// validateDisks checks the disks and resolves mounts of type disk into bind
+// mounts of the disk's mount path.
+func validateDisks(verr *validationError, spec *Spec) {
+	paths := map[string]string{}
+	for i := range spec.Disks {
+		d := &spec.Disks[i]
+		field := fmt.Sprintf("disks[%d]", i)
+		if d.Name == "" {
+			verr.add("%s: name is required", field)
+			continue
+		}
+		if !validName(d.Name) {
+			verr.add("%s: invalid name %q", field, d.Name)
+			continue
+		}
+		if _, ok := paths[d.Name]; ok {
+			verr.add("%s: duplicate disk name %q", field, d.Name)
+		}
+		if d.MountPath == "" {
+			d.MountPath = filepath.Join(diskMountDir, d.Name)
+		} else if !filepath.IsAbs(d.MountPath) {
+			verr.add("%s.mount-path: %q is not an absolute path", field, d.MountPath)
+		}
+		paths[d.Name] = d.MountPath
+		switch d.Format {
+		case "", "ext4", "xfs":
+		default:
+			verr.add("%s.format: unknown filesystem %q, must be ext4 or xfs", field, d.Format)
+		}
+		if d.Timeout != "" {
+			if _, err := time.ParseDuration(d.Timeout); err != nil {
+				verr.add("%s.timeout: %v", field, err)
+			}
+		}
+	}
+
+	resolve := func(field string, c *ContainerSpec) {
+		for j := range c.Mounts {
+			m := &c.Mounts[j]
+			if m.Type != mountDisk {
+				continue
+			}
+			path, ok := paths[m.Source]
+			if !ok {
+				verr.add("%s.mounts[%d]: no disk named %q", field, j, m.Source)
+				continue
+			}
+			m.Type, m.Source = "bind", path
+		}
+	}
+	for i := range spec.InitContainers {
+		resolve(fmt.Sprintf("init-containers[%d]", i), &spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		field := fmt.Sprintf("containers[%d]", i)
+		resolve(field, c)
+		for j := range c.Sidecars {
+			resolve(fmt.Sprintf("%s.sidecars[%d]", field, j), &c.Sidecars[j])
+		}
+	}
+}
+
+// prepareDisks waits for each disk, formats it if requested and blank, and
+// mounts it. Disks stay mounted when the spec changes.
+func prepareDisks(ctx context.Context, disks []DiskSpec) error {
+	for _, d := range disks {
+		if err := prepareDisk(ctx, d); err != nil {
+			return fmt.Errorf("disk %s: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+func prepareDisk(ctx context.Context, d DiskSpec) error {
+	logger := logger.With("disk", d.Name)
+	mounted, err := isMountPoint(d.MountPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		logger.Debug("disk is already mounted at", d.MountPath)
+		return nil
+	}
+
+	timeout := defaultDiskTimeout
+	if d.Timeout != "" {
+		timeout, _ = time.ParseDuration(d.Timeout)
+	}
+	dev, err := waitForDisk(ctx, d, timeout)
+	if err != nil {
+		return err
+	}
+
+	fstype, err := detectFilesystem(dev)
+	if err != nil {
+		return err
+	}
+	if fstype == "" {
+		if d.Format == "" {
+			return fmt.Errorf("%s has no filesystem and no format is set", dev)
+		}
+		logger.With("event", "format").Infof("formatting %s as %s", dev, d.Format)
+		if err := formatDisk(ctx, dev, d.Format); err != nil {
+			return err
+		}
+		fstype = d.Format
+	}
+
+	if err := os.MkdirAll(d.MountPath, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount(dev, d.MountPath, fstype, 0, strings.Join(d.Options, ",")); err != nil {
+		return fmt.Errorf("error mounting %s on %s: %v", dev, d.MountPath, err)
+	}
+	logger.With("event", "mount").Infof("mounted %s (%s) on %s", dev, fstype, d.MountPath)
+	return nil
+}
+
+// waitForDisk returns the block device of d once it is attached.
+func waitForDisk(ctx context.Context, d DiskSpec, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	logged := false
+	for {
+		dev := d.Device
+		if dev == "" {
+			dev = findDisk(d.Name)
+		}
+		if dev != "" {
+			if _, err := os.Stat(dev); err == nil {
+				return dev, nil
+			}
+		}
+		if !logged {
+			logger.Infof("Waiting for disk %s to be attached", d.Name)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("disk was not attached within %s", timeout)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// findDisk returns the block device with the given device name. Without
+// udev's /dev/disk/by-id links the name is read from the serial number the
+// disk reports, which is the device name on GCE.
+func findDisk(name string) string {
+	if dev := "/dev/disk/by-id/google-" + name; fileExists(dev) {
+		return dev
+	}
+	blocks, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return ""
+	}
+	for _, b := range blocks {
+		serial, err := ioutil.ReadFile(filepath.Join("/sys/block", b.Name(), "device/vpd_pg80"))
+		if err != nil || len(serial) < 4 {
+			continue
+		}
+		// The page starts with a 4 byte header.
+		if strings.TrimSpace(string(serial[4:])) == name {
+			return "/dev/" + b.Name()
+		}
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// detectFilesystem returns "ext4" or "xfs" if dev holds one of those
+// filesystems, or "" if it is blank. Anything else is an error so that
+// disks with unknown data are never formatted.
+func detectFilesystem(dev string) (string, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := make([]byte, 1<<20)
+	if _, err := io.ReadFull(f, b); err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(b, []byte("XFSB")):
+		return "xfs", nil
+	case b[1080] == 0x53 && b[1081] == 0xef:
+		// ext2, 3 and 4 share a magic, the ext4 driver mounts them all.
+		return "ext4", nil
+	case bytes.Count(b, []byte{0}) == len(b):
+		return "", nil
+	}
+	return "", fmt.Errorf("%s holds data that is not an ext4 or xfs filesystem", dev)
+}
+
+func formatDisk(ctx context.Context, dev, fstype string) error {
+	args := []string{"-f", dev}
+	if fstype == "ext4" {
+		args = []string{"-F", "-m", "0", "-E", "lazy_itable_init=0,lazy_journal_init=0,discard", dev}
+	}
+	out, err := exec.CommandContext(ctx, "mkfs."+fstype, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error formatting %s: %v: %s", dev, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// isMountPoint reports whether path is a mount point in the agent's mount
+// namespace.
+func isMountPoint(path string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	path = filepath.Clean(path)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// The fifth field is the mount point.
+		fields := strings.Fields(s.Text())
+		if len(fields) > 4 && fields[4] == path {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/oci"
+)
+
+// netFilesDir holds the generated resolv.conf and hosts files of each
+// container.
+const netFilesDir = "/run/caaos/net"
+
+// DNSSpec replaces the host's resolv.conf in the container.
+type DNSSpec struct {
+	Servers []string `json:"servers"`
+	Search  []string `json:"search"`
+	Options []string `json:"options"`
+}
+
+func (d *DNSSpec) validate() error {
+	if d == nil {
+		return nil
+	}
+	for _, s := range d.Servers {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("server %q is not an IP address", s)
+		}
+	}
+	return nil
+}
+
+// parseExtraHost parses "hostname:ip", the IP may be IPv6.
+func parseExtraHost(s string) (string, string, error) {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid host %q, want hostname:ip", s)
+	}
+	host, ip := s[:i], strings.Trim(s[i+1:], "[]")
+	if net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid host %q: %q is not an IP address", s, ip)
+	}
+	return host, ip, nil
+}
+
+func validateHostname(h string) error {
+	if len(h) > 64 || strings.Trim(h, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-.") != "" {
+		return fmt.Errorf("invalid hostname %q", h)
+	}
+	return nil
+}
+
+// resolvConf returns the contents of resolv.conf for d, the host's
+// nameservers are used if d has none.
+func (d *DNSSpec) resolvConf() []byte {
+	var b bytes.Buffer
+	for _, s := range d.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(d.Servers) == 0 {
+		host, _ := ioutil.ReadFile("/etc/resolv.conf")
+		for _, l := range strings.Split(string(host), "\n") {
+			if strings.HasPrefix(l, "nameserver") {
+				fmt.Fprintln(&b, l)
+			}
+		}
+	}
+	if len(d.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(d.Search, " "))
+	}
+	if len(d.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(d.Options, " "))
+	}
+	return b.Bytes()
+}
+
+// hostsFile returns the host's /etc/hosts followed by the container's
+// hostname and extra hosts.
+func hostsFile(hostname string, extra []string) ([]byte, error) {
+	b, err := ioutil.ReadFile("/etc/hosts")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) == 0 {
+		b = []byte("127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n")
+	}
+	buf := bytes.NewBuffer(b)
+	if !bytes.HasSuffix(b, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	if hostname != "" {
+		fmt.Fprintf(buf, "127.0.1.1\t%s\n", hostname)
+	}
+	for _, e := range extra {
+		host, ip, err := parseExtraHost(e)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(buf, "%s\t%s\n", ip, host)
+	}
+	return buf.Bytes(), nil
+}
+
+// withNetworkFiles sets the container's hostname and mounts resolv.conf and
+// hosts files generated from its spec, or the host's files if they are not
+// customized.
+func withNetworkFiles(id string, c ContainerSpec) ([]oci.SpecOpts, func(), error) {
+	nop := func() {}
+	opts := []oci.SpecOpts{oci.WithHostHostsFile, oci.WithHostResolvconf}
+	if c.DNS == nil && c.Hostname == "" && len(c.ExtraHosts) == 0 {
+		return opts, nop, nil
+	}
+
+	dir := filepath.Join(netFilesDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nop, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	opts = nil
+	var mounts []MountSpec
+	if c.DNS != nil {
+		p := filepath.Join(dir, "resolv.conf")
+		if err := ioutil.WriteFile(p, c.DNS.resolvConf(), 0644); err != nil {
+			cleanup()
+			return nil, nop, err
+		}
+		mounts = append(mounts, MountSpec{Source: p, Destination: "/etc/resolv.conf", Options: []string{"rbind", "ro"}})
+	} else {
+		opts = append(opts, oci.WithHostResolvconf)
+	}
+	if c.Hostname != "" || len(c.ExtraHosts) > 0 {
+		b, err := hostsFile(c.Hostname, c.ExtraHosts)
+		if err != nil {
+			cleanup()
+			return nil, nop, err
+		}
+		p := filepath.Join(dir, "hosts")
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			cleanup()
+			return nil, nop, err
+		}
+		mounts = append(mounts, MountSpec{Source: p, Destination: "/etc/hosts", Options: []string{"rbind", "ro"}})
+	} else {
+		opts = append(opts, oci.WithHostHostsFile)
+	}
+	if c.Hostname != "" {
+		opts = append(opts, oci.WithHostname(c.Hostname))
+	}
+	return append(opts, oci.WithMounts(ociMounts(mounts))), cleanup, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+)
+
+const (
+	nft         = "/bin/nft"
+	egressTable = "caaos_egress"
+
+	egressAllow = "allow"
+	egressDeny  = "deny"
+)
+
+// EgressSpec restricts the connections a container makes. Replies to
+// connections made to the container are always allowed.
+type EgressSpec struct {
+	// Default is what happens to traffic no rule matches, "allow" (the
+	// default) or "deny". With deny, remember to allow DNS.
+	Default string `json:"default"`
+	// Rules are checked in order, the first that matches decides.
+	Rules []EgressRule `json:"rules"`
+}
+
+// EgressRule matches traffic to any of CIDRs on any of Ports, an empty
+// list matches everything.
+type EgressRule struct {
+	// Action is "allow" or "deny".
+	Action string `json:"action"`
+	// CIDRs are IPv4 or IPv6 networks or addresses.
+	CIDRs []string `json:"cidrs"`
+	Ports []int    `json:"ports"`
+	// Protocol is "tcp", "udp" or empty for both.
+	Protocol string `json:"protocol"`
+}
+
+func (e *EgressSpec) validate(verr *validationError, field string) {
+	if e == nil {
+		return
+	}
+	if e.Default != "" && e.Default != egressAllow && e.Default != egressDeny {
+		verr.add("%s.egress.default: must be allow or deny, not %q", field, e.Default)
+	}
+	for i, r := range e.Rules {
+		rfield := fmt.Sprintf("%s.egress.rules[%d]", field, i)
+		if r.Action != egressAllow && r.Action != egressDeny {
+			verr.add("%s.action: must be allow or deny, not %q", rfield, r.Action)
+		}
+		for _, c := range r.CIDRs {
+			if _, err := parseCIDR(c); err != nil {
+				verr.add("%s.cidrs: %v", rfield, err)
+			}
+		}
+		for _, p := range r.Ports {
+			if p < 1 || p > 65535 {
+				verr.add("%s.ports: invalid port %d", rfield, p)
+			}
+		}
+		if r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp" {
+			verr.add("%s.protocol: must be tcp, udp or empty, not %q", rfield, r.Protocol)
+		}
+	}
+}
+
+// parseCIDR parses a network, or an address as a network of one.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", s)
+	}
+	return n, nil
+}
+
+// nftRules returns the nft statements for r, one per address family of
+// its CIDRs.
+func (r EgressRule) nftRules() []string {
+	verdict := "accept"
+	if r.Action == egressDeny {
+		verdict = "drop"
+	}
+	var match string
+	if len(r.Ports) > 0 {
+		ports := make([]string, len(r.Ports))
+		for i, p := range r.Ports {
+			ports[i] = strconv.Itoa(p)
+		}
+		proto := "{ tcp, udp }"
+		if r.Protocol != "" {
+			proto = r.Protocol
+		}
+		match = fmt.Sprintf(" meta l4proto %s th dport { %s }", proto, strings.Join(ports, ", "))
+	} else if r.Protocol != "" {
+		match = " meta l4proto " + r.Protocol
+	}
+	if len(r.CIDRs) == 0 {
+		return []string{strings.TrimSpace(match + " " + verdict)}
+	}
+	var v4, v6 []string
+	for _, c := range r.CIDRs {
+		n, _ := parseCIDR(c)
+		if n.IP.To4() != nil {
+			v4 = append(v4, n.String())
+		} else {
+			v6 = append(v6, n.String())
+		}
+	}
+	var out []string
+	if len(v4) > 0 {
+		out = append(out, fmt.Sprintf("ip daddr { %s }%s %s", strings.Join(v4, ", "), match, verdict))
+	}
+	if len(v6) > 0 {
+		out = append(out, fmt.Sprintf("ip6 daddr { %s }%s %s", strings.Join(v6, ", "), match, verdict))
+	}
+	return out
+}
+
+// egressChains returns the names of the base chain that selects the
+// traffic of container id and the chain with its rules.
+func egressChains(id string) (string, string) {
+	id = strings.NewReplacer("-", "_", ".", "_").Replace(id)
+	return "o_" + id, "c_" + id
+}
+
+// applyEgress adds nftables rules enforcing c's egress policy to the traffic
+// of container, which on the host network is selected by its cgroup and on
+// the bridge network by its address, ip. Rules left by a previous agent are
+// replaced. The returned function removes them.
+func applyEgress(ctx context.Context, logger *Logger, c ContainerSpec, container containerd.Container, ip string) (func(), error) {
+	e := c.Egress
+	if e == nil {
+		return func() {}, nil
+	}
+	base, chain := egressChains(container.ID())
+
+	var selector, hook string
+	switch {
+	case c.Network == networkBridge && c.netns != "":
+		return nil, fmt.Errorf("sidecars of bridge containers use the egress policy of their container")
+	case c.Network == networkBridge:
+		hook = "forward"
+		selector = "ip saddr " + ip
+		if strings.Contains(ip, ":") {
+			selector = "ip6 saddr " + ip
+		}
+	default:
+		if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+			return nil, fmt.Errorf("egress rules on the host network need cgroup v2")
+		}
+		spec, err := container.Spec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Linux == nil || spec.Linux.CgroupsPath == "" {
+			return nil, fmt.Errorf("container has no cgroup path")
+		}
+		path := strings.Trim(spec.Linux.CgroupsPath, "/")
+		hook = "output"
+		selector = fmt.Sprintf("socket cgroupv2 level %d %q", strings.Count(path, "/")+1, path)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table inet %s\n", egressTable)
+	fmt.Fprintf(&b, "add chain inet %s %s\n", egressTable, chain)
+	fmt.Fprintf(&b, "flush chain inet %s %s\n", egressTable, chain)
+	fmt.Fprintf(&b, "add rule inet %s %s ct state established,related accept\n", egressTable, chain)
+	for _, r := range e.Rules {
+		for _, rule := range r.nftRules() {
+			fmt.Fprintf(&b, "add rule inet %s %s %s\n", egressTable, chain, rule)
+		}
+	}
+	if e.Default == egressDeny {
+		fmt.Fprintf(&b, "add rule inet %s %s drop\n", egressTable, chain)
+	}
+	fmt.Fprintf(&b, "add chain inet %s %s { type filter hook %s priority 0; policy accept; }\n", egressTable, base, hook)
+	fmt.Fprintf(&b, "flush chain inet %s %s\n", egressTable, base)
+	fmt.Fprintf(&b, "add rule inet %s %s %s jump %s comment %q\n", egressTable, base, selector, chain, "caaos "+c.Name)
+	if err := runNft(ctx, b.String()); err != nil {
+		return nil, fmt.Errorf("error adding egress rules: %v", err)
+	}
+	def := e.Default
+	if def == "" {
+		def = egressAllow
+	}
+	logger.Infof("egress restricted by %d rules, default %s", len(e.Rules), def)
+
+	return func() {
+		script := fmt.Sprintf("delete chain inet %s %s\ndelete chain inet %s %s\n", egressTable, base, egressTable, chain)
+		if err := runNft(detach(ctx), script); err != nil {
+			logger.Error("Error removing egress rules:", err)
+		}
+	}, nil
+}
+
+// removeEgress removes any egress rules of container id, such as those of
+// an orphaned container.
+func removeEgress(ctx context.Context, id string) {
+	base, chain := egressChains(id)
+	for _, ch := range []string{base, chain} {
+		// Fails if the container had no egress policy.
+		runNft(ctx, fmt.Sprintf("delete chain inet %s %s\n", egressTable, ch))
+	}
+}
+
+// runNft runs an nft script atomically.
+func runNft(ctx context.Context, script string) error {
+	cmd := exec.CommandContext(ctx, nft, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
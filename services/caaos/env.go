@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseEnv parses the container-env attribute, which is either a JSON object
+// or KEY=VAL entries, one per line. Blank lines and lines starting with # are
+// ignored.
+func parseEnv(s string) (map[string]string, error) {
+	env := map[string]string{}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return env, nil
+	}
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), &env); err != nil {
+			return nil, err
+		}
+		return env, nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected KEY=VAL", line)
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env, scanner.Err()
+}
+
+// mergeEnv returns the union of base and override, with override taking
+// precedence.
+func mergeEnv(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+	env := map[string]string{}
+	for k, v := range base {
+		env[k] = v
+	}
+	for k, v := range override {
+		env[k] = v
+	}
+	return env
+}
+
+// expandEnv replaces ${attribute} references in env values with the value
+// of that instance attribute, it is an error to reference an attribute that
+// does not exist. A bare $ is left alone so values such as passwords don't
+// need escaping, and ${secret:...} references are left for
+// resolveSecretEnv.
+func expandEnv(env map[string]string, attrs map[string]string) error {
+	var missing []string
+	for k, v := range env {
+		var out strings.Builder
+		for {
+			i := strings.Index(v, "${")
+			if i < 0 {
+				break
+			}
+			j := strings.Index(v[i:], "}")
+			if j < 0 {
+				break
+			}
+			name := v[i+2 : i+j]
+			if strings.HasPrefix(name, "secret:") {
+				// Secret references are resolved when the container starts.
+				out.WriteString(v[:i+j+1])
+				v = v[i+j+1:]
+				continue
+			}
+			val, ok := attrs[name]
+			if !ok {
+				missing = append(missing, name)
+			}
+			out.WriteString(v[:i])
+			out.WriteString(val)
+			v = v[i+j+1:]
+		}
+		out.WriteString(v)
+		env[k] = out.String()
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("env references unknown attributes %q", missing)
+	}
+	return nil
+}
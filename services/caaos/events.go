@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifecycle event types sent on /v1/events.
+const (
+	eventPulling    = "pulling"
+	eventPulled     = "pulled"
+	eventCreated    = "created"
+	eventStarted    = "started"
+	eventExited     = "exited"
+	eventRestarting = "restarting"
+	eventOOM        = "oom"
+)
+
+// eventHistory is how many events are kept for clients that reconnect.
+const eventHistory = 100
+
+// eventKeepalive is how often an idle /v1/events stream is written to, so
+// that proxies don't close it.
+const eventKeepalive = 15 * time.Second
+
+// lifecycleEvent is a change in the state of a container.
+type lifecycleEvent struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Container string    `json:"container"`
+	ID        string    `json:"id,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	ExitCode  *uint32   `json:"exit-code,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// eventBus fans lifecycle events out to /v1/events clients and keeps the
+// last eventHistory of them.
+type eventBus struct {
+	mx     sync.Mutex
+	seq    uint64
+	recent []lifecycleEvent
+	subs   map[chan lifecycleEvent]bool
+}
+
+var lifecycle = &eventBus{subs: map[chan lifecycleEvent]bool{}}
+
+func (b *eventBus) publish(e lifecycleEvent) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	e.Time = time.Now().UTC()
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventHistory {
+		b.recent = b.recent[len(b.recent)-eventHistory:]
+	}
+	for c := range b.subs {
+		// Drop events for clients that can't keep up rather than block
+		// the supervisor.
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns the kept events after seq and a channel new events are
+// sent to until cancel is called.
+func (b *eventBus) subscribe(seq uint64) ([]lifecycleEvent, <-chan lifecycleEvent, func()) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	var missed []lifecycleEvent
+	for _, e := range b.recent {
+		if e.Seq > seq {
+			missed = append(missed, e)
+		}
+	}
+	c := make(chan lifecycleEvent, 100)
+	b.subs[c] = true
+	cancel := func() {
+		b.mx.Lock()
+		defer b.mx.Unlock()
+		delete(b.subs, c)
+	}
+	return missed, c, cancel
+}
+
+// handleEvents serves GET /v1/events[?container=name&type=a,b], a stream of
+// lifecycle events as server-sent events. Events are sent from when the
+// request is made, or, if the Last-Event-ID header is set, from after that
+// event as long as it is still kept.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	container := r.URL.Query().Get("container")
+	types := map[string]bool{}
+	if t := r.URL.Query().Get("type"); t != "" {
+		for _, s := range strings.Split(t, ",") {
+			types[strings.TrimSpace(s)] = true
+		}
+	}
+	match := func(e lifecycleEvent) bool {
+		return (container == "" || e.Container == container) && (len(types) == 0 || types[e.Type]) && tenants.visible(r.Context(), e.Container)
+	}
+
+	seq := ^uint64(0)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		seq = n
+	}
+	missed, c, cancel := lifecycle.subscribe(seq)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	send := func(e lifecycleEvent) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, b)
+		return err
+	}
+	for _, e := range missed {
+		if match(e) {
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	}
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case e := <-c:
+			if !match(e) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/namespaces"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Frame types sent to the client of an exec session. Each frame is the type
+// byte, a big endian uint32 length and the data, an exit frame holds the
+// exit code as a big endian uint32.
+const (
+	execStdout byte = 1
+	execStderr byte = 2
+	execExit   byte = 3
+)
+
+// execTarget is a running container that processes can be executed in.
+type execTarget struct {
+	namespace string
+	container containerd.Container
+	task      containerd.Task
+}
+
+// context returns ctx in the namespace of the target's container.
+func (e execTarget) context(ctx context.Context) context.Context {
+	return namespaces.WithNamespace(ctx, e.namespace)
+}
+
+// taskRegistry tracks the running task of each container by name.
+type taskRegistry struct {
+	mx    sync.Mutex
+	tasks map[string]execTarget
+}
+
+var running = &taskRegistry{tasks: map[string]execTarget{}}
+
+// add registers the task of container name in namespace ns, the returned
+// function removes it.
+func (t *taskRegistry) add(name, ns string, container containerd.Container, task containerd.Task) func() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.tasks[name] = execTarget{namespace: ns, container: container, task: task}
+	return func() {
+		t.mx.Lock()
+		defer t.mx.Unlock()
+		if t.tasks[name].task == task {
+			delete(t.tasks, name)
+		}
+	}
+}
+
+// all returns the running tasks by container name.
+func (t *taskRegistry) all() map[string]execTarget {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	all := make(map[string]execTarget, len(t.tasks))
+	for name, e := range t.tasks {
+		all[name] = e
+	}
+	return all
+}
+
+func (t *taskRegistry) get(name string) (execTarget, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	e, ok := t.tasks[name]
+	return e, ok
+}
+
+// frameWriter writes output as frames of type typ.
+type frameWriter struct {
+	mx  *sync.Mutex
+	w   *bufio.Writer
+	typ byte
+}
+
+func (f frameWriter) Write(b []byte) (int, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if err := writeFrame(f.w, f.typ, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func writeFrame(w *bufio.Writer, typ byte, b []byte) error {
+	hdr := make([]byte, 5)
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// eofReader closes eof once r returns an error.
+type eofReader struct {
+	r    io.Reader
+	once sync.Once
+	eof  chan struct{}
+}
+
+func (e *eofReader) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	if err != nil {
+		e.once.Do(func() { close(e.eof) })
+	}
+	return n, err
+}
+
+// handleExec serves POST /v1/exec/<name>?arg=...[&tty=true&rows=N&cols=N],
+// running a process in the container's task. The connection is upgraded
+// to a stream, the request side carries stdin and the response side
+// carries output and exit frames.
+func handleExec(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/v1/exec/")
+		target, ok := running.get(name)
+		if !ok {
+			http.Error(w, "container "+name+" is not running", http.StatusNotFound)
+			return
+		}
+		ctx := target.context(ctx)
+		q := r.URL.Query()
+		args := q["arg"]
+		if len(args) == 0 {
+			args = []string{"/bin/sh"}
+		}
+		tty := q.Get("tty") == "true"
+
+		spec, err := target.container.Spec(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pspec := *spec.Process
+		pspec.Args = args
+		pspec.Terminal = tty
+
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection can not be upgraded", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: caaos-exec\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			return
+		}
+
+		clogger := containerLogger(name)
+		clogger.With("event", "exec").Infof("executing %q", args)
+		var mx sync.Mutex
+		stdin := &eofReader{r: rw.Reader, eof: make(chan struct{})}
+		opts := []cio.Opt{cio.WithStreams(stdin, frameWriter{&mx, rw.Writer, execStdout}, frameWriter{&mx, rw.Writer, execStderr})}
+		if tty {
+			opts = append(opts, cio.WithTerminal)
+		}
+		code, err := execProcess(ctx, target, fmt.Sprintf("exec-%d", rand.Int63()), &pspec, cio.NewCreator(opts...), stdin, q)
+		if err != nil {
+			clogger.Error("Error executing process:", err)
+			mx.Lock()
+			writeFrame(rw.Writer, execStderr, []byte(err.Error()+"\n"))
+			mx.Unlock()
+			code = 126
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, code)
+		mx.Lock()
+		writeFrame(rw.Writer, execExit, b)
+		mx.Unlock()
+	}
+}
+
+// execProcess runs pspec in the target's task and returns its exit code.
+func execProcess(ctx context.Context, target execTarget, id string, pspec *specs.Process, creator cio.Creator, stdin *eofReader, q url.Values) (uint32, error) {
+	p, err := target.task.Exec(ctx, id, pspec, creator)
+	if err != nil {
+		return 0, err
+	}
+	defer p.Delete(detach(ctx), containerd.WithProcessKill)
+	statusC, err := p.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.Start(ctx); err != nil {
+		return 0, err
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-stdin.eof:
+		case <-exited:
+			return
+		}
+		// Without a TTY end of input is passed on to the process, with one
+		// it means the client has gone.
+		if pspec.Terminal {
+			p.Kill(ctx, syscall.SIGKILL)
+			return
+		}
+		p.CloseIO(ctx, containerd.WithStdinCloser)
+	}()
+	if pspec.Terminal {
+		rows, _ := strconv.ParseUint(q.Get("rows"), 10, 32)
+		cols, _ := strconv.ParseUint(q.Get("cols"), 10, 32)
+		if rows > 0 && cols > 0 {
+			p.Resize(ctx, uint32(cols), uint32(rows))
+		}
+	}
+	status := <-statusC
+	p.IO().Wait()
+	code, _, err := status.Result()
+	return code, err
+}
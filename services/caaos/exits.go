@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl/v2"
+)
+
+// exitMonitor receives containerd's task exit events and passes them on to
+// the supervisor of the task, so that a single stream serves every task.
+type exitMonitor struct {
+	mx   sync.Mutex
+	subs map[string]*exitSub
+}
+
+// exitSub is a task waiting for its exit status.
+type exitSub struct {
+	ctx  context.Context
+	task containerd.Task
+	c    chan containerd.ExitStatus
+	done bool
+}
+
+var exits = &exitMonitor{subs: map[string]*exitSub{}}
+
+func exitKey(ns, id string) string {
+	return ns + "/" + id
+}
+
+// run receives exit events until ctx is canceled, resubscribing if the
+// connection to containerd is lost. Exits missed while not subscribed are
+// found by checking the status of every task waited for.
+func (m *exitMonitor) run(ctx context.Context, client *containerd.Client) {
+	for {
+		evC, errC := client.Subscribe(ctx, `topic=="/tasks/exit"`)
+		m.reconcile()
+		m.receive(ctx, evC, errC)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (m *exitMonitor) receive(ctx context.Context, evC <-chan *events.Envelope, errC <-chan error) {
+	for {
+		select {
+		case env := <-evC:
+			v, err := typeurl.UnmarshalAny(env.Event)
+			if err != nil {
+				logger.Error("Error decoding exit event:", err)
+				continue
+			}
+			// Exits of exec'd processes have their own ID.
+			if e, ok := v.(*apievents.TaskExit); ok && e.ID == e.ContainerID {
+				m.notify(exitKey(env.Namespace, e.ContainerID), *containerd.NewExitStatus(e.ExitStatus, e.ExitedAt.AsTime(), nil))
+			}
+		case err := <-errC:
+			if err != nil && ctx.Err() == nil {
+				logger.Error("Error receiving containerd events:", err)
+			}
+			return
+		}
+	}
+}
+
+// subscribe returns a channel that receives the exit status of task and a
+// function to unsubscribe. A task that has already exited, such as one
+// that exited while the agent was down, gets its status right away.
+func (m *exitMonitor) subscribe(ctx context.Context, task containerd.Task) (<-chan containerd.ExitStatus, func()) {
+	ns, _ := namespaces.Namespace(ctx)
+	key := exitKey(ns, task.ID())
+	sub := &exitSub{ctx: ctx, task: task, c: make(chan containerd.ExitStatus, 1)}
+	m.mx.Lock()
+	m.subs[key] = sub
+	m.mx.Unlock()
+	m.check(key, sub)
+	return sub.c, func() {
+		m.mx.Lock()
+		defer m.mx.Unlock()
+		if m.subs[key] == sub {
+			delete(m.subs, key)
+		}
+	}
+}
+
+// reconcile checks every task waited for, for exits whose event was
+// missed.
+func (m *exitMonitor) reconcile() {
+	m.mx.Lock()
+	subs := map[string]*exitSub{}
+	for key, sub := range m.subs {
+		subs[key] = sub
+	}
+	m.mx.Unlock()
+	for key, sub := range subs {
+		m.check(key, sub)
+	}
+}
+
+// check sends the exit status of sub's task if it has stopped.
+func (m *exitMonitor) check(key string, sub *exitSub) {
+	st, err := sub.task.Status(sub.ctx)
+	if err != nil || st.Status != containerd.Stopped {
+		return
+	}
+	m.notify(key, *containerd.NewExitStatus(st.ExitStatus, st.ExitTime, nil))
+}
+
+// notify sends status to the subscriber of key, once.
+func (m *exitMonitor) notify(key string, status containerd.ExitStatus) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if sub, ok := m.subs[key]; ok && !sub.done {
+		sub.done = true
+		sub.c <- status
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cloudInitUserData = "/var/lib/cloud/instance/user-data.txt"
+
+	// filePollInterval is used when inotify is unavailable.
+	filePollInterval = 30 * time.Second
+	// fileSettle gives writers a moment to finish before the file is reread.
+	fileSettle = 100 * time.Millisecond
+)
+
+// fileProvider reads attributes from a local file and reloads it whenever
+// the directory it is in changes. The file is parsed as user data.
+type fileProvider struct {
+	name  string
+	path  string
+	parse func([]byte) ([]byte, error)
+	fd    int
+	poller
+}
+
+func newFileProvider(path string) *fileProvider {
+	return &fileProvider{name: "file", path: path, fd: -1}
+}
+
+// newCloudInitProvider reads cloud-init user-data. A #cloud-config document
+// is used if it has a top level caaos key, any other user data is used as is.
+func newCloudInitProvider() *fileProvider {
+	return &fileProvider{name: "cloud-init", path: cloudInitUserData, parse: parseCloudConfig, fd: -1}
+}
+
+func (p *fileProvider) Name() string { return p.name }
+
+func parseCloudConfig(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte("#cloud-config")) {
+		return b, nil
+	}
+	var cc struct {
+		Caaos interface{} `json:"caaos"`
+	}
+	if err := yaml.Unmarshal(b, &cc); err != nil {
+		return nil, fmt.Errorf("error parsing cloud-config: %v", err)
+	}
+	if cc.Caaos == nil {
+		return nil, nil
+	}
+	if s, ok := cc.Caaos.(string); ok {
+		return []byte(s), nil
+	}
+	return yaml.Marshal(cc.Caaos)
+}
+
+func (p *fileProvider) attributes(ctx context.Context) (map[string]string, error) {
+	attrs := map[string]string{}
+	b, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.parse != nil {
+		if b, err = p.parse(b); err != nil {
+			return nil, err
+		}
+	}
+	mergeUserData(attrs, b)
+	return attrs, nil
+}
+
+// watch sets up an inotify watch on the directory containing the file so
+// that editors replacing the file are also seen.
+func (p *fileProvider) watch() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(p.path), unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE|unix.IN_DELETE); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	p.fd = fd
+	return nil
+}
+
+// wait blocks until the directory containing the file changes, falling back
+// to polling if inotify can not be used.
+func (p *fileProvider) wait(ctx context.Context) error {
+	if p.fd < 0 {
+		if err := p.watch(); err != nil {
+			logger.Warnf("Error watching %s, polling instead: %v", p.path, err)
+			return every(filePollInterval)(ctx)
+		}
+	}
+	fds := []unix.PollFd{{Fd: int32(p.fd), Events: unix.POLLIN}}
+	buf := make([]byte, 4096)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n, err := unix.Poll(fds, 1000)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Drain the events, the file is reread regardless of which entry in
+		// the directory changed.
+		time.Sleep(fileSettle)
+		for {
+			if _, err := unix.Read(p.fd, buf); err != nil {
+				break
+			}
+		}
+		return nil
+	}
+}
+
+// Watch returns the attributes from the file whenever they change.
+func (p *fileProvider) Watch(ctx context.Context) (*attributesJSON, error) {
+	return p.poll(ctx, p.wait, p.attributes)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nftInputChain is the chain host ports are opened in when the host
+// firewall is managed with nft rather than iptables. Accepting traffic in a
+// chain of our own would not override a drop in the host's.
+const nftInputChain = "inet filter input"
+
+// hostPort is a port or range of ports opened in the host firewall.
+type hostPort struct {
+	first, last int
+	proto       string
+}
+
+// parseHostPort parses "port[-last][/protocol]", the protocol defaults to
+// tcp.
+func parseHostPort(s string) (hostPort, error) {
+	p := hostPort{proto: "tcp"}
+	ports := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		ports, p.proto = s[:i], s[i+1:]
+	}
+	if p.proto != "tcp" && p.proto != "udp" {
+		return p, fmt.Errorf("invalid protocol in %q", s)
+	}
+	first, last := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		first, last = ports[:i], ports[i+1:]
+	}
+	var err error
+	if p.first, err = strconv.Atoi(first); err != nil {
+		return p, fmt.Errorf("invalid port in %q", s)
+	}
+	if p.last, err = strconv.Atoi(last); err != nil {
+		return p, fmt.Errorf("invalid port in %q", s)
+	}
+	if p.first < 1 || p.last > 65535 || p.first > p.last {
+		return p, fmt.Errorf("port %q out of range", s)
+	}
+	return p, nil
+}
+
+// ports returns the port or range in the form iptables and nft take.
+func (p hostPort) ports(sep string) string {
+	if p.first == p.last {
+		return strconv.Itoa(p.first)
+	}
+	return fmt.Sprintf("%d%s%d", p.first, sep, p.last)
+}
+
+func (p hostPort) String() string {
+	return p.ports("-") + "/" + p.proto
+}
+
+// firewall opens ports in the host firewall. open is a no-op for a port
+// that is already open, as for a container reattached to after an agent
+// restart, and returns the function closing it.
+type firewall interface {
+	open(ctx context.Context, p hostPort, comment string) (func() error, error)
+}
+
+// hostFirewall returns the firewall of the host, iptables if it is
+// installed and nft otherwise.
+func hostFirewall() (firewall, error) {
+	if _, err := os.Stat(iptables); err == nil {
+		return iptablesFirewall{}, nil
+	}
+	if _, err := os.Stat(nft); err == nil {
+		return nftFirewall{}, nil
+	}
+	return nil, fmt.Errorf("neither %s nor %s is installed", iptables, nft)
+}
+
+type iptablesFirewall struct{}
+
+func (iptablesFirewall) open(ctx context.Context, p hostPort, comment string) (func() error, error) {
+	rule := []string{"INPUT", "-p", p.proto, "--dport", p.ports(":"), "-j", "ACCEPT", "-m", "comment", "--comment", comment}
+	closeRule := func() error {
+		return runCmd(detach(ctx), iptables, append([]string{"-D"}, rule...))
+	}
+	if runCmd(ctx, iptables, append([]string{"-C"}, rule...)) == nil {
+		return closeRule, nil
+	}
+	if err := runCmd(ctx, iptables, append([]string{"-I"}, rule...)); err != nil {
+		return nil, err
+	}
+	return closeRule, nil
+}
+
+type nftFirewall struct{}
+
+var nftHandle = regexp.MustCompile(`# handle (\d+)$`)
+
+func (nftFirewall) open(ctx context.Context, p hostPort, comment string) (func() error, error) {
+	rule := fmt.Sprintf("%s dport %s accept comment %q", p.proto, p.ports("-"), comment)
+	out, err := exec.CommandContext(ctx, nft, "-a", "list", "chain", nftInputChain).Output()
+	if err != nil {
+		// Without the chain nothing drops the traffic.
+		logger.Debugf("Not opening %s, no %s chain: %v", p, nftInputChain, err)
+		return func() error { return nil }, nil
+	}
+	handle := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := nftHandle.FindStringSubmatch(line); m != nil && strings.Contains(line, rule) {
+			handle = m[1]
+			break
+		}
+	}
+	if handle == "" {
+		out, err := exec.CommandContext(ctx, nft, "-e", "-a", "insert rule "+nftInputChain+" "+rule).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		m := nftHandle.FindStringSubmatch(strings.TrimSpace(string(out)))
+		if m == nil {
+			return nil, fmt.Errorf("no handle in nft output %q", out)
+		}
+		handle = m[1]
+	}
+	return func() error {
+		return runNft(detach(ctx), fmt.Sprintf("delete rule %s handle %s\n", nftInputChain, handle))
+	}, nil
+}
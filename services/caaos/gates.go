@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// gateRetryInterval is how often a boot gate that is not yet open is
+	// checked again.
+	gateRetryInterval = 2 * time.Second
+	// gateProbeTimeout bounds a single DNS lookup or registry request.
+	gateProbeTimeout = 10 * time.Second
+	// maxClockSkew is how far the clock may be from a registry's before
+	// TLS certificates are at risk of being seen as not yet valid.
+	maxClockSkew = time.Minute
+)
+
+// bootGate is a condition waited for before the first images are pulled.
+type bootGate struct {
+	name    string
+	timeout time.Duration
+	check   func(ctx context.Context) error
+}
+
+// waitBootGates waits, in order, for the network to be up, the registries
+// of spec to resolve and the clock to be in sync. A gate that is still
+// closed at its timeout is logged and skipped, the pull then gets its own
+// retries. A zero timeout disables a gate.
+func waitBootGates(ctx context.Context, spec *Spec) {
+	registries := specRegistries(spec)
+	gates := []bootGate{
+		{"network", *networkGateFlag, checkNetwork},
+		{"dns", *dnsGateFlag, func(ctx context.Context) error { return checkDNS(ctx, registries) }},
+		{"clock", *clockGateFlag, func(ctx context.Context) error { return checkClock(ctx, registries) }},
+	}
+	for _, g := range gates {
+		if g.timeout <= 0 {
+			continue
+		}
+		glogger := logger.With("event", "boot-gate", "gate", g.name)
+		start := time.Now()
+		gctx, cancel := context.WithTimeout(ctx, g.timeout)
+		err := waitGate(gctx, g.check)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			glogger.Errorf("Boot gate %s still closed after %s, continuing anyway: %v", g.name, g.timeout, err)
+		default:
+			glogger.Infof("boot gate %s open after %s", g.name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	boot.mark(phaseGates)
+}
+
+// waitGate calls check until it succeeds or ctx is done, returning the last
+// error.
+func waitGate(ctx context.Context, check func(context.Context) error) error {
+	for {
+		err := check(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(gateRetryInterval):
+		}
+	}
+}
+
+// specRegistries returns the registry hosts the images of spec are pulled
+// from, preloaded images are skipped.
+func specRegistries(spec *Spec) []string {
+	if spec == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	add := func(image string) {
+		if _, ok := imageRef(image); ok || isArchiveImage(image) {
+			return
+		}
+		named, err := reference.ParseDockerRef(image)
+		if err != nil {
+			return
+		}
+		host := reference.Domain(named)
+		if host == "docker.io" {
+			host = "registry-1.docker.io"
+		}
+		seen[host] = true
+	}
+	for _, c := range append(append([]ContainerSpec{}, spec.InitContainers...), spec.Containers...) {
+		add(c.Image)
+		for _, sc := range c.Sidecars {
+			add(sc.Image)
+		}
+		for _, image := range c.Hooks.images() {
+			add(image)
+		}
+	}
+	var hosts []string
+	for h := range seen {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// checkNetwork succeeds once there is a default route through an interface
+// other than loopback.
+func checkNetwork(context.Context) error {
+	for _, f := range []string{"/proc/net/route", "/proc/net/ipv6_route"} {
+		if hasDefaultRoute(f) {
+			return nil
+		}
+	}
+	return errors.New("no default route")
+}
+
+func hasDefaultRoute(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		switch {
+		case len(fields) >= 2 && fields[0] != "Iface" && len(fields[1]) == 8:
+			// /proc/net/route: Iface Destination Gateway ...
+			if fields[1] == "00000000" && fields[0] != "lo" {
+				return true
+			}
+		case len(fields) == 10:
+			// /proc/net/ipv6_route: destination prefix-length ... device
+			if fields[0] == strings.Repeat("0", 32) && fields[1] == "00" && fields[9] != "lo" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDNS succeeds once every registry resolves.
+func checkDNS(ctx context.Context, registries []string) error {
+	for _, host := range registries {
+		lctx, cancel := context.WithTimeout(ctx, gateProbeTimeout)
+		_, err := net.DefaultResolver.LookupHost(lctx, host)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error resolving %s: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// checkClock succeeds if the kernel reports the clock as synchronized or,
+// as there may be no NTP client, if the clock is within maxClockSkew of the
+// Date returned by the first registry.
+func checkClock(ctx context.Context, registries []string) error {
+	var tx unix.Timex
+	if state, err := unix.Adjtimex(&tx); err == nil && state != unix.TIME_ERROR && tx.Status&unix.STA_UNSYNC == 0 {
+		return nil
+	}
+	if len(registries) == 0 {
+		return nil
+	}
+	rctx, cancel := context.WithTimeout(ctx, gateProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", "https://"+registries[0]+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(rctx))
+	if err != nil {
+		var cerr x509.CertificateInvalidError
+		if errors.As(err, &cerr) && cerr.Reason == x509.Expired {
+			return fmt.Errorf("%s's certificate is not valid at %s, the clock is likely wrong: %v", registries[0], time.Now().UTC().Format(time.RFC3339), err)
+		}
+		return err
+	}
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("no Date from %s to check the clock against", registries[0])
+	}
+	if skew := time.Since(date); skew > maxClockSkew+time.Second || skew < -maxClockSkew {
+		return fmt.Errorf("clock is %s off from %s", skew.Round(time.Second), registries[0])
+	}
+	return nil
+}
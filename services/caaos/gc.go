@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	containerdRoot = "/var/lib/containerd"
+
+	defaultGCInterval      = 1 * time.Hour
+	defaultGCDiskThreshold = 85
+	gcDiskCheckInterval    = 1 * time.Minute
+	gcMinSnapshotAge       = 10 * time.Minute
+	// gcMinImageAge protects images pulled or prefetched since the keep
+	// list was last configured.
+	gcMinImageAge = 10 * time.Minute
+)
+
+var (
+	gcRuns             = expvar.NewInt("gc_runs")
+	gcImagesRemoved    = expvar.NewInt("gc_images_removed")
+	gcSnapshotsRemoved = expvar.NewInt("gc_snapshots_removed")
+	gcReclaimedBytes   = expvar.NewInt("gc_reclaimed_bytes")
+)
+
+// imagePins holds the images of containers that are being started, from
+// before the pull until the container referencing the image is created.
+type imagePins struct {
+	mx   sync.Mutex
+	refs map[string]int
+}
+
+var pins = &imagePins{refs: map[string]int{}}
+
+// hold pins ref until the returned function is called, which may be called
+// more than once.
+func (p *imagePins) hold(ref string) func() {
+	p.mx.Lock()
+	p.refs[ref]++
+	p.mx.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mx.Lock()
+			defer p.mx.Unlock()
+			if p.refs[ref]--; p.refs[ref] <= 0 {
+				delete(p.refs, ref)
+			}
+		})
+	}
+}
+
+func (p *imagePins) held(ref string) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.refs[ref] > 0
+}
+
+// collector periodically removes images and snapshots that are not used by
+// any container, by the current spec or by a container being started.
+type collector struct {
+	client *containerd.Client
+
+	mx            sync.Mutex
+	interval      time.Duration
+	diskThreshold int
+	keep          map[string]bool
+	namespaces    []string
+	snapshotter   string
+}
+
+func newCollector(client *containerd.Client) *collector {
+	return &collector{
+		client:        client,
+		interval:      defaultGCInterval,
+		diskThreshold: defaultGCDiskThreshold,
+		namespaces:    []string{*namespaceFlag},
+		snapshotter:   containerd.DefaultSnapshotter,
+	}
+}
+
+// configure updates the collection schedule, the set of images that should
+// be kept even when no container is using them, the namespaces to collect
+// in and the snapshotter images are unpacked into.
+func (g *collector) configure(interval time.Duration, diskThreshold int, keep, nss []string, snapshotter string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if interval > 0 {
+		g.interval = interval
+	}
+	if diskThreshold > 0 {
+		g.diskThreshold = diskThreshold
+	}
+	g.keep = map[string]bool{}
+	for _, k := range keep {
+		g.keep[k] = true
+	}
+	g.namespaces = nss
+	g.snapshotter = snapshotter
+}
+
+// run collects every interval, or sooner if disk usage crosses the
+// threshold, until ctx is canceled.
+func (g *collector) run(ctx context.Context) {
+	last := time.Now()
+	ticker := time.NewTicker(gcDiskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		g.mx.Lock()
+		interval, threshold := g.interval, g.diskThreshold
+		g.mx.Unlock()
+
+		usage, err := diskUsage(containerdRoot)
+		if err != nil {
+			logger.Warn("Error checking disk usage:", err)
+		}
+		if time.Since(last) < interval && usage < threshold {
+			continue
+		}
+		if usage >= threshold {
+			logger.Warnf("Disk usage %d%% is over the %d%% threshold, running garbage collection", usage, threshold)
+		}
+		g.collect(ctx)
+		last = time.Now()
+	}
+}
+
+// collect removes unused images and any active snapshots that are not
+// owned by a container, which are left behind if the agent dies before
+// cleaning up, in each namespace.
+func (g *collector) collect(ctx context.Context) {
+	before, _ := freeBytes(containerdRoot)
+
+	g.mx.Lock()
+	nss := g.namespaces
+	g.mx.Unlock()
+	var removedImages, removedSnapshots int64
+	for _, ns := range nss {
+		i, s := g.collectNamespace(namespaces.WithNamespace(ctx, ns))
+		removedImages += i
+		removedSnapshots += s
+	}
+
+	after, _ := freeBytes(containerdRoot)
+	reclaimed := int64(after) - int64(before)
+	if reclaimed < 0 {
+		reclaimed = 0
+	}
+	gcRuns.Add(1)
+	gcImagesRemoved.Add(removedImages)
+	gcSnapshotsRemoved.Add(removedSnapshots)
+	gcReclaimedBytes.Add(reclaimed)
+	logger.Infof("GC: removed %d images and %d snapshots, reclaimed %d bytes", removedImages, removedSnapshots, reclaimed)
+}
+
+// collectNamespace collects in the namespace of ctx and returns the number
+// of images and snapshots removed.
+func (g *collector) collectNamespace(ctx context.Context) (removedImages, removedSnapshots int64) {
+	cs, err := g.client.Containers(ctx)
+	if err != nil {
+		logger.Error("GC: error listing containers:", err)
+		return
+	}
+	inUse := map[string]bool{}
+	snapshotsInUse := map[string]bool{}
+	for _, c := range cs {
+		info, err := c.Info(ctx)
+		if err != nil {
+			logger.Error("GC: error getting container info:", err)
+			return
+		}
+		inUse[info.Image] = true
+		snapshotsInUse[info.Snapshotter+"/"+info.SnapshotKey] = true
+	}
+
+	g.mx.Lock()
+	for k := range g.keep {
+		inUse[k] = true
+	}
+	// Snapshots are also collected from the default snapshotter, which
+	// holds those of containers from before the snapshotter was changed.
+	snapshotters := []string{containerd.DefaultSnapshotter}
+	if g.snapshotter != containerd.DefaultSnapshotter {
+		snapshotters = append(snapshotters, g.snapshotter)
+	}
+	g.mx.Unlock()
+
+	imgs, err := g.client.ImageService().List(ctx)
+	if err != nil {
+		logger.Error("GC: error listing images:", err)
+		return
+	}
+	for _, img := range imgs {
+		if inUse[img.Name] || pins.held(img.Name) || time.Since(img.UpdatedAt) < gcMinImageAge {
+			continue
+		}
+		if err := g.client.ImageService().Delete(ctx, img.Name, images.SynchronousDelete()); err != nil {
+			logger.Errorf("GC: error removing image %s: %v", img.Name, err)
+			continue
+		}
+		logger.Info("GC: removed image", img.Name)
+		removedImages++
+	}
+
+	for _, name := range snapshotters {
+		var stale []string
+		sn := g.client.SnapshotService(name)
+		if err := sn.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+			// Skip new snapshots, they may belong to a container that is
+			// being created.
+			if info.Kind == snapshots.KindActive && !snapshotsInUse[name+"/"+info.Name] && time.Since(info.Created) > gcMinSnapshotAge {
+				stale = append(stale, info.Name)
+			}
+			return nil
+		}); err != nil {
+			logger.Errorf("GC: error listing %s snapshots: %v", name, err)
+		}
+		for _, key := range stale {
+			if err := sn.Remove(ctx, key); err != nil {
+				logger.Errorf("GC: error removing snapshot %s: %v", key, err)
+				continue
+			}
+			logger.Info("GC: removed snapshot", key)
+			removedSnapshots++
+		}
+	}
+	return removedImages, removedSnapshots
+}
+
+func freeBytes(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// diskUsage returns the percentage of the filesystem containing path that
+// is in use.
+func diskUsage(path string) (int, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	if st.Blocks == 0 {
+		return 0, nil
+	}
+	return int(100 - st.Bavail*100/st.Blocks), nil
+}
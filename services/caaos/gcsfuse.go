@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	mountGCSFuse = "gcsfuse"
+
+	// gcsMountDir is where buckets are mounted on the host before they are
+	// bound into containers.
+	gcsMountDir = "/mnt/gcs"
+)
+
+// gcsMountPath returns the host path the bucket, or bucket directory, in
+// m.Source is mounted on. Containers mounting the same source share the
+// mount, the options of the first one to start apply.
+func gcsMountPath(m MountSpec) string {
+	return filepath.Join(gcsMountDir, m.Source)
+}
+
+// gcsfuseArgs returns the gcsfuse arguments for m. Options are gcsfuse
+// flags without the leading dashes, such as implicit-dirs or
+// file-mode=644, apart from ro and rw.
+func gcsfuseArgs(m MountSpec) []string {
+	bucket, dir := m.Source, ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, dir = bucket[:i], bucket[i+1:]
+	}
+	var args []string
+	if dir != "" {
+		args = append(args, "--only-dir="+dir)
+	}
+	for _, o := range m.Options {
+		switch o {
+		case "ro":
+			args = append(args, "-o", "ro")
+		case "rw":
+		default:
+			args = append(args, "--"+o)
+		}
+	}
+	return append(args, bucket, gcsMountPath(m))
+}
+
+// mountGCSBucket mounts the bucket of m on the host with gcsfuse if it is
+// not already. gcsfuse authenticates as the VM's service account and keeps
+// running in the background once the bucket is mounted.
+func mountGCSBucket(m MountSpec) error {
+	path := gcsMountPath(m)
+	mounted, err := isMountPoint(path)
+	if err != nil || mounted {
+		return err
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	out, err := exec.Command("gcsfuse", gcsfuseArgs(m)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error mounting gs://%s: %v: %s", m.Source, err, bytes.TrimSpace(out))
+	}
+	logger.With("event", "mount").Infof("mounted gs://%s on %s", m.Source, path)
+	return nil
+}
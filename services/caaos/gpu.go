@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/contrib/nvidia"
+	"github.com/containerd/containerd/oci"
+)
+
+// GPUSpec requests NVIDIA GPUs for a container. The host must have the
+// NVIDIA driver and nvidia-container-cli installed.
+type GPUSpec struct {
+	// Devices lists GPU indexes to expose, empty means all GPUs.
+	Devices []int `json:"devices"`
+	// Capabilities lists driver capabilities (compute, utility, video,
+	// graphics, display), empty means all.
+	Capabilities []string `json:"capabilities"`
+}
+
+func (g *GPUSpec) validate() error {
+	if g == nil {
+		return nil
+	}
+	valid := map[nvidia.Capability]bool{}
+	for _, c := range nvidia.AllCaps() {
+		valid[c] = true
+	}
+	for _, c := range g.Capabilities {
+		if !valid[nvidia.Capability(c)] {
+			return fmt.Errorf("unknown GPU capability %q", c)
+		}
+	}
+	for _, d := range g.Devices {
+		if d < 0 {
+			return fmt.Errorf("invalid GPU index %d", d)
+		}
+	}
+	return nil
+}
+
+// specOpts returns the OCI spec options that add the GPUs to the container
+// via the nvidia-container-cli prestart hook.
+func (g *GPUSpec) specOpts() []oci.SpecOpts {
+	if g == nil {
+		return nil
+	}
+	var opts []nvidia.Opts
+	if len(g.Devices) > 0 {
+		opts = append(opts, nvidia.WithDevices(g.Devices...))
+	} else {
+		opts = append(opts, nvidia.WithAllDevices)
+	}
+	if len(g.Capabilities) > 0 {
+		var caps []nvidia.Capability
+		for _, c := range g.Capabilities {
+			caps = append(caps, nvidia.Capability(c))
+		}
+		opts = append(opts, nvidia.WithCapabilities(caps...))
+	} else {
+		opts = append(opts, nvidia.WithAllCapabilities)
+	}
+	return []oci.SpecOpts{nvidia.WithGPUs(opts...)}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthRetries  = 3
+
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// HealthCheckSpec describes how to check that a container is healthy.
+// Exactly one of Exec, HTTPGet or TCPSocket must be set.
+type HealthCheckSpec struct {
+	// Exec runs a command in the container, exit code 0 is healthy.
+	Exec []string `json:"exec"`
+	// HTTPGet makes a request to the container, any 2xx or 3xx response is
+	// healthy.
+	HTTPGet *HTTPGetSpec `json:"http-get"`
+	// TCPSocket is a port that must accept connections.
+	TCPSocket int `json:"tcp-socket"`
+	// Interval, Timeout and StartPeriod are durations such as "10s".
+	// Failures during StartPeriod are not counted.
+	Interval    string `json:"interval"`
+	Timeout     string `json:"timeout"`
+	StartPeriod string `json:"start-period"`
+	// Retries is the number of consecutive failures before the container is
+	// unhealthy.
+	Retries int `json:"retries"`
+}
+
+// HTTPGetSpec is an HTTP health check.
+type HTTPGetSpec struct {
+	Path string `json:"path"`
+	Port int    `json:"port"`
+}
+
+func (h *HealthCheckSpec) validate() error {
+	if h == nil {
+		return nil
+	}
+	n := 0
+	if len(h.Exec) > 0 {
+		n++
+	}
+	if h.HTTPGet != nil {
+		n++
+		if h.HTTPGet.Port < 1 || h.HTTPGet.Port > 65535 {
+			return fmt.Errorf("http-get port %d out of range", h.HTTPGet.Port)
+		}
+	}
+	if h.TCPSocket != 0 {
+		n++
+		if h.TCPSocket < 1 || h.TCPSocket > 65535 {
+			return fmt.Errorf("tcp-socket port %d out of range", h.TCPSocket)
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of exec, http-get or tcp-socket must be set")
+	}
+	for _, d := range []string{h.Interval, h.Timeout, h.StartPeriod} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return err
+		}
+	}
+	if h.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+	return nil
+}
+
+func durationOr(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// probeClient never uses a proxy as containers are reached directly.
+var probeClient = &http.Client{Transport: &http.Transport{}}
+
+// probe runs the check once. host is the address the container's ports
+// are reachable on.
+func (h *HealthCheckSpec) probe(ctx context.Context, container containerd.Container, task containerd.Task, host string) error {
+	switch {
+	case len(h.Exec) > 0:
+		return execProbe(ctx, container, task, h.Exec)
+	case h.HTTPGet != nil:
+		url := fmt.Sprintf("http://%s%s", net.JoinHostPort(host, strconv.Itoa(h.HTTPGet.Port)), h.HTTPGet.Path)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := probeClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("%s returned %s", url, resp.Status)
+		}
+		return nil
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(h.TCPSocket)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// execProbe runs args in the container with the container's process
+// settings.
+func execProbe(ctx context.Context, container containerd.Container, task containerd.Task, args []string) error {
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return err
+	}
+	pspec := *spec.Process
+	pspec.Args = args
+	pspec.Terminal = false
+
+	id := fmt.Sprintf("health-%d", rand.Int63())
+	p, err := task.Exec(ctx, id, &pspec, cio.NullIO)
+	if err != nil {
+		return err
+	}
+	defer p.Delete(detach(ctx), containerd.WithProcessKill)
+	statusC, err := p.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := p.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case status := <-statusC:
+		code, _, err := status.Result()
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("%q exited with %d", args, code)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// healthSignals tracks the health of the containers in a deployment.
+type healthSignals struct {
+	mx      sync.Mutex
+	healthy map[string]*startSignal
+	// failed receives the first container to become unhealthy.
+	failed chan error
+}
+
+func newHealthSignals(spec *Spec) *healthSignals {
+	h := &healthSignals{healthy: map[string]*startSignal{}, failed: make(chan error, 1)}
+	for _, c := range spec.Containers {
+		h.healthy[c.Name] = &startSignal{c: make(chan struct{})}
+	}
+	return h
+}
+
+func (h *healthSignals) markHealthy(name string) {
+	if h == nil {
+		return
+	}
+	if s, ok := h.healthy[name]; ok {
+		s.once.Do(func() { close(s.c) })
+	}
+}
+
+func (h *healthSignals) markUnhealthy(name string, err error) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.failed <- fmt.Errorf("container %s is unhealthy: %v", name, err):
+	default:
+	}
+}
+
+// monitorHealth runs c's health check until ctx is canceled, publishing
+// changes in health with st.
+func (r *runner) monitorHealth(ctx context.Context, logger *Logger, c ContainerSpec, container containerd.Container, task containerd.Task, host string, st *containerStatus) {
+	h := c.HealthCheck
+	interval := durationOr(h.Interval, defaultHealthInterval)
+	timeout := durationOr(h.Timeout, defaultHealthTimeout)
+	retries := h.Retries
+	if retries == 0 {
+		retries = defaultHealthRetries
+	}
+	startDeadline := time.Now().Add(durationOr(h.StartPeriod, 0))
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		err := h.probe(pctx, container, task, host)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		health := st.Health
+		switch {
+		case err == nil:
+			failures = 0
+			health = healthHealthy
+			r.health.markHealthy(c.Name)
+		case time.Now().Before(startDeadline):
+			logger.Debug("health check failed during start period:", err)
+		default:
+			failures++
+			logger.Warnf("health check failed (%d/%d): %v", failures, retries, err)
+			if failures >= retries {
+				health = healthUnhealthy
+				r.health.markUnhealthy(c.Name, err)
+			}
+		}
+		if health != st.Health {
+			logger.With("event", "health").Info("container is", health)
+			st.Health = health
+			st.publish(ctx, logger)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+// agentState is the state reported by /healthz and /readyz.
+type agentState struct {
+	mx           sync.Mutex
+	provider     string
+	lastMetadata time.Time
+	metadataErr  string
+	deployment   *deployment
+	containers   map[string]containerStatus
+	// usage is the last sampled usage of each running container.
+	usage map[string]*containerUsage
+}
+
+var agent = &agentState{containers: map[string]containerStatus{}, usage: map[string]*containerUsage{}}
+
+func (a *agentState) metadataReceived() {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.lastMetadata = time.Now()
+	a.metadataErr = ""
+}
+
+func (a *agentState) metadataError(err error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.metadataErr = err.Error()
+}
+
+func (a *agentState) setDeployment(d *deployment) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.deployment = d
+}
+
+func (a *agentState) setContainer(st containerStatus) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.containers[st.Name] = st
+}
+
+func (a *agentState) setUsage(usage map[string]*containerUsage) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.usage = usage
+}
+
+func (a *agentState) container(name string) (containerStatus, bool) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	st, ok := a.containers[name]
+	return st, ok
+}
+
+type healthReport struct {
+	Status     string            `json:"status"`
+	Version    string            `json:"version"`
+	Containerd componentReport   `json:"containerd"`
+	Metadata   metadataReport    `json:"metadata"`
+	Containers []containerStatus `json:"containers"`
+}
+
+type componentReport struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type metadataReport struct {
+	Provider   string     `json:"provider"`
+	LastUpdate *time.Time `json:"last-update,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// report checks containerd and returns the agent state, ready is true once
+// metadata has been received and all containers of the current spec have
+// started and none are unhealthy.
+func (a *agentState) report(ctx context.Context, client *containerd.Client) (*healthReport, bool) {
+	r := &healthReport{Version: version}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	serving, err := client.IsServing(ctx)
+	r.Containerd.OK = serving
+	if err != nil {
+		r.Containerd.Error = err.Error()
+	}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	r.Metadata = metadataReport{Provider: a.provider, Error: a.metadataErr}
+	if !a.lastMetadata.IsZero() {
+		t := a.lastMetadata
+		r.Metadata.LastUpdate = &t
+	}
+
+	ready := serving && !a.lastMetadata.IsZero()
+	if d := a.deployment; d != nil {
+		select {
+		case <-d.ready:
+		default:
+			ready = false
+		}
+		for _, c := range append(append([]ContainerSpec{}, d.spec.InitContainers...), d.spec.Containers...) {
+			st, ok := a.containers[c.Name]
+			if !ok {
+				continue
+			}
+			if st.Health == healthUnhealthy {
+				ready = false
+			}
+			st.Usage = a.usage[c.Name]
+			r.Containers = append(r.Containers, st)
+		}
+	}
+	sort.Slice(r.Containers, func(i, j int) bool { return r.Containers[i].Name < r.Containers[j].Name })
+	return r, ready
+}
+
+func writeReport(w http.ResponseWriter, r *healthReport, ok bool, status string) {
+	code := http.StatusOK
+	r.Status = "ok"
+	if !ok {
+		code = http.StatusServiceUnavailable
+		r.Status = status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(r)
+}
+
+// healthMux serves /healthz, which fails if containerd is unreachable,
+// /readyz, which fails until the containers are ready, /debug/vars,
+// container usage on /metrics and lifecycle events on /v1/events.
+func healthMux(client *containerd.Client) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		r, _ := agent.report(req.Context(), client)
+		writeReport(w, r, r.Containerd.OK, "unhealthy")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		r, ready := agent.report(req.Context(), client)
+		writeReport(w, r, ready, "not ready")
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/v1/events", handleEvents)
+	return mux
+}
+
+// healthServer serves healthMux on localhost and, once enabled, on the
+// VM's internal IP.
+type healthServer struct {
+	port     string
+	mux      *http.ServeMux
+	internal sync.Once
+}
+
+func newHealthServer(addr string, client *containerd.Client) (*healthServer, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &healthServer{port: port, mux: healthMux(client)}
+	go s.serve(addr)
+	return s, nil
+}
+
+func (s *healthServer) serve(addr string) {
+	logger.Info("serving health endpoints on", addr)
+	if err := http.ListenAndServe(addr, s.mux); err != nil {
+		logger.Errorf("Error serving health endpoints on %s: %v", addr, err)
+	}
+}
+
+// serveInternal starts serving on the first non loopback IPv4 address.
+// Once started it keeps serving until the agent exits.
+func (s *healthServer) serveInternal() {
+	s.internal.Do(func() {
+		ip, err := internalIP()
+		if err != nil {
+			logger.Error("Error finding internal IP for health endpoints:", err)
+			return
+		}
+		go s.serve(net.JoinHostPort(ip, s.port))
+	})
+}
+
+// internalIP returns the host's first IPv4 address, or global IPv6
+// address if there is none or IPv6 is preferred.
+func internalIP() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	var v4, v6 string
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLoopback() {
+			continue
+		}
+		switch {
+		case n.IP.To4() != nil && v4 == "":
+			v4 = n.IP.String()
+		case n.IP.To4() == nil && n.IP.IsGlobalUnicast() && v6 == "":
+			v6 = n.IP.String()
+		}
+	}
+	if v6 != "" && (v4 == "" || preferIPv6()) {
+		return v6, nil
+	}
+	if v4 != "" {
+		return v4, nil
+	}
+	return "", errors.New("no non loopback address")
+}
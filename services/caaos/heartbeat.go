@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// heartbeat is published to the guest attribute caaos/heartbeat so that
+// fleet tooling can inventory instances without logging in to them.
+type heartbeat struct {
+	Version  string `json:"version"`
+	Provider string `json:"provider"`
+	// AgentUptime and Uptime are in seconds.
+	AgentUptime float64              `json:"agent-uptime"`
+	Uptime      float64              `json:"uptime,omitempty"`
+	Containers  []heartbeatContainer `json:"containers"`
+	LastError   *lastError           `json:"last-error,omitempty"`
+	Time        time.Time            `json:"time"`
+}
+
+type heartbeatContainer struct {
+	Name      string    `json:"name"`
+	Image     string    `json:"image"`
+	Digest    string    `json:"digest,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	State     string    `json:"state"`
+	StartTime time.Time `json:"start-time"`
+}
+
+func newHeartbeat() *heartbeat {
+	now := time.Now()
+	h := &heartbeat{
+		Version:     version,
+		AgentUptime: now.Sub(boot.start).Seconds(),
+		LastError:   recentError(),
+		Time:        now,
+		Containers:  []heartbeatContainer{},
+	}
+	if up, err := uptime(); err == nil {
+		h.Uptime = up.Seconds()
+	}
+
+	agent.mx.Lock()
+	h.Provider = agent.provider
+	for _, st := range agent.containers {
+		h.Containers = append(h.Containers, heartbeatContainer{
+			Name:      st.Name,
+			Image:     st.Image,
+			Digest:    st.Digest,
+			ID:        st.ID,
+			State:     st.State,
+			StartTime: st.StartTime,
+		})
+	}
+	agent.mx.Unlock()
+	sort.Slice(h.Containers, func(i, j int) bool { return h.Containers[i].Name < h.Containers[j].Name })
+	return h
+}
+
+// publishHeartbeats publishes a heartbeat every interval until ctx is
+// canceled.
+func publishHeartbeats(ctx context.Context, interval time.Duration) {
+	wait := every(interval)
+	for {
+		b, err := json.Marshal(newHeartbeat())
+		if err != nil {
+			logger.Error("Error encoding heartbeat:", err)
+		} else if err := setGuestAttribute(ctx, "heartbeat", string(b)); err != nil && ctx.Err() == nil {
+			logger.Debug("Error publishing heartbeat:", err)
+		}
+		if wait(ctx) != nil {
+			return
+		}
+	}
+}
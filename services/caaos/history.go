@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	historyDir = "/var/lib/caaos/history"
+	maxHistory = 100
+)
+
+// runRecord is a single completed run of a container.
+type runRecord struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Kind  string `json:"kind,omitempty"`
+	// ID is the queue message or task ID of a worker run.
+	ID        string    `json:"id,omitempty"`
+	StartTime time.Time `json:"start-time"`
+	EndTime   time.Time `json:"end-time"`
+	Duration  float64   `json:"duration-seconds"`
+	ExitCode  uint32    `json:"exit-code"`
+	// Result is "succeeded", "failed" or "timed-out".
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// LogTail is the last lines of the run's output.
+	LogTail []string `json:"log-tail,omitempty"`
+}
+
+var historyMx sync.Mutex
+
+func historyFile(name string) string {
+	return filepath.Join(historyDir, name+".jsonl")
+}
+
+// readHistory returns the recorded runs for the container, oldest first.
+func readHistory(name string) ([]runRecord, error) {
+	historyMx.Lock()
+	defer historyMx.Unlock()
+	return readHistoryLocked(name)
+}
+
+func readHistoryLocked(name string) ([]runRecord, error) {
+	f, err := os.Open(historyFile(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []runRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		runs = append(runs, r)
+	}
+	return runs, scanner.Err()
+}
+
+// appendHistory records a run, keeping only the last maxHistory runs.
+func appendHistory(r runRecord) error {
+	if !validName(r.Name) {
+		return fmt.Errorf("invalid container name %q", r.Name)
+	}
+	historyMx.Lock()
+	defer historyMx.Unlock()
+
+	runs, err := readHistoryLocked(r.Name)
+	if err != nil {
+		return err
+	}
+	runs = append(runs, r)
+	if len(runs) > maxHistory {
+		runs = runs[len(runs)-maxHistory:]
+	}
+
+	if err := mkdirPrivate(historyDir); err != nil {
+		return err
+	}
+	tmp := historyFile(r.Name) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, run := range runs {
+		if err := enc.Encode(run); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, historyFile(r.Name))
+}
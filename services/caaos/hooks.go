@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	hookPreStart = "pre-start"
+	hookPostStop = "post-stop"
+
+	defaultHookTimeout = time.Minute
+)
+
+// HooksSpec lists what to run around each start of a container, in order.
+type HooksSpec struct {
+	// PreStart hooks run before the container is created, if one fails the
+	// start fails.
+	PreStart []HookSpec `json:"pre-start"`
+	// PostStop hooks run after the container has exited and been deleted,
+	// failures are only logged.
+	PostStop []HookSpec `json:"post-stop"`
+}
+
+// HookSpec is either a command run on the host or a container run to
+// completion.
+type HookSpec struct {
+	// Command is run on the host as the agent, with CAAOS_CONTAINER and
+	// CAAOS_HOOK set in its environment.
+	Command   []string       `json:"command"`
+	Container *ContainerSpec `json:"container"`
+	// Timeout defaults to a minute.
+	Timeout string `json:"timeout"`
+}
+
+func (h *HooksSpec) validate(verr *validationError, field string, c *ContainerSpec) {
+	if h == nil {
+		return
+	}
+	check := func(stage string, hooks []HookSpec) {
+		for i := range hooks {
+			hk := &hooks[i]
+			hfield := fmt.Sprintf("%s.hooks.%s[%d]", field, stage, i)
+			if (len(hk.Command) > 0) == (hk.Container != nil) {
+				verr.add("%s: exactly one of command and container must be set", hfield)
+			}
+			if len(hk.Command) > 0 && hk.Command[0] == "" {
+				verr.add("%s.command: the program is empty", hfield)
+			}
+			if hk.Timeout != "" {
+				if d, err := time.ParseDuration(hk.Timeout); err != nil || d <= 0 {
+					verr.add("%s.timeout: invalid duration %q", hfield, hk.Timeout)
+				}
+			}
+			if hc := hk.Container; hc != nil {
+				if hc.Name == "" {
+					hc.Name = fmt.Sprintf("%s-%s-%d", c.Name, stage, i)
+				}
+				if hc.Namespace == "" {
+					hc.Namespace = c.Namespace
+				}
+				if hc.Hooks != nil || len(hc.Sidecars) > 0 || hc.Schedule != "" || len(hc.DependsOn) > 0 {
+					verr.add("%s.container: hook containers can not have hooks, sidecars, a schedule or depends-on", hfield)
+				}
+				validateContainer(verr, hfield+".container", hc, map[string]bool{})
+			}
+		}
+	}
+	check(hookPreStart, h.PreStart)
+	check(hookPostStop, h.PostStop)
+}
+
+// images returns the images of the hook containers.
+func (h *HooksSpec) images() []string {
+	if h == nil {
+		return nil
+	}
+	var refs []string
+	for _, hk := range append(append([]HookSpec{}, h.PreStart...), h.PostStop...) {
+		if hk.Container != nil {
+			ref, _ := imageRef(hk.Container.Image)
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+func (h HookSpec) timeout() time.Duration {
+	if d, err := time.ParseDuration(h.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultHookTimeout
+}
+
+// runHooks runs the hooks of stage for c in order. Pre-start hooks stop at
+// the first failure, which is returned.
+func (r *runner) runHooks(ctx context.Context, logger *Logger, c ContainerSpec, stage string, hooks []HookSpec) error {
+	for i, h := range hooks {
+		hlogger := logger.With("event", "hook", "hook", stage)
+		hctx, cancel := context.WithTimeout(ctx, h.timeout())
+		var err error
+		if h.Container != nil {
+			err = r.runHookContainer(hctx, c, *h.Container)
+		} else {
+			err = runHookCommand(hctx, hlogger, c, stage, h.Command)
+		}
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("%s hook %d: %v", stage, i, err)
+			hlogger.Error("Error running hook:", err)
+			if stage == hookPreStart {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runHookCommand runs command on the host and logs its output.
+func runHookCommand(ctx context.Context, logger *Logger, c ContainerSpec, stage string, command []string) error {
+	logger.Infof("running %q", command)
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), "CAAOS_CONTAINER="+c.Name, "CAAOS_HOOK="+stage)
+	out, err := cmd.CombinedOutput()
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		logger.Info(s.Text())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out")
+	}
+	return err
+}
+
+// runHookContainer runs hc to completion, its output goes to the same log
+// sinks as any container's.
+func (r *runner) runHookContainer(ctx context.Context, c ContainerSpec, hc ContainerSpec) error {
+	hlogger := containerLogger(hc.Name)
+	hlogger.Info("running hook container for", c.Name)
+	code, err := r.runContainer(ctx, hlogger, hc)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out")
+	}
+	if code != 0 {
+		return fmt.Errorf("hook container exited with %d", code)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// integritySecureBoot requires Secure Boot to be on and a vTPM.
+	integritySecureBoot = "secure-boot"
+	// integrityMeasuredBoot also requires the Shielded VM integrity
+	// monitoring report for this boot to pass both its early and late boot
+	// policy evaluations.
+	integrityMeasuredBoot = "measured-boot"
+
+	secureBootVar      = "/sys/firmware/efi/efivars/SecureBoot-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+	tpmDevice          = "/dev/tpmrm0"
+	loggingEntriesURL  = "https://logging.googleapis.com/v2/entries:list"
+	integrityLogName   = "compute.googleapis.com%2Fshielded_vm_integrity"
+	integrityReportTTL = 5 * time.Minute
+)
+
+func validateIntegrityLevel(level string) error {
+	switch level {
+	case "", integritySecureBoot, integrityMeasuredBoot:
+		return nil
+	}
+	return fmt.Errorf("unknown integrity level %q", level)
+}
+
+// integrityStatus is published to the guest attribute caaos/integrity.
+type integrityStatus struct {
+	Level  string    `json:"level"`
+	Passed bool      `json:"passed"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func (s *integrityStatus) publish(ctx context.Context) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		logger.Error("Error encoding integrity status:", err)
+		return
+	}
+	if err := setGuestAttribute(ctx, "integrity", string(b)); err != nil {
+		logger.Error("Error publishing integrity status:", err)
+	}
+}
+
+// integrityGate checks platform integrity before containers are run, a
+// check that passed is not repeated as the state can't change until the
+// next boot.
+type integrityGate struct {
+	mx     sync.Mutex
+	passed map[string]bool
+}
+
+var integrity = &integrityGate{passed: map[string]bool{}}
+
+// check returns an error if the instance does not meet level, the result
+// is published to guest attributes.
+func (g *integrityGate) check(ctx context.Context, level string) error {
+	if level == "" {
+		return nil
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if g.passed[level] {
+		return nil
+	}
+	err := checkIntegrity(ctx, level)
+	st := &integrityStatus{Level: level, Passed: err == nil, Time: time.Now()}
+	if err != nil {
+		st.Reason = err.Error()
+	} else {
+		g.passed[level] = true
+		logger.Info("Platform integrity check passed:", level)
+	}
+	st.publish(ctx)
+	return err
+}
+
+func checkIntegrity(ctx context.Context, level string) error {
+	b, err := ioutil.ReadFile(secureBootVar)
+	if err != nil {
+		return fmt.Errorf("error reading Secure Boot state: %v", err)
+	}
+	// efivars start with 4 bytes of attributes.
+	if len(b) < 5 || b[4] != 1 {
+		return errors.New("Secure Boot is not enabled")
+	}
+	if _, err := os.Stat(tpmDevice); err != nil {
+		return fmt.Errorf("no vTPM: %v", err)
+	}
+	if level == integrityMeasuredBoot {
+		return checkIntegrityReport(ctx)
+	}
+	return nil
+}
+
+type integrityReport struct {
+	Timestamp   time.Time `json:"timestamp"`
+	JSONPayload struct {
+		EarlyBootReportEvent *bootReportEvent `json:"earlyBootReportEvent"`
+		LateBootReportEvent  *bootReportEvent `json:"lateBootReportEvent"`
+	} `json:"jsonPayload"`
+}
+
+type bootReportEvent struct {
+	PolicyEvaluationPassed bool `json:"policyEvaluationPassed"`
+}
+
+// checkIntegrityReport reads this boot's integrity monitoring reports from
+// Cloud Logging, they are written shortly after boot so this waits for
+// them for a while.
+func checkIntegrityReport(ctx context.Context) error {
+	up, err := uptime()
+	if err != nil {
+		return err
+	}
+	since := time.Now().Add(-up)
+	project, err := getMetadata(ctx, "project/project-id")
+	if err != nil {
+		return err
+	}
+	id, err := getMetadata(ctx, "instance/id")
+	if err != nil {
+		return err
+	}
+	filter := fmt.Sprintf(`logName="projects/%s/logs/%s" AND resource.type="gce_instance" AND resource.labels.instance_id="%s" AND timestamp>="%s"`,
+		project, integrityLogName, id, since.UTC().Format(time.RFC3339))
+
+	deadline := time.Now().Add(integrityReportTTL)
+	var early, late *bootReportEvent
+	for {
+		reports, err := listIntegrityReports(ctx, project, filter)
+		if err != nil {
+			return fmt.Errorf("error reading integrity reports: %v", err)
+		}
+		for _, r := range reports {
+			if e := r.JSONPayload.EarlyBootReportEvent; e != nil && early == nil {
+				early = e
+			}
+			if e := r.JSONPayload.LateBootReportEvent; e != nil && late == nil {
+				late = e
+			}
+		}
+		if early != nil && !early.PolicyEvaluationPassed {
+			return errors.New("early boot integrity policy evaluation failed")
+		}
+		if late != nil && !late.PolicyEvaluationPassed {
+			return errors.New("late boot integrity policy evaluation failed")
+		}
+		if early != nil && late != nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("no integrity report for this boot")
+		}
+		logger.Info("Waiting for the integrity report for this boot")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(15 * time.Second):
+		}
+	}
+}
+
+// listIntegrityReports returns the newest reports matching filter first.
+func listIntegrityReports(ctx context.Context, project, filter string) ([]integrityReport, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceNames": []string{"projects/" + project},
+		"filter":        filter,
+		"orderBy":       "timestamp desc",
+		"pageSize":      10,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tok, err := saToken.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", loggingEntriesURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var out struct {
+		Entries []integrityReport `json:"entries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Entries, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The metadata servers' IPv6 addresses, used on IPv6-only VMs where the
+// link-local IPv4 address is unreachable. Azure has none.
+const (
+	gceMetadataIPv6 = "http://[fd20:ce::254]/computeMetadata/v1/"
+	awsIMDSIPv6     = "http://[fd00:ec2::254]/"
+)
+
+var useIPv6 struct {
+	sync.Mutex
+	on bool
+}
+
+// ipv6Only reports whether the host has an IPv6 default route and no IPv4
+// one.
+func ipv6Only() bool {
+	return !hasDefaultRoute("/proc/net/route") && hasDefaultRoute("/proc/net/ipv6_route")
+}
+
+// preferIPv6 reports whether IPv6 is used, because of -prefer-ipv6 or
+// because the host is IPv6-only.
+func preferIPv6() bool {
+	useIPv6.Lock()
+	defer useIPv6.Unlock()
+	return useIPv6.on
+}
+
+// configureIPv6 switches the metadata servers to their IPv6 addresses once
+// -prefer-ipv6 is set or the host is found to be IPv6-only, unless
+// -metadata-endpoint is set. It is called until the network is up.
+func configureIPv6() {
+	useIPv6.Lock()
+	defer useIPv6.Unlock()
+	if useIPv6.on || !(*preferIPv6Flag || ipv6Only()) {
+		return
+	}
+	useIPv6.on = true
+	if *metadataFlag != "" {
+		return
+	}
+	logger.Info("Using IPv6 for the metadata server and registries")
+	metadataBase, imdsBase = gceMetadataIPv6, awsIMDSIPv6
+}
+
+// installIPv6Dialer makes the default transport, used by every client the
+// agent creates including registry pulls, connect to IPv6 addresses first
+// once IPv6 is preferred.
+func installIPv6Dialer() {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := d.DialContext
+	http.DefaultTransport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !preferIPv6() {
+			return dial(ctx, network, addr)
+		}
+		return dialIPv6First(ctx, dial, network, addr)
+	}
+}
+
+// dialIPv6First dials each address of addr's host in turn, IPv6 addresses
+// first.
+func dialIPv6First(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].IP.To4() == nil && ips[j].IP.To4() != nil
+	})
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
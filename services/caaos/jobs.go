@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kindService = "service"
+	// kindJob containers run to completion once and are never restarted,
+	// each run is recorded in the history.
+	kindJob = "job"
+
+	// logTailLines is how many lines of output are kept with a run.
+	logTailLines = 20
+
+	// stateTimedOut is the state of a container stopped by its timeout.
+	stateTimedOut = "timed-out"
+
+	// Results of a recorded run.
+	resultSucceeded = "succeeded"
+	resultFailed    = "failed"
+	resultTimedOut  = stateTimedOut
+)
+
+var errTimedOut = errors.New("container ran longer than its timeout")
+
+func validateKind(c ContainerSpec) error {
+	switch c.Kind {
+	case "", kindService:
+		return nil
+	case kindJob:
+		if c.Schedule != "" {
+			return fmt.Errorf("a job can't have a schedule, scheduled containers already run to completion")
+		}
+		if p, err := parseRestartPolicy(c.RestartPolicy); err == nil && p.mode != restartNever {
+			return fmt.Errorf("a job can't have restart policy %q", c.RestartPolicy)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown kind %q", c.Kind)
+}
+
+func validateTimeout(c ContainerSpec) error {
+	if c.Timeout == "" {
+		return nil
+	}
+	if c.Kind != kindJob && c.Schedule == "" {
+		return fmt.Errorf("only jobs and scheduled containers can have a timeout")
+	}
+	if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid duration %q", c.Timeout)
+	}
+	return nil
+}
+
+// timeout returns the container's timeout, 0 if it has none.
+func (c ContainerSpec) timeout() time.Duration {
+	d, _ := time.ParseDuration(c.Timeout)
+	return d
+}
+
+// runResult returns the result recorded for a run.
+func runResult(code uint32, err error) string {
+	switch {
+	case err == errTimedOut:
+		return resultTimedOut
+	case err != nil, code != 0:
+		return resultFailed
+	}
+	return resultSucceeded
+}
+
+// tailSink keeps the last lines of output of the containers being tracked
+// so that they can be recorded with the run.
+type tailSink struct {
+	mx    sync.Mutex
+	tails map[string][]string
+}
+
+var runOutput = &tailSink{tails: map[string][]string{}}
+
+func (s *tailSink) write(e logEntry) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	t, ok := s.tails[e.container]
+	if !ok {
+		return
+	}
+	t = append(t, fmt.Sprintf("%s %s", e.stream, e.text))
+	if len(t) > logTailLines {
+		t = t[len(t)-logTailLines:]
+	}
+	s.tails[e.container] = t
+}
+
+// track starts keeping the output of name.
+func (s *tailSink) track(name string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.tails[name] = []string{}
+}
+
+// take stops tracking name and returns its last lines of output.
+func (s *tailSink) take(name string) []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	t := s.tails[name]
+	delete(s.tails, name)
+	return t
+}
+
+// runRecorded runs the container once and appends the run to its history.
+func (r *runner) runRecorded(ctx context.Context, logger *Logger, c ContainerSpec) (uint32, error) {
+	kind := c.Kind
+	if c.Schedule != "" {
+		kind = "scheduled"
+	}
+	rec := runRecord{Name: c.Name, Image: c.Image, Kind: kind, StartTime: time.Now()}
+	runOutput.track(c.Name)
+	code, err := r.runContainer(ctx, logger, c)
+	rec.EndTime = time.Now()
+	rec.Duration = rec.EndTime.Sub(rec.StartTime).Seconds()
+	rec.ExitCode = code
+	rec.Result = runResult(code, err)
+	rec.LogTail = runOutput.take(c.Name)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := appendHistory(rec); err != nil {
+		logger.Error("Error recording run history:", err)
+	}
+	return code, err
+}
+
+// runJob runs a job to completion, it is never restarted.
+func (r *runner) runJob(ctx context.Context, logger *Logger, c ContainerSpec) {
+	code, err := r.runRecorded(ctx, logger, c)
+	logger = logger.With("event", "job", "exit_code", code)
+	switch {
+	case err != nil:
+		logger.Error("Job failed:", err)
+	case code != 0:
+		logger.Errorf("Job exited with %d", code)
+	default:
+		logger.Info("Job completed")
+	}
+}
+
+// handleHistory serves GET /v1/history/, the names of the containers with
+// recorded runs, and GET /v1/history/<name>, the container's runs.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var v interface{}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/history/")
+	if name == "" {
+		files, err := filepath.Glob(filepath.Join(historyDir, "*.jsonl"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		names := []string{}
+		for _, f := range files {
+			if name := strings.TrimSuffix(filepath.Base(f), ".jsonl"); tenants.visible(r.Context(), name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		v = names
+	} else {
+		if !validName(name) {
+			http.Error(w, "invalid container name", http.StatusBadRequest)
+			return
+		}
+		runs, err := readHistory(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if runs == nil {
+			if _, err := os.Stat(historyFile(name)); os.IsNotExist(err) {
+				http.Error(w, "no history for container "+name, http.StatusNotFound)
+				return
+			}
+		}
+		v = runs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
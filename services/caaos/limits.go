@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// rlimits maps ulimit names to their resource.
+var rlimits = map[string]string{
+	"as":         "RLIMIT_AS",
+	"core":       "RLIMIT_CORE",
+	"cpu":        "RLIMIT_CPU",
+	"data":       "RLIMIT_DATA",
+	"fsize":      "RLIMIT_FSIZE",
+	"locks":      "RLIMIT_LOCKS",
+	"memlock":    "RLIMIT_MEMLOCK",
+	"msgqueue":   "RLIMIT_MSGQUEUE",
+	"nice":       "RLIMIT_NICE",
+	"nofile":     "RLIMIT_NOFILE",
+	"nproc":      "RLIMIT_NPROC",
+	"rss":        "RLIMIT_RSS",
+	"rtprio":     "RLIMIT_RTPRIO",
+	"rttime":     "RLIMIT_RTTIME",
+	"sigpending": "RLIMIT_SIGPENDING",
+	"stack":      "RLIMIT_STACK",
+}
+
+// namespacedSysctls are the IPC sysctls that can be set per container,
+// net.* sysctls can also be set unless the container uses the host
+// network.
+var namespacedSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// UlimitSpec is a soft and hard limit, in a spec it is either an object or
+// a single number used for both.
+type UlimitSpec struct {
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+func (u *UlimitSpec) UnmarshalJSON(b []byte) error {
+	var n uint64
+	if err := json.Unmarshal(b, &n); err == nil {
+		u.Soft, u.Hard = n, n
+		return nil
+	}
+	type plain UlimitSpec
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("ulimit must be a number or {\"soft\": n, \"hard\": n}")
+	}
+	*u = UlimitSpec(p)
+	return nil
+}
+
+func validateUlimits(ulimits map[string]UlimitSpec) error {
+	for name, u := range ulimits {
+		if _, ok := rlimits[name]; !ok {
+			return fmt.Errorf("unknown ulimit %q", name)
+		}
+		if u.Soft > u.Hard {
+			return fmt.Errorf("%s: soft limit %d is greater than hard limit %d", name, u.Soft, u.Hard)
+		}
+	}
+	return nil
+}
+
+func validateSysctls(sysctls map[string]string, hostNetwork bool) error {
+	for k := range sysctls {
+		switch {
+		case namespacedSysctls[k], strings.HasPrefix(k, "fs.mqueue."):
+		case strings.HasPrefix(k, "net."):
+			if hostNetwork {
+				return fmt.Errorf("%s can not be set for containers on the host network", k)
+			}
+		default:
+			return fmt.Errorf("%s is not a namespaced sysctl", k)
+		}
+	}
+	return nil
+}
+
+// withUlimits sets the container's rlimits, replacing the defaults for
+// the same resources.
+func withUlimits(ulimits map[string]UlimitSpec) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *specs.Spec) error {
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		var names []string
+		for name := range ulimits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rl := specs.POSIXRlimit{Type: rlimits[name], Soft: ulimits[name].Soft, Hard: ulimits[name].Hard}
+			replaced := false
+			for i := range s.Process.Rlimits {
+				if s.Process.Rlimits[i].Type == rl.Type {
+					s.Process.Rlimits[i] = rl
+					replaced = true
+				}
+			}
+			if !replaced {
+				s.Process.Rlimits = append(s.Process.Rlimits, rl)
+			}
+		}
+		return nil
+	}
+}
+
+func withSysctls(sysctls map[string]string) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *specs.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Sysctl == nil {
+			s.Linux.Sysctl = map[string]string{}
+		}
+		for k, v := range sysctls {
+			s.Linux.Sysctl[k] = v
+		}
+		return nil
+	}
+}
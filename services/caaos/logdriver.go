@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Log drivers select where a container's output goes, besides the log
+// buffer read by caaosctl logs and the run history which always get it.
+const (
+	// logDriverDefault is the console, the log files and Cloud Logging if
+	// it is enabled with cloud-logging.
+	logDriverDefault = "default"
+	logDriverConsole = "console"
+	logDriverFile    = "file"
+	logDriverFluentd = "fluentd"
+	logDriverCloud   = "cloud-logging"
+	logDriverNone    = "none"
+
+	defaultFluentdAddress = "127.0.0.1:24224"
+	fluentdBuffer         = 1000
+	fluentdRetry          = 5 * time.Second
+)
+
+// LoggingSpec selects a container's log driver, as with Docker's
+// --log-driver and --log-opt.
+type LoggingSpec struct {
+	Driver string `json:"driver"`
+	// Options are fluentd-address, defaulting to 127.0.0.1:24224 so that a
+	// fluentd or fluent-bit sidecar can receive the output, and tag,
+	// defaulting to caaos.<name>, for the fluentd driver.
+	Options map[string]string `json:"options"`
+}
+
+func (l *LoggingSpec) validate() error {
+	if l == nil {
+		return nil
+	}
+	switch l.Driver {
+	case "", logDriverDefault, logDriverConsole, logDriverFile, logDriverCloud, logDriverNone:
+		if len(l.Options) > 0 {
+			return fmt.Errorf("the %s log driver takes no options", l.Driver)
+		}
+	case logDriverFluentd:
+		for k, v := range l.Options {
+			switch k {
+			case "fluentd-address":
+				if _, _, err := net.SplitHostPort(v); err != nil {
+					return fmt.Errorf("fluentd-address: %v", err)
+				}
+			case "tag":
+			default:
+				return fmt.Errorf("unknown fluentd option %q", k)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown log driver %q", l.Driver)
+	}
+	return nil
+}
+
+// usesLogDriver reports whether any container of the spec uses driver.
+func (spec *Spec) usesLogDriver(driver string) bool {
+	for _, list := range [][]ContainerSpec{spec.InitContainers, spec.Containers} {
+		for _, c := range list {
+			if c.Logging != nil && c.Logging.Driver == driver {
+				return true
+			}
+			for _, sc := range c.Sidecars {
+				if sc.Logging != nil && sc.Logging.Driver == driver {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// containerLog returns the log for a run of c, writing to the sinks of its
+// log driver.
+func (r *runner) containerLog(logger *Logger, c ContainerSpec) *containerLog {
+	driver := logDriverDefault
+	if c.Logging != nil && c.Logging.Driver != "" {
+		driver = c.Logging.Driver
+	}
+	sinks := append([]logSink{}, r.internalSinks...)
+	switch driver {
+	case logDriverDefault:
+		return newContainerLog(c.Name, r.logSinks)
+	case logDriverNone:
+	case logDriverFluentd:
+		addr := c.Logging.Options["fluentd-address"]
+		if addr == "" {
+			addr = defaultFluentdAddress
+		}
+		tag := c.Logging.Options["tag"]
+		if tag == "" {
+			tag = "caaos." + c.Name
+		}
+		fs := newFluentdSink(addr, tag)
+		l := newContainerLog(c.Name, append(sinks, fs))
+		l.closers = append(l.closers, fs.close)
+		return l
+	default:
+		s, ok := r.logDrivers[driver]
+		if !ok {
+			logger.Warnf("Log driver %s is unavailable, using the default", driver)
+			return newContainerLog(c.Name, r.logSinks)
+		}
+		sinks = append(sinks, s)
+	}
+	return newContainerLog(c.Name, sinks)
+}
+
+// fluentdSink sends container output to a fluentd or fluent-bit forward
+// input. Output is dropped rather than block the container if the
+// endpoint can't keep up or is unreachable.
+type fluentdSink struct {
+	addr string
+	tag  string
+	c    chan logEntry
+	wg   sync.WaitGroup
+}
+
+func newFluentdSink(addr, tag string) *fluentdSink {
+	s := &fluentdSink{addr: addr, tag: tag, c: make(chan logEntry, fluentdBuffer)}
+	s.wg.Add(1)
+	go s.loop()
+	return s
+}
+
+func (s *fluentdSink) write(e logEntry) {
+	select {
+	case s.c <- e:
+	default:
+	}
+}
+
+// close sends any remaining entries and closes the connection.
+func (s *fluentdSink) close() {
+	close(s.c)
+	s.wg.Wait()
+}
+
+func (s *fluentdSink) loop() {
+	defer s.wg.Done()
+	var conn net.Conn
+	var retryAt time.Time
+	for e := range s.c {
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			var err error
+			if conn, err = net.DialTimeout("tcp", s.addr, fluentdRetry); err != nil {
+				logger.Warnf("Error connecting to fluentd at %s, dropping output of %s: %v", s.addr, e.container, err)
+				retryAt = time.Now().Add(fluentdRetry)
+				continue
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(fluentdRetry))
+		if _, err := conn.Write(s.encode(e)); err != nil {
+			logger.Warnf("Error writing to fluentd at %s: %v", s.addr, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// encode returns e as a forward protocol message, the MessagePack array
+// [tag, time, record].
+func (s *fluentdSink) encode(e logEntry) []byte {
+	var b bytes.Buffer
+	b.WriteByte(0x93)
+	msgpackString(&b, s.tag)
+	b.WriteByte(0xd3)
+	binary.Write(&b, binary.BigEndian, e.time.Unix())
+	b.WriteByte(0x83)
+	msgpackString(&b, "container_name")
+	msgpackString(&b, e.container)
+	msgpackString(&b, "source")
+	msgpackString(&b, e.stream)
+	msgpackString(&b, "log")
+	msgpackString(&b, e.text)
+	return b.Bytes()
+}
+
+func msgpackString(b *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		b.WriteByte(0xa0 | byte(n))
+	case n < 1<<8:
+		b.WriteByte(0xd9)
+		b.WriteByte(byte(n))
+	case n < 1<<16:
+		b.WriteByte(0xda)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(0xdb)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	}
+	b.WriteString(s)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelFatal
+)
+
+// String returns the Cloud Logging severity for the level.
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO"
+	case levelWarn:
+		return "WARNING"
+	case levelError:
+		return "ERROR"
+	}
+	return "CRITICAL"
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info", "":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// logConfig is shared by all Loggers.
+var logConfig = struct {
+	sync.Mutex
+	level logLevel
+	json  bool
+	out   io.Writer
+	// lastErr is the most recent error logged, whatever the level.
+	lastErr *lastError
+}{level: levelInfo, json: true, out: os.Stdout}
+
+type lastError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// recentError returns the last error logged or nil if there was none.
+func recentError() *lastError {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	if logConfig.lastErr == nil {
+		return nil
+	}
+	e := *logConfig.lastErr
+	return &e
+}
+
+// setLogLevel sets the minimum level written.
+func setLogLevel(l logLevel) {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	logConfig.level = l
+}
+
+// setLogFormat selects JSON ("json") or human readable ("text") records.
+func setLogFormat(format string) error {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	switch format {
+	case "json":
+		logConfig.json = true
+	case "text":
+		logConfig.json = false
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// Logger is a leveled logger that writes structured records. Fields added
+// with With are included in every record.
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a Logger that adds the given key value pairs to each record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	return &Logger{fields: append(append([]interface{}{}, l.fields...), kv...)}
+}
+
+func (l *Logger) output(level logLevel, msg string) {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	now := time.Now()
+	if level >= levelError {
+		logConfig.lastErr = &lastError{Message: msg, Time: now}
+	}
+	if level < logConfig.level {
+		return
+	}
+
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		file = "???"
+	}
+	caller := fmt.Sprintf("%s:%d", filepath.Base(file), line)
+
+	if !logConfig.json {
+		var b strings.Builder
+		fmt.Fprintf(&b, "[caaos]: %s %s: %s %s", now.Format("2006/01/02 15:04:05.000000"), caller, level, msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", l.fields[i], l.fields[i+1])
+		}
+		fmt.Fprintln(logConfig.out, b.String())
+		return
+	}
+
+	rec := map[string]interface{}{
+		"time":     now.Format(time.RFC3339Nano),
+		"severity": level.String(),
+		"message":  msg,
+		"caller":   caller,
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		v := l.fields[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		rec[fmt.Sprint(l.fields[i])] = v
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Fprintf(logConfig.out, "{\"severity\":\"ERROR\",\"message\":%q}\n", err.Error())
+		return
+	}
+	logConfig.out.Write(append(b, '\n'))
+}
+
+// sprintln formats like fmt.Println without the trailing newline.
+func sprintln(v ...interface{}) string {
+	s := fmt.Sprintln(v...)
+	return s[:len(s)-1]
+}
+
+func (l *Logger) Debug(v ...interface{}) { l.output(levelDebug, sprintln(v...)) }
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(levelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Info(v ...interface{}) { l.output(levelInfo, sprintln(v...)) }
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(levelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warn(v ...interface{}) { l.output(levelWarn, sprintln(v...)) }
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(levelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Error(v ...interface{}) { l.output(levelError, sprintln(v...)) }
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(levelError, fmt.Sprintf(format, v...))
+}
+
+// Fatal logs at CRITICAL and exits.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.output(levelFatal, sprintln(v...))
+	os.Exit(1)
+}
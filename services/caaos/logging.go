@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	containerLogDir = "/var/log/caaos"
+	maxLogFileSize  = 10 << 20
+	maxLogFiles     = 3
+
+	cloudLoggingURL   = "https://logging.googleapis.com/v2/entries:write"
+	cloudLogName      = "caaos-containers"
+	cloudAuditLogName = "caaos-audit"
+	cloudLogBatchSize = 100
+	cloudLogInterval  = 5 * time.Second
+	// cloudLogMaxQueued caps the entries waiting to be sent, more are
+	// dropped so that a slow Logging API never blocks container output.
+	cloudLogMaxQueued = 10 * cloudLogBatchSize
+)
+
+// logEntry is a single line of container output.
+type logEntry struct {
+	container string
+	stream    string
+	time      time.Time
+	text      string
+}
+
+// logSink is a destination for container output, sinks must be safe for
+// concurrent use.
+type logSink interface {
+	write(e logEntry)
+}
+
+// maxLogLine is the longest line of container output written as a single
+// entry, longer lines are split.
+const maxLogLine = 256 * 1024
+
+// containerLog splits a container's stdout and stderr into lines and fans
+// them out to the configured sinks.
+type containerLog struct {
+	name   string
+	sinks  []logSink
+	wg     sync.WaitGroup
+	pipes  []*io.PipeWriter
+	stdout io.Writer
+	stderr io.Writer
+	// closers are called once all output has been written.
+	closers []func()
+}
+
+func newContainerLog(name string, sinks []logSink) *containerLog {
+	l := &containerLog{name: name, sinks: sinks}
+	l.stdout = l.pipe("stdout")
+	l.stderr = l.pipe("stderr")
+	return l
+}
+
+func (l *containerLog) pipe(stream string) io.Writer {
+	pr, pw := io.Pipe()
+	l.pipes = append(l.pipes, pw)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		// Lines longer than the buffer are returned in parts, each is
+		// written as its own entry.
+		r := bufio.NewReaderSize(pr, maxLogLine)
+		for {
+			line, _, err := r.ReadLine()
+			if err != nil {
+				// Only returned once the writer is closed.
+				return
+			}
+			e := logEntry{container: l.name, stream: stream, time: time.Now(), text: string(line)}
+			for _, s := range l.sinks {
+				s.write(e)
+			}
+		}
+	}()
+	return pw
+}
+
+// Stdout returns the writer for the container's stdout.
+func (l *containerLog) Stdout() io.Writer { return l.stdout }
+
+// Stderr returns the writer for the container's stderr.
+func (l *containerLog) Stderr() io.Writer { return l.stderr }
+
+// Close flushes any buffered output and waits for it to be written.
+func (l *containerLog) Close() {
+	for _, p := range l.pipes {
+		p.Close()
+	}
+	l.wg.Wait()
+	for _, c := range l.closers {
+		c()
+	}
+}
+
+// consoleSink writes container output to the agent's stdout, which init
+// connects to the serial console.
+type consoleSink struct{}
+
+var consoleMx sync.Mutex
+
+func (consoleSink) write(e logEntry) {
+	consoleMx.Lock()
+	defer consoleMx.Unlock()
+	fmt.Fprintf(os.Stdout, "[%s %s]: %s\n", e.container, e.stream, e.text)
+}
+
+// fileSink writes container output to one file per container in dir,
+// rotating files once they reach maxLogFileSize.
+type fileSink struct {
+	dir   string
+	mx    sync.Mutex
+	files map[string]*os.File
+}
+
+// mkdirPrivate creates dir readable only by root, container output and run
+// history may hold secrets. Directories created by earlier versions are
+// restricted too.
+func mkdirPrivate(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(dir, 0700)
+}
+
+func newFileSink(dir string) (*fileSink, error) {
+	if err := mkdirPrivate(dir); err != nil {
+		return nil, err
+	}
+	return &fileSink{dir: dir, files: map[string]*os.File{}}, nil
+}
+
+func (s *fileSink) write(e logEntry) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	f, err := s.file(e.container)
+	if err != nil {
+		logger.Errorf("Error opening log file for %s: %v", e.container, err)
+		return
+	}
+	f.WriteString(formatLogEntry(e))
+}
+
+func (s *fileSink) file(name string) (*os.File, error) {
+	p := filepath.Join(s.dir, name+".log")
+	f, ok := s.files[name]
+	if ok {
+		fi, err := f.Stat()
+		if err != nil || fi.Size() < maxLogFileSize {
+			return f, err
+		}
+		f.Close()
+		delete(s.files, name)
+		for i := maxLogFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", p, i-1), fmt.Sprintf("%s.%d", p, i))
+		}
+		os.Rename(p, p+".0")
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.files[name] = f
+	return f, nil
+}
+
+// cloudLogSink batches container output and sends it to the Cloud Logging
+// API as structured entries labeled with the container name.
+type cloudLogSink struct {
+	ctx      context.Context
+	logName  string
+	resource map[string]interface{}
+
+	mx      sync.Mutex
+	entries []map[string]interface{}
+	dropped int
+	// full wakes loop to send a full batch.
+	full chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCloudLogSink(ctx context.Context, logName string) (*cloudLogSink, error) {
+	project, err := getMetadata(ctx, "project/project-id")
+	if err != nil {
+		return nil, err
+	}
+	id, err := getMetadata(ctx, "instance/id")
+	if err != nil {
+		return nil, err
+	}
+	zone, err := getMetadata(ctx, "instance/zone")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &cloudLogSink{
+		ctx:     ctx,
+		logName: fmt.Sprintf("projects/%s/logs/%s", project, logName),
+		resource: map[string]interface{}{
+			"type": "gce_instance",
+			"labels": map[string]string{
+				"instance_id": id,
+				"zone":        path.Base(zone),
+			},
+		},
+		full: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.loop()
+	return s, nil
+}
+
+func (s *cloudLogSink) write(e logEntry) {
+	severity := "INFO"
+	if e.stream == "stderr" {
+		severity = "ERROR"
+	}
+	s.add(map[string]interface{}{
+		"timestamp": e.time.Format(time.RFC3339Nano),
+		"severity":  severity,
+		"labels":    map[string]string{"container": e.container},
+		"jsonPayload": map[string]string{
+			"container": e.container,
+			"stream":    e.stream,
+			"message":   e.text,
+		},
+	})
+}
+
+// add queues a log entry and wakes loop once a batch is full. It never
+// blocks, entries are dropped while cloudLogMaxQueued are waiting.
+func (s *cloudLogSink) add(entry map[string]interface{}) {
+	s.mx.Lock()
+	if len(s.entries) >= cloudLogMaxQueued {
+		s.dropped++
+		s.mx.Unlock()
+		return
+	}
+	s.entries = append(s.entries, entry)
+	full := len(s.entries) >= cloudLogBatchSize
+	s.mx.Unlock()
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *cloudLogSink) loop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(cloudLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.full:
+			s.flush()
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *cloudLogSink) flush() {
+	s.mx.Lock()
+	entries, dropped := s.entries, s.dropped
+	s.entries, s.dropped = nil, 0
+	s.mx.Unlock()
+	if dropped > 0 {
+		logger.Warnf("Dropped %d container log entries, Cloud Logging is not keeping up", dropped)
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"logName":  s.logName,
+		"resource": s.resource,
+		"entries":  entries,
+	})
+	if err != nil {
+		logger.Error("Error encoding log entries:", err)
+		return
+	}
+	tok, err := saToken.get(s.ctx)
+	if err != nil {
+		logger.Error("Error getting token for Cloud Logging:", err)
+		return
+	}
+	req, err := http.NewRequest("POST", cloudLoggingURL, bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Error writing to Cloud Logging:", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(s.ctx))
+	if err != nil {
+		logger.Error("Error writing to Cloud Logging:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Error("Error writing to Cloud Logging:", resp.Status)
+	}
+}
+
+// Close flushes any remaining entries.
+func (s *cloudLogSink) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type captureSink struct {
+	mx      sync.Mutex
+	entries []logEntry
+}
+
+func (c *captureSink) write(e logEntry) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.entries = append(c.entries, e)
+}
+
+func TestContainerLogLongLines(t *testing.T) {
+	sink := &captureSink{}
+	l := newContainerLog("app", []logSink{sink})
+	long := strings.Repeat("x", 2*maxLogLine+10)
+	fmt.Fprintf(l.Stdout(), "first\n%s\nafter\r\nlast", long)
+	l.Close()
+
+	var got []string
+	for _, e := range sink.entries {
+		if e.container != "app" || e.stream != "stdout" {
+			t.Errorf("entry from %s/%s, want app/stdout", e.container, e.stream)
+		}
+		got = append(got, e.text)
+	}
+	want := []string{"first", long[:maxLogLine], long[maxLogLine : 2*maxLogLine], long[2*maxLogLine:], "after", "last"}
+	if !equalStrings(got, want) {
+		t.Errorf("got %d entries, want %d: the long line must be split and output after it kept", len(got), len(want))
+	}
+}
@@ -3,46 +3,156 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
-	"github.com/google/shlex"
-	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	metadataURL  = "http://metadata.google.internal/computeMetadata/v1/instance/attributes"
-	metadataHang = "/?recursive=true&alt=json&wait_for_change=true&timeout_sec=120&last_etag="
-	defaultEtag  = "NONE"
+	defaultEtag = "NONE"
+
+	defaultGracePeriod = 30 * time.Second
 )
 
 var (
-	defaultTimeout = 130 * time.Second
-	etag           = defaultEtag
+	logger = &Logger{}
+
+	providerFlag   = flag.String("metadata-provider", "auto", "metadata provider to use: auto, gce, aws, azure, file or cloud-init")
+	configFlag     = flag.String("config", "/etc/caaos/config.yaml", "local configuration file used by the file provider")
+	updateKeyFlag  = flag.String("update-key", "/etc/caaos/update-key.pem", "PEM encoded public key used to verify self-updates")
+	healthAddrFlag = flag.String("health-address", "127.0.0.1:8484", "address to serve /healthz and /readyz on, empty disables")
+	logBufferFlag  = flag.Int64("log-buffer-size", defaultRingLogSize>>20, "MiB of output kept for each container for caaosctl logs")
+	logLevelFlag   = flag.String("log-level", "info", "minimum log level: debug, info, warn or error, overridden by the caaos-log-level attribute")
+	logFormatFlag  = flag.String("log-format", "json", "log record format: json or text")
+	attrPrefixFlag = flag.String("attribute-prefix", "", "only use attributes whose names start with this prefix, e.g. caaos-, the prefix may be left off attribute names")
+
+	containerdAddrFlag = flag.String("containerd-address", "/run/containerd/containerd.sock", "containerd socket to connect to")
+	namespaceFlag      = flag.String("namespace", "caaos", "containerd namespace to run containers in")
+	metadataFlag       = flag.String("metadata-endpoint", "", "metadata server URL, e.g. http://localhost:8080, replacing the provider's default for testing")
+	bootReportFlag     = flag.Bool("boot-report", false, "record how long each boot phase takes and publish the report to the serial console and the boot-report guest attribute")
+	certsDirFlag       = flag.String("certs-dir", "/etc/caaos/certs.d", "directory with a <registry>/*.crt CA bundle for each registry with a private CA")
+	pprofFlag          = flag.String("pprof-address", "", "localhost address to serve the agent's pprof endpoints on, e.g. 127.0.0.1:6060, empty disables")
+	profileMemFlag     = flag.Uint64("profile-memory-threshold", 0, "MiB of memory use above which goroutine and heap profiles are written to "+profileDir+", 0 disables")
+	mdTimeoutFlag      = flag.Duration("metadata-timeout", 120*time.Second, "how long a wait_for_change request to the metadata server hangs before it is repeated")
+	mdWaitFlag         = flag.Bool("metadata-wait-for-change", true, "use hanging GETs to watch the metadata server, if false it is polled every -metadata-poll-interval")
+	mdPollFlag         = flag.Duration("metadata-poll-interval", time.Minute, "how often to poll the metadata server when not waiting for changes")
+	mdBackoffFlag      = flag.Duration("metadata-retry-backoff", time.Second, "initial delay before retrying a failed metadata request, doubled on each failure")
+	mdMaxBackoffFlag   = flag.Duration("metadata-max-backoff", time.Minute, "maximum delay between retries of failed metadata requests")
+	mdJitterFlag       = flag.Duration("metadata-jitter", 10*time.Second, "maximum random time added to metadata timeouts, poll intervals and retries so fleets don't poll in lockstep")
+	heartbeatFlag      = flag.Duration("heartbeat-interval", 5*time.Minute, "how often to publish the agent version, uptime, containers and last error to the heartbeat guest attribute, 0 disables")
+	auditLogFlag       = flag.String("audit-log", "/var/lib/caaos/audit.log", "append-only file recording specs received, images pulled, containers started and stopped, policy denials and shutdowns, empty disables")
+	otlpFlag           = flag.String("otlp-endpoint", "", "OTLP/HTTP collector URL to export traces to, e.g. http://localhost:4318, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+
+	controlAddrFlag      = flag.String("control-address", "", "TCP address to also serve the control API on, requests must carry the bearer token in "+controlTokenFile+", empty disables")
+	controlCertFlag      = flag.String("control-tls-cert", "", "PEM certificate to serve the control API's TCP address with TLS")
+	controlKeyFlag       = flag.String("control-tls-key", "", "PEM private key of -control-tls-cert")
+	controlClientCAFlag  = flag.String("control-client-ca", "", "PEM CA bundle, when set clients of the control API's TCP address must present a certificate it signed")
+	controlTokenAttrFlag = flag.Bool("control-token-guest-attribute", false, "also publish the control API token to the control-token guest attribute")
 
-	logger = log.New(os.Stdout, "[caaos]: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	networkGateFlag  = flag.Duration("boot-network-timeout", 2*time.Minute, "how long to wait for a default route before the first pull, 0 disables")
+	dnsGateFlag      = flag.Duration("boot-dns-timeout", time.Minute, "how long to wait for the spec's registries to resolve before the first pull, 0 disables")
+	clockGateFlag    = flag.Duration("boot-clock-timeout", time.Minute, "how long to wait for the clock to be synchronized, or within a minute of the registry's, before the first pull, 0 disables")
+	preferIPv6Flag   = flag.Bool("prefer-ipv6", false, "use the metadata server's IPv6 address and connect to registries over IPv6 when they have both, on by default on IPv6-only VMs")
+	snapshotterFlag  = flag.String("snapshotter", "", "containerd snapshotter to unpack images into when the snapshotter attribute is not set: overlayfs, native, devmapper, btrfs, zfs or a proxy plugin, empty for containerd's default")
+	offlineDelayFlag = flag.Duration("offline-fallback-delay", 30*time.Second, "how long the metadata server must be unreachable at boot before the cached spec of a VM with offline-fallback set is run")
 )
 
 type attributesJSON struct {
-	ContainerID   string `json:"container-id"`
-	ContainerArgs string `json:"container-args"`
-	StopOnExit    bool   `json:"stop-on-exit,string"`
+	ContainerID        string `json:"container-id"`
+	ContainerArgs      string `json:"container-args"`
+	ContainerDigest    string `json:"container-digest"`
+	Containers         string `json:"containers"`
+	Spec               string `json:"caaos-spec"`
+	Compose            string `json:"caaos-compose"`
+	ContainerNetwork   string `json:"container-network"`
+	RestartPolicy      string `json:"restart-policy"`
+	RegistryAuth       string `json:"registry-auth"`
+	RegistryHosts      string `json:"registry-hosts"`
+	RegistryCA         string `json:"registry-ca"`
+	ContainerEnv       string `json:"container-env"`
+	ContainerMounts    string `json:"container-mounts"`
+	ContainerResources string `json:"container-resources"`
+	CloudLogging       bool   `json:"google-logging-enabled,string"`
+	Privileged         bool   `json:"privileged,string"`
+	EnableGPU          bool   `json:"enable-gpu,string"`
+	GracePeriod        string `json:"shutdown-grace-period"`
+	SignaturePolicy    string `json:"image-signature-policy"`
+	ImagePolicy        string `json:"image-policy"`
+	ImagePolicyURL     string `json:"image-policy-url"`
+	PolicyMode         string `json:"policy-mode"`
+	PullPolicy         string `json:"pull-policy"`
+	PullConcurrency    int    `json:"pull-concurrency,string"`
+	Snapshotter        string `json:"snapshotter"`
+	PrefetchImages     string `json:"prefetch-images"`
+	HTTPProxy          string `json:"http-proxy"`
+	HTTPSProxy         string `json:"https-proxy"`
+	NoProxy            string `json:"no-proxy"`
+	PullTimeout        string `json:"pull-timeout"`
+	GCInterval         string `json:"gc-interval"`
+	GCDiskThreshold    int    `json:"gc-disk-threshold,string"`
+	StopOnExit         bool   `json:"stop-on-exit,string"`
+	LogLevel           string `json:"caaos-log-level"`
+	UpdateChannel      string `json:"caaos-update-channel"`
+	UpdateInterval     string `json:"caaos-update-interval"`
+	UpdateStrategy     string `json:"update-strategy"`
+	CanaryPeriod       string `json:"canary-period"`
+	HealthInternal     bool   `json:"health-listen-internal,string"`
+	// RefreshSubscription is a Pub/Sub subscription, messages published to
+	// it make the agent fetch metadata immediately.
+	RefreshSubscription string `json:"caaos-refresh-subscription"`
+	// RefreshWebhookSecret is the Secret Manager version of the key used
+	// to sign requests to /v1/refresh.
+	RefreshWebhookSecret string `json:"caaos-refresh-webhook-secret"`
+	// WorkerSubscription is a Pub/Sub subscription whose messages are
+	// containers to run once, WorkerTaskTokenSecret is the Secret Manager
+	// version of the token Cloud Tasks HTTP tasks to /v1/tasks must carry.
+	WorkerSubscription    string `json:"worker-subscription"`
+	WorkerTaskTokenSecret string `json:"worker-task-token-secret"`
+	WorkerConcurrency     int    `json:"worker-concurrency,string"`
+	// WorkerAllowHostAccess lets tasks use hooks, privileges, devices and
+	// host or disk mounts, anyone able to publish a task then has root on
+	// the host.
+	WorkerAllowHostAccess bool `json:"worker-allow-host-access,string"`
+	// Integrity is the platform integrity required before containers are
+	// run: "secure-boot" or "measured-boot".
+	Integrity string `json:"require-integrity"`
+	// AuditCloudLogging also sends the audit log to Cloud Logging, under
+	// the caaos-audit log name.
+	AuditCloudLogging bool `json:"audit-cloud-logging,string"`
+	// OfflineFallback caches the spec once applied so that it is run again
+	// if the metadata server is unreachable at boot.
+	OfflineFallback bool `json:"offline-fallback,string"`
+
+	// all holds every instance attribute so they can be referenced from
+	// other attributes.
+	all map[string]string
+	// project, if set, holds the project attributes whose containers are
+	// merged with these.
+	project *attributesJSON
+	// instance, if project is set, holds the instance's own attributes.
+	instance *attributesJSON
+	// offline is set on attributes read from the spec cache.
+	offline bool
 }
 
 func runCmd(ctx context.Context, path string, args []string) error {
-	logger.Printf("Running %q with args %q", path, args)
+	logger.Infof("Running %q with args %q", path, args)
 
 	c := exec.Command(path, args...)
 
@@ -62,187 +172,964 @@ func runCmd(ctx context.Context, path string, args []string) error {
 
 	in := bufio.NewScanner(pr)
 	for in.Scan() {
-		logger.Printf("%s: %s", filepath.Base(path), in.Text())
+		logger.Infof("%s: %s", filepath.Base(path), in.Text())
 	}
 
 	return c.Wait()
 }
 
-func updateEtag(resp *http.Response) bool {
-	oldEtag := etag
-	etag = resp.Header.Get("etag")
-	if etag == "" {
-		etag = defaultEtag
-	}
-	return etag == oldEtag
+func containerLogger(name string) *Logger {
+	return logger.With("container", name)
 }
 
-func watchMetadata(ctx context.Context) (*attributesJSON, error) {
-	client := &http.Client{
-		Timeout: defaultTimeout,
-	}
+// runner holds the state shared by all containers started from a single
+// metadata update.
+type runner struct {
+	client *containerd.Client
+	// images, containers and tasks replace the containerd client for the
+	// run logic if set, such as with fakes.
+	images     ImagePuller
+	containers ContainerRunner
+	tasks      TaskSupervisor
+	// env replaces the agent's state and host setup if set.
+	env *runEnv
 
-	req, err := http.NewRequest("GET", metadataURL+metadataHang+etag, nil)
-	if err != nil {
-		return nil, err
+	resolver     remotes.Resolver
+	logSinks     []logSink
+	gracePeriod  time.Duration
+	sigPolicy    *signaturePolicy
+	imagePolicy  *imagePolicy
+	pullDeadline time.Duration
+	// pullConcurrency is the maximum number of layers downloaded at once.
+	pullConcurrency int
+	// snapshotter is the snapshotter images are unpacked into.
+	snapshotter string
+	// specHash is the hash of the spec being run and adopt holds the
+	// containers of the same spec left running by a previous agent.
+	specHash string
+	adopt    *adoptSet
+	// internalSinks get the output of containers whatever their log
+	// driver, logDrivers are the sinks of the other log drivers by name.
+	internalSinks []logSink
+	logDrivers    map[string]logSink
+
+	// started has a channel per container that is closed once the
+	// container's task has first started.
+	started map[string]*startSignal
+	// ready, if set, is closed once all non scheduled containers have
+	// started.
+	ready chan struct{}
+	// health, if set, tracks the health of the containers and healthy is
+	// closed once all non scheduled containers are healthy.
+	health  *healthSignals
+	healthy chan struct{}
+}
+
+// detach returns a context in the same namespace as ctx that is never
+// canceled, used to clean up containers after ctx has been canceled.
+func detach(ctx context.Context) context.Context {
+	ns, _ := namespaces.Namespace(ctx)
+	return namespaces.WithNamespace(context.Background(), ns)
+}
+
+// stopTask sends SIGTERM to the task and waits up to gracePeriod for it to
+// exit before sending SIGKILL.
+func stopTask(ctx context.Context, logger *Logger, task containerd.Task, statusC <-chan containerd.ExitStatus, gracePeriod time.Duration) containerd.ExitStatus {
+	logger.With("event", "stop").Infof("stopping task, grace period %s", gracePeriod)
+	if err := task.Kill(ctx, syscall.SIGTERM); err != nil {
+		logger.Error("Error sending SIGTERM:", err)
 	}
-	req.Header.Add("Metadata-Flavor", "Google")
-	req = req.WithContext(ctx)
+	if status, ok := awaitExit(ctx, task, statusC, time.After(gracePeriod)); ok {
+		return status
+	}
+	logger.Warn("task did not exit in time, sending SIGKILL")
+	if err := task.Kill(ctx, syscall.SIGKILL, containerd.WithKillAll); err != nil {
+		logger.Error("Error sending SIGKILL:", err)
+	}
+	status, _ := awaitExit(ctx, task, statusC, nil)
+	return status
+}
+
+// stopPollInterval is how often a stopping task's status is checked in case
+// its exit event is missed.
+const stopPollInterval = time.Second
 
+// awaitExit waits for the task's exit status until timeout fires, a nil
+// timeout waits forever. The status is also polled so that stopping does not
+// hang if the exit event never arrives.
+func awaitExit(ctx context.Context, task containerd.Task, statusC <-chan containerd.ExitStatus, timeout <-chan time.Time) (containerd.ExitStatus, bool) {
+	ctx = detach(ctx)
+	tick := time.NewTicker(stopPollInterval)
+	defer tick.Stop()
 	for {
-		resp, err := client.Do(req)
-		// Don't return error on a canceled context.
-		if err != nil && ctx.Err() != nil {
-			return nil, nil
-		}
-		if err != nil {
-			return nil, err
+		select {
+		case status := <-statusC:
+			return status, true
+		case <-timeout:
+			return containerd.ExitStatus{}, false
+		case <-tick.C:
+			st, err := task.Status(ctx)
+			if errdefs.IsNotFound(err) {
+				return *containerd.NewExitStatus(containerd.UnknownExitStatus, time.Now(), nil), true
+			}
+			if err == nil && st.Status == containerd.Stopped {
+				return *containerd.NewExitStatus(st.ExitStatus, st.ExitTime, nil), true
+			}
 		}
+	}
+}
 
-		// Only return metadata on updated etag.
-		if updateEtag(resp) {
-			continue
+// containerID returns a containerd ID for a run of the named container, the
+// name with a random suffix so that IDs are readable in ctr output and
+// don't collide when a container restarts quickly.
+func containerID(name string) string {
+	return fmt.Sprintf("%s-%06x", name, rand.Intn(1<<24))
+}
+
+func (r *runner) runContainer(ctx context.Context, logger *Logger, c ContainerSpec) (code uint32, err error) {
+	env := r.environment()
+	client := r.containerRunner()
+	ctx = namespaces.WithNamespace(ctx, c.namespace())
+	logger = logger.With("image", c.Image)
+	// Post-stop hooks run once the container has been started or adopted,
+	// unless it is left running for a new agent.
+	postStop := false
+	if c.Hooks != nil {
+		defer func() {
+			if postStop && err != errHandoff {
+				r.runHooks(detach(ctx), logger, c, hookPostStop, c.Hooks.PostStop)
+			}
+		}()
+	}
+	if id, pc, ok := r.adopt.take(c.Name); ok {
+		code, adopted, err := r.adoptContainer(ctx, logger, c, id, pc)
+		if adopted {
+			postStop = true
+			return code, err
+		}
+		logger.Warnf("Error reattaching to container %s, starting a new one: %v", id, err)
+	}
+	// The span covers getting the container running, not the time it runs.
+	sctx, span := startSpan(ctx, "container.start", attribute.String("container", c.Name), attribute.String("image", c.Image))
+	defer func() {
+		if span != nil {
+			endSpan(span, err)
 		}
+	}()
+	if err := r.imagePolicy.evaluate(logger, c, r.sigPolicy != nil); err != nil {
+		env.audit.record(auditRecord{Action: auditDenied, Container: c.Name, Image: c.Image, SpecHash: r.specHash, Detail: err.Error()})
+		st := &containerStatus{Name: c.Name, Image: c.Image, StartTime: time.Now()}
+		st.rejected(err)
+		st.publish(ctx, logger)
+		return 0, err
+	}
+	ref, _ := imageRef(c.Image)
+	unpin := pins.hold(ref)
+	defer unpin()
+	img, err := r.getImage(sctx, logger, c)
+	if err != nil {
+		return 0, err
+	}
+	env.boot.container(c.Name, phasePulled)
+	if err := verifyDigest(img, c.Digest); err != nil {
+		return 0, err
+	}
+	logger.With("event", "pulled").Info("pulled image with digest", img.Target().Digest)
+	env.audit.record(auditRecord{Action: auditImagePulled, Container: c.Name, Image: c.Image, Digest: img.Target().Digest.String(), SpecHash: r.specHash})
+	env.lifecycle.publish(lifecycleEvent{Type: eventPulled, Container: c.Name, Image: c.Image, Digest: img.Target().Digest.String()})
+	if r.sigPolicy != nil {
+		if err := r.sigPolicy.verify(ctx, r.resolver, ref, img.Target().Digest); err != nil {
+			logger.With("event", "rejected").Error("Image signature verification failed:", err)
+			env.audit.record(auditRecord{Action: auditDenied, Container: c.Name, Image: c.Image, Digest: img.Target().Digest.String(), SpecHash: r.specHash, Detail: err.Error()})
+			st := &containerStatus{Name: c.Name, Image: c.Image, Digest: img.Target().Digest.String(), StartTime: time.Now()}
+			st.rejected(err)
+			st.publish(ctx, logger)
+			return 0, err
+		}
+		logger.Info("image signature verified")
+	}
 
-		md, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return nil, err
+	if c.Hooks != nil {
+		if err := r.runHooks(ctx, logger, c, hookPreStart, c.Hooks.PreStart); err != nil {
+			return 0, err
 		}
-		var attr attributesJSON
-		return &attr, json.Unmarshal(md, &attr)
+		postStop = true
 	}
-}
 
-func runContainer(ctx context.Context, client *containerd.Client, id string, args []string) error {
-	logger.Println("pulling image")
-	img, err := client.Pull(ctx, id, containerd.WithPullUnpack)
-	if err != nil {
-		return err
+	if err := prepareMounts(c.Mounts); err != nil {
+		return 0, err
 	}
 
-	rnd := fmt.Sprintf("%d", time.Now().Unix())
+	rnd := containerID(c.Name)
+	logger = logger.With("id", rnd)
+	// Everything after the container exists uses a context that outlives
+	// ctx so that the task can be stopped and cleaned up on shutdown.
+	cctx := detach(ctx)
 
-	logger.Println("creating container")
+	logger.Debug("creating container")
+	imageConfig := oci.WithImageConfig(img)
+	if len(c.Command) > 0 {
+		imageConfig = oci.WithImageConfigArgs(img, c.Command)
+	}
 	opts := []oci.SpecOpts{
-		oci.WithImageConfig(img),
-		oci.WithHostNamespace(specs.NetworkNamespace),
-		oci.WithHostHostsFile,
-		oci.WithHostResolvconf,
+		imageConfig,
 		//oci.WithTTY,
-		oci.WithPrivileged,
 		//oci.WithRootFSPath("/cntr"),
 	}
-	if len(args) > 0 {
-		opts = append(opts, oci.WithProcessArgs(args...))
+	netOpts, removeNetFiles, err := withNetworkFiles(rnd, c)
+	if err != nil {
+		return 0, err
 	}
+	defer func() {
+		if err != errHandoff {
+			removeNetFiles()
+		}
+	}()
+	opts = append(opts, netOpts...)
+	opts = append(opts, c.specOpts()...)
+	secretOpts, removeSecrets, err := env.withSecrets(ctx, rnd, c)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != errHandoff {
+			removeSecrets()
+		}
+	}()
+	opts = append(opts, secretOpts...)
 
-	container, err := client.NewContainer(
-		ctx,
-		rnd,
-		//containerd.WithImage(img),
-		containerd.WithNewSnapshot(rnd, img),
+	snapshotOpt := containerd.WithNewSnapshot(rnd, img)
+	if c.TmpfsRootfs > 0 {
+		rootfs, merr := mountTmpfsRootfs(cctx, client.SnapshotService(r.snapshotter), rnd, img, c.TmpfsRootfs)
+		if merr != nil {
+			return 0, fmt.Errorf("error creating tmpfs rootfs: %v", merr)
+		}
+		// Runs after the container, and the view snapshot it references,
+		// has been deleted.
+		defer func() {
+			if err != errHandoff {
+				removeTmpfsRootfs(rnd)
+			}
+		}()
+		logger.Infof("writable layer on a %d byte tmpfs", c.TmpfsRootfs)
+		opts = append(opts, oci.WithRootFSPath(rootfs))
+		snapshotOpt = containerd.WithSnapshot(rnd)
+	}
+
+	copts := []containerd.NewContainerOpts{
+		containerd.WithImageName(img.Name()),
+		containerd.WithSnapshotter(r.snapshotter),
+		snapshotOpt,
 		containerd.WithNewSpec(opts...),
-	)
+		containerd.WithContainerLabels(map[string]string{
+			labelName:     c.Name,
+			labelSpecHash: r.specHash,
+			labelDigest:   img.Target().Digest.String(),
+		}),
+	}
+	if rt := c.runtimeName(); rt != "" {
+		logger.Info("using runtime", rt)
+		copts = append(copts, containerd.WithRuntime(rt, nil))
+	}
+	_, snapSpan := startSpan(sctx, "snapshot.create", attribute.String("snapshotter", r.snapshotter))
+	container, err := client.NewContainer(cctx, rnd, copts...)
+	endSpan(snapSpan, err)
+	unpin()
 	if err != nil {
-		return err
+		if c.TmpfsRootfs > 0 {
+			client.SnapshotService(r.snapshotter).Remove(cctx, rnd)
+		}
+		return 0, err
 	}
-	defer container.Delete(ctx, containerd.WithSnapshotCleanup)
+	defer func() {
+		if err != errHandoff {
+			container.Delete(cctx, containerd.WithSnapshotCleanup)
+		}
+	}()
+	env.lifecycle.publish(lifecycleEvent{Type: eventCreated, Container: c.Name, ID: rnd, Image: c.Image, Digest: img.Target().Digest.String()})
 
 	// create a new task
-	logger.Println("creating task")
-	task, err := container.NewTask(ctx, cio.NewCreator(append([]cio.Opt{cio.WithStdio})...))
+	_, taskSpan := startSpan(sctx, "task.start")
+	defer func() {
+		if taskSpan != nil {
+			endSpan(taskSpan, err)
+		}
+	}()
+	logger.Debug("creating task")
+	out := r.containerLog(logger, c)
+	defer out.Close()
+	var topts []containerd.NewTaskOpts
+	if dir, ok := env.checkpoints.takeRestore(c.Name); ok {
+		defer os.RemoveAll(dir)
+		if c.Network == networkBridge {
+			logger.Error("Error restoring container: checkpoints can only be restored with host networking")
+		} else {
+			logger.With("event", "restore").Info("restoring container from checkpoint")
+			topts = append(topts, containerd.WithRestoreImagePath(dir))
+		}
+	}
+	task, err := container.NewTask(cctx, cio.NewCreator(cio.WithStreams(nil, out.Stdout(), out.Stderr())), topts...)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	pid := task.Pid()
-	fmt.Println(pid)
+	logger.With("pid", pid).Debug("created task")
 
 	// Setup wait channel
-	statusC, err := task.Wait(ctx)
+	statusC, unsubscribeExit := r.taskSupervisor().Exit(cctx, task)
+	defer unsubscribeExit()
+
+	// host is the address the container's ports are reachable on.
+	host := "127.0.0.1"
+	if c.Network == networkBridge && c.netns == "" {
+		logger.Debug("setting up network")
+		ip, err := env.setupNetwork(cctx, rnd, task.Pid(), c.Ports)
+		if err != nil {
+			task.Delete(cctx, containerd.WithProcessKill)
+			return 0, fmt.Errorf("error setting up network: %v", err)
+		}
+		logger.Debug("container IP:", ip)
+		host = ip
+		if r := c.Resources; r != nil && (r.IngressBandwidth > 0 || r.EgressBandwidth > 0) {
+			if err := throttleNetwork(cctx, task.Pid(), r.IngressBandwidth, r.EgressBandwidth); err != nil {
+				env.removeNetwork(cctx, rnd, task.Pid(), c.Ports)
+				task.Delete(cctx, containerd.WithProcessKill)
+				return 0, err
+			}
+		}
+		if _, err := container.SetLabels(cctx, map[string]string{labelHost: ip}); err != nil {
+			logger.Error("Error labeling container:", err)
+		}
+		defer func() {
+			if err == errHandoff {
+				return
+			}
+			if err := env.removeNetwork(cctx, rnd, task.Pid(), c.Ports); err != nil {
+				logger.Error("Error removing network:", err)
+			}
+		}()
+	}
+
+	removeEgress, err := applyEgress(cctx, logger, c, container, host)
 	if err != nil {
-		return err
+		task.Delete(cctx, containerd.WithProcessKill)
+		return 0, err
 	}
+	defer func() {
+		if err != errHandoff {
+			removeEgress()
+		}
+	}()
 
 	// start the task
-	logger.Println("running task")
-	if err := task.Start(ctx); err != nil {
-		return err
+	logger.With("event", "start").Info("running task")
+	if err := task.Start(cctx); err != nil {
+		return 0, err
 	}
+	taskSpan.End()
+	span.End()
+	taskSpan, span = nil, nil
+	env.boot.container(c.Name, phaseRunning)
+	env.audit.record(auditRecord{Action: auditStarted, Container: c.Name, Image: c.Image, Digest: img.Target().Digest.String(), SpecHash: r.specHash})
+	env.lifecycle.publish(lifecycleEvent{Type: eventStarted, Container: c.Name, ID: rnd, Image: c.Image, Digest: img.Target().Digest.String()})
+	st := &containerStatus{
+		Name:      c.Name,
+		Image:     c.Image,
+		Digest:    img.Target().Digest.String(),
+		ID:        rnd,
+		State:     stateRunning,
+		StartTime: time.Now(),
+	}
+	return r.waitTask(ctx, logger, c, container, task, statusC, host, st)
+}
+
+// waitTask supervises a started task until it exits or ctx is canceled, in
+// which case the task is stopped. st is the container's running status.
+func (r *runner) waitTask(ctx context.Context, logger *Logger, c ContainerSpec, container containerd.Container, task containerd.Task, statusC <-chan containerd.ExitStatus, host string, st *containerStatus) (uint32, error) {
+	env := r.environment()
+	cctx := detach(ctx)
+	oomC, unsubscribeOOM := r.taskSupervisor().OOM(container.ID())
+	defer unsubscribeOOM()
+
+	if c.HealthCheck != nil {
+		st.Health = healthStarting
+	}
+	st.publish(cctx, logger)
+	r.markStarted(c.Name)
+	defer env.running.add(c.Name, c.namespace(), container, task)()
+	env.state.addContainer(container.ID(), persistedContainer{
+		Name:      c.Name,
+		Namespace: c.namespace(),
+		SpecHash:  r.specHash,
+		Host:      host,
+		Digest:    st.Digest,
+		StartTime: st.StartTime,
+	})
+	defer func() {
+		if !handingOff() {
+			env.state.removeContainer(container.ID())
+		}
+	}()
+
+	stopHealth := func() {}
+	if c.HealthCheck != nil {
+		hctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.monitorHealth(hctx, logger, c, container, task, host, st)
+		}()
+		stopHealth = func() {
+			cancel()
+			<-done
+		}
+	} else {
+		r.health.markHealthy(c.Name)
+	}
+
+	var diskLimit int64
+	if c.Resources != nil {
+		diskLimit = c.Resources.Disk
+	}
+	dctx, stopDisk := context.WithCancel(cctx)
+	defer stopDisk()
+	diskC := r.watchDisk(dctx, logger, container, diskLimit)
+	diskExceeded := false
+
+	// The timeout counts from the start of the task, which for an adopted
+	// container was before the agent restarted.
+	var timeoutC <-chan time.Time
+	if d := c.timeout(); d > 0 {
+		t := time.NewTimer(d - time.Since(st.StartTime))
+		defer t.Stop()
+		timeoutC = t.C
+	}
+	timedOut := false
+
+	closeFirewall := openFirewall(cctx, logger, c)
+	defer func() {
+		if !handingOff() {
+			closeFirewall()
+		}
+	}()
+
+	stopSidecars := r.startSidecars(ctx, c, task.Pid())
+	defer stopSidecars()
 
 	// wait for the task to exit and get the exit status
-	logger.Println("waiting...")
-	status := <-statusC
+	logger.Debug("waiting...")
+	var status containerd.ExitStatus
+wait:
+	for {
+		select {
+		case status = <-statusC:
+			break wait
+		case <-oomC:
+			r.oomKilled(cctx, logger, st)
+			if c.RestartOnOOM {
+				logger.Warn("stopping container after OOM kill")
+				status = stopTask(cctx, logger, task, statusC, r.gracePeriod)
+				break wait
+			}
+		case <-diskC:
+			logger.Warn("stopping container over its disk limit")
+			diskExceeded = true
+			status = stopTask(cctx, logger, task, statusC, r.gracePeriod)
+			break wait
+		case <-timeoutC:
+			logger.With("event", "timeout").Warnf("stopping container that ran longer than its %s timeout", c.Timeout)
+			timedOut = true
+			status = stopTask(cctx, logger, task, statusC, r.gracePeriod)
+			break wait
+		case <-ctx.Done():
+			if handingOff() {
+				stopHealth()
+				logger.With("event", "handoff").Info("leaving task running for the new agent")
+				return 0, errHandoff
+			}
+			gracePeriod := r.gracePeriod
+			if isPreempting() && gracePeriod > preemptGracePeriod {
+				gracePeriod = preemptGracePeriod
+			}
+			status = stopTask(cctx, logger, task, statusC, gracePeriod)
+			break wait
+		}
+	}
+	stopHealth()
 	code, _, err := status.Result()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	// The OOM event can arrive after the exit.
+	select {
+	case <-oomC:
+		r.oomKilled(cctx, logger, st)
+	default:
+	}
+
+	logger.With("event", "exit", "exit_code", code).Info("return code:", code)
+	env.audit.record(auditRecord{Action: auditStopped, Container: c.Name, Image: c.Image, Digest: st.Digest, SpecHash: r.specHash, ExitCode: &code})
+	env.lifecycle.publish(lifecycleEvent{Type: eventExited, Container: c.Name, ID: st.ID, Image: c.Image, Digest: st.Digest, ExitCode: &code})
+	st.exited(code)
+	if diskExceeded {
+		diskQuotaExceeded(st)
+	}
+	if timedOut {
+		st.State = stateTimedOut
+		st.Error = errTimedOut.Error()
+	}
+	if isPreempting() {
+		st.State = statePreempted
+	}
+	st.publish(cctx, logger)
+
+	logger.Debug("deleting task")
+	if _, err := task.Delete(cctx); err != nil {
+		logger.Error(err)
+	}
+
+	if timedOut {
+		return code, errTimedOut
+	}
+	if diskExceeded {
+		return code, errDiskQuota
+	}
+	if st.OOMKilled && c.RestartOnOOM {
+		return code, errOOMKilled
+	}
+	return code, nil
+}
+
+// newSpecRunner returns a runner for spec, whose hash is hash, with the
+// registry, policy and logging settings of md.
+func newSpecRunner(ctx context.Context, client *containerd.Client, md *attributesJSON, spec *Spec, hash, snapshotter string, sinks, internalSinks []logSink, logDrivers map[string]logSink) (*runner, *cloudLogSink, error) {
+	creds, err := parseRegistryAuth(md.RegistryAuth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading registry credentials: %v", err)
+	}
+	registries, err := parseRegistryConfig(md)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading registry configuration: %v", err)
+	}
+	imgPolicy, err := parseImagePolicy(ctx, md)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading image policy: %v", err)
+	}
+	sigPolicy, err := parseSignaturePolicy(md.SignaturePolicy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading image signature policy: %v", err)
 	}
 
-	logger.Println("return code:", code)
+	gracePeriod := defaultGracePeriod
+	if md.GracePeriod != "" {
+		gracePeriod, err = time.ParseDuration(md.GracePeriod)
+		if err != nil {
+			logger.Error("Error parsing shutdown-grace-period:", err)
+			gracePeriod = defaultGracePeriod
+		}
+	}
 
-	logger.Println("deleting task")
-	if _, err := task.Delete(ctx); err != nil {
-		logger.Println(err)
+	var pullDeadline time.Duration
+	if md.PullTimeout != "" {
+		if pullDeadline, err = time.ParseDuration(md.PullTimeout); err != nil {
+			logger.Error("Error parsing pull-timeout:", err)
+		}
 	}
 
-	// kill the process and get the exit status
-	//if err := task.Kill(ctx, syscall.SIGTERM); err != nil {
-	//	logger.Println(err)
-	//}
+	r := &runner{
+		client:       client,
+		resolver:     newResolver(ctx, creds, registries),
+		logSinks:     sinks,
+		gracePeriod:  gracePeriod,
+		sigPolicy:    sigPolicy,
+		imagePolicy:  imgPolicy,
+		pullDeadline: pullDeadline,
 
-	return nil
+		pullConcurrency: md.PullConcurrency,
+		snapshotter:     snapshotter,
+		specHash:        hash,
+		internalSinks:   internalSinks,
+		logDrivers:      logDrivers,
+	}
+	var cl *cloudLogSink
+	if md.CloudLogging || spec.usesLogDriver(logDriverCloud) {
+		// Use a detached context so that remaining entries are
+		// flushed after ctx is canceled.
+		cl, err = newCloudLogSink(detach(ctx), cloudLogName)
+		if err != nil {
+			logger.Error("Error setting up Cloud Logging:", err)
+		} else {
+			r.logDrivers = map[string]logSink{logDriverCloud: cl}
+			for k, v := range logDrivers {
+				r.logDrivers[k] = v
+			}
+			if md.CloudLogging {
+				r.logSinks = append(r.logSinks[:len(sinks):len(sinks)], cl)
+			}
+		}
+	}
+	return r, cl, nil
 }
 
 func main() {
-	logger.Println("Starting caaos...")
+	flag.Parse()
+	if err := setLogFormat(*logFormatFlag); err != nil {
+		logger.Fatal(err)
+	}
+	defaultLevel, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	setLogLevel(defaultLevel)
+	if flag.Arg(0) == "validate" {
+		os.Exit(runValidate(flag.Args()[1:]))
+	}
+
+	logger.Info("Starting caaos", version, "on", platforms.DefaultString())
+	if *bootReportFlag {
+		boot.enable()
+	}
+	rand.Seed(time.Now().UnixNano())
+	updateHealthy := checkPendingUpdate()
+	if err := persisted.load(); err != nil {
+		logger.Error("Error loading state:", err)
+	}
 
-	logger.Println("creating client")
-	client, err := containerd.New("/run/containerd/containerd.sock")
+	shutdownTracing, err := setupTracing(context.Background(), *otlpFlag)
 	if err != nil {
-		logger.Fatalln(err)
+		logger.Error("Error setting up tracing:", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	installProxy()
+	installIPv6Dialer()
+	if *metadataFlag != "" {
+		setMetadataEndpoint(*metadataFlag)
+	}
+	configureIPv6()
+	provider, err := selectProvider(context.Background(), *providerFlag)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("using metadata provider", provider.Name())
+	agent.provider = provider.Name()
+
+	logger.Info("creating client")
+	client, err := containerd.New(*containerdAddrFlag)
+	if err != nil {
+		logger.Fatal(err)
 	}
 	defer client.Close()
 
-	ctx := namespaces.WithNamespace(context.Background(), "caaos")
+	ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), *namespaceFlag))
+	defer cancel()
+
+	if *auditLogFlag != "" {
+		if err := audit.open(*auditLogFlag); err != nil {
+			logger.Error("Error opening audit log:", err)
+		}
+	}
+	defer audit.close()
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigC
+		logger.Infof("Received %s, stopping containers", sig)
+		audit.record(auditRecord{Action: auditShutdown, Detail: "received " + sig.String()})
+		cancel()
+	}()
+	usrC := make(chan os.Signal, 1)
+	signal.Notify(usrC, syscall.SIGUSR2)
+	go func() {
+		for range usrC {
+			logger.Info("Received SIGUSR2, restarting agent")
+			requestReexec()
+		}
+	}()
 
+	sinks := []logSink{consoleSink{}, runOutput}
+	internalSinks := []logSink{runOutput}
+	logDrivers := map[string]logSink{logDriverConsole: consoleSink{}}
+	if fs, err := newFileSink(containerLogDir); err != nil {
+		logger.Error("Error setting up container log files:", err)
+	} else {
+		sinks = append(sinks, fs)
+		logDrivers[logDriverFile] = fs
+	}
+
+	mux := http.NewServeMux()
+	if ring, err := newRingSink(ringLogDir, *logBufferFlag<<20); err != nil {
+		logger.Error("Error setting up container log buffers:", err)
+	} else {
+		sinks = append(sinks, ring)
+		internalSinks = append(internalSinks, ring)
+		mux.Handle("/v1/logs/", handleLogs(ring))
+	}
+	mux.Handle("/v1/exec/", handleExec(ctx))
+	mux.Handle("/v1/checkpoint/", handleCheckpoint(ctx))
+	mux.Handle("/v1/restore/", handleRestore(ctx))
+	mux.HandleFunc("/v1/history/", handleHistory)
+	mux.HandleFunc("/v1/stats", handleStats)
+	mux.HandleFunc("/v1/events", handleEvents)
+	mux.Handle("/v1/spec", handleSpec(ctx, client))
+	handlePprof(mux)
+	go func() {
+		if err := serveControl(ctx, controlSocket, tenants.authorize(mux)); err != nil {
+			logger.Error("Error serving control socket:", err)
+		}
+	}()
+	if *controlAddrFlag != "" {
+		if cfg, err := controlTLSConfig(*controlCertFlag, *controlKeyFlag, *controlClientCAFlag); err != nil {
+			logger.Errorf("Error configuring TLS for the control API on %s: %v", *controlAddrFlag, err)
+		} else {
+			go func() {
+				if err := serveControlTCP(ctx, *controlAddrFlag, cfg, mux); err != nil {
+					logger.Errorf("Error serving control API on %s: %v", *controlAddrFlag, err)
+				}
+			}()
+		}
+	}
+
+	go ooms.run(ctx, client)
+	// Exit events are still needed to stop the containers once ctx is
+	// canceled, the monitor is stopped once they have exited.
+	exitsCtx, stopExits := context.WithCancel(detach(ctx))
+	defer stopExits()
+	go exits.run(exitsCtx, client)
+	go collectUsage(ctx)
+
+	if *pprofFlag != "" {
+		go servePprof(*pprofFlag)
+	}
+	if *profileMemFlag > 0 {
+		go profileOnHighMemory(ctx, *profileMemFlag<<20)
+	}
+
+	gc := newCollector(client)
+	go gc.run(ctx)
+
+	var health *healthServer
+	if *healthAddrFlag != "" {
+		if health, err = newHealthServer(*healthAddrFlag, client); err != nil {
+			logger.Error("Error starting health server:", err)
+		}
+	}
+	refresh := &refresher{}
+	prefetch := newPrefetcher(client)
+	work := newWorker(client, sinks)
+	if health != nil {
+		health.mux.HandleFunc("/v1/refresh", refresh.handleWebhook)
+		health.mux.HandleFunc("/v1/tasks", work.handleTask)
+	}
+
+	if _, ok := provider.(*gceProvider); ok {
+		go watchPreemption(ctx, cancel)
+		if *heartbeatFlag > 0 {
+			go publishHeartbeats(ctx, *heartbeatFlag)
+		}
+	}
+
+	upd, err := newUpdater(*updateKeyFlag, requestReexec)
+	if err != nil {
+		logger.Warn("Self-update disabled:", err)
+	} else {
+		go upd.run(ctx)
+	}
+
+	watcher := newWatcher(provider, agentWatcherConfig())
+	watcher.Start(ctx)
+	defer watcher.Stop()
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Error("Error notifying systemd:", err)
+	}
+	go runWatchdog(ctx, client)
+
+	// exitAction is the power action to take once all containers have
+	// stopped.
+	var exitAction string
+	// first is set until the first spec is deployed, only then can
+	// containers left running by a previous agent be adopted.
+	first := true
+	// snapshotter is the snapshotter resolved from the latest metadata.
+	var snapshotter string
+	dep := &deployer{
+		env: agentEnv,
+		newRunner: func(ctx context.Context, md *attributesJSON, spec *Spec, hash string) (*runner, *cloudLogSink, error) {
+			r, cl, err := newSpecRunner(ctx, client, md, spec, hash, snapshotter, sinks, internalSinks, logDrivers)
+			if err != nil {
+				return nil, nil, err
+			}
+			if first {
+				r.adopt = adoptOrRemove(ctx, client, adoptableHashes(r.specHash, md), spec)
+				waitBootGates(ctx, spec)
+			}
+			first = false
+			return r, cl, nil
+		},
+		cache: func(md *attributesJSON) { cacheSpec(provider.Name(), md) },
+	}
+loop:
 	for {
-		logger.Println("Waiting for metadata...")
-		md, err := watchMetadata(ctx)
-		if err != nil {
-			logger.Println("Error grabing metadata:", err)
-			time.Sleep(1 * time.Second)
+		agent.setDeployment(dep.cur)
+		var md *attributesJSON
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-dep.curDone:
+			if ctx.Err() != nil {
+				break loop
+			}
+			if d := dep.finished(); d.md.StopOnExit {
+				logger.Info("Finished running all containers, shutting down")
+				exitAction = onExitPoweroff
+				audit.record(auditRecord{Action: auditShutdown, Detail: "all containers finished with stop-on-exit set"})
+				break loop
+			}
+			logger.Info("Finished running all containers, waiting for next command...")
+			continue
+		case <-reexecC:
+			logger.Info("Restarting agent, leaving containers running")
+			// Only the containers of the applied spec are left running.
+			dep.abortRollout()
+			beginHandoff()
+			audit.record(auditRecord{Action: auditShutdown, SpecHash: dep.applied, Detail: "agent restart, containers left running"})
+			break loop
+		case exitAction = <-shutdownC:
+			logger.Infof("Stopping containers for %s", exitAction)
+			audit.record(auditRecord{Action: auditShutdown, Detail: exitAction + " requested by a container's on-exit"})
+			break loop
+		case d := <-dep.rolloutC:
+			dep.finishRollout(d)
 			continue
+		case md = <-watcher.Updates():
+		}
+		if _, err := client.Version(ctx); err == nil {
+			updateHealthy()
 		}
 
-		if md.ContainerID == "" {
-			logger.Println("No container set, waiting...")
-			continue
+		if md.HealthInternal && health != nil {
+			health.serveInternal()
 		}
 
-		var args []string
-		if md.ContainerArgs != "" {
-			args, err = shlex.Split(md.ContainerArgs)
-			if err != nil {
-				logger.Println("Error parsing arguments:", err)
-				continue
+		audit.configure(ctx, md.AuditCloudLogging)
+		proxy.configure(md.HTTPProxy, md.HTTPSProxy, md.NoProxy)
+		refresh.configure(ctx, md.RefreshSubscription, md.RefreshWebhookSecret)
+		prefetch.configure(ctx, md)
+		work.configure(ctx, md)
+
+		if upd != nil {
+			var interval time.Duration
+			if md.UpdateInterval != "" {
+				if interval, err = time.ParseDuration(md.UpdateInterval); err != nil {
+					logger.Error("Error parsing caaos-update-interval:", err)
+				}
 			}
+			upd.configure(md.UpdateChannel, interval)
 		}
 
-		if err := runContainer(ctx, client, md.ContainerID, args); err != nil {
-			logger.Println("Error:", err)
-			time.Sleep(5 * time.Second)
+		level := defaultLevel
+		if md.LogLevel != "" {
+			if level, err = parseLogLevel(md.LogLevel); err != nil {
+				logger.Error("Error parsing caaos-log-level:", err)
+				level = defaultLevel
+			}
 		}
+		setLogLevel(level)
 
-		if md.StopOnExit {
-			logger.Printf("Finished running %s, shutting down", md.ContainerID)
-			syscall.Sync()
-			if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
-				logger.Println("Error calling shutdown:", err)
+		spec, err := md.spec()
+		if err != nil {
+			logger.Error("Error reading containers:", err)
+			publishValidation(ctx, err)
+			continue
+		}
+		tenants.configure(spec)
+
+		var gcInterval time.Duration
+		if md.GCInterval != "" {
+			if gcInterval, err = time.ParseDuration(md.GCInterval); err != nil {
+				logger.Error("Error parsing gc-interval:", err)
 			}
-			select {}
 		}
+		// Prefetched images are kept even if no containers are set.
+		keep := parseImageList(md.PrefetchImages)
+		var containers []ContainerSpec
+		if spec != nil {
+			containers = append(append(containers, spec.InitContainers...), spec.Containers...)
+		}
+		for _, c := range containers {
+			ref, _ := imageRef(c.Image)
+			keep = append(keep, ref)
+			for _, sc := range c.Sidecars {
+				ref, _ := imageRef(sc.Image)
+				keep = append(keep, ref)
+			}
+			keep = append(keep, c.Hooks.images()...)
+		}
+		snapshotter = resolveSnapshotter(ctx, client, md.snapshotter())
+		gc.configure(gcInterval, md.GCDiskThreshold, keep, specNamespaces(spec), snapshotter)
 
-		logger.Printf("Finished running %s, waiting for next command...", md.ContainerID)
+		if spec == nil || len(spec.Containers) == 0 {
+			if dep.cur != nil {
+				logger.Info("No container set, stopping containers")
+			}
+			dep.stop()
+			logger.Info("No container set, waiting...")
+			publishValidation(ctx, nil)
+			continue
+		}
+		if err := validateIntegrityLevel(md.Integrity); err != nil {
+			logger.Error("Error parsing require-integrity, refusing to run containers:", err)
+			publishValidation(ctx, fmt.Errorf("require-integrity: %v", err))
+			continue
+		}
+		if err := integrity.check(ctx, md.Integrity); err != nil {
+			logger.With("event", "rejected").Error("Platform integrity check failed, refusing to run containers:", err)
+			audit.record(auditRecord{Action: auditDenied, SpecHash: specHash(spec), Detail: err.Error()})
+			dep.stop()
+			continue
+		}
+		dep.apply(ctx, md, spec)
+	}
+	dep.abortRollout()
+	state := "STOPPING=1"
+	if handingOff() {
+		state = "RELOADING=1"
+		persisted.setHandoff(&handoffState{SpecHash: dep.applied, MetadataHash: dep.appliedMD, Time: time.Now()})
+	}
+	if err := sdNotify(state); err != nil {
+		logger.Error("Error notifying systemd:", err)
+	}
+	cancel()
+	if dep.cur != nil {
+		<-dep.cur.done
+	}
+	stopExits()
+	tctx, tcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(tctx); err != nil {
+		logger.Error("Error flushing traces:", err)
+	}
+	tcancel()
+
+	if handingOff() {
+		audit.close()
+		if err := reexec(); err != nil {
+			logger.Error("Error restarting agent:", err)
+		}
+		// Containers are still reattached to when init restarts the agent.
+		os.Exit(1)
+	}
+	if exitAction != "" {
+		logger.Infof("All containers stopped, %s", exitAction)
+		audit.close()
+		if err := powerAction(exitAction); err != nil {
+			logger.Error("Error calling shutdown:", err)
+		}
+		select {}
+	}
+	if isPreempting() {
+		syscall.Sync()
 	}
+	logger.Info("All containers stopped, exiting")
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// mergeSpecs returns base with the containers of override merged in, see
+// mergeContainers. Either may be nil.
+func mergeSpecs(base, override *Spec) *Spec {
+	switch {
+	case base == nil:
+		return override
+	case override == nil:
+		return base
+	}
+	return &Spec{
+		InitContainers: mergeContainers(base.InitContainers, override.InitContainers, "init-%d"),
+		Containers:     mergeContainers(base.Containers, override.Containers, "container-%d"),
+		Disks:          mergeDisks(base.Disks, override.Disks),
+		Namespaces:     mergeNamespaces(base.Namespaces, override.Namespaces),
+	}
+}
+
+// mergeNamespaces returns the grants of base with those of the same
+// namespace replaced by override.
+func mergeNamespaces(base, override map[string]NamespaceSpec) map[string]NamespaceSpec {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	out := map[string]NamespaceSpec{}
+	for ns, g := range base {
+		out[ns] = g
+	}
+	for ns, g := range override {
+		out[ns] = g
+	}
+	return out
+}
+
+// mergeDisks returns base with disks of the same name replaced by those in
+// override and the others appended.
+func mergeDisks(base, override []DiskSpec) []DiskSpec {
+	out := append([]DiskSpec{}, base...)
+next:
+	for _, d := range override {
+		for i := range out {
+			if out[i].Name == d.Name {
+				out[i] = d
+				continue next
+			}
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// mergeContainers matches containers by name, unnamed containers by their
+// default name, format, and their index. Each field set in an override
+// container replaces the base container's, env is merged. Containers only in
+// override are added after those of base.
+func mergeContainers(base, override []ContainerSpec, format string) []ContainerSpec {
+	name := func(c ContainerSpec, i int) string {
+		if c.Name != "" {
+			return c.Name
+		}
+		return fmt.Sprintf(format, i)
+	}
+	out := make([]ContainerSpec, len(base))
+	index := map[string]int{}
+	for i, c := range base {
+		out[i] = c
+		index[name(c, i)] = i
+	}
+	for i, c := range override {
+		j, ok := index[name(c, i)]
+		if !ok {
+			out = append(out, c)
+			continue
+		}
+		out[j] = mergeContainer(out[j], c)
+	}
+	return out
+}
+
+func mergeContainer(base, override ContainerSpec) ContainerSpec {
+	env := envMap{}
+	for k, v := range base.Env {
+		env[k] = v
+	}
+	for k, v := range override.Env {
+		env[k] = v
+	}
+
+	b := reflect.ValueOf(&base).Elem()
+	o := reflect.ValueOf(override)
+	for i := 0; i < o.NumField(); i++ {
+		if f := o.Field(i); b.Field(i).CanSet() && !f.IsZero() {
+			b.Field(i).Set(f)
+		}
+	}
+	if len(env) > 0 {
+		base.Env = env
+	}
+	return base
+}
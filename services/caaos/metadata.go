@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	guestNamespace = "caaos"
+
+	probeTimeout = 2 * time.Second
+)
+
+var (
+	// metadataBase is the GCE metadata server and imdsBase the AWS and
+	// Azure instance metadata service.
+	metadataBase = "http://metadata.google.internal/computeMetadata/v1/"
+	imdsBase     = "http://169.254.169.254/"
+)
+
+// setMetadataEndpoint points all metadata providers at endpoint, such as a
+// fake metadata server.
+func setMetadataEndpoint(endpoint string) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	metadataBase = endpoint + "/computeMetadata/v1/"
+	imdsBase = endpoint + "/"
+}
+
+// getMetadata returns the value at the given path relative to metadataBase,
+// e.g. "instance/zone".
+func getMetadata(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest("GET", metadataBase+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	req = req.WithContext(ctx)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting metadata %s: %s", path, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// hangTimeout returns how long the next wait_for_change request hangs for,
+// jittered so that instances don't poll in lockstep.
+func hangTimeout() time.Duration {
+	return *mdTimeoutFlag + jitter(*mdJitterFlag)
+}
+
+func waitQuery(hang time.Duration, lastEtag string) string {
+	return fmt.Sprintf("&wait_for_change=true&timeout_sec=%d&last_etag=%s", int(hang.Seconds()), lastEtag)
+}
+
+// jitter returns a random duration up to max.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// waitMetadata waits for the value at path to change from the one with
+// etag lastEtag and returns the new value and its etag.
+func waitMetadata(ctx context.Context, path, lastEtag string) (string, string, error) {
+	hang := hangTimeout()
+	req, err := http.NewRequest("GET", metadataBase+path+"?"+waitQuery(hang, lastEtag), nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	req = req.WithContext(ctx)
+
+	client := &http.Client{Timeout: hang + 10*time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("error getting metadata %s: %s", path, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(b)), resp.Header.Get("etag"), nil
+}
+
+// setGuestAttribute writes value to the guest attribute caaos/key.
+func setGuestAttribute(ctx context.Context, key, value string) error {
+	req, err := http.NewRequest("PUT", metadataBase+"instance/guest-attributes/"+guestNamespace+"/"+key, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	req = req.WithContext(ctx)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error setting guest attribute %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// MetadataProvider is a source of instance attributes.
+type MetadataProvider interface {
+	// Name returns the name of the provider.
+	Name() string
+	// Watch blocks until the attributes change, or ctx is canceled in which
+	// case it returns nil attributes and a nil error.
+	Watch(ctx context.Context) (*attributesJSON, error)
+}
+
+// parseAttributes parses a JSON object of attribute names to string values.
+func parseAttributes(md []byte) (*attributesJSON, error) {
+	if *attrPrefixFlag != "" {
+		var m map[string]string
+		if err := json.Unmarshal(md, &m); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(withPrefix(m, *attrPrefixFlag))
+		if err != nil {
+			return nil, err
+		}
+		md = b
+	}
+	var attr attributesJSON
+	if err := json.Unmarshal(md, &attr); err != nil {
+		return nil, err
+	}
+	return &attr, json.Unmarshal(md, &attr.all)
+}
+
+// withPrefix returns the attributes whose names start with prefix, each
+// both with and without the prefix so that both caaos-spec and
+// caaos-stop-on-exit work with the prefix caaos-.
+func withPrefix(attrs map[string]string, prefix string) map[string]string {
+	out := map[string]string{}
+	for k, v := range attrs {
+		if strings.HasPrefix(k, prefix) {
+			out[k] = v
+		}
+	}
+	for k, v := range attrs {
+		if strings.HasPrefix(k, prefix) {
+			out[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return out
+}
+
+// mergeUserData merges user data into attrs. User data is either a JSON or
+// YAML object of attributes or, if not, is used as the caaos-spec attribute.
+func mergeUserData(attrs map[string]string, ud []byte) {
+	ud = bytes.TrimSpace(ud)
+	var udAttrs map[string]string
+	if err := yaml.Unmarshal(ud, &udAttrs); err == nil {
+		for k, v := range udAttrs {
+			attrs[k] = v
+		}
+	} else if len(ud) > 0 {
+		attrs["caaos-spec"] = string(ud)
+	}
+}
+
+// etagTracker holds the etag of the last metadata response, which the next
+// wait_for_change request waits for a change from.
+type etagTracker struct {
+	mx   sync.Mutex
+	etag string
+	// missing is set if the last response had no etag.
+	missing bool
+}
+
+// get returns the last etag, defaultEtag if there is none.
+func (t *etagTracker) get() string {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.etag == "" {
+		return defaultEtag
+	}
+	return t.etag
+}
+
+// update records the etag header of a response, a response without one
+// keeps the previous etag.
+func (t *etagTracker) update(h http.Header) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	etag := h.Get("etag")
+	t.missing = etag == ""
+	if !t.missing {
+		t.etag = etag
+	}
+}
+
+// lastMissing reports whether the last response had no etag.
+func (t *etagTracker) lastMissing() bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.missing
+}
+
+// reset makes the next request return right away.
+func (t *etagTracker) reset() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.etag, t.missing = "", false
+}
+
+// gceMetadata is the part of the metadata server's recursive listing that
+// holds attributes.
+type gceMetadata struct {
+	Instance struct {
+		Attributes json.RawMessage `json:"attributes"`
+	} `json:"instance"`
+	Project struct {
+		Attributes json.RawMessage `json:"attributes"`
+	} `json:"project"`
+}
+
+// gceProvider reads instance attributes from the GCE metadata server
+// merged with project attributes, see mergeProjectAttributes.
+type gceProvider struct {
+	last [sha256.Size]byte
+	etag etagTracker
+}
+
+func (*gceProvider) Name() string { return "gce" }
+
+// watch waits for a change to the instance or project metadata, or for a
+// refresh to be requested.
+func (p *gceProvider) watch(ctx context.Context) (*gceMetadata, error) {
+	for {
+		var md *gceMetadata
+		err := waitOrRefresh(ctx, func(ctx context.Context) error {
+			var err error
+			md, err = p.waitChange(ctx)
+			return err
+		})
+		// Don't return error on a canceled context.
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if md == nil {
+			// Refresh requested, get the current metadata without
+			// waiting.
+			p.etag.reset()
+			continue
+		}
+		return md, nil
+	}
+}
+
+func (p *gceProvider) waitChange(ctx context.Context) (*gceMetadata, error) {
+	etag := p.etag.get()
+	url := metadataBase + "?recursive=true&alt=json"
+	timeout := 10 * time.Second
+	switch {
+	case p.etag.lastMissing():
+		// Without the etag of the current metadata a wait would return
+		// right away, poll until the server sends one again.
+		if err := every(*mdPollFlag)(ctx); err != nil {
+			return nil, err
+		}
+	case *mdWaitFlag:
+		hang := hangTimeout()
+		url += waitQuery(hang, etag)
+		timeout += hang
+	case etag != defaultEtag:
+		// Polling, only the first request is made right away.
+		if err := every(*mdPollFlag)(ctx); err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{Timeout: timeout}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// An error response's etag is not that of the metadata, waiting on it
+	// would return right away or never.
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting metadata: %s", resp.Status)
+	}
+
+	// The etag is only used for the next wait, an unchanged etag is not
+	// trusted to mean unchanged content. Watch compares the attributes
+	// themselves.
+	p.etag.update(resp.Header)
+	var md gceMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&md); err != nil {
+		return nil, err
+	}
+	return &md, nil
+}
+
+func (p *gceProvider) Watch(ctx context.Context) (*attributesJSON, error) {
+	for {
+		md, err := p.watch(ctx)
+		if md == nil || err != nil {
+			return nil, err
+		}
+		// Any metadata change ends the wait, only return attribute
+		// changes.
+		sum := sha256.Sum256(append(append([]byte{}, md.Instance.Attributes...), md.Project.Attributes...))
+		if sum == p.last {
+			continue
+		}
+		p.last = sum
+
+		attrs, err := parseAttributes(orEmpty(md.Instance.Attributes))
+		if err != nil {
+			return nil, err
+		}
+		project, err := parseAttributes(orEmpty(md.Project.Attributes))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing project attributes: %v", err)
+		}
+		return mergeProjectAttributes(attrs, project)
+	}
+}
+
+// mergeProjectAttributes returns the project attributes overridden by the
+// instance attributes. The containers are the project's containers merged
+// with the instance's, see mergeSpecs, so that a fleet can share a spec
+// that individual instances adjust.
+func mergeProjectAttributes(instance, project *attributesJSON) (*attributesJSON, error) {
+	if len(project.all) == 0 {
+		return instance, nil
+	}
+	all := map[string]string{}
+	for k, v := range project.all {
+		all[k] = v
+	}
+	for k, v := range instance.all {
+		all[k] = v
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return nil, err
+	}
+	merged := &attributesJSON{all: all}
+	if err := json.Unmarshal(b, merged); err != nil {
+		return nil, err
+	}
+	// The containers are merged by spec(), so only the instance's own
+	// container attributes are kept here.
+	merged.Spec = instance.Spec
+	merged.Compose = instance.Compose
+	merged.Containers = instance.Containers
+	merged.ContainerID = instance.ContainerID
+	merged.ContainerArgs = instance.ContainerArgs
+	merged.ContainerDigest = instance.ContainerDigest
+	merged.project = project
+	merged.instance = instance
+	return merged, nil
+}
+
+// orEmpty returns b or an empty JSON object if b is empty.
+func orEmpty(b []byte) []byte {
+	if len(b) == 0 {
+		return []byte("{}")
+	}
+	return b
+}
+
+// onGCE probes the GCE metadata server.
+func onGCE(ctx context.Context) bool {
+	req, err := http.NewRequest("GET", metadataBase, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: probeTimeout}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Metadata-Flavor") == "Google"
+}
+
+// selectProvider returns the named provider, or for "auto" the first
+// provider whose metadata server responds.
+func selectProvider(ctx context.Context, name string) (MetadataProvider, error) {
+	switch name {
+	case "gce":
+		return &gceProvider{}, nil
+	case "aws":
+		return newAWSProvider(), nil
+	case "azure":
+		return newAzureProvider(), nil
+	case "file":
+		return newFileProvider(*configFlag), nil
+	case "cloud-init":
+		return newCloudInitProvider(), nil
+	case "auto":
+		start := time.Now()
+		for {
+			// The network may only just have come up.
+			configureIPv6()
+			if onGCE(ctx) {
+				return &gceProvider{}, nil
+			}
+			if onAWS(ctx) {
+				return newAWSProvider(), nil
+			}
+			if onAzure(ctx) {
+				return newAzureProvider(), nil
+			}
+			if _, err := os.Stat(*configFlag); err == nil {
+				logger.Info("No metadata server found, using", *configFlag)
+				return newFileProvider(*configFlag), nil
+			}
+			if _, err := os.Stat(cloudInitUserData); err == nil {
+				logger.Info("No metadata server found, using cloud-init user-data")
+				return newCloudInitProvider(), nil
+			}
+			if p := offlineProvider(); p != "" && time.Since(start) >= *offlineDelayFlag {
+				logger.Infof("No metadata server found, using %s, the provider of the cached spec", p)
+				return selectProvider(ctx, p)
+			}
+			logger.Info("No metadata server found, retrying...")
+			time.Sleep(5 * time.Second)
+		}
+	}
+	return nil, fmt.Errorf("unknown metadata provider %q", name)
+}
+
+// poller implements Watch for providers without a hanging GET by polling
+// and only returning attributes that differ from the last ones returned.
+type poller struct {
+	last   [sha256.Size]byte
+	polled bool
+}
+
+func (p *poller) poll(ctx context.Context, wait func(context.Context) error, fetch func(context.Context) (map[string]string, error)) (*attributesJSON, error) {
+	for {
+		if p.polled {
+			if err := waitOrRefresh(ctx, wait); err != nil {
+				if ctx.Err() != nil {
+					return nil, nil
+				}
+				return nil, err
+			}
+		}
+		p.polled = true
+
+		attrs, err := fetch(ctx)
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(attrs)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		if sum == p.last {
+			continue
+		}
+		p.last = sum
+		return parseAttributes(b)
+	}
+}
+
+// every returns a wait function for poll that waits for d plus jitter.
+func every(d time.Duration) func(context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d + jitter(*mdJitterFlag)):
+			return nil
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type gceResponse struct {
+	status int
+	etag   string
+	body   string
+}
+
+// gceServer serves the recursive metadata listing, each response is taken
+// from responses. The last_etag of each hanging GET, or "" for a request
+// that doesn't wait, is sent on etags.
+func gceServer(t *testing.T, responses <-chan gceResponse, etags chan<- string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("wait_for_change") == "true" {
+			etags <- r.URL.Query().Get("last_etag")
+		} else {
+			etags <- ""
+		}
+		var resp gceResponse
+		select {
+		case resp = <-responses:
+		case <-r.Context().Done():
+			return
+		}
+		if resp.etag != "" {
+			w.Header().Set("etag", resp.etag)
+		}
+		w.WriteHeader(resp.status)
+		fmt.Fprint(w, resp.body)
+	}))
+	t.Cleanup(srv.Close)
+	oldBase, oldIMDS := metadataBase, imdsBase
+	setMetadataEndpoint(srv.URL)
+	t.Cleanup(func() { metadataBase, imdsBase = oldBase, oldIMDS })
+}
+
+func attributesBody(restartPolicy string) string {
+	return fmt.Sprintf(`{"instance":{"attributes":{"restart-policy":%q}},"project":{}}`, restartPolicy)
+}
+
+func TestGCEWaitChangeEtag(t *testing.T) {
+	responses, etags := make(chan gceResponse, 1), make(chan string, 1)
+	gceServer(t, responses, etags)
+	p := &gceProvider{}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		resp     gceResponse
+		wantEtag string
+		wantErr  bool
+	}{
+		{gceResponse{http.StatusOK, "e1", attributesBody("always")}, defaultEtag, false},
+		{gceResponse{http.StatusOK, "e2", attributesBody("never")}, "e1", false},
+		// Errors must not replace the etag waited on.
+		{gceResponse{http.StatusServiceUnavailable, "bad", "unavailable"}, "e2", true},
+		{gceResponse{http.StatusOK, "e3", attributesBody("never")}, "e2", false},
+	} {
+		responses <- tc.resp
+		_, err := p.waitChange(ctx)
+		if got := <-etags; got != tc.wantEtag {
+			t.Errorf("last_etag = %q, want %q", got, tc.wantEtag)
+		}
+		if (err != nil) != tc.wantErr {
+			t.Errorf("waitChange with status %d: err = %v, want error %v", tc.resp.status, err, tc.wantErr)
+		}
+	}
+	if got := p.etag.get(); got != "e3" {
+		t.Errorf("etag = %q, want e3", got)
+	}
+}
+
+func TestGCEWaitChangeMissingEtag(t *testing.T) {
+	responses, etags := make(chan gceResponse, 1), make(chan string, 1)
+	gceServer(t, responses, etags)
+	oldPoll, oldJitter := *mdPollFlag, *mdJitterFlag
+	*mdPollFlag, *mdJitterFlag = 50*time.Millisecond, 0
+	defer func() { *mdPollFlag, *mdJitterFlag = oldPoll, oldJitter }()
+	p := &gceProvider{}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		resp     gceResponse
+		wantEtag string
+		// wantDelay is set if the request must wait for the poll
+		// interval.
+		wantDelay bool
+	}{
+		{gceResponse{http.StatusOK, "e1", attributesBody("always")}, defaultEtag, false},
+		{gceResponse{http.StatusOK, "", attributesBody("never")}, "e1", false},
+		// Without an etag the server is polled rather than waited on.
+		{gceResponse{http.StatusOK, "", attributesBody("never")}, "", true},
+		{gceResponse{http.StatusOK, "e2", attributesBody("never")}, "", true},
+		{gceResponse{http.StatusOK, "e3", attributesBody("never")}, "e2", false},
+	} {
+		responses <- tc.resp
+		start := time.Now()
+		missing := p.etag.lastMissing()
+		if _, err := p.waitChange(ctx); err != nil {
+			t.Fatalf("waitChange: %v", err)
+		}
+		if got := <-etags; got != tc.wantEtag {
+			t.Errorf("last_etag = %q, want %q", got, tc.wantEtag)
+		}
+		if delayed := time.Since(start) >= *mdPollFlag; delayed != tc.wantDelay {
+			t.Errorf("request with the last etag missing %v: delayed %v, want %v", missing, delayed, tc.wantDelay)
+		}
+	}
+	if got := p.etag.get(); got != "e3" {
+		t.Errorf("etag = %q, want e3", got)
+	}
+}
+
+func TestGCEWatchHangingGET(t *testing.T) {
+	responses, etags := make(chan gceResponse), make(chan string, 4)
+	gceServer(t, responses, etags)
+	p := &gceProvider{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type result struct {
+		md  *attributesJSON
+		err error
+	}
+	watch := func() <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			md, err := p.Watch(ctx)
+			c <- result{md, err}
+		}()
+		return c
+	}
+
+	resC := watch()
+	responses <- gceResponse{http.StatusOK, "e1", attributesBody("always")}
+	res := <-resC
+	if res.err != nil || res.md == nil || res.md.RestartPolicy != "always" {
+		t.Fatalf("first Watch = %+v, %v, want restart-policy always", res.md, res.err)
+	}
+
+	resC = watch()
+	// The wait hangs until the metadata changes. A change outside of
+	// the attributes ends it but is not returned.
+	if got := <-etags; got != defaultEtag {
+		t.Errorf("first last_etag = %q, want %q", got, defaultEtag)
+	}
+	if got := <-etags; got != "e1" {
+		t.Errorf("last_etag = %q, want e1", got)
+	}
+	select {
+	case res := <-resC:
+		t.Fatalf("Watch returned %+v, %v before the metadata changed", res.md, res.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	responses <- gceResponse{http.StatusOK, "e2", attributesBody("always")}
+	if got := <-etags; got != "e2" {
+		t.Errorf("last_etag = %q, want e2", got)
+	}
+	responses <- gceResponse{http.StatusOK, "e3", attributesBody("never")}
+	res = <-resC
+	if res.err != nil || res.md == nil || res.md.RestartPolicy != "never" {
+		t.Fatalf("Watch = %+v, %v, want restart-policy never", res.md, res.err)
+	}
+
+	// Canceling ends a hanging wait without an error.
+	cctx, ccancel := context.WithCancel(ctx)
+	go func() {
+		<-etags
+		ccancel()
+	}()
+	md, err := p.Watch(cctx)
+	if md != nil || err != nil {
+		t.Errorf("canceled Watch = %+v, %v, want nil, nil", md, err)
+	}
+}
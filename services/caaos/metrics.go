@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/containerd/cgroups/v3/cgroup1/stats"
+	v2 "github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/containerd/containerd"
+	"github.com/containerd/typeurl/v2"
+)
+
+// usageInterval is how often the usage of running containers is sampled.
+const usageInterval = 15 * time.Second
+
+// containerUsage is a container's resource usage read from its cgroup, on
+// both cgroup v1 and v2 hosts.
+type containerUsage struct {
+	CPUNanoseconds uint64 `json:"cpu-nanoseconds"`
+	// MemoryBytes excludes inactive page cache, as docker stats does.
+	MemoryBytes  uint64    `json:"memory-bytes"`
+	MemoryLimit  uint64    `json:"memory-limit-bytes,omitempty"`
+	IOReadBytes  uint64    `json:"io-read-bytes"`
+	IOWriteBytes uint64    `json:"io-write-bytes"`
+	Pids         uint64    `json:"pids"`
+	Time         time.Time `json:"time"`
+}
+
+// taskUsage reads the usage of task from containerd.
+func taskUsage(ctx context.Context, task containerd.Task) (*containerUsage, error) {
+	m, err := task.Metrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := typeurl.UnmarshalAny(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	u := &containerUsage{Time: time.Now()}
+	switch s := v.(type) {
+	case *v1.Metrics:
+		if s.CPU != nil && s.CPU.Usage != nil {
+			u.CPUNanoseconds = s.CPU.Usage.Total
+		}
+		if s.Memory != nil && s.Memory.Usage != nil {
+			u.MemoryBytes = subtract(s.Memory.Usage.Usage, s.Memory.TotalInactiveFile)
+			// An unlimited cgroup v1 reports a limit near 2^63.
+			if s.Memory.Usage.Limit < 1<<62 {
+				u.MemoryLimit = s.Memory.Usage.Limit
+			}
+		}
+		if s.Blkio != nil {
+			for _, e := range s.Blkio.IoServiceBytesRecursive {
+				switch strings.ToLower(e.Op) {
+				case "read":
+					u.IOReadBytes += e.Value
+				case "write":
+					u.IOWriteBytes += e.Value
+				}
+			}
+		}
+		if s.Pids != nil {
+			u.Pids = s.Pids.Current
+		}
+	case *v2.Metrics:
+		if s.CPU != nil {
+			u.CPUNanoseconds = s.CPU.UsageUsec * 1000
+		}
+		if s.Memory != nil {
+			u.MemoryBytes = subtract(s.Memory.Usage, s.Memory.InactiveFile)
+			// An unlimited cgroup v2 reports max as 2^64-1.
+			if s.Memory.UsageLimit < 1<<62 {
+				u.MemoryLimit = s.Memory.UsageLimit
+			}
+		}
+		if s.Io != nil {
+			for _, e := range s.Io.Usage {
+				u.IOReadBytes += e.Rbytes
+				u.IOWriteBytes += e.Wbytes
+			}
+		}
+		if s.Pids != nil {
+			u.Pids = s.Pids.Current
+		}
+	default:
+		return nil, fmt.Errorf("unknown metrics type %T", v)
+	}
+	return u, nil
+}
+
+func subtract(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// collectUsage samples the usage of each running container every
+// usageInterval until ctx is canceled.
+func collectUsage(ctx context.Context) {
+	wait := every(usageInterval)
+	for {
+		usage := map[string]*containerUsage{}
+		for name, t := range running.all() {
+			u, err := taskUsage(t.context(ctx), t.task)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Debugf("Error reading usage of %s: %v", name, err)
+				}
+				continue
+			}
+			usage[name] = u
+		}
+		agent.setUsage(usage)
+		if wait(ctx) != nil {
+			return
+		}
+	}
+}
+
+// handleMetrics serves the usage of each container in the Prometheus text
+// format.
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	agent.mx.Lock()
+	var names []string
+	for name := range agent.usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	usage := make([]*containerUsage, len(names))
+	for i, name := range names {
+		usage[i] = agent.usage[name]
+	}
+	agent.mx.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, typ, help string, value func(*containerUsage) (float64, bool)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for i, u := range usage {
+			if v, ok := value(u); ok {
+				fmt.Fprintf(w, "%s{container=%q} %g\n", name, names[i], v)
+			}
+		}
+	}
+	metric("caaos_container_cpu_seconds_total", "counter", "CPU time used by the container.", func(u *containerUsage) (float64, bool) {
+		return float64(u.CPUNanoseconds) / 1e9, true
+	})
+	metric("caaos_container_memory_bytes", "gauge", "Memory used by the container, excluding inactive page cache.", func(u *containerUsage) (float64, bool) {
+		return float64(u.MemoryBytes), true
+	})
+	metric("caaos_container_memory_limit_bytes", "gauge", "Memory limit of the container.", func(u *containerUsage) (float64, bool) {
+		return float64(u.MemoryLimit), u.MemoryLimit > 0
+	})
+	metric("caaos_container_io_read_bytes_total", "counter", "Bytes read from block devices by the container.", func(u *containerUsage) (float64, bool) {
+		return float64(u.IOReadBytes), true
+	})
+	metric("caaos_container_io_write_bytes_total", "counter", "Bytes written to block devices by the container.", func(u *containerUsage) (float64, bool) {
+		return float64(u.IOWriteBytes), true
+	})
+	metric("caaos_container_pids", "gauge", "Number of processes in the container.", func(u *containerUsage) (float64, bool) {
+		return float64(u.Pids), true
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// prepareMounts checks that the host source of each bind mount exists,
+// creating it if requested, and mounts NFS exports and buckets on the host.
+func prepareMounts(mounts []MountSpec) error {
+	for _, m := range mounts {
+		switch m.Type {
+		case mountNFS:
+			if err := mountNFSExport(m); err != nil {
+				return err
+			}
+			continue
+		case mountGCSFuse:
+			if err := mountGCSBucket(m); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.Type != "" && m.Type != "bind" {
+			continue
+		}
+		_, err := os.Stat(m.Source)
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) || !m.Create {
+			return fmt.Errorf("mount source %s: %v", m.Source, err)
+		}
+		if err := os.MkdirAll(m.Source, 0755); err != nil {
+			return fmt.Errorf("error creating mount source %s: %v", m.Source, err)
+		}
+	}
+	return nil
+}
+
+// ociMounts translates the mounts into OCI spec mounts, filling in default
+// types and options.
+func ociMounts(mounts []MountSpec) []specs.Mount {
+	var out []specs.Mount
+	for _, m := range mounts {
+		typ := m.Type
+		if typ == "" {
+			typ = "bind"
+		}
+		source := m.Source
+		options := m.Options
+		switch typ {
+		case "bind":
+			if len(options) == 0 {
+				options = []string{"rbind", "rw"}
+			}
+		case mountNFS, mountGCSFuse:
+			// Bind the export or bucket mounted by prepareMounts.
+			source = nfsMountPath(m)
+			if typ == mountGCSFuse {
+				source = gcsMountPath(m)
+			}
+			typ = "bind"
+			options = []string{"rbind", "rw"}
+			if readOnly(m.Options) {
+				options[1] = "ro"
+			}
+		case "tmpfs":
+			if source == "" {
+				source = "tmpfs"
+			}
+			if len(options) == 0 {
+				options = []string{"nosuid", "nodev", "mode=1777"}
+			}
+		}
+		out = append(out, specs.Mount{
+			Source:      source,
+			Destination: m.Destination,
+			Type:        typ,
+			Options:     options,
+		})
+	}
+	return out
+}
+
+// parseTmpfs parses a "path[:options]" tmpfs entry.
+func parseTmpfs(s string) MountSpec {
+	m := MountSpec{Type: "tmpfs", Destination: s}
+	if i := strings.Index(s, ":"); i >= 0 {
+		m.Destination = s[:i]
+		m.Options = append([]string{"nosuid", "nodev"}, strings.Split(s[i+1:], ",")...)
+	}
+	return m
+}
+
+// allMounts returns the container's mounts including its tmpfs mounts.
+func (c ContainerSpec) allMounts() []MountSpec {
+	mounts := c.Mounts
+	for _, t := range c.Tmpfs {
+		mounts = append(mounts[:len(mounts):len(mounts)], parseTmpfs(t))
+	}
+	return mounts
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	gocni "github.com/containerd/go-cni"
+)
+
+const (
+	networkHost   = "host"
+	networkBridge = "bridge"
+
+	cniBinDir  = "/opt/cni/bin"
+	cniConfDir = "/etc/caaos/cni"
+)
+
+// defaultCNIConfig is used when no conflist is found in cniConfDir. It
+// gives each container an address on a NATed bridge and maps published
+// ports with iptables.
+const defaultCNIConfig = `{
+	"cniVersion": "0.4.0",
+	"name": "caaos",
+	"plugins": [
+		{
+			"type": "bridge",
+			"bridge": "caaos0",
+			"isGateway": true,
+			"ipMasq": true,
+			"hairpinMode": true,
+			"ipam": {
+				"type": "host-local",
+				"routes": [{"dst": "0.0.0.0/0"}],
+				"ranges": [[{"subnet": "10.88.0.0/16"}]]
+			}
+		},
+		{
+			"type": "portmap",
+			"capabilities": {"portMappings": true}
+		}
+	]
+}`
+
+var (
+	cniOnce sync.Once
+	cniNet  gocni.CNI
+	cniErr  error
+)
+
+// network returns the CNI instance, loading the configuration the first time
+// it is called.
+func network() (gocni.CNI, error) {
+	cniOnce.Do(func() {
+		opts := []gocni.Opt{gocni.WithLoNetwork}
+		confs, _ := filepath.Glob(filepath.Join(cniConfDir, "*.conflist"))
+		sort.Strings(confs)
+		if len(confs) > 0 {
+			logger.Debug("using CNI config", confs[0])
+			b, err := ioutil.ReadFile(confs[0])
+			if err != nil {
+				cniErr = err
+				return
+			}
+			opts = append(opts, gocni.WithConfListBytes(b))
+		} else {
+			opts = append(opts, gocni.WithConfListBytes([]byte(defaultCNIConfig)))
+		}
+		cniNet, cniErr = gocni.New(gocni.WithPluginDir([]string{cniBinDir}), gocni.WithInterfacePrefix("eth"))
+		if cniErr == nil {
+			cniErr = cniNet.Load(opts...)
+		}
+	})
+	return cniNet, cniErr
+}
+
+func portMappings(ports []PortSpec) []gocni.PortMapping {
+	var pm []gocni.PortMapping
+	for _, p := range ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		host := p.HostPort
+		if host == 0 {
+			host = p.Port
+		}
+		pm = append(pm, gocni.PortMapping{
+			HostPort:      int32(host),
+			ContainerPort: int32(p.Port),
+			Protocol:      proto,
+		})
+	}
+	return pm
+}
+
+// setupNetwork attaches the network namespace of the task with the given pid
+// to the CNI network and returns the container's IP address.
+func setupNetwork(ctx context.Context, id string, pid uint32, ports []PortSpec) (string, error) {
+	n, err := network()
+	if err != nil {
+		return "", fmt.Errorf("error loading CNI config: %v", err)
+	}
+	res, err := n.Setup(ctx, id, netnsPath(pid), gocni.WithCapabilityPortMap(portMappings(ports)))
+	if err != nil {
+		return "", err
+	}
+	for name, cfg := range res.Interfaces {
+		if name == "lo" {
+			continue
+		}
+		for _, ip := range cfg.IPConfigs {
+			return ip.IP.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// removeNetwork detaches the container from the CNI network, releasing its
+// address and port mappings.
+func removeNetwork(ctx context.Context, id string, pid uint32, ports []PortSpec) error {
+	n, err := network()
+	if err != nil {
+		return err
+	}
+	return n.Remove(ctx, id, netnsPath(pid), gocni.WithCapabilityPortMap(portMappings(ports)))
+}
+
+func netnsPath(pid uint32) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mountNFS = "nfs"
+
+	// nfsMountDir is where NFS exports are mounted on the host before they
+	// are bound into containers.
+	nfsMountDir = "/mnt/nfs"
+)
+
+// nfsMountPath returns the host path export m.Source of m.Server is mounted
+// on. Containers mounting the same export share the mount, the options of
+// the first one to start apply.
+func nfsMountPath(m MountSpec) string {
+	return filepath.Join(nfsMountDir, m.Server, m.Source)
+}
+
+// mountNFSExport mounts the export of m on the host if it is not already.
+// Without a version option NFSv3 is used, which is all Filestore's basic
+// tiers support. There is no rpc.statd, so NFSv3 locks are local to the VM
+// unless the options say otherwise.
+func mountNFSExport(m MountSpec) error {
+	path := nfsMountPath(m)
+	mounted, err := isMountPoint(path)
+	if err != nil || mounted {
+		return err
+	}
+	ips, err := net.LookupIP(m.Server)
+	if err != nil {
+		return fmt.Errorf("error resolving NFS server %s: %v", m.Server, err)
+	}
+
+	// The kernel does not resolve the server itself.
+	opts := []string{"addr=" + ips[0].String()}
+	var flags uintptr
+	version, locking := "", false
+	for _, o := range m.Options {
+		switch {
+		case o == "ro":
+			flags |= unix.MS_RDONLY
+			continue
+		case o == "rw":
+			continue
+		case strings.HasPrefix(o, "vers=") || strings.HasPrefix(o, "nfsvers="):
+			version = o[strings.Index(o, "=")+1:]
+		case o == "lock" || o == "nolock" || strings.HasPrefix(o, "local_lock="):
+			locking = true
+		}
+		opts = append(opts, o)
+	}
+	if version == "" {
+		version = "3"
+		opts = append(opts, "vers=3")
+	}
+	if version == "3" && !locking {
+		opts = append(opts, "nolock")
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	source := m.Server + ":" + m.Source
+	if err := unix.Mount(source, path, "nfs", flags, strings.Join(opts, ",")); err != nil {
+		return fmt.Errorf("error mounting %s: %v", source, err)
+	}
+	logger.With("event", "mount").Infof("mounted %s on %s", source, path)
+	return nil
+}
+
+// readOnly reports whether the mount options include ro.
+func readOnly(options []string) bool {
+	for _, o := range options {
+		if o == "ro" {
+			return true
+		}
+	}
+	return false
+}
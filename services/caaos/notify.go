@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+// sdNotify sends a state such as READY=1 to the service manager, it does
+// nothing unless the agent was started by systemd with Type=notify.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// Names starting with @ are in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval set with WatchdogSec=, or 0 if the
+// watchdog is not enabled for the agent.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half its interval until ctx is
+// canceled. Each ping first builds the health report, so a hung agent
+// misses its pings and is restarted.
+func runWatchdog(ctx context.Context, client *containerd.Client) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logger.Info("pinging the systemd watchdog every", interval/2)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		agent.report(ctx, client)
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Error("Error pinging the systemd watchdog:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// specCacheFile holds the attributes of the last applied spec of a VM with
+// offline-fallback set, so that it can be run again if the metadata server
+// is unreachable at boot.
+const specCacheFile = "/var/lib/caaos/spec-cache.json"
+
+// cachedSpec is the content of specCacheFile.
+type cachedSpec struct {
+	Provider   string            `json:"provider"`
+	Time       time.Time         `json:"time"`
+	Attributes map[string]string `json:"attributes"`
+	Project    map[string]string `json:"project,omitempty"`
+}
+
+// cacheSpec records the attributes md was deployed from, or removes the
+// cache if md doesn't have offline-fallback set.
+func cacheSpec(provider string, md *attributesJSON) {
+	if !md.OfflineFallback {
+		if err := os.Remove(specCacheFile); err != nil && !os.IsNotExist(err) {
+			logger.Error("Error removing cached spec:", err)
+		}
+		return
+	}
+	cs := cachedSpec{Provider: provider, Time: time.Now().UTC(), Attributes: md.all}
+	if md.project != nil {
+		cs.Attributes, cs.Project = md.instance.all, md.project.all
+	}
+	b, err := json.Marshal(cs)
+	if err != nil {
+		logger.Error("Error encoding cached spec:", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(specCacheFile), 0755); err != nil {
+		logger.Error("Error caching spec:", err)
+		return
+	}
+	tmp := specCacheFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		logger.Error("Error caching spec:", err)
+		return
+	}
+	if err := os.Rename(tmp, specCacheFile); err != nil {
+		logger.Error("Error caching spec:", err)
+	}
+}
+
+// loadCachedSpec returns the cached spec, nil if there is none.
+func loadCachedSpec() (*cachedSpec, error) {
+	b, err := ioutil.ReadFile(specCacheFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cs cachedSpec
+	if err := json.Unmarshal(b, &cs); err != nil {
+		return nil, err
+	}
+	return &cs, nil
+}
+
+// attributes returns the attributes the cached spec was deployed from.
+func (cs *cachedSpec) attributes() (*attributesJSON, error) {
+	parse := func(all map[string]string) (*attributesJSON, error) {
+		b, err := json.Marshal(all)
+		if err != nil {
+			return nil, err
+		}
+		attr := &attributesJSON{all: all}
+		return attr, json.Unmarshal(b, attr)
+	}
+	attrs, err := parse(cs.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	if len(cs.Project) == 0 {
+		return attrs, nil
+	}
+	project, err := parse(cs.Project)
+	if err != nil {
+		return nil, err
+	}
+	return mergeProjectAttributes(attrs, project)
+}
+
+// offlineAttributes returns the cached attributes to run while the metadata
+// server is unreachable, nil if there are none.
+func offlineAttributes() *attributesJSON {
+	cs, err := loadCachedSpec()
+	if err != nil {
+		logger.Error("Error reading cached spec:", err)
+		return nil
+	}
+	if cs == nil {
+		return nil
+	}
+	md, err := cs.attributes()
+	if err != nil {
+		logger.Error("Error parsing cached spec:", err)
+		return nil
+	}
+	md.offline = true
+	logger.With("event", "offline-fallback").Warnf("Metadata server unreachable for %s, running the spec cached at %s until it responds", *offlineDelayFlag, cs.Time.Format(time.RFC3339))
+	return md
+}
+
+// offlineProvider returns the provider the cached spec was received from,
+// empty if there is no cached spec.
+func offlineProvider() string {
+	cs, err := loadCachedSpec()
+	if err != nil || cs == nil {
+		return ""
+	}
+	return cs.Provider
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+const (
+	onExitNone     = "none"
+	onExitPoweroff = "poweroff"
+	onExitReboot   = "reboot"
+	// onExitRunContainer is followed by the image of a container to run
+	// once, e.g. to clean up after the container.
+	onExitRunContainer = "run-container:"
+)
+
+// shutdownC receives the power action requested by a container's on-exit
+// policy, the agent stops all containers before carrying it out.
+var shutdownC = make(chan string, 1)
+
+func validateOnExit(s string) error {
+	switch {
+	case s == "", s == onExitNone, s == onExitPoweroff, s == onExitReboot:
+		return nil
+	case strings.HasPrefix(s, onExitRunContainer):
+		if strings.TrimPrefix(s, onExitRunContainer) == "" {
+			return fmt.Errorf("%q is missing an image", s)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown on-exit policy %q", s)
+}
+
+// runExitAction carries out an on-exit style action for c, a container run
+// by the action is named c's name plus suffix.
+func (r *runner) runExitAction(ctx context.Context, logger *Logger, c ContainerSpec, action, suffix string) {
+	switch {
+	case action == "", action == onExitNone:
+	case action == onExitPoweroff, action == onExitReboot:
+		logger.Infof("requesting %s", action)
+		select {
+		case shutdownC <- action:
+		default:
+		}
+	case strings.HasPrefix(action, onExitRunContainer):
+		hook := ContainerSpec{
+			Name:      c.Name + suffix,
+			Image:     strings.TrimPrefix(action, onExitRunContainer),
+			Env:       c.Env,
+			Namespace: c.Namespace,
+		}
+		hlogger := containerLogger(hook.Name)
+		hlogger.Info("running container for", c.Name)
+		code, err := r.runContainer(ctx, hlogger, hook)
+		if err != nil {
+			hlogger.Error("Error:", err)
+		} else if code != 0 {
+			hlogger.Errorf("Container exited with %d", code)
+		}
+	}
+}
+
+// powerAction syncs filesystems then powers off or reboots the VM.
+func powerAction(action string) error {
+	cmd := syscall.LINUX_REBOOT_CMD_POWER_OFF
+	if action == onExitReboot {
+		cmd = syscall.LINUX_REBOOT_CMD_RESTART
+	}
+	syscall.Sync()
+	return syscall.Reboot(cmd)
+}
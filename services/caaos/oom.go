@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/typeurl/v2"
+)
+
+var (
+	oomKills = expvar.NewMap("oom_kills")
+
+	errOOMKilled = errors.New("container was OOM killed")
+)
+
+// oomMonitor receives containerd's OOM events and passes them on to the
+// container they are for.
+type oomMonitor struct {
+	mx   sync.Mutex
+	subs map[string]chan struct{}
+}
+
+var ooms = &oomMonitor{subs: map[string]chan struct{}{}}
+
+// run receives OOM events until ctx is canceled, resubscribing if the
+// connection to containerd is lost.
+func (m *oomMonitor) run(ctx context.Context, client *containerd.Client) {
+	for {
+		evC, errC := client.Subscribe(ctx, `topic=="/tasks/oom"`)
+		m.receive(ctx, evC, errC)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (m *oomMonitor) receive(ctx context.Context, evC <-chan *events.Envelope, errC <-chan error) {
+	for {
+		select {
+		case env := <-evC:
+			v, err := typeurl.UnmarshalAny(env.Event)
+			if err != nil {
+				logger.Error("Error decoding OOM event:", err)
+				continue
+			}
+			if e, ok := v.(*apievents.TaskOOM); ok {
+				m.notify(e.ContainerID)
+			}
+		case err := <-errC:
+			if err != nil && ctx.Err() == nil {
+				logger.Error("Error receiving containerd events:", err)
+			}
+			return
+		}
+	}
+}
+
+// subscribe returns a channel that receives the OOM events of container id
+// and a function to unsubscribe.
+func (m *oomMonitor) subscribe(id string) (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.subs[id] = c
+	return c, func() {
+		m.mx.Lock()
+		defer m.mx.Unlock()
+		delete(m.subs, id)
+	}
+}
+
+func (m *oomMonitor) notify(id string) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if c, ok := m.subs[id]; ok {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// oomKilled records an OOM kill in the container's status.
+func (r *runner) oomKilled(ctx context.Context, logger *Logger, st *containerStatus) {
+	logger.With("event", "oom").Error("container was OOM killed")
+	oomKills.Add(st.Name, 1)
+	r.environment().lifecycle.publish(lifecycleEvent{Type: eventOOM, Container: st.Name, ID: st.ID, Image: st.Image, Digest: st.Digest})
+	st.OOMKilled = true
+	st.Error = errOOMKilled.Error()
+	st.publish(ctx, logger)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// Labels set on each container so that a restarted agent can tell which
+// spec it belongs to.
+const (
+	labelName     = "caaos/name"
+	labelSpecHash = "caaos/spec-hash"
+	labelDigest   = "caaos/digest"
+	labelHost     = "caaos/host"
+)
+
+// previousContainers returns the containers in the namespace, which on
+// startup were all left by a previous agent, keyed by ID. The state file
+// is used where it has an entry and the labels otherwise.
+func previousContainers(ctx context.Context, client *containerd.Client) (map[string]persistedContainer, error) {
+	cs, err := client.Containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	m := map[string]persistedContainer{}
+	for _, c := range cs {
+		if pc, ok := persisted.container(c.ID()); ok {
+			pc.Namespace = ns
+			m[c.ID()] = pc
+			continue
+		}
+		info, err := c.Info(ctx)
+		if err != nil {
+			return nil, err
+		}
+		host := info.Labels[labelHost]
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		m[c.ID()] = persistedContainer{
+			Name:      info.Labels[labelName],
+			Namespace: ns,
+			SpecHash:  info.Labels[labelSpecHash],
+			Digest:    info.Labels[labelDigest],
+			Host:      host,
+			StartTime: info.CreatedAt,
+		}
+	}
+	return m, nil
+}
+
+// adoptOrRemove returns the containers left by a previous agent in the
+// namespaces of spec, or of the state file, that were started from a spec
+// with one of the given hashes, the others are removed.
+func adoptOrRemove(ctx context.Context, client *containerd.Client, hashes []string, spec *Spec) *adoptSet {
+	wanted := map[string]bool{}
+	for _, h := range hashes {
+		wanted[h] = true
+	}
+	nss := map[string]bool{}
+	for _, ns := range append(specNamespaces(spec), persisted.namespaces()...) {
+		nss[ns] = true
+	}
+	adopt := map[string]persistedContainer{}
+	named := map[string]bool{}
+	stale := map[string]persistedContainer{}
+	for ns := range nss {
+		prev, err := previousContainers(namespaces.WithNamespace(ctx, ns), client)
+		if err != nil {
+			logger.Errorf("Error listing containers from a previous run in namespace %s: %v", ns, err)
+			continue
+		}
+		for id, pc := range prev {
+			if pc.Name == "" || !wanted[pc.SpecHash] || named[pc.Name] {
+				stale[id] = pc
+				continue
+			}
+			named[pc.Name] = true
+			adopt[id] = pc
+		}
+	}
+	removeStale(ctx, client, stale)
+	return newAdoptSet(adopt)
+}
+
+// removeStale removes containers, with their tasks and snapshots, that are
+// no longer wanted. Each is looked up in its recorded namespace, or that of
+// ctx.
+func removeStale(ctx context.Context, client *containerd.Client, stale map[string]persistedContainer) {
+	for id, pc := range stale {
+		persisted.removeContainer(id)
+		os.RemoveAll(filepath.Join(secretsDir, id))
+		ctx := ctx
+		if pc.Namespace != "" {
+			ctx = namespaces.WithNamespace(ctx, pc.Namespace)
+		}
+		container, err := client.LoadContainer(ctx, id)
+		if err != nil {
+			logger.Errorf("Error loading stale container %s: %v", id, err)
+			continue
+		}
+		if err := removeContainer(ctx, container); err != nil {
+			logger.Errorf("Error removing stale container %s: %v", id, err)
+			continue
+		}
+		logger.Info("Removed stale container", id)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+const (
+	policyEnforce = "enforce"
+	policyAudit   = "audit"
+
+	maxPolicySize = 1 << 20
+)
+
+// imagePolicy decides which images may be run, it is the image-policy
+// attribute or is fetched from image-policy-url.
+type imagePolicy struct {
+	// AllowedRegistries lists the registries, or registry/repository
+	// prefixes such as us-docker.pkg.dev/my-project, images may come from.
+	// Empty allows any registry.
+	AllowedRegistries []string `json:"allowed-registries"`
+	// DeniedTags lists tags that may not be run, e.g. latest.
+	DeniedTags []string `json:"denied-tags"`
+	// RequireDigest requires images to be pinned with a digest.
+	RequireDigest bool `json:"require-digest"`
+	// RequireSignature requires image-signature-policy to be set so that
+	// every image's signature is verified.
+	RequireSignature bool `json:"require-signature"`
+
+	// mode is enforce, the default, or audit which only logs denials.
+	mode string
+}
+
+// parseImagePolicy returns the policy from the image-policy attribute, or
+// fetched from image-policy-url, and the policy-mode attribute. No policy
+// returns nil.
+func parseImagePolicy(ctx context.Context, md *attributesJSON) (*imagePolicy, error) {
+	mode := md.PolicyMode
+	switch mode {
+	case "":
+		mode = policyEnforce
+	case policyEnforce, policyAudit:
+	default:
+		return nil, fmt.Errorf("unknown policy-mode %q", md.PolicyMode)
+	}
+	raw := []byte(md.ImagePolicy)
+	if md.ImagePolicyURL != "" {
+		if len(raw) > 0 {
+			return nil, errors.New("only one of image-policy and image-policy-url may be set")
+		}
+		var err error
+		if raw, err = fetchPolicy(ctx, md.ImagePolicyURL); err != nil {
+			return nil, fmt.Errorf("error fetching image policy: %v", err)
+		}
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	p := &imagePolicy{mode: mode}
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, fmt.Errorf("error parsing image policy: %v", err)
+	}
+	return p, nil
+}
+
+// fetchPolicy gets the policy from a policy service, Google APIs are sent
+// the service account token.
+func fetchPolicy(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(url, "https://") && strings.Contains(url, ".googleapis.com/") {
+		tok, err := saToken.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxPolicySize})
+}
+
+// violations returns the reasons image is not allowed by p. signed is
+// whether the image's signature will be verified.
+func (p *imagePolicy) violations(image, dgst string, signed bool) []string {
+	var reasons []string
+	if isArchiveImage(image) {
+		if len(p.AllowedRegistries) > 0 {
+			reasons = append(reasons, "image archives are not from an allowed registry")
+		}
+		if p.RequireDigest && dgst == "" {
+			reasons = append(reasons, "image is not pinned by digest")
+		}
+		if p.RequireSignature {
+			reasons = append(reasons, "signatures of image archives can't be verified")
+		}
+		return reasons
+	}
+	ref, _ := imageRef(image)
+	named, err := reference.ParseDockerRef(ref)
+	if err != nil {
+		return []string{fmt.Sprintf("invalid image reference: %v", err)}
+	}
+	if len(p.AllowedRegistries) > 0 {
+		name := named.Name()
+		allowed := false
+		for _, a := range p.AllowedRegistries {
+			a = strings.TrimSuffix(a, "/")
+			if name == a || strings.HasPrefix(name, a+"/") {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			reasons = append(reasons, fmt.Sprintf("registry %s is not allowed", reference.Domain(named)))
+		}
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		for _, t := range p.DeniedTags {
+			if tagged.Tag() == t {
+				reasons = append(reasons, fmt.Sprintf("tag %q is denied", t))
+			}
+		}
+	}
+	if _, ok := named.(reference.Digested); p.RequireDigest && !ok && dgst == "" {
+		reasons = append(reasons, "image is not pinned by digest")
+	}
+	if p.RequireSignature && !signed {
+		reasons = append(reasons, "signature verification is required but image-signature-policy is not set")
+	}
+	return reasons
+}
+
+// evaluate returns an error if the container's image is denied by p, in
+// audit mode denials are only logged. Every decision is logged.
+func (p *imagePolicy) evaluate(logger *Logger, c ContainerSpec, signed bool) error {
+	if p == nil {
+		return nil
+	}
+	reasons := p.violations(c.Image, c.Digest, signed)
+	decision := "allow"
+	if len(reasons) > 0 {
+		decision = "deny"
+	}
+	logger = logger.With("event", "policy", "decision", decision, "mode", p.mode, "reasons", reasons)
+	if len(reasons) == 0 {
+		logger.Infof("image policy allows %s", c.Image)
+		return nil
+	}
+	if p.mode == policyAudit {
+		logger.Warnf("image policy would deny %s: %s", c.Image, strings.Join(reasons, "; "))
+		return nil
+	}
+	return fmt.Errorf("image %s denied by policy: %s", c.Image, strings.Join(reasons, "; "))
+}
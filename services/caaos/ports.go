@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+const iptables = "/bin/iptables"
+
+// publishedPort is a port a container listens on as seen from the host.
+type publishedPort struct {
+	Container string `json:"container"`
+	Port      int    `json:"port"`
+	HostPort  int    `json:"host-port"`
+	Protocol  string `json:"protocol"`
+	Network   string `json:"network"`
+}
+
+// publishedPorts returns the ports each container exposes on the host.
+// Sidecars share the network namespace of their container.
+func (spec *Spec) publishedPorts() []publishedPort {
+	var out []publishedPort
+	add := func(name, network string, ports []PortSpec) {
+		if network == "" {
+			network = networkHost
+		}
+		for _, p := range ports {
+			pp := publishedPort{Container: name, Port: p.Port, HostPort: p.Port, Protocol: p.Protocol, Network: network}
+			if network == networkBridge && p.HostPort != 0 {
+				pp.HostPort = p.HostPort
+			}
+			if pp.Protocol == "" {
+				pp.Protocol = "tcp"
+			}
+			out = append(out, pp)
+		}
+	}
+	for _, c := range spec.Containers {
+		add(c.Name, c.Network, c.Ports)
+		for _, sc := range c.Sidecars {
+			add(sc.Name, c.Network, sc.Ports)
+		}
+	}
+	return out
+}
+
+// validatePorts reports host ports claimed by more than one container.
+func validatePorts(verr *validationError, spec *Spec) {
+	seen := map[string]string{}
+	for _, p := range spec.publishedPorts() {
+		key := fmt.Sprintf("%d/%s", p.HostPort, p.Protocol)
+		if other, ok := seen[key]; ok {
+			verr.add("ports: %s is used by both %q and %q", key, other, p.Container)
+			continue
+		}
+		seen[key] = p.Container
+	}
+}
+
+// publishPorts writes the port mapping to the guest attribute caaos/ports so
+// other tools can discover what the instance is listening on.
+func publishPorts(ctx context.Context, spec *Spec) {
+	b, err := json.Marshal(spec.publishedPorts())
+	if err != nil {
+		logger.Error("Error encoding ports:", err)
+		return
+	}
+	if err := setGuestAttribute(ctx, "ports", string(b)); err != nil {
+		logger.Error("Error publishing ports:", err)
+	}
+}
+
+// openFirewall opens the container's ports that have Firewall set and its
+// host-ports in the host firewall, the returned function closes them again.
+func openFirewall(ctx context.Context, logger *Logger, c ContainerSpec) func() {
+	var open []hostPort
+	for _, p := range c.Ports {
+		if !p.Firewall {
+			continue
+		}
+		port := p.Port
+		if c.Network == networkBridge && p.HostPort != 0 {
+			port = p.HostPort
+		}
+		proto := p.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		open = append(open, hostPort{first: port, last: port, proto: proto})
+	}
+	for _, s := range c.HostPorts {
+		// Already validated.
+		if p, err := parseHostPort(s); err == nil {
+			open = append(open, p)
+		}
+	}
+	if len(open) == 0 {
+		return func() {}
+	}
+	fw, err := hostFirewall()
+	if err != nil {
+		logger.Error("Error opening firewall:", err)
+		return func() {}
+	}
+	var closers []func() error
+	for _, p := range open {
+		closeFn, err := fw.open(ctx, p, "caaos "+c.Name)
+		if err != nil {
+			logger.Errorf("Error opening firewall for %s: %v", p, err)
+			continue
+		}
+		closers = append(closers, closeFn)
+	}
+	return func() {
+		for _, closeFn := range closers {
+			if err := closeFn(); err != nil {
+				logger.Error("Error closing firewall:", err)
+			}
+		}
+	}
+}
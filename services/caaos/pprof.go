@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sort"
+	"time"
+)
+
+const (
+	profileDir           = "/var/lib/caaos/profiles"
+	profileCheckInterval = time.Minute
+	// minProfileInterval limits how often profiles are written while memory
+	// stays over the threshold.
+	minProfileInterval = 10 * time.Minute
+	maxProfileSets     = 10
+)
+
+// handlePprof registers the agent's net/http/pprof endpoints on mux.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// servePprof serves the pprof endpoints on addr, which should be a
+// localhost address. They are always served on the control socket.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	handlePprof(mux)
+	logger.Info("serving pprof on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("Error serving pprof on %s: %v", addr, err)
+	}
+}
+
+// profileOnHighMemory writes goroutine and heap profiles to profileDir
+// while the agent's memory use exceeds threshold bytes, so that leaks in
+// long running agents can be debugged afterwards.
+func profileOnHighMemory(ctx context.Context, threshold uint64) {
+	var last time.Time
+	ticker := time.NewTicker(profileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if ms.Sys < threshold || time.Since(last) < minProfileInterval {
+			continue
+		}
+		last = time.Now()
+		logger.Warnf("Agent memory use %d MiB is over the %d MiB threshold, writing profiles", ms.Sys>>20, threshold>>20)
+		if err := writeProfiles(last); err != nil {
+			logger.Error("Error writing profiles:", err)
+		}
+	}
+}
+
+func writeProfiles(t time.Time) error {
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+	stamp := t.UTC().Format("20060102T150405Z")
+	for _, name := range []string{"goroutine", "heap"} {
+		p := filepath.Join(profileDir, fmt.Sprintf("%s-%s.pprof", stamp, name))
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		err = rpprof.Lookup(name).WriteTo(f, 0)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return pruneProfiles()
+}
+
+// pruneProfiles keeps the newest maxProfileSets sets of profiles.
+func pruneProfiles() error {
+	files, err := filepath.Glob(filepath.Join(profileDir, "*.pprof"))
+	if err != nil {
+		return err
+	}
+	// Names start with the time so they sort oldest first.
+	sort.Strings(files)
+	if keep := maxProfileSets * 2; len(files) > keep {
+		for _, f := range files[:len(files)-keep] {
+			os.Remove(f)
+		}
+	}
+	return nil
+}
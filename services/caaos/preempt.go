@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	preemptedPath        = "instance/preempted"
+	maintenanceEventPath = "instance/maintenance-event"
+
+	// preemptGracePeriod caps the shutdown grace period once a preemption
+	// notice arrives so that containers stop, logs are flushed and status
+	// is published within the 30 second preemption window.
+	preemptGracePeriod = 20 * time.Second
+
+	statePreempted = "preempted"
+)
+
+// preempting is set once the instance is being preempted or terminated for
+// maintenance.
+var preempting int32
+
+func isPreempting() bool {
+	return atomic.LoadInt32(&preempting) == 1
+}
+
+// watchPath calls fn with the value at path every time it changes until ctx
+// is canceled.
+func watchPath(ctx context.Context, path string, fn func(string)) {
+	etag := defaultEtag
+	for {
+		v, newEtag, err := waitMetadata(ctx, path, etag)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorf("Error watching %s: %v", path, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if newEtag != etag {
+			fn(v)
+		}
+		etag = newEtag
+	}
+}
+
+// watchPreemption watches for GCE preemption and maintenance events and
+// calls stop once the instance is about to be stopped.
+func watchPreemption(ctx context.Context, stop func()) {
+	notify := func() {
+		if atomic.CompareAndSwapInt32(&preempting, 0, 1) {
+			stop()
+		}
+	}
+	go watchPath(ctx, preemptedPath, func(v string) {
+		if v == "TRUE" {
+			logger.With("event", "preempted").Warn("Instance is being preempted, stopping containers")
+			notify()
+		}
+	})
+	watchPath(ctx, maintenanceEventPath, func(v string) {
+		logger.With("event", "maintenance").Info("Maintenance event:", v)
+		if err := setGuestAttribute(ctx, "maintenance-event", v); err != nil {
+			logger.Error("Error publishing maintenance event:", err)
+		}
+		if v == "TERMINATE_ON_HOST_MAINTENANCE" {
+			logger.With("event", "maintenance").Warn("Instance is being terminated for maintenance, stopping containers")
+			notify()
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/containerd/containerd"
+)
+
+// prefetcher pulls the images listed in the prefetch-images attribute in
+// the background so that they are present before a spec references them.
+type prefetcher struct {
+	client *containerd.Client
+
+	mx     sync.Mutex
+	images string
+	cancel context.CancelFunc
+}
+
+func newPrefetcher(client *containerd.Client) *prefetcher {
+	return &prefetcher{client: client}
+}
+
+// parseImageList splits a comma or whitespace separated list of images.
+func parseImageList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+// configure starts pulling images with the registry credentials and
+// snapshotter from md, any prefetch of a previous list is canceled.
+func (p *prefetcher) configure(ctx context.Context, md *attributesJSON) {
+	images := parseImageList(md.PrefetchImages)
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	key := strings.Join(images, ",")
+	if key == p.images {
+		return
+	}
+	p.images = key
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	if len(images) == 0 {
+		return
+	}
+
+	creds, err := parseRegistryAuth(md.RegistryAuth)
+	if err != nil {
+		logger.Error("Error reading registry credentials, not prefetching images:", err)
+		return
+	}
+	registries, err := parseRegistryConfig(md)
+	if err != nil {
+		logger.Error("Error reading registry configuration, not prefetching images:", err)
+		return
+	}
+	ctx, p.cancel = context.WithCancel(ctx)
+	r := &runner{
+		client:          p.client,
+		resolver:        newResolver(ctx, creds, registries),
+		pullConcurrency: md.PullConcurrency,
+		snapshotter:     resolveSnapshotter(ctx, p.client, md.snapshotter()),
+	}
+	go r.prefetch(ctx, images)
+}
+
+// prefetch pulls each image that is not already present, one at a time.
+func (r *runner) prefetch(ctx context.Context, images []string) {
+	logger := logger.With("event", "prefetch")
+	for _, ref := range images {
+		if _, ok := imageRef(ref); ok || isArchiveImage(ref) {
+			continue
+		}
+		if img, err := r.imagePuller().Image(ctx, ref, ""); err == nil {
+			if err := unpack(ctx, img, r.snapshotter); err == nil {
+				logger.Debug("image already present", ref)
+				continue
+			}
+		}
+		if _, err := r.pullWithRetry(ctx, logger, ref, ""); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Errorf("Error prefetching %s: %v", ref, err)
+			continue
+		}
+		logger.Info("prefetched image", ref)
+	}
+}
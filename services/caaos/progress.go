@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultMaxConcurrentDownloads = 4
+	pullProgressInterval          = 10 * time.Second
+)
+
+var (
+	pullsTotal    = expvar.NewInt("pulls_total")
+	pullBytes     = expvar.NewInt("pull_bytes")
+	pullDurations = expvar.NewMap("pull_duration_seconds")
+)
+
+// pullProgress tracks the layers of an image being pulled so that progress
+// can be logged.
+type pullProgress struct {
+	mx     sync.Mutex
+	layers map[digest.Digest]int64
+}
+
+func newPullProgress() *pullProgress {
+	return &pullProgress{layers: map[digest.Digest]int64{}}
+}
+
+// handler records each layer as the image's manifests are walked.
+func (p *pullProgress) handler() images.Handler {
+	return images.HandlerFunc(func(_ context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsLayerType(desc.MediaType) {
+			p.mx.Lock()
+			p.layers[desc.Digest] = desc.Size
+			p.mx.Unlock()
+		}
+		return nil, nil
+	})
+}
+
+// status returns the number of layers downloaded and the bytes downloaded
+// so far, along with the totals.
+func (p *pullProgress) status(ctx context.Context, cs content.Store) (layers, totalLayers int, bytes, totalBytes int64) {
+	active := map[digest.Digest]int64{}
+	if statuses, err := cs.ListStatuses(ctx); err == nil {
+		for _, st := range statuses {
+			active[st.Expected] = st.Offset
+		}
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for dgst, size := range p.layers {
+		totalLayers++
+		totalBytes += size
+		if offset, ok := active[dgst]; ok {
+			bytes += offset
+			continue
+		}
+		if _, err := cs.Info(ctx, dgst); err == nil {
+			layers++
+			bytes += size
+		}
+	}
+	return layers, totalLayers, bytes, totalBytes
+}
+
+// report logs progress every pullProgressInterval until ctx is canceled.
+func (p *pullProgress) report(ctx context.Context, logger *Logger, cs content.Store, ref string) {
+	start := time.Now()
+	ticker := time.NewTicker(pullProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		layers, totalLayers, bytes, totalBytes := p.status(ctx, cs)
+		if totalLayers == 0 {
+			continue
+		}
+		elapsed := time.Since(start)
+		eta := "unknown"
+		if bytes > 0 {
+			rate := float64(bytes) / elapsed.Seconds()
+			eta = time.Duration(float64(totalBytes-bytes) / rate * float64(time.Second)).Round(time.Second).String()
+		}
+		logger.With("event", "pull-progress", "bytes", bytes, "total_bytes", totalBytes).
+			Infof("pulling %s: %d/%d layers, %d/%d MiB, ETA %s", ref, layers, totalLayers, bytes>>20, totalBytes>>20, eta)
+	}
+}
+
+// pulled records the metrics for a completed pull.
+func (p *pullProgress) pulled(ref string, d time.Duration) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	var total int64
+	for _, size := range p.layers {
+		total += size
+	}
+	pullsTotal.Add(1)
+	pullBytes.Add(total)
+	f := new(expvar.Float)
+	f.Set(d.Seconds())
+	pullDurations.Set(ref, f)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// noProxyAlways lists the metadata servers and loopback addresses, which
+// are never reached through a proxy.
+var noProxyAlways = []string{"169.254.169.254", "fd00:ec2::254", "fd20:ce::254", "metadata.google.internal", "metadata", "localhost", "127.0.0.1", "::1"}
+
+// proxyConfig is the proxy used for all outbound HTTP the agent does,
+// including image pulls. It starts from the http_proxy, https_proxy and
+// no_proxy environment variables and is replaced by the http-proxy,
+// https-proxy and no-proxy attributes when any is set.
+type proxyConfig struct {
+	mx  sync.Mutex
+	cfg httpproxy.Config
+	fn  func(*url.URL) (*url.URL, error)
+}
+
+var proxy = &proxyConfig{}
+
+// installProxy makes the default transport, used by every client the agent
+// creates, use proxy.
+func installProxy() {
+	proxy.configure("", "", "")
+	http.DefaultTransport.(*http.Transport).Proxy = proxy.proxyURL
+}
+
+func (p *proxyConfig) configure(httpProxy, httpsProxy, noProxy string) {
+	cfg := httpproxy.FromEnvironment()
+	if httpProxy != "" || httpsProxy != "" || noProxy != "" {
+		cfg = &httpproxy.Config{HTTPProxy: httpProxy, HTTPSProxy: httpsProxy, NoProxy: noProxy}
+	}
+	cfg.NoProxy = strings.Join(append([]string{cfg.NoProxy}, noProxyAlways...), ",")
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if *cfg == p.cfg {
+		return
+	}
+	if cfg.HTTPProxy != "" || cfg.HTTPSProxy != "" {
+		logger.Infof("Using HTTP proxy %q, HTTPS proxy %q, no proxy for %q", cfg.HTTPProxy, cfg.HTTPSProxy, cfg.NoProxy)
+	}
+	p.cfg = *cfg
+	p.fn = cfg.ProxyFunc()
+}
+
+func (p *proxyConfig) proxyURL(req *http.Request) (*url.URL, error) {
+	p.mx.Lock()
+	fn := p.fn
+	p.mx.Unlock()
+	return fn(req.URL)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	pullAlways       = "always"
+	pullIfNotPresent = "ifnotpresent"
+	pullNever        = "never"
+
+	// localImagePrefix marks an image that was imported into the image
+	// store when the VM image was built, e.g. local:docker.io/library/nginx:1.25,
+	// it is never pulled.
+	localImagePrefix = "local:"
+
+	defaultPullDeadline = 10 * time.Minute
+	initialPullBackoff  = 2 * time.Second
+	maxPullBackoff      = 1 * time.Minute
+)
+
+// parsePullPolicy parses a pull policy, matching is case insensitive so
+// that the Kubernetes spellings (Always, IfNotPresent, Never) work. An empty
+// policy is the same as "always".
+func parsePullPolicy(s string) (string, error) {
+	p := strings.ToLower(s)
+	switch p {
+	case "":
+		return pullAlways, nil
+	case pullAlways, pullIfNotPresent, pullNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown pull policy %q", s)
+}
+
+// imageRef returns the name of image in the image store and whether it is a
+// preloaded image.
+func imageRef(image string) (string, bool) {
+	if strings.HasPrefix(image, localImagePrefix) {
+		return strings.TrimPrefix(image, localImagePrefix), true
+	}
+	return image, false
+}
+
+// getImage returns the image for the container, pulling it according to the
+// container's pull policy. Preloaded images are never pulled, image archives
+// are downloaded and imported.
+func (r *runner) getImage(ctx context.Context, logger *Logger, c ContainerSpec) (containerd.Image, error) {
+	if ref, ok := imageRef(c.Image); ok {
+		img, err := r.localImage(ctx, ref, c.Platform)
+		if errdefs.IsNotFound(err) {
+			return nil, fmt.Errorf("preloaded image %s is not in the image store", ref)
+		}
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("using preloaded image", ref)
+		return img, unpack(ctx, img, r.snapshotter)
+	}
+
+	policy, err := parsePullPolicy(c.PullPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy != pullAlways {
+		img, err := r.localImage(ctx, c.Image, c.Platform)
+		switch {
+		case err == nil:
+			logger.Info("using local image", c.Image)
+			return img, unpack(ctx, img, r.snapshotter)
+		case !errdefs.IsNotFound(err):
+			return nil, err
+		case policy == pullNever:
+			return nil, fmt.Errorf("image %s is not present and pull policy is never", c.Image)
+		}
+	}
+
+	r.environment().lifecycle.publish(lifecycleEvent{Type: eventPulling, Container: c.Name, Image: c.Image})
+	if isArchiveImage(c.Image) {
+		return r.importArchive(ctx, logger, c)
+	}
+	return r.pullWithRetry(ctx, logger, c.Image, c.Platform)
+}
+
+// localImage returns the image from the image store. For multi-arch images
+// the variant for platform is used, or the host's if platform is empty.
+func (r *runner) localImage(ctx context.Context, ref, platform string) (containerd.Image, error) {
+	return r.imagePuller().Image(ctx, ref, platform)
+}
+
+// pullWithRetry pulls the image, retrying with jittered exponential backoff
+// until the pull deadline, unless the error is permanent. A lease is held across attempts so content that
+// was already downloaded is kept and not fetched again. For multi-arch
+// images the variant for platform is pulled, or the host's if it is empty.
+func (r *runner) pullWithRetry(ctx context.Context, logger *Logger, ref, platform string) (_ containerd.Image, err error) {
+	deadline := r.pullDeadline
+	if deadline == 0 {
+		deadline = defaultPullDeadline
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	images := r.imagePuller()
+	ctx, done, err := images.WithLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done(detach(ctx))
+
+	concurrency := r.pullConcurrency
+	if concurrency == 0 {
+		concurrency = defaultMaxConcurrentDownloads
+	}
+	progress := newPullProgress()
+	pctx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go progress.report(pctx, logger, images.ContentStore(), ref)
+	start := time.Now()
+	var platformOpts []containerd.RemoteOpt
+	if platform != "" {
+		platformOpts = append(platformOpts, containerd.WithPlatform(platform))
+	} else {
+		platform = platforms.DefaultString()
+	}
+	ctx, span := startSpan(ctx, "image.pull", attribute.String("image", ref), attribute.String("platform", platform))
+	defer func() { endSpan(span, err) }()
+
+	backoff := initialPullBackoff
+	for attempt := 1; ; attempt++ {
+		logger.Infof("pulling image %s for %s (attempt %d)", ref, platform, attempt)
+		// Layers are unpacked as they finish downloading.
+		opts := append([]containerd.RemoteOpt{
+			containerd.WithPullUnpack,
+			containerd.WithResolver(r.resolver),
+			containerd.WithMaxConcurrentDownloads(concurrency),
+			containerd.WithImageHandler(progress.handler()),
+		}, pullSnapshotterOpts(r.snapshotter, ref)...)
+		opts = append(opts, platformOpts...)
+		img, err := images.Pull(ctx, ref, opts...)
+		if err == nil {
+			d := time.Since(start)
+			progress.pulled(ref, d)
+			span.SetAttributes(attribute.Int("attempts", attempt))
+			logger.With("event", "pulled", "duration_seconds", d.Seconds()).Infof("pulled image %s in %s", ref, d.Round(time.Millisecond))
+			return img, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("error pulling %s, giving up after %d attempts: %v", ref, attempt, err)
+		}
+		if permanentPullError(err) {
+			return nil, fmt.Errorf("error pulling %s: %v", ref, err)
+		}
+
+		// Full jitter, sleep a random duration up to backoff.
+		sleep := time.Duration(rand.Int63n(int64(backoff)))
+		logger.Warnf("Error pulling %s: %v, retrying in %s", ref, err, sleep)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error pulling %s, giving up after %d attempts: %v", ref, attempt, err)
+		case <-time.After(sleep):
+		}
+		backoff *= 2
+		if backoff > maxPullBackoff {
+			backoff = maxPullBackoff
+		}
+	}
+}
+
+// permanentPullError reports whether retrying a pull that failed with err
+// is pointless: the image does not exist, access to it is denied or its
+// reference is invalid.
+func permanentPullError(err error) bool {
+	return errdefs.IsNotFound(err) || errdefs.IsInvalidArgument(err) || errdefs.IsUnauthorized(err) || errdefs.IsPermissionDenied(err) ||
+		errors.Is(err, docker.ErrInvalidAuthorization) || errors.Is(err, reference.ErrInvalid) ||
+		errors.Is(err, reference.ErrObjectRequired) || errors.Is(err, reference.ErrHostnameRequired)
+}
+
+// unpack makes sure a local image is unpacked into snapshotter.
+func unpack(ctx context.Context, img containerd.Image, snapshotter string) error {
+	unpacked, err := img.IsUnpacked(ctx, snapshotter)
+	if err != nil || unpacked {
+		return err
+	}
+	return img.Unpack(ctx, snapshotter)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+// diskCheckInterval is how often the writable layer of containers with a
+// disk limit is measured.
+const diskCheckInterval = 30 * time.Second
+
+var (
+	diskQuotaKills = expvar.NewMap("disk_quota_kills")
+
+	errDiskQuota = errors.New("container exceeded its disk limit")
+)
+
+// watchDisk measures the container's writable layer every
+// diskCheckInterval until ctx is canceled, and closes the returned channel
+// once it is larger than limit bytes.
+func (r *runner) watchDisk(ctx context.Context, logger *Logger, container containerd.Container, limit int64) <-chan struct{} {
+	exceeded := make(chan struct{})
+	if limit <= 0 {
+		return exceeded
+	}
+	go func() {
+		info, err := container.Info(ctx)
+		if err != nil {
+			logger.Error("Error reading container, disk limit is not enforced:", err)
+			return
+		}
+		sn := r.client.SnapshotService(info.Snapshotter)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(diskCheckInterval):
+			}
+			u, err := sn.Usage(ctx, info.SnapshotKey)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Warn("Error measuring writable layer:", err)
+				}
+				continue
+			}
+			if u.Size > limit {
+				logger.With("event", "disk-quota", "bytes", u.Size, "limit", limit).Errorf("writable layer uses %d bytes, over the limit of %d", u.Size, limit)
+				close(exceeded)
+				return
+			}
+		}
+	}()
+	return exceeded
+}
+
+// diskQuotaExceeded records a container stopped for exceeding its disk
+// limit in its status.
+func diskQuotaExceeded(st *containerStatus) {
+	diskQuotaKills.Add(st.Name, 1)
+	st.Error = errDiskQuota.Error()
+}
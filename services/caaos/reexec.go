@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reexecC is sent to, by SIGUSR2 or a self-update, to restart the agent in
+// place without stopping its containers.
+var reexecC = make(chan struct{}, 1)
+
+// errHandoff is returned for containers left running for a new agent.
+var errHandoff = errors.New("container handed off to a new agent")
+
+// handoff is set once the agent is handing its containers over to a new
+// agent process. Supervisors then return without stopping their containers
+// and leave them in the state file for the new process to reattach to.
+var handoff int32
+
+func handingOff() bool {
+	return atomic.LoadInt32(&handoff) == 1
+}
+
+// beginHandoff marks the agent as handing off its containers.
+func beginHandoff() {
+	atomic.StoreInt32(&handoff, 1)
+}
+
+// requestReexec asks the main loop to reexec the agent.
+func requestReexec() {
+	select {
+	case reexecC <- struct{}{}:
+	default:
+	}
+}
+
+// handoffState is recorded in the state file before the agent reexecs. A
+// new agent version may hash the same spec differently, so containers
+// started from the old hash are also adopted as long as the metadata is
+// unchanged.
+type handoffState struct {
+	SpecHash     string    `json:"spec-hash"`
+	MetadataHash string    `json:"metadata-hash"`
+	Time         time.Time `json:"time"`
+}
+
+func (s *stateStore) setHandoff(h *handoffState) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.st.Handoff = h
+	s.save()
+}
+
+// takeHandoff returns and clears the handoff left by a previous agent.
+func (s *stateStore) takeHandoff() *handoffState {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	h := s.st.Handoff
+	if h != nil {
+		s.st.Handoff = nil
+		s.save()
+	}
+	return h
+}
+
+// metadataHash returns a hash of the raw attributes md was parsed from.
+func metadataHash(md *attributesJSON) string {
+	all := []map[string]string{md.all}
+	if md.project != nil {
+		all = append(all, md.project.all)
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// adoptableHashes returns the spec hashes of containers a new agent may
+// reattach to for the spec with hash, deployed from md.
+func adoptableHashes(hash string, md *attributesJSON) []string {
+	hashes := []string{hash}
+	if h := persisted.takeHandoff(); h != nil && h.MetadataHash == metadataHash(md) {
+		hashes = append(hashes, h.SpecHash)
+	}
+	return hashes
+}
+
+// reexec replaces the agent with the binary at its path, which may have
+// just been updated, keeping the PID and arguments. It only returns on
+// error.
+func reexec() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logger.With("event", "reexec").Info("restarting agent", exe)
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pubsubURL = "https://pubsub.googleapis.com/v1/"
+	// webhookSignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the
+	// request body keyed with the webhook secret.
+	webhookSignatureHeader = "X-Caaos-Signature"
+	maxWebhookBody         = 64 << 10
+)
+
+// refreshC asks the metadata provider to get the attributes now instead of
+// waiting for a change or the next poll.
+var refreshC = make(chan struct{}, 1)
+
+func requestRefresh(source string) {
+	logger.Info("Metadata refresh requested by", source)
+	select {
+	case refreshC <- struct{}{}:
+	default:
+	}
+}
+
+// waitOrRefresh calls wait, returning nil early if a refresh is requested.
+func waitOrRefresh(ctx context.Context, wait func(context.Context) error) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	refreshed := make(chan struct{})
+	go func() {
+		select {
+		case <-refreshC:
+			close(refreshed)
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+	err := wait(wctx)
+	select {
+	case <-refreshed:
+		return nil
+	default:
+	}
+	return err
+}
+
+// refresher requests refreshes when a message is published to a Pub/Sub
+// subscription or a signed webhook is received.
+type refresher struct {
+	mx           sync.Mutex
+	subscription string
+	cancel       context.CancelFunc
+	secretName   string
+	secret       []byte
+}
+
+// configure starts pulling from subscription, a full subscription name,
+// and loads the webhook secret from Secret Manager. Empty values disable
+// them.
+func (r *refresher) configure(ctx context.Context, subscription, secretName string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if subscription != r.subscription {
+		if r.cancel != nil {
+			r.cancel()
+			r.cancel = nil
+		}
+		r.subscription = subscription
+		if subscription != "" {
+			var sctx context.Context
+			sctx, r.cancel = context.WithCancel(ctx)
+			go r.pull(sctx, subscription)
+		}
+	}
+	// The name is only recorded once the secret is loaded, so that loading
+	// it is retried on the next metadata update.
+	if secretName != r.secretName || (secretName != "" && r.secret == nil) {
+		r.secretName, r.secret = "", nil
+		if secretName != "" {
+			secret, err := accessSecret(ctx, secretName)
+			if err != nil {
+				logger.Error("Error reading the refresh webhook secret, webhook disabled:", err)
+				return
+			}
+			r.secret = secret
+		}
+		r.secretName = secretName
+	}
+}
+
+// pull requests a refresh for each message published to the subscription
+// until ctx is canceled.
+func (r *refresher) pull(ctx context.Context, subscription string) {
+	logger.Info("Listening for refresh requests on", subscription)
+	for {
+		n, err := pullPubSub(ctx, subscription)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorf("Error pulling from %s: %v", subscription, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		if n > 0 {
+			requestRefresh("Pub/Sub")
+		}
+	}
+}
+
+// pullPubSub pulls and acknowledges messages, returning how many were
+// received. The pull waits for messages for a while before returning none.
+func pullPubSub(ctx context.Context, subscription string) (int, error) {
+	var out struct {
+		ReceivedMessages []struct {
+			AckID string `json:"ackId"`
+		} `json:"receivedMessages"`
+	}
+	if err := pubsubCall(ctx, subscription+":pull", map[string]interface{}{"maxMessages": 10}, &out); err != nil {
+		return 0, err
+	}
+	if len(out.ReceivedMessages) == 0 {
+		return 0, nil
+	}
+	var ids []string
+	for _, m := range out.ReceivedMessages {
+		ids = append(ids, m.AckID)
+	}
+	return len(ids), pubsubCall(ctx, subscription+":acknowledge", map[string]interface{}{"ackIds": ids}, nil)
+}
+
+func pubsubCall(ctx context.Context, method string, in, out interface{}) error {
+	tok, err := saToken.get(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", pubsubURL+method, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// handleWebhook serves POST /v1/refresh, the body must be signed with the
+// webhook secret.
+func (r *refresher) handleWebhook(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mx.Lock()
+	secret := r.secret
+	r.mx.Unlock()
+	if secret == nil {
+		http.Error(w, "refresh webhook is not enabled", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(req.Header.Get(webhookSignatureHeader), "sha256="))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		logger.Warn("Rejected refresh webhook with an invalid signature from", req.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	requestRefresh("webhook")
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// RegistryHostSpec configures how a registry is reached, it is keyed by
+// registry host in the registry-hosts attribute.
+type RegistryHostSpec struct {
+	// Mirrors are tried in order before the registry, as a host[:port] or
+	// a URL such as http://10.0.0.5:5000. A mirror can have its own entry
+	// for its CA or to allow plain HTTP.
+	Mirrors []string `json:"mirrors"`
+	// CA is a PEM bundle trusted in addition to the system roots.
+	CA string `json:"ca"`
+	// PlainHTTP reaches the registry over HTTP instead of HTTPS.
+	PlainHTTP bool `json:"plain-http"`
+	// SkipVerify disables TLS certificate verification.
+	SkipVerify bool `json:"skip-verify"`
+}
+
+// registryConfig configures the registries the resolver pulls from.
+type registryConfig struct {
+	hosts map[string]RegistryHostSpec
+	// ca is a PEM bundle trusted for all registries.
+	ca string
+}
+
+// parseRegistryConfig parses the registry-hosts and registry-ca attributes.
+func parseRegistryConfig(md *attributesJSON) (*registryConfig, error) {
+	rc := &registryConfig{hosts: map[string]RegistryHostSpec{}, ca: md.RegistryCA}
+	if rc.ca != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(rc.ca)) {
+		return nil, fmt.Errorf("registry-ca: no certificates found")
+	}
+	if md.RegistryHosts == "" {
+		return rc, nil
+	}
+	if err := json.Unmarshal([]byte(md.RegistryHosts), &rc.hosts); err != nil {
+		return nil, fmt.Errorf("error parsing registry-hosts: %v", err)
+	}
+	for host, h := range rc.hosts {
+		for _, m := range h.Mirrors {
+			if _, _, _, err := parseMirror(m); err != nil {
+				return nil, fmt.Errorf("registry-hosts: %s: %v", host, err)
+			}
+		}
+		if h.CA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(h.CA)) {
+			return nil, fmt.Errorf("registry-hosts: %s: no certificates found in ca", host)
+		}
+	}
+	return rc, nil
+}
+
+// parseMirror returns the scheme, host and path of a mirror, an empty
+// scheme means the mirror's settings decide.
+func parseMirror(m string) (scheme, host, path string, err error) {
+	if !strings.Contains(m, "://") {
+		return "", m, "/v2", nil
+	}
+	u, err := url.Parse(m)
+	if err != nil {
+		return "", "", "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", "", fmt.Errorf("invalid mirror %q", m)
+	}
+	path = strings.TrimSuffix(u.Path, "/")
+	if !strings.HasSuffix(path, "/v2") {
+		path += "/v2"
+	}
+	return u.Scheme, u.Host, path, nil
+}
+
+// registryHosts returns the hosts to pull from for each registry, mirrors
+// first. Registries without any configuration use containerd's defaults.
+func (rc *registryConfig) registryHosts(creds func(string) (string, string, error)) docker.RegistryHosts {
+	defaults := docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(docker.NewDockerAuthorizer(docker.WithAuthCreds(creds))),
+		docker.WithPlainHTTP(docker.MatchLocalhost),
+	)
+	return func(registry string) ([]docker.RegistryHost, error) {
+		spec, ok := rc.hosts[registry]
+		if !ok && rc.ca == "" && len(certsDirCAs(registry)) == 0 {
+			return defaults(registry)
+		}
+		var rh []docker.RegistryHost
+		for _, m := range spec.Mirrors {
+			scheme, host, path, err := parseMirror(m)
+			if err != nil {
+				return nil, err
+			}
+			h, err := rc.registryHost(host, rc.hosts[host], scheme, host, path, creds)
+			if err != nil {
+				return nil, err
+			}
+			h.Capabilities = docker.HostCapabilityPull | docker.HostCapabilityResolve
+			rh = append(rh, h)
+		}
+		host := registry
+		if host == "docker.io" {
+			host = "registry-1.docker.io"
+		}
+		h, err := rc.registryHost(registry, spec, "", host, "/v2", creds)
+		if err != nil {
+			return nil, err
+		}
+		h.Capabilities = docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush
+		return append(rh, h), nil
+	}
+}
+
+// registryHost returns the configuration of host, name is the registry or
+// mirror name the host's certificates directory is named after.
+func (rc *registryConfig) registryHost(name string, spec RegistryHostSpec, scheme, host, path string, creds func(string) (string, string, error)) (docker.RegistryHost, error) {
+	if scheme == "" {
+		scheme = "https"
+		if spec.PlainHTTP {
+			scheme = "http"
+		}
+	}
+	tlsConfig, err := rc.tlsConfig(name, spec)
+	if err != nil {
+		return docker.RegistryHost{}, fmt.Errorf("registry %s: %v", host, err)
+	}
+	// Clone the default transport to keep the proxy settings.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	client := &http.Client{Transport: tr}
+	return docker.RegistryHost{
+		Client:     client,
+		Authorizer: docker.NewDockerAuthorizer(docker.WithAuthClient(client), docker.WithAuthCreds(creds)),
+		Host:       host,
+		Scheme:     scheme,
+		Path:       path,
+	}, nil
+}
+
+// tlsConfig trusts the system roots, registry-ca, spec's CA and the
+// certificates in name's certificates directory.
+func (rc *registryConfig) tlsConfig(name string, spec RegistryHostSpec) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: spec.SkipVerify}
+	cas := certsDirCAs(name)
+	if rc.ca != "" {
+		cas = append(cas, []byte(rc.ca))
+	}
+	if spec.CA != "" {
+		cas = append(cas, []byte(spec.CA))
+	}
+	if len(cas) == 0 {
+		return cfg, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, ca := range cas {
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA bundle")
+		}
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// certsDirCAs returns the contents of the *.crt files in
+// <certs-dir>/<name>, e.g. /etc/caaos/certs.d/harbor.internal:8443/ca.crt.
+func certsDirCAs(name string) [][]byte {
+	if *certsDirFlag == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(*certsDirFlag, name, "*.crt"))
+	if err != nil {
+		return nil
+	}
+	var cas [][]byte
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Errorf("Error reading CA certificate %s: %v", f, err)
+			}
+			continue
+		}
+		cas = append(cas, b)
+	}
+	return cas
+}
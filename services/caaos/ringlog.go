@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	ringLogDir         = "/var/lib/caaos/logs"
+	defaultRingLogSize = 1 << 20
+
+	ringMagic = "CAAOSRB1"
+	// ringHeaderSize is the magic, the write offset and the wrapped flag.
+	ringHeaderSize = 24
+)
+
+// ringFile is a fixed size file holding the most recent output of a
+// container, older output is overwritten once it is full.
+type ringFile struct {
+	f       *os.File
+	size    int64
+	head    int64
+	wrapped bool
+}
+
+func openRingFile(path string, size int64) (*ringFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &ringFile{f: f, size: size}
+	hdr := make([]byte, ringHeaderSize)
+	fi, err := f.Stat()
+	if err == nil && fi.Size() == ringHeaderSize+size {
+		if _, err := f.ReadAt(hdr, 0); err == nil && string(hdr[:8]) == ringMagic {
+			r.head = int64(binary.LittleEndian.Uint64(hdr[8:16]))
+			r.wrapped = binary.LittleEndian.Uint64(hdr[16:24]) == 1
+			if r.head >= 0 && r.head < size {
+				return r, nil
+			}
+		}
+	}
+	// New, resized or corrupt, start over.
+	r.head, r.wrapped = 0, false
+	if err := f.Truncate(ringHeaderSize + size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := r.writeHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ringFile) writeHeader() error {
+	hdr := make([]byte, ringHeaderSize)
+	copy(hdr, ringMagic)
+	binary.LittleEndian.PutUint64(hdr[8:16], uint64(r.head))
+	if r.wrapped {
+		binary.LittleEndian.PutUint64(hdr[16:24], 1)
+	}
+	_, err := r.f.WriteAt(hdr, 0)
+	return err
+}
+
+func (r *ringFile) write(b []byte) error {
+	if int64(len(b)) > r.size {
+		b = b[int64(len(b))-r.size:]
+	}
+	for len(b) > 0 {
+		n := r.size - r.head
+		if int64(len(b)) < n {
+			n = int64(len(b))
+		}
+		if _, err := r.f.WriteAt(b[:n], ringHeaderSize+r.head); err != nil {
+			return err
+		}
+		r.head += n
+		if r.head == r.size {
+			r.head = 0
+			r.wrapped = true
+		}
+		b = b[n:]
+	}
+	return r.writeHeader()
+}
+
+// contents returns the buffered output oldest first, starting at the first
+// complete line.
+func (r *ringFile) contents() ([]byte, error) {
+	if !r.wrapped {
+		b := make([]byte, r.head)
+		_, err := r.f.ReadAt(b, ringHeaderSize)
+		return b, err
+	}
+	b := make([]byte, r.size)
+	if _, err := r.f.ReadAt(b[:r.size-r.head], ringHeaderSize+r.head); err != nil {
+		return nil, err
+	}
+	if _, err := r.f.ReadAt(b[r.size-r.head:], ringHeaderSize); err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	}
+	return b, nil
+}
+
+// ringSink keeps the last size bytes of each container's output in a ring
+// file in dir, so that output can be read back with caaosctl logs, and lets
+// readers follow new output.
+type ringSink struct {
+	dir  string
+	size int64
+
+	mx    sync.Mutex
+	rings map[string]*ringFile
+	subs  map[string]map[chan logEntry]bool
+}
+
+func newRingSink(dir string, size int64) (*ringSink, error) {
+	if err := mkdirPrivate(dir); err != nil {
+		return nil, err
+	}
+	return &ringSink{
+		dir:   dir,
+		size:  size,
+		rings: map[string]*ringFile{},
+		subs:  map[string]map[chan logEntry]bool{},
+	}, nil
+}
+
+// ring returns the ring file for name, s.mx must be held.
+func (s *ringSink) ring(name string) (*ringFile, error) {
+	if r, ok := s.rings[name]; ok {
+		return r, nil
+	}
+	r, err := openRingFile(filepath.Join(s.dir, name+".ring"), s.size)
+	if err != nil {
+		return nil, err
+	}
+	s.rings[name] = r
+	return r, nil
+}
+
+func formatLogEntry(e logEntry) string {
+	return fmt.Sprintf("%s %s %s\n", e.time.Format(time.RFC3339Nano), e.stream, e.text)
+}
+
+func (s *ringSink) write(e logEntry) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	r, err := s.ring(e.container)
+	if err != nil {
+		logger.Errorf("Error opening log buffer for %s: %v", e.container, err)
+		return
+	}
+	if err := r.write([]byte(formatLogEntry(e))); err != nil {
+		logger.Errorf("Error writing log buffer for %s: %v", e.container, err)
+	}
+	for c := range s.subs[e.container] {
+		// Drop entries for readers that can't keep up rather than block
+		// the container.
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// read returns the buffered output of the container. If follow is set new
+// entries are sent to the returned channel until cancel is called.
+func (s *ringSink) read(name string, follow bool) ([]byte, <-chan logEntry, func(), error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, err := os.Stat(filepath.Join(s.dir, name+".ring")); err != nil {
+		return nil, nil, nil, err
+	}
+	r, err := s.ring(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	b, err := r.contents()
+	if err != nil || !follow {
+		return b, nil, func() {}, err
+	}
+
+	c := make(chan logEntry, 100)
+	if s.subs[name] == nil {
+		s.subs[name] = map[chan logEntry]bool{}
+	}
+	s.subs[name][c] = true
+	cancel := func() {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		delete(s.subs[name], c)
+	}
+	return b, c, cancel, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/image-spec/identity"
+	"golang.org/x/sys/unix"
+)
+
+// tmpfsRootfsDir holds a tmpfs for each container with tmpfs-rootfs set,
+// with the container's writable layer and its root filesystem, an overlay
+// of the image's layers.
+const tmpfsRootfsDir = "/run/caaos/rootfs"
+
+func tmpfsRootfsPath(id string) string {
+	return filepath.Join(tmpfsRootfsDir, id, "rootfs")
+}
+
+// mountTmpfsRootfs mounts the root filesystem of container id, the layers
+// of img in sn with a writable layer on a tmpfs of size bytes, and returns
+// its path. The layers are read from a view snapshot keyed by id, for the
+// container to reference with WithSnapshot.
+func mountTmpfsRootfs(ctx context.Context, sn snapshots.Snapshotter, id string, img containerd.Image, size int64) (_ string, err error) {
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return "", err
+	}
+	mounts, err := sn.View(ctx, id, identity.ChainID(diffIDs).String())
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			sn.Remove(ctx, id)
+		}
+	}()
+	lower, err := lowerDirs(mounts)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(tmpfsRootfsDir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, fmt.Sprintf("size=%d,mode=0700", size)); err != nil {
+		os.Remove(dir)
+		return "", fmt.Errorf("error mounting tmpfs: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			removeTmpfsRootfs(id)
+		}
+	}()
+	upper, work, rootfs := filepath.Join(dir, "upper"), filepath.Join(dir, "work"), tmpfsRootfsPath(id)
+	for _, d := range []string{upper, work, rootfs} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return "", err
+		}
+	}
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if len(data) >= os.Getpagesize() {
+		return "", fmt.Errorf("image has too many layers for a tmpfs rootfs")
+	}
+	if err := unix.Mount("overlay", rootfs, "overlay", 0, data); err != nil {
+		return "", fmt.Errorf("error mounting overlay: %v", err)
+	}
+	return rootfs, nil
+}
+
+// lowerDirs returns the overlay lowerdir option for the mounts of a view
+// snapshot, which are an overlay for images with several layers and a bind
+// mount for those with one.
+func lowerDirs(mounts []mount.Mount) (string, error) {
+	if len(mounts) != 1 {
+		return "", fmt.Errorf("snapshotter returned %d mounts, expected 1", len(mounts))
+	}
+	m := mounts[0]
+	switch m.Type {
+	case "bind":
+		return m.Source, nil
+	case "overlay":
+		for _, o := range m.Options {
+			if strings.HasPrefix(o, "lowerdir=") {
+				return strings.TrimPrefix(o, "lowerdir="), nil
+			}
+		}
+		return "", fmt.Errorf("overlay mount without lowerdir")
+	}
+	return "", fmt.Errorf("%s mounts can't be used for a tmpfs rootfs, use the overlayfs or native snapshotter", m.Type)
+}
+
+// removeTmpfsRootfs unmounts and removes the tmpfs root filesystem of
+// container id, if it has one.
+func removeTmpfsRootfs(id string) {
+	dir := filepath.Join(tmpfsRootfsDir, id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+	for _, p := range []string{tmpfsRootfsPath(id), dir} {
+		if err := unix.Unmount(p, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			logger.Errorf("Error unmounting %s: %v", p, err)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Error("Error removing tmpfs rootfs:", err)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/snapshots"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The fakes embed the containerd interfaces they implement, calling a
+// method that isn't faked panics.
+
+type fakeImage struct {
+	containerd.Image
+	name string
+}
+
+func (i *fakeImage) Name() string { return i.name }
+
+func (i *fakeImage) Target() ocispec.Descriptor {
+	return ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString(i.name)}
+}
+
+func (i *fakeImage) IsUnpacked(context.Context, string) (bool, error) { return true, nil }
+
+type fakeImages struct {
+	ImagePuller
+}
+
+func (fakeImages) Image(_ context.Context, ref, _ string) (containerd.Image, error) {
+	return &fakeImage{name: ref}, nil
+}
+
+// fakeTask exits when exit is called or it is killed. Its exit is sent as
+// an event unless noEvents is set, in which case it is only seen by
+// polling its status.
+type fakeTask struct {
+	containerd.Task
+	pid      uint32
+	noEvents bool
+	onStart  func(t *fakeTask)
+	exitC    chan containerd.ExitStatus
+
+	mx      sync.Mutex
+	status  *containerd.ExitStatus
+	kills   []syscall.Signal
+	deleted bool
+}
+
+func (t *fakeTask) Pid() uint32 { return t.pid }
+
+func (t *fakeTask) Start(context.Context) error {
+	if t.onStart != nil {
+		t.onStart(t)
+	}
+	return nil
+}
+
+func (t *fakeTask) exit(code uint32) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.status != nil {
+		return
+	}
+	t.status = containerd.NewExitStatus(code, time.Now(), nil)
+	if !t.noEvents {
+		t.exitC <- *t.status
+	}
+}
+
+func (t *fakeTask) Kill(_ context.Context, sig syscall.Signal, _ ...containerd.KillOpts) error {
+	t.mx.Lock()
+	t.kills = append(t.kills, sig)
+	t.mx.Unlock()
+	t.exit(128 + uint32(sig))
+	return nil
+}
+
+func (t *fakeTask) Status(context.Context) (containerd.Status, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.status == nil {
+		return containerd.Status{Status: containerd.Running}, nil
+	}
+	return containerd.Status{Status: containerd.Stopped, ExitStatus: t.status.ExitCode(), ExitTime: t.status.ExitTime()}, nil
+}
+
+func (t *fakeTask) Delete(context.Context, ...containerd.ProcessDeleteOpts) (*containerd.ExitStatus, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.deleted = true
+	return t.status, nil
+}
+
+func (t *fakeTask) killed() []syscall.Signal {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return append([]syscall.Signal{}, t.kills...)
+}
+
+type fakeContainer struct {
+	containerd.Container
+	id   string
+	task *fakeTask
+
+	mx      sync.Mutex
+	deleted bool
+}
+
+func (c *fakeContainer) ID() string { return c.id }
+
+func (c *fakeContainer) NewTask(context.Context, cio.Creator, ...containerd.NewTaskOpts) (containerd.Task, error) {
+	return c.task, nil
+}
+
+func (c *fakeContainer) SetLabels(_ context.Context, labels map[string]string) (map[string]string, error) {
+	return labels, nil
+}
+
+func (c *fakeContainer) Delete(context.Context, ...containerd.DeleteOpts) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.deleted = true
+	return nil
+}
+
+// fakeBackend creates containers whose tasks are made by newTask and
+// supervises them.
+type fakeBackend struct {
+	newTask func() *fakeTask
+
+	mx         sync.Mutex
+	containers []*fakeContainer
+}
+
+func (b *fakeBackend) NewContainer(_ context.Context, id string, _ ...containerd.NewContainerOpts) (containerd.Container, error) {
+	t := b.newTask()
+	t.exitC = make(chan containerd.ExitStatus, 1)
+	c := &fakeContainer{id: id, task: t}
+	b.mx.Lock()
+	b.containers = append(b.containers, c)
+	b.mx.Unlock()
+	return c, nil
+}
+
+func (b *fakeBackend) LoadContainer(context.Context, string) (containerd.Container, error) {
+	panic("LoadContainer is not faked")
+}
+
+func (b *fakeBackend) SnapshotService(string) snapshots.Snapshotter {
+	panic("SnapshotService is not faked")
+}
+
+func (b *fakeBackend) Exit(_ context.Context, task containerd.Task) (<-chan containerd.ExitStatus, func()) {
+	return task.(*fakeTask).exitC, func() {}
+}
+
+func (b *fakeBackend) OOM(string) (<-chan struct{}, func()) {
+	return nil, func() {}
+}
+
+func (b *fakeBackend) created() []*fakeContainer {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return append([]*fakeContainer{}, b.containers...)
+}
+
+// testEnv returns an environment writing its state to a temporary
+// directory. Statuses are published to a fake metadata server.
+func testEnv(t *testing.T) *runEnv {
+	dir := t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(srv.Close)
+	oldBase, oldIMDS := metadataBase, imdsBase
+	setMetadataEndpoint(srv.URL)
+	t.Cleanup(func() { metadataBase, imdsBase = oldBase, oldIMDS })
+	return &runEnv{
+		state:       &stateStore{path: filepath.Join(dir, "state.json"), st: agentDiskState{Containers: map[string]persistedContainer{}}},
+		running:     &taskRegistry{tasks: map[string]execTarget{}},
+		audit:       &auditLog{},
+		lifecycle:   &eventBus{subs: map[chan lifecycleEvent]bool{}},
+		checkpoints: &checkpointState{checkpointed: map[string]bool{}, restores: map[string]string{}},
+		boot:        &bootReport{},
+		accessSecret: func(context.Context, string) ([]byte, error) {
+			t.Error("unexpected secret access")
+			return nil, os.ErrNotExist
+		},
+		secretsDir: filepath.Join(dir, "secrets"),
+		setupNetwork: func(context.Context, string, uint32, []PortSpec) (string, error) {
+			t.Error("unexpected network setup")
+			return "", os.ErrNotExist
+		},
+		removeNetwork: func(context.Context, string, uint32, []PortSpec) error {
+			t.Error("unexpected network removal")
+			return nil
+		},
+	}
+}
+
+func testRunner(env *runEnv, b *fakeBackend) *runner {
+	return &runner{
+		images:      fakeImages{},
+		containers:  b,
+		tasks:       b,
+		env:         env,
+		gracePeriod: time.Minute,
+	}
+}
+
+func eventTypes(env *runEnv) []string {
+	events, _, cancel := env.lifecycle.subscribe(0)
+	cancel()
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRunContainerExit(t *testing.T) {
+	env := testEnv(t)
+	b := &fakeBackend{}
+	var task *fakeTask
+	b.newTask = func() *fakeTask {
+		task = &fakeTask{pid: 42, onStart: func(ft *fakeTask) {
+			if len(env.running.all()) != 0 {
+				t.Error("task registered before it started")
+			}
+			go ft.exit(3)
+		}}
+		return task
+	}
+	r := testRunner(env, b)
+	c := ContainerSpec{Name: "app", Image: "gcr.io/p/app:1", PullPolicy: pullIfNotPresent}
+
+	code, err := r.runContainer(context.Background(), containerLogger(c.Name), c)
+	if err != nil || code != 3 {
+		t.Fatalf("runContainer = %d, %v, want 3, nil", code, err)
+	}
+	created := b.created()
+	if len(created) != 1 || !created[0].deleted || !task.deleted {
+		t.Errorf("container and task were not deleted")
+	}
+	if len(task.killed()) != 0 {
+		t.Errorf("exited task was killed with %v", task.killed())
+	}
+	if n := len(env.state.st.Containers); n != 0 {
+		t.Errorf("%d containers left in the state file", n)
+	}
+	if n := len(env.running.all()); n != 0 {
+		t.Errorf("%d tasks left registered", n)
+	}
+	want := []string{eventPulled, eventCreated, eventStarted, eventExited}
+	if got := eventTypes(env); !equalStrings(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestRunContainerStop(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		noEvents bool
+	}{
+		{"exit event", false},
+		// The exit is only found by polling the task's status.
+		{"no exit event", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := testEnv(t)
+			b := &fakeBackend{}
+			started := make(chan *fakeTask, 1)
+			b.newTask = func() *fakeTask {
+				return &fakeTask{pid: 42, noEvents: tc.noEvents, onStart: func(ft *fakeTask) { started <- ft }}
+			}
+			r := testRunner(env, b)
+			c := ContainerSpec{Name: "app", Image: "gcr.io/p/app:1", PullPolicy: pullIfNotPresent}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			type result struct {
+				code uint32
+				err  error
+			}
+			resC := make(chan result, 1)
+			go func() {
+				code, err := r.runContainer(ctx, containerLogger(c.Name), c)
+				resC <- result{code, err}
+			}()
+			task := <-started
+			// The task is recorded once it runs, so that it can be
+			// reattached to.
+			deadline := time.Now().Add(5 * time.Second)
+			for len(env.running.all()) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			env.state.mx.Lock()
+			persistedN := len(env.state.st.Containers)
+			env.state.mx.Unlock()
+			if persistedN != 1 {
+				t.Errorf("%d containers in the state file while running, want 1", persistedN)
+			}
+			cancel()
+
+			select {
+			case res := <-resC:
+				if res.err != nil || res.code != 128+uint32(syscall.SIGTERM) {
+					t.Errorf("runContainer = %d, %v, want %d, nil", res.code, res.err, 128+syscall.SIGTERM)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("runContainer did not return after ctx was canceled")
+			}
+			if got := task.killed(); len(got) != 1 || got[0] != syscall.SIGTERM {
+				t.Errorf("task killed with %v, want SIGTERM only", got)
+			}
+			if n := len(env.state.st.Containers); n != 0 {
+				t.Errorf("%d containers left in the state file", n)
+			}
+		})
+	}
+}
+
+func TestSuperviseRestart(t *testing.T) {
+	env := testEnv(t)
+	b := &fakeBackend{}
+	b.newTask = func() *fakeTask {
+		return &fakeTask{pid: 42, onStart: func(ft *fakeTask) { go ft.exit(0) }}
+	}
+	r := testRunner(env, b)
+	c := ContainerSpec{Name: "app", Image: "gcr.io/p/app:1", PullPolicy: pullIfNotPresent}
+	policy, err := parseRestartPolicy("always:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.supervise(context.Background(), containerLogger(c.Name), c, policy)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("supervise did not return once the retries were used up")
+	}
+	created := b.created()
+	if len(created) != 2 {
+		t.Fatalf("%d containers created, want 2", len(created))
+	}
+	if created[0].id == created[1].id {
+		t.Errorf("restart reused container ID %s", created[0].id)
+	}
+	want := []string{
+		eventPulled, eventCreated, eventStarted, eventExited,
+		eventRestarting,
+		eventPulled, eventCreated, eventStarted, eventExited,
+	}
+	if got := eventTypes(env); !equalStrings(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestRunContainerBridgeSecrets(t *testing.T) {
+	env := testEnv(t)
+	var accessed []string
+	env.accessSecret = func(_ context.Context, name string) ([]byte, error) {
+		accessed = append(accessed, name)
+		return []byte("s3cret"), nil
+	}
+	var setUp, removed []string
+	env.setupNetwork = func(_ context.Context, id string, pid uint32, _ []PortSpec) (string, error) {
+		if pid != 42 {
+			t.Errorf("network set up for pid %d, want 42", pid)
+		}
+		setUp = append(setUp, id)
+		return "10.88.0.2", nil
+	}
+	env.removeNetwork = func(_ context.Context, id string, _ uint32, _ []PortSpec) error {
+		removed = append(removed, id)
+		return nil
+	}
+
+	b := &fakeBackend{}
+	var secretFile string
+	b.newTask = func() *fakeTask {
+		return &fakeTask{pid: 42, onStart: func(ft *fakeTask) {
+			id := b.created()[0].id
+			secretFile = filepath.Join(env.secretsDir, id, "0")
+			if got, err := ioutil.ReadFile(secretFile); err != nil || string(got) != "s3cret" {
+				t.Errorf("secret file = %q, %v, want s3cret", got, err)
+			}
+			go ft.exit(0)
+		}}
+	}
+	r := testRunner(env, b)
+	c := ContainerSpec{
+		Name:       "app",
+		Image:      "gcr.io/p/app:1",
+		PullPolicy: pullIfNotPresent,
+		Network:    networkBridge,
+		Secrets:    []SecretFileSpec{{Secret: "projects/p/secrets/file", Path: "/run/secret"}},
+	}
+
+	if code, err := r.runContainer(context.Background(), containerLogger(c.Name), c); err != nil || code != 0 {
+		t.Fatalf("runContainer = %d, %v, want 0, nil", code, err)
+	}
+	id := b.created()[0].id
+	if !equalStrings(setUp, []string{id}) || !equalStrings(removed, []string{id}) {
+		t.Errorf("network set up for %v and removed for %v, want %s", setUp, removed, id)
+	}
+	if !equalStrings(accessed, []string{"projects/p/secrets/file"}) {
+		t.Errorf("secrets accessed = %v", accessed)
+	}
+	if _, err := os.Stat(secretFile); !os.IsNotExist(err) {
+		t.Errorf("secret file %s not removed: %v", secretFile, err)
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	env := testEnv(t)
+	r := testRunner(env, &fakeBackend{})
+	st := &containerStatus{Name: "app", Image: "gcr.io/p/app:1", State: stateRunning}
+	r.oomKilled(context.Background(), containerLogger(st.Name), st)
+	if !st.OOMKilled || st.Error == "" {
+		t.Errorf("status = %+v, want it OOM killed", st)
+	}
+	if got, want := eventTypes(env), []string{eventOOM}; !equalStrings(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxArgLen is the kernel's limit on a single argument or environment
+	// string, MAX_ARG_STRLEN.
+	maxArgLen = 128 << 10
+	// maxExecBytes caps the arguments and environment of a container
+	// together, well below the usual 2 MiB ARG_MAX so the exec doesn't
+	// fail with E2BIG on instances with a small stack limit.
+	maxExecBytes = 1 << 20
+)
+
+// shellOperators are arguments that only mean something to a shell. The
+// agent runs args and command without one, so they would be passed to the
+// process as is.
+var shellOperators = map[string]bool{
+	"&&":   true,
+	"||":   true,
+	"|":    true,
+	">":    true,
+	">>":   true,
+	"<":    true,
+	"2>&1": true,
+	"&>":   true,
+}
+
+// operatorCommands take shell operators as ordinary arguments.
+var operatorCommands = map[string]bool{
+	"expr": true,
+	"test": true,
+	"[":    true,
+}
+
+// validateImage checks that image is set and is a single word.
+func validateImage(verr *validationError, field, image string) {
+	if strings.TrimSpace(image) == "" {
+		verr.add("%s: image is required", field)
+		return
+	}
+	if strings.IndexFunc(image, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		verr.add("%s.image: %q contains whitespace or control characters", field, image)
+		return
+	}
+	if ref, ok := imageRef(image); ok && ref == "" {
+		verr.add("%s.image: %s must be followed by an image reference", field, localImagePrefix)
+	}
+	if isArchiveImage(image) {
+		if err := validateArchiveURL(image); err != nil {
+			verr.add("%s.image: %v", field, err)
+		}
+	}
+}
+
+// validateExec checks the args, command and environment of c can be passed
+// to the container's process as intended.
+func validateExec(verr *validationError, field string, c *ContainerSpec) {
+	total := 0
+	check := func(name string, argv []string) {
+		skipOperators := len(argv) > 0 && name == "args" && operatorCommands[path.Base(argv[0])]
+		for j, a := range argv {
+			total += len(a) + 1
+			switch {
+			case strings.IndexByte(a, 0) >= 0:
+				verr.add("%s.%s[%d]: contains a NUL byte", field, name, j)
+			case len(a) > maxArgLen:
+				verr.add("%s.%s[%d]: %d bytes is over the limit of %d", field, name, j, len(a), maxArgLen)
+			case shellOperators[a] && !skipOperators:
+				verr.add("%s.%s[%d]: %q is a shell operator but %s are not run by a shell, use [\"/bin/sh\", \"-c\", \"...\"]", field, name, j, a, name)
+			}
+		}
+	}
+	check("args", c.Args)
+	check("command", c.Command)
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := c.Env[k]
+		total += len(k) + len(v) + 2
+		if strings.IndexByte(k, 0) >= 0 || strings.IndexByte(v, 0) >= 0 {
+			verr.add("%s.env: %q contains a NUL byte", field, k)
+		} else if len(k)+len(v)+1 > maxArgLen {
+			verr.add("%s.env: %q is over the limit of %d bytes", field, k, maxArgLen)
+		}
+	}
+	if total > maxExecBytes {
+		verr.add("%s: args, command and env total %d bytes, over the limit of %d", field, total, maxExecBytes)
+	}
+}
+
+// specValidation is published to the guest attribute caaos/spec-validation
+// each time the result of reading the spec from metadata changes, so that a
+// spec the agent refuses to run can be told apart from one still starting.
+type specValidation struct {
+	Valid  bool      `json:"valid"`
+	Errors []string  `json:"errors,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// lastValidation is the last specValidation published, it is only used by
+// the main loop.
+var lastValidation *specValidation
+
+// publishValidation publishes the result of reading the spec, err is nil
+// if it was accepted.
+func publishValidation(ctx context.Context, err error) {
+	v := &specValidation{Valid: err == nil, Time: time.Now()}
+	if verr, ok := err.(validationError); ok {
+		v.Errors = verr
+	} else if err != nil {
+		v.Errors = []string{err.Error()}
+	}
+	if lastValidation != nil && lastValidation.Valid == v.Valid && reflect.DeepEqual(lastValidation.Errors, v.Errors) {
+		return
+	}
+	lastValidation = v
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("Error encoding spec validation:", err)
+		return
+	}
+	if err := setGuestAttribute(ctx, "spec-validation", string(b)); err != nil {
+		logger.Error("Error publishing spec validation:", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// runScheduled runs the container every time its cron schedule fires until
+// ctx is canceled. Runs never overlap, triggers that fire while a run is in
+// progress are skipped.
+func (r *runner) runScheduled(ctx context.Context, logger *Logger, c ContainerSpec) {
+	sched, err := cron.ParseStandard(c.Schedule)
+	if err != nil {
+		logger.Error("Error parsing schedule:", err)
+		return
+	}
+
+	for {
+		next := sched.Next(time.Now())
+		logger.Debugf("next run at %s", next.Format(time.RFC3339))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		start := time.Now()
+		if _, err := r.runRecorded(ctx, logger, c); err != nil {
+			logger.Error("Error:", err)
+		}
+
+		if end := time.Now(); sched.Next(next).Before(end) {
+			logger.Warnf("run took %s, skipping triggers missed while running", end.Sub(start))
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/oci"
+)
+
+const (
+	secretManagerURL = "https://secretmanager.googleapis.com/v1/"
+	// secretRefPrefix marks a Secret Manager reference in an env value,
+	// e.g. ${secret:projects/p/secrets/s/versions/latest}.
+	secretRefPrefix = "${secret:"
+	// secretsDir holds secret files while their container runs, /run is a
+	// tmpfs so secrets are never written to disk.
+	secretsDir = "/run/caaos/secrets"
+)
+
+// envMap is a container's environment. In a spec a value is either a string
+// or {"secret": "<secret version>"}, which is stored as a secret reference
+// and resolved when the container starts.
+type envMap map[string]string
+
+func (e *envMap) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	env := envMap{}
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			env[k] = s
+			continue
+		}
+		var ref struct {
+			Secret string `json:"secret"`
+		}
+		if err := json.Unmarshal(v, &ref); err != nil || ref.Secret == "" {
+			return fmt.Errorf("env %s: value must be a string or {\"secret\": \"<secret version>\"}", k)
+		}
+		env[k] = secretRefPrefix + ref.Secret + "}"
+	}
+	*e = env
+	return nil
+}
+
+// SecretFileSpec writes a secret to a file in the container.
+type SecretFileSpec struct {
+	// Secret is a Secret Manager secret version, a secret without a
+	// version uses the latest version.
+	Secret string `json:"secret"`
+	// Path is the absolute path of the file in the container.
+	Path string `json:"path"`
+	// Mode is the octal file mode, it defaults to 0444.
+	Mode string `json:"mode"`
+}
+
+func (s SecretFileSpec) validate() error {
+	if s.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if !filepath.IsAbs(s.Path) {
+		return fmt.Errorf("path %q must be an absolute path", s.Path)
+	}
+	if s.Mode != "" {
+		if _, err := strconv.ParseUint(s.Mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid mode %q", s.Mode)
+		}
+	}
+	return nil
+}
+
+// secretVersion returns the full resource name of the secret version.
+func secretVersion(name string) string {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return name
+}
+
+// accessSecret returns the payload of a secret version using the VM's
+// service account.
+func accessSecret(ctx context.Context, name string) ([]byte, error) {
+	tok, err := saToken.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", secretManagerURL+secretVersion(name)+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error accessing secret %s: %s", name, resp.Status)
+	}
+	var out struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Payload.Data)
+}
+
+// hasSecretRef reports whether an env value references a secret.
+func hasSecretRef(v string) bool {
+	return strings.Contains(v, secretRefPrefix)
+}
+
+// resolveSecretEnv returns the env entries of c that reference secrets with
+// the references replaced by the secret values read with access. The values
+// are only passed to the container and must never be logged.
+func resolveSecretEnv(ctx context.Context, access func(context.Context, string) ([]byte, error), c ContainerSpec) ([]string, error) {
+	cache := map[string]string{}
+	var env []string
+	for k, v := range c.Env {
+		if !hasSecretRef(v) {
+			continue
+		}
+		var out strings.Builder
+		for {
+			i := strings.Index(v, secretRefPrefix)
+			if i < 0 {
+				break
+			}
+			j := strings.Index(v[i:], "}")
+			if j < 0 {
+				break
+			}
+			name := v[i+len(secretRefPrefix) : i+j]
+			val, ok := cache[name]
+			if !ok {
+				b, err := access(ctx, name)
+				if err != nil {
+					return nil, fmt.Errorf("env %s: %v", k, err)
+				}
+				val = string(b)
+				cache[name] = val
+			}
+			out.WriteString(v[:i])
+			out.WriteString(val)
+			v = v[i+j+1:]
+		}
+		out.WriteString(v)
+		env = append(env, k+"="+out.String())
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// withSecrets returns the spec options injecting c's secrets and a function
+// that removes the secret files once the container has exited. id must be
+// unique to this run of the container.
+func (e *runEnv) withSecrets(ctx context.Context, id string, c ContainerSpec) ([]oci.SpecOpts, func(), error) {
+	nop := func() {}
+	var opts []oci.SpecOpts
+	env, err := resolveSecretEnv(ctx, e.accessSecret, c)
+	if err != nil {
+		return nil, nop, err
+	}
+	if len(env) > 0 {
+		opts = append(opts, oci.WithEnv(env))
+	}
+	if len(c.Secrets) == 0 {
+		return opts, nop, nil
+	}
+
+	dir := filepath.Join(e.secretsDir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nop, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	var mounts []MountSpec
+	for i, s := range c.Secrets {
+		b, err := e.accessSecret(ctx, s.Secret)
+		if err != nil {
+			cleanup()
+			return nil, nop, err
+		}
+		mode := uint64(0444)
+		if s.Mode != "" {
+			mode, _ = strconv.ParseUint(s.Mode, 8, 32)
+		}
+		p := filepath.Join(dir, strconv.Itoa(i))
+		if err := ioutil.WriteFile(p, b, os.FileMode(mode)); err != nil {
+			cleanup()
+			return nil, nop, err
+		}
+		mounts = append(mounts, MountSpec{Source: p, Destination: s.Path, Options: []string{"rbind", "ro"}})
+	}
+	return append(opts, oci.WithMounts(ociMounts(mounts))), cleanup, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/oci"
+)
+
+const (
+	seccompDefault    = "default"
+	seccompUnconfined = "unconfined"
+)
+
+// SecuritySpec controls the privileges given to a container. The zero value
+// is an unprivileged container with containerd's default capabilities, the
+// default seccomp profile and no-new-privileges set.
+type SecuritySpec struct {
+	Privileged bool     `json:"privileged"`
+	CapAdd     []string `json:"cap-add"`
+	CapDrop    []string `json:"cap-drop"`
+	// Seccomp is "default", "unconfined" or the path to a profile on the
+	// host.
+	Seccomp         string `json:"seccomp"`
+	NoNewPrivileges *bool  `json:"no-new-privileges"`
+}
+
+// normalizeCaps upper cases capability names and adds the CAP_ prefix if
+// missing, "ALL" is passed through as is.
+func normalizeCaps(caps []string) []string {
+	var out []string
+	for _, c := range caps {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c != "ALL" && !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func (s *SecuritySpec) validate() error {
+	if s == nil {
+		return nil
+	}
+	switch s.Seccomp {
+	case "", seccompDefault, seccompUnconfined:
+	default:
+		if !strings.HasPrefix(s.Seccomp, "/") {
+			return fmt.Errorf("seccomp profile %q must be %q, %q or an absolute path", s.Seccomp, seccompDefault, seccompUnconfined)
+		}
+	}
+	for _, c := range normalizeCaps(s.CapAdd) {
+		if c == "ALL" {
+			return fmt.Errorf("cap-add does not support ALL, use privileged instead")
+		}
+	}
+	return nil
+}
+
+// specOpts returns the OCI spec options for the security settings.
+func (s *SecuritySpec) specOpts() []oci.SpecOpts {
+	if s == nil {
+		s = &SecuritySpec{}
+	}
+	if s.Privileged {
+		return []oci.SpecOpts{oci.WithPrivileged}
+	}
+
+	var opts []oci.SpecOpts
+	drop := normalizeCaps(s.CapDrop)
+	for _, c := range drop {
+		if c == "ALL" {
+			opts = append(opts, oci.WithCapabilities(nil))
+			drop = nil
+			break
+		}
+	}
+	if len(drop) > 0 {
+		opts = append(opts, oci.WithDroppedCapabilities(drop))
+	}
+	if add := normalizeCaps(s.CapAdd); len(add) > 0 {
+		opts = append(opts, oci.WithAddedCapabilities(add))
+	}
+
+	switch s.Seccomp {
+	case "", seccompDefault:
+		opts = append(opts, seccomp.WithDefaultProfile())
+	case seccompUnconfined:
+	default:
+		opts = append(opts, seccomp.WithProfile(s.Seccomp))
+	}
+
+	if s.NoNewPrivileges == nil || *s.NoNewPrivileges {
+		opts = append(opts, oci.WithNoNewPrivileges)
+	}
+	return opts
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// startSidecars starts the sidecars of c, joined to the network namespace of
+// the task with the given pid. The returned function stops the sidecars and
+// waits for them to exit, it must be called once the main task exits.
+func (r *runner) startSidecars(ctx context.Context, c ContainerSpec, pid uint32) func() {
+	if len(c.Sidecars) == 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, sc := range c.Sidecars {
+		sc.netns = fmt.Sprintf("/proc/%d/ns/net", pid)
+		wg.Add(1)
+		go func(sc ContainerSpec) {
+			defer wg.Done()
+			slogger := containerLogger(c.Name + "/" + sc.Name)
+			policy, err := parseRestartPolicy(sc.RestartPolicy)
+			if err != nil {
+				slogger.Error("Error:", err)
+				return
+			}
+			r.supervise(ctx, slogger, sc, policy)
+		}(sc)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// withNetNS joins the container to the network namespace at path.
+func withNetNS(path string) oci.SpecOpts {
+	return oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: path})
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+
+	// maxSignatureSize caps how much we read of a signature manifest or
+	// payload.
+	maxSignatureSize = 1 << 20
+)
+
+var (
+	// Fulcio certificate extensions holding the OIDC issuer.
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// signaturePolicy is the image-signature-policy attribute. Either PublicKey
+// or Keyless must be set.
+type signaturePolicy struct {
+	// PublicKey is a PEM encoded public key, as generated by
+	// `cosign generate-key-pair`.
+	PublicKey string         `json:"public-key"`
+	Keyless   *keylessPolicy `json:"keyless"`
+	key       crypto.PublicKey
+	roots     *x509.CertPool
+	rekorKey  crypto.PublicKey
+	rekorID   string
+}
+
+// keylessPolicy verifies signatures made with a Fulcio issued certificate.
+// The signature must have been entered in the Rekor transparency log while
+// the certificate was valid, shown by the bundle cosign attaches to it.
+type keylessPolicy struct {
+	Identity string `json:"identity"`
+	Issuer   string `json:"issuer"`
+	// Roots is the PEM encoded Fulcio root certificate(s).
+	Roots string `json:"roots"`
+	// RekorPublicKey is the PEM encoded public key of the Rekor log.
+	RekorPublicKey string `json:"rekor-public-key"`
+}
+
+// parseSignaturePolicy parses the image-signature-policy attribute, an empty
+// attribute returns a nil policy which allows any image.
+func parseSignaturePolicy(s string) (*signaturePolicy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var p signaturePolicy
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		return nil, fmt.Errorf("error parsing image-signature-policy: %v", err)
+	}
+	switch {
+	case p.PublicKey != "" && p.Keyless != nil:
+		return nil, errors.New("image-signature-policy: only one of public-key and keyless may be set")
+	case p.PublicKey != "":
+		block, _ := pem.Decode([]byte(p.PublicKey))
+		if block == nil {
+			return nil, errors.New("image-signature-policy: public-key is not PEM encoded")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("image-signature-policy: %v", err)
+		}
+		p.key = key
+	case p.Keyless != nil:
+		if p.Keyless.Identity == "" || p.Keyless.Issuer == "" {
+			return nil, errors.New("image-signature-policy: keyless requires identity and issuer")
+		}
+		p.roots = x509.NewCertPool()
+		if !p.roots.AppendCertsFromPEM([]byte(p.Keyless.Roots)) {
+			return nil, errors.New("image-signature-policy: keyless requires PEM encoded roots")
+		}
+		block, _ := pem.Decode([]byte(p.Keyless.RekorPublicKey))
+		if block == nil {
+			return nil, errors.New("image-signature-policy: keyless requires a PEM encoded rekor-public-key")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("image-signature-policy: rekor-public-key: %v", err)
+		}
+		// Rekor identifies its log by the hash of its key.
+		sum := sha256.Sum256(block.Bytes)
+		p.rekorKey, p.rekorID = key, hex.EncodeToString(sum[:])
+	default:
+		return nil, errors.New("image-signature-policy: one of public-key or keyless must be set")
+	}
+	return &p, nil
+}
+
+// simpleSigning is the payload signed by cosign.
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verify checks that at least one cosign signature for the image with the
+// given digest satisfies the policy.
+func (p *signaturePolicy) verify(ctx context.Context, resolver remotes.Resolver, image string, dgst digest.Digest) error {
+	if isArchiveImage(image) {
+		return errors.New("signatures of image archives can't be verified")
+	}
+	spec, err := reference.Parse(image)
+	if err != nil {
+		return err
+	}
+	// cosign stores signatures in the same repository under the tag
+	// sha256-<hex>.sig.
+	sigRef := fmt.Sprintf("%s:%s-%s.sig", spec.Locator, dgst.Algorithm(), dgst.Hex())
+	name, desc, err := resolver.Resolve(ctx, sigRef)
+	if err != nil {
+		return fmt.Errorf("no signature found for %s: %v", image, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return err
+	}
+	b, err := fetchBlob(ctx, fetcher, desc)
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return fmt.Errorf("error parsing signature manifest: %v", err)
+	}
+
+	var errs []string
+	for _, layer := range manifest.Layers {
+		err := p.verifyLayer(ctx, fetcher, layer, dgst)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no signatures found for %s", image)
+	}
+	return fmt.Errorf("no valid signature for %s: %s", image, strings.Join(errs, "; "))
+}
+
+func (p *signaturePolicy) verifyLayer(ctx context.Context, fetcher remotes.Fetcher, layer ocispec.Descriptor, dgst digest.Digest) error {
+	payload, err := fetchBlob(ctx, fetcher, layer)
+	if err != nil {
+		return err
+	}
+	return p.verifyPayload(layer.Annotations, payload, dgst)
+}
+
+// verifyPayload checks the signature in annotations of the payload of a
+// signature layer, and that it signs dgst.
+func (p *signaturePolicy) verifyPayload(annotations map[string]string, payload []byte, dgst digest.Digest) error {
+	sig, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil || len(sig) == 0 {
+		return errors.New("missing or malformed signature annotation")
+	}
+
+	key := p.key
+	if p.Keyless != nil {
+		if key, err = p.verifyCertificate(annotations, payload, sig); err != nil {
+			return err
+		}
+	}
+	if err := verifySignature(key, payload, sig); err != nil {
+		return err
+	}
+
+	var ss simpleSigning
+	if err := json.Unmarshal(payload, &ss); err != nil {
+		return fmt.Errorf("error parsing signature payload: %v", err)
+	}
+	if got := ss.Critical.Image.DockerManifestDigest; got != dgst.String() {
+		return fmt.Errorf("signature is for digest %s", got)
+	}
+	return nil
+}
+
+// verifyCertificate checks the Fulcio certificate attached to the signature
+// sig of payload and returns its public key. Fulcio certificates expire
+// minutes after they are issued, the chain is verified as of the time the
+// signature was entered in the transparency log.
+func (p *signaturePolicy) verifyCertificate(annotations map[string]string, payload, sig []byte) (crypto.PublicKey, error) {
+	certPEM := annotations[cosignCertificateAnnotation]
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("missing signing certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	integrated, err := p.verifyBundle(annotations[cosignBundleAnnotation], cert, payload, sig)
+	if err != nil {
+		return nil, err
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(annotations[cosignChainAnnotation]))
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   integrated,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, fmt.Errorf("invalid signing certificate: %v", err)
+	}
+
+	if !certHasIdentity(cert, p.Keyless.Identity) {
+		return nil, fmt.Errorf("certificate identity does not match %q", p.Keyless.Identity)
+	}
+	if issuer := certIssuer(cert.Extensions); issuer != p.Keyless.Issuer {
+		return nil, fmt.Errorf("certificate issuer %q does not match %q", issuer, p.Keyless.Issuer)
+	}
+	return cert.PublicKey, nil
+}
+
+// rekorBundle is the bundle annotation, the transparency log entry of the
+// signature with the log's signed entry timestamp.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte             `json:"SignedEntryTimestamp"`
+	Payload              rekorBundlePayload `json:"Payload"`
+}
+
+// rekorBundlePayload is what the signed entry timestamp signs, its fields
+// are in the order of its canonical JSON encoding.
+type rekorBundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of the log entry of a signature.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifyBundle checks that the bundle was signed by the policy's Rekor log
+// and that its entry is of sig of payload made with cert, and returns the
+// time the entry was integrated in the log.
+func (p *signaturePolicy) verifyBundle(bundle string, cert *x509.Certificate, payload, sig []byte) (time.Time, error) {
+	if bundle == "" {
+		return time.Time{}, errors.New("missing transparency log bundle")
+	}
+	var b rekorBundle
+	if err := json.Unmarshal([]byte(bundle), &b); err != nil {
+		return time.Time{}, fmt.Errorf("error parsing transparency log bundle: %v", err)
+	}
+	if b.Payload.LogID != p.rekorID {
+		return time.Time{}, fmt.Errorf("transparency log bundle is from log %q", b.Payload.LogID)
+	}
+	signed, err := json.Marshal(b.Payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifySignature(p.rekorKey, signed, b.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("transparency log bundle: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error decoding transparency log entry: %v", err)
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("error parsing transparency log entry: %v", err)
+	}
+	h := sha256.Sum256(payload)
+	block, _ := pem.Decode(entry.Spec.Signature.PublicKey.Content)
+	switch {
+	case entry.Kind != "hashedrekord":
+		return time.Time{}, fmt.Errorf("unsupported transparency log entry kind %q", entry.Kind)
+	case entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(h[:]):
+		return time.Time{}, errors.New("transparency log entry is for another payload")
+	case string(entry.Spec.Signature.Content) != string(sig):
+		return time.Time{}, errors.New("transparency log entry is for another signature")
+	case block == nil || string(block.Bytes) != string(cert.Raw):
+		return time.Time{}, errors.New("transparency log entry is for another certificate")
+	}
+	return time.Unix(b.Payload.IntegratedTime, 0), nil
+}
+
+func certHasIdentity(cert *x509.Certificate, identity string) bool {
+	for _, e := range cert.EmailAddresses {
+		if e == identity {
+			return true
+		}
+	}
+	for _, u := range cert.URIs {
+		if u.String() == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func certIssuer(exts []pkix.Extension) string {
+	for _, ext := range exts {
+		switch {
+		case ext.Id.Equal(oidFulcioIssuerV2):
+			var s string
+			if _, err := asn1.Unmarshal(ext.Value, &s); err == nil {
+				return s
+			}
+		case ext.Id.Equal(oidFulcioIssuer):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+func verifySignature(key crypto.PublicKey, payload, sig []byte) error {
+	h := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, h[:], sig) {
+			return errors.New("signature does not match")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig); err != nil {
+			return errors.New("signature does not match")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return errors.New("signature does not match")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+func fetchBlob(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	if desc.Size > maxSignatureSize {
+		return nil, fmt.Errorf("blob %s is too large", desc.Digest)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(rc, maxSignatureSize))
+	if err != nil {
+		return nil, err
+	}
+	if desc.Digest != "" && digest.FromBytes(b) != desc.Digest {
+		return nil, fmt.Errorf("blob %s failed digest verification", desc.Digest)
+	}
+	return b, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const testIssuer = "https://accounts.example.com"
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func publicKeyPEM(t *testing.T, k *ecdsa.PrivateKey) string {
+	t.Helper()
+	b, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}))
+}
+
+func sign(t *testing.T, k *ecdsa.PrivateKey, b []byte) []byte {
+	t.Helper()
+	h := sha256.Sum256(b)
+	sig, err := ecdsa.SignASN1(rand.Reader, k, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func signedPayload(dgst digest.Digest) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"gcr.io/p/app"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, dgst))
+}
+
+// fulcio issues short lived code signing certificates like Fulcio does.
+type fulcio struct {
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	rootPEM string
+}
+
+func newFulcio(t *testing.T) *fulcio {
+	t.Helper()
+	f := &fulcio{key: newKey(t)}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake fulcio"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &f.key.PublicKey, f.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	f.rootPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return f
+}
+
+// issue returns a certificate for email valid for ten minutes from
+// notBefore and its key.
+func (f *fulcio) issue(t *testing.T, email string, notBefore time.Time) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	k := newKey(t)
+	issuer, _ := asn1.Marshal(testIssuer)
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       notBefore,
+		NotAfter:        notBefore.Add(10 * time.Minute),
+		EmailAddresses:  []string{email},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: oidFulcioIssuerV2, Value: issuer}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.cert, &k.PublicKey, f.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// rekorEntry returns the bundle of the log entry of sig of payload made
+// with certPEM, integrated at integrated in the log of key.
+func rekorEntry(t *testing.T, key *ecdsa.PrivateKey, certPEM, payload, sig []byte, integrated time.Time) string {
+	t.Helper()
+	var entry hashedRekord
+	entry.Kind = "hashedrekord"
+	h := sha256.Sum256(payload)
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(h[:])
+	entry.Spec.Signature.Content = sig
+	entry.Spec.Signature.PublicKey.Content = certPEM
+	body, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logID := sha256.Sum256(der)
+	b := rekorBundle{Payload: rekorBundlePayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: integrated.Unix(),
+		LogID:          hex.EncodeToString(logID[:]),
+		LogIndex:       7,
+	}}
+	signed, err := json.Marshal(b.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SignedEntryTimestamp = sign(t, key, signed)
+	out, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestParseSignaturePolicy(t *testing.T) {
+	key := publicKeyPEM(t, newKey(t))
+	f := newFulcio(t)
+	rekor := publicKeyPEM(t, newKey(t))
+	keyless := func(identity, issuer, roots, rekorKey string) string {
+		b, _ := json.Marshal(map[string]interface{}{"keyless": keylessPolicy{Identity: identity, Issuer: issuer, Roots: roots, RekorPublicKey: rekorKey}})
+		return string(b)
+	}
+	for _, tc := range []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"public key", fmt.Sprintf(`{"public-key":%q}`, key), ""},
+		{"keyless", keyless("ci@example.com", testIssuer, f.rootPEM, rekor), ""},
+		{"not json", "{", "error parsing"},
+		{"neither", "{}", "one of public-key or keyless"},
+		{"both", fmt.Sprintf(`{"public-key":%q,"keyless":{}}`, key), "only one of"},
+		{"bad public key", `{"public-key":"key"}`, "not PEM encoded"},
+		{"keyless without identity", keyless("", testIssuer, f.rootPEM, rekor), "identity and issuer"},
+		{"keyless without roots", keyless("ci@example.com", testIssuer, "", rekor), "PEM encoded roots"},
+		{"keyless without rekor key", keyless("ci@example.com", testIssuer, f.rootPEM, ""), "rekor-public-key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := parseSignaturePolicy(tc.policy)
+			checkError(t, err, tc.wantErr)
+			if tc.policy == "" && p != nil {
+				t.Errorf("parseSignaturePolicy of an empty attribute = %+v, want nil", p)
+			}
+		})
+	}
+}
+
+func TestVerifyPublicKeySignature(t *testing.T) {
+	k := newKey(t)
+	p, err := parseSignaturePolicy(fmt.Sprintf(`{"public-key":%q}`, publicKeyPEM(t, k)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromString("image")
+	payload := signedPayload(dgst)
+	for _, tc := range []struct {
+		name    string
+		sig     []byte
+		payload []byte
+		dgst    digest.Digest
+		wantErr string
+	}{
+		{"valid", sign(t, k, payload), payload, dgst, ""},
+		{"other key", sign(t, newKey(t), payload), payload, dgst, "does not match"},
+		{"other image", sign(t, k, payload), payload, digest.FromString("other"), "signature is for digest"},
+		{"modified payload", sign(t, k, payload), append([]byte(" "), payload...), dgst, "does not match"},
+		{"no signature", nil, payload, dgst, "missing or malformed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(tc.sig)}
+			checkError(t, p.verifyPayload(annotations, tc.payload, tc.dgst), tc.wantErr)
+		})
+	}
+}
+
+func TestVerifyKeylessSignature(t *testing.T) {
+	f := newFulcio(t)
+	rekor := newKey(t)
+	const identity = "ci@example.com"
+	b, _ := json.Marshal(map[string]interface{}{"keyless": keylessPolicy{
+		Identity:       identity,
+		Issuer:         testIssuer,
+		Roots:          f.rootPEM,
+		RekorPublicKey: publicKeyPEM(t, rekor),
+	}})
+	p, err := parseSignaturePolicy(string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromString("image")
+	payload := signedPayload(dgst)
+	// The certificate expired long before the image is verified.
+	issued := time.Now().Add(-2 * time.Hour)
+
+	for _, tc := range []struct {
+		name    string
+		email   string
+		bundle  func(cert, sig []byte) string
+		wantErr string
+	}{
+		{"logged while valid", identity, func(cert, sig []byte) string {
+			return rekorEntry(t, rekor, cert, payload, sig, issued.Add(time.Minute))
+		}, ""},
+		{"no bundle", identity, func(cert, sig []byte) string { return "" }, "missing transparency log bundle"},
+		{"logged after expiry", identity, func(cert, sig []byte) string {
+			return rekorEntry(t, rekor, cert, payload, sig, issued.Add(time.Hour))
+		}, "invalid signing certificate"},
+		{"other log", identity, func(cert, sig []byte) string {
+			return rekorEntry(t, newKey(t), cert, payload, sig, issued.Add(time.Minute))
+		}, "from log"},
+		{"tampered time", identity, func(cert, sig []byte) string {
+			var b rekorBundle
+			json.Unmarshal([]byte(rekorEntry(t, rekor, cert, payload, sig, issued.Add(time.Hour))), &b)
+			b.Payload.IntegratedTime = issued.Add(time.Minute).Unix()
+			out, _ := json.Marshal(b)
+			return string(out)
+		}, "signature does not match"},
+		{"entry of another signature", identity, func(cert, sig []byte) string {
+			return rekorEntry(t, rekor, cert, payload, []byte("other"), issued.Add(time.Minute))
+		}, "another signature"},
+		{"entry of another payload", identity, func(cert, sig []byte) string {
+			return rekorEntry(t, rekor, cert, []byte("other"), sig, issued.Add(time.Minute))
+		}, "another payload"},
+		{"other identity", "someone@example.com", func(cert, sig []byte) string {
+			return rekorEntry(t, rekor, cert, payload, sig, issued.Add(time.Minute))
+		}, "identity does not match"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k, cert := f.issue(t, tc.email, issued)
+			sig := sign(t, k, payload)
+			annotations := map[string]string{
+				cosignSignatureAnnotation:   base64.StdEncoding.EncodeToString(sig),
+				cosignCertificateAnnotation: string(cert),
+			}
+			if bundle := tc.bundle(cert, sig); bundle != "" {
+				annotations[cosignBundleAnnotation] = bundle
+			}
+			checkError(t, p.verifyPayload(annotations, payload, dgst), tc.wantErr)
+		})
+	}
+}
+
+// checkError checks that err contains want, or is nil if want is empty.
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("unexpected error: %v", err)
+	case want != "" && err == nil:
+		t.Errorf("no error, want one containing %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Errorf("error = %v, want one containing %q", err, want)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// Snapshotters built into containerd. overlayfs is the default, native
+// works on any filesystem, btrfs and zfs need containerd's root on such a
+// filesystem and devmapper needs a thin pool configured in containerd's
+// config.
+const (
+	snapshotterOverlayfs = "overlayfs"
+	snapshotterNative    = "native"
+	snapshotterDevmapper = "devmapper"
+	snapshotterBtrfs     = "btrfs"
+	snapshotterZFS       = "zfs"
+)
+
+var builtinSnapshotters = map[string]bool{
+	snapshotterOverlayfs: true,
+	snapshotterNative:    true,
+	snapshotterDevmapper: true,
+	snapshotterBtrfs:     true,
+	snapshotterZFS:       true,
+}
+
+// Snapshotters that support lazy pulling, these must be configured as proxy
+// plugins in containerd's config.
+const (
+	snapshotterStargz = "stargz"
+	snapshotterSOCI   = "soci"
+)
+
+// isRemoteSnapshotter reports whether the snapshotter fetches layers on
+// demand, in which case layers need the image labels to find their content.
+func isRemoteSnapshotter(name string) bool {
+	return name == snapshotterStargz || name == snapshotterSOCI
+}
+
+// snapshotter returns the snapshotter set in md, or -snapshotter.
+func (a *attributesJSON) snapshotter() string {
+	if a.Snapshotter != "" {
+		return a.Snapshotter
+	}
+	return *snapshotterFlag
+}
+
+// resolveSnapshotter returns name if containerd has a working snapshotter by
+// that name, otherwise the default snapshotter.
+func resolveSnapshotter(ctx context.Context, client *containerd.Client, name string) string {
+	if name == "" || name == containerd.DefaultSnapshotter {
+		return containerd.DefaultSnapshotter
+	}
+	if err := checkSnapshotter(ctx, client, name); err != nil {
+		logger.Warnf("Snapshotter %q is unavailable, using %s: %v", name, containerd.DefaultSnapshotter, err)
+		return containerd.DefaultSnapshotter
+	}
+	return name
+}
+
+func checkSnapshotter(ctx context.Context, client *containerd.Client, name string) error {
+	resp, err := client.IntrospectionService().Plugins(ctx, []string{fmt.Sprintf("type==io.containerd.snapshotter.v1,id==%s", name)})
+	if err != nil {
+		return err
+	}
+	if len(resp.Plugins) == 0 {
+		if !builtinSnapshotters[name] {
+			return fmt.Errorf("no snapshotter plugin %q, other than %s, %s, %s, %s and %s snapshotters must be configured as proxy plugins in containerd's config", name, snapshotterOverlayfs, snapshotterNative, snapshotterDevmapper, snapshotterBtrfs, snapshotterZFS)
+		}
+		return fmt.Errorf("no snapshotter plugin %q", name)
+	}
+	if e := resp.Plugins[0].InitErr; e != nil {
+		return fmt.Errorf("snapshotter plugin %q failed to load: %s", name, e.Message)
+	}
+	if name == snapshotterDevmapper {
+		if _, err := os.Stat("/dev/mapper/control"); err != nil {
+			return fmt.Errorf("device-mapper is unavailable: %v", err)
+		}
+	}
+	// A loaded plugin can still fail on use, such as devmapper whose thin
+	// pool has been removed.
+	errStop := errors.New("stop")
+	if err := client.SnapshotService(name).Walk(ctx, func(context.Context, snapshots.Info) error { return errStop }); err != nil && err != errStop {
+		return fmt.Errorf("snapshotter %q is not usable: %v", name, err)
+	}
+	return nil
+}
+
+// pullSnapshotterOpts returns the pull options to unpack into snapshotter.
+func pullSnapshotterOpts(snapshotter, ref string) []containerd.RemoteOpt {
+	opts := []containerd.RemoteOpt{containerd.WithPullSnapshotter(snapshotter)}
+	if isRemoteSnapshotter(snapshotter) {
+		opts = append(opts, containerd.WithImageHandlerWrapper(snapshotters.AppendInfoHandlerWrapper(ref)))
+	}
+	return opts
+}
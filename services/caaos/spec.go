@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/platforms"
+	"github.com/ghodss/yaml"
+	"github.com/google/shlex"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/robfig/cron"
+)
+
+// Spec is the document stored in the caaos-spec attribute, it may be
+// written as either YAML or JSON.
+type Spec struct {
+	// InitContainers are run in order, each to completion, before any of
+	// Containers are started.
+	InitContainers []ContainerSpec `json:"init-containers"`
+	Containers     []ContainerSpec `json:"containers"`
+	// Disks are mounted on the host before any containers start.
+	Disks []DiskSpec `json:"disks"`
+	// Namespaces grants users access to the containers of each namespace
+	// through the control socket.
+	Namespaces map[string]NamespaceSpec `json:"namespaces"`
+}
+
+// ContainerSpec describes a single container to run.
+type ContainerSpec struct {
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+	// Args replaces the image's entrypoint and command, Command replaces
+	// only the command.
+	Args          []string       `json:"args"`
+	Command       []string       `json:"command"`
+	Env           envMap         `json:"env"`
+	Mounts        []MountSpec    `json:"mounts"`
+	Ports         []PortSpec     `json:"ports"`
+	RestartPolicy string         `json:"restart-policy"`
+	PullPolicy    string         `json:"pull-policy"`
+	Resources     *ResourcesSpec `json:"resources"`
+	Security      *SecuritySpec  `json:"security"`
+	GPU           *GPUSpec       `json:"gpu"`
+	// Kind is "service" (the default), which is kept running according to
+	// its restart policy, or "job", which runs to completion once.
+	Kind string `json:"kind"`
+	// Schedule is a standard cron expression, when set the container is run
+	// each time the schedule fires instead of being kept running.
+	Schedule string `json:"schedule"`
+	// Timeout is the longest a job or scheduled container may run, such as
+	// "30m", after which it is stopped and its run recorded as timed-out.
+	Timeout string `json:"timeout"`
+	// DependsOn lists containers that must be started before this one.
+	DependsOn []string `json:"depends-on"`
+	// Sidecars are started each time this container starts, share its
+	// network namespace and are stopped when it exits.
+	Sidecars []ContainerSpec `json:"sidecars"`
+	// Hooks are run before each start of the container and after it stops.
+	Hooks *HooksSpec `json:"hooks"`
+
+	// netns is the network namespace to join, set for sidecars.
+	netns string
+	// Network is "host" (the default) to share the host's network namespace
+	// or "bridge" to give the container its own address via CNI.
+	Network string `json:"network"`
+	// Runtime is the containerd runtime to use, either one of the short
+	// names in runtimes or a full runtime name. Empty uses containerd's
+	// default.
+	Runtime string `json:"runtime"`
+	// ReadOnlyRootfs mounts the container's root filesystem read only, use
+	// Tmpfs or Mounts for paths that need to be writable.
+	ReadOnlyRootfs bool `json:"read-only-rootfs"`
+	// Tmpfs lists tmpfs mounts as "path" or "path:options", where options
+	// is a comma separated list of mount options such as "size=64m".
+	Tmpfs []string `json:"tmpfs"`
+	// TmpfsRootfs, if set, is the size in bytes of a tmpfs the container's
+	// writable layer is placed on instead of the disk. Writes beyond it fail
+	// and are lost when the container exits.
+	TmpfsRootfs int64 `json:"tmpfs-rootfs"`
+	// Egress restricts the connections the container can make, enforced
+	// with nftables.
+	Egress *EgressSpec `json:"egress"`
+	// HostPorts are opened in the host firewall while the container runs,
+	// as "port[-last][/protocol]" with the protocol defaulting to tcp.
+	HostPorts []string `json:"host-ports"`
+	// User is the user to run as, "uid", "uid:gid", "user" or "user:group",
+	// names are resolved from the image's /etc/passwd and /etc/group. Empty
+	// uses the image's user.
+	User string `json:"user"`
+	// Groups are supplemental groups, by name or gid, added to those of
+	// the user in the image's /etc/group.
+	Groups []string `json:"groups"`
+	// Secrets are written to files in the container.
+	Secrets []SecretFileSpec `json:"secrets"`
+	// HealthCheck is run periodically once the container has started.
+	HealthCheck *HealthCheckSpec `json:"health-check"`
+	// RestartOnOOM stops the container when any of its processes is OOM
+	// killed so that it is restarted as a failure by its restart policy.
+	RestartOnOOM bool `json:"restart-on-oom"`
+	// OnExit is what to do once the container has exited and will not be
+	// restarted: "none" (the default), "poweroff", "reboot" or
+	// "run-container:<image>" to run a cleanup container.
+	OnExit string `json:"on-exit"`
+	// CrashLoop configures when to stop restarting a failing container, by
+	// default after 5 failures within 10 minutes.
+	CrashLoop *CrashLoopSpec `json:"crash-loop"`
+	// Ulimits are keyed by name, such as nofile, nproc or memlock.
+	Ulimits map[string]UlimitSpec `json:"ulimits"`
+	// Sysctls are namespaced kernel parameters, net.* sysctls require
+	// bridge networking.
+	Sysctls map[string]string `json:"sysctls"`
+	// Devices are host devices to expose, "host-path[:container-path[:rwm]]".
+	Devices []string `json:"devices"`
+	// Hostname is the container's hostname, it resolves to 127.0.1.1.
+	Hostname string `json:"hostname"`
+	// DNS replaces the host's resolv.conf.
+	DNS *DNSSpec `json:"dns"`
+	// ExtraHosts are added to the host's /etc/hosts as "hostname:ip".
+	ExtraHosts []string `json:"extra-hosts"`
+	// Platform selects the variant of a multi-arch image to run, such as
+	// linux/arm64. Empty uses the host's platform.
+	Platform string `json:"platform"`
+	// Logging selects where the container's output is sent.
+	Logging *LoggingSpec `json:"logging"`
+	// Namespace is the containerd namespace to run the container in, giving
+	// it images and containers of its own. Empty uses the agent's namespace,
+	// sidecars default to their container's.
+	Namespace string `json:"namespace"`
+}
+
+// runtimes maps short runtime names to containerd runtime names.
+var runtimes = map[string]string{
+	"runc":   "io.containerd.runc.v2",
+	"runsc":  "io.containerd.runsc.v1",
+	"gvisor": "io.containerd.runsc.v1",
+	"kata":   "io.containerd.kata.v2",
+}
+
+// runtimeName returns the containerd runtime name for the container.
+func (c ContainerSpec) runtimeName() string {
+	if r, ok := runtimes[c.Runtime]; ok {
+		return r
+	}
+	return c.Runtime
+}
+
+// MountSpec describes a mount inside the container.
+type MountSpec struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+	// Create makes the host source directory if it does not exist.
+	Create bool `json:"create"`
+	// Server is the NFS server of an nfs mount, whose source is the path
+	// of the export.
+	Server string `json:"server"`
+}
+
+// PortSpec describes a port the container listens on.
+type PortSpec struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	// HostPort is the port published on the host when using the bridge
+	// network, it defaults to Port.
+	HostPort int `json:"host-port"`
+	// Firewall opens the port in the host firewall while the container
+	// runs.
+	Firewall bool `json:"firewall"`
+}
+
+// ResourcesSpec describes resource limits for the container.
+type ResourcesSpec struct {
+	// Memory is the memory limit in bytes.
+	Memory    int64  `json:"memory"`
+	CPUShares uint64 `json:"cpu-shares"`
+	// CPUQuota is the CPU time in microseconds the container may use every
+	// CPUPeriod microseconds.
+	CPUQuota  int64  `json:"cpu-quota"`
+	CPUPeriod uint64 `json:"cpu-period"`
+	// Pids is the maximum number of processes.
+	Pids int64 `json:"pids"`
+	// Disk is the limit in bytes of the container's writable layer. It is
+	// checked periodically, a container over the limit is stopped and
+	// restarted according to its restart policy.
+	Disk int64 `json:"disk"`
+	// IngressBandwidth and EgressBandwidth limit the container's network
+	// traffic in bits per second, on the bridge network only.
+	IngressBandwidth int64 `json:"ingress-bandwidth"`
+	EgressBandwidth  int64 `json:"egress-bandwidth"`
+	// BlockIO throttles the container's IO to block devices.
+	BlockIO []BlockIOSpec `json:"block-io"`
+}
+
+// parseSpec parses a YAML or JSON spec, unknown fields are rejected so that
+// typos don't silently get ignored.
+func parseSpec(data string) (*Spec, error) {
+	j, err := yaml.YAMLToJSON([]byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing caaos-spec: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	var spec Spec
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("error parsing caaos-spec: %v", err)
+	}
+	return &spec, nil
+}
+
+// validationError collects all the problems found in a spec so they can be
+// reported at once.
+type validationError []string
+
+func (v validationError) Error() string {
+	return "invalid spec: " + strings.Join(v, "; ")
+}
+
+func (v *validationError) add(format string, a ...interface{}) {
+	*v = append(*v, fmt.Sprintf(format, a...))
+}
+
+// validate checks the spec for errors and fills in default container names.
+func (spec *Spec) validate() error {
+	var verr validationError
+	seen := map[string]bool{}
+	for i := range spec.InitContainers {
+		c := &spec.InitContainers[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("init-%d", i)
+		}
+		field := fmt.Sprintf("init-containers[%d]", i)
+		if c.Schedule != "" {
+			verr.add("%s: init containers can not have a schedule", field)
+		}
+		if len(c.DependsOn) > 0 {
+			verr.add("%s: init containers can not have depends-on", field)
+		}
+		validateContainer(&verr, field, c, seen)
+	}
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("container-%d", i)
+		}
+		field := fmt.Sprintf("containers[%d]", i)
+		validateContainer(&verr, field, c, seen)
+		for j := range c.Sidecars {
+			sc := &c.Sidecars[j]
+			if sc.Name == "" {
+				sc.Name = fmt.Sprintf("%s-sidecar-%d", c.Name, j)
+			}
+			sfield := fmt.Sprintf("%s.sidecars[%d]", field, j)
+			if sc.Schedule != "" || len(sc.DependsOn) > 0 || len(sc.Sidecars) > 0 {
+				verr.add("%s: sidecars can not have a schedule, depends-on or sidecars", sfield)
+			}
+			if sc.Namespace == "" {
+				sc.Namespace = c.Namespace
+			} else if sc.Namespace != c.Namespace {
+				verr.add("%s.namespace: sidecars must run in their container's namespace", sfield)
+			}
+			validateContainer(&verr, sfield, sc, seen)
+		}
+	}
+	validateDependencies(&verr, spec.Containers)
+	validatePorts(&verr, spec)
+	validateDisks(&verr, spec)
+	for ns := range spec.Namespaces {
+		if err := identifiers.Validate(ns); err != nil {
+			verr.add("namespaces: %v", err)
+		}
+	}
+	if len(verr) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validateDependencies checks that depends-on only references other
+// containers and contains no cycles.
+func validateDependencies(verr *validationError, list []ContainerSpec) {
+	deps := map[string][]string{}
+	for i, c := range list {
+		for _, d := range c.DependsOn {
+			found := false
+			for _, o := range list {
+				if o.Name == d && d != c.Name {
+					found = true
+				}
+			}
+			if !found {
+				verr.add("containers[%d].depends-on: unknown container %q", i, d)
+			}
+		}
+		deps[c.Name] = c.DependsOn
+	}
+
+	// Depth first search for cycles.
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			return false
+		case done:
+			return true
+		}
+		state[name] = visiting
+		for _, d := range deps[name] {
+			if !visit(d) {
+				return false
+			}
+		}
+		state[name] = done
+		return true
+	}
+	for _, c := range list {
+		if !visit(c.Name) {
+			verr.add("depends-on: dependency cycle involving container %q", c.Name)
+			return
+		}
+	}
+}
+
+// validateContainer checks a single container, seen holds the names of the
+// containers validated so far.
+func validateContainer(verr *validationError, field string, c *ContainerSpec, seen map[string]bool) {
+	if seen[c.Name] {
+		verr.add("%s: duplicate container name %q", field, c.Name)
+	}
+	seen[c.Name] = true
+	// containerd IDs are the name with a random suffix, see containerID.
+	if err := identifiers.Validate(c.Name + "-000000"); err != nil {
+		verr.add("%s.name: %v", field, err)
+	}
+	validateImage(verr, field, c.Image)
+	c.Egress.validate(verr, field)
+	if c.Digest != "" {
+		if _, err := digest.Parse(c.Digest); err != nil {
+			verr.add("%s.digest: %v", field, err)
+		}
+	}
+	if c.Platform != "" {
+		if _, err := platforms.Parse(c.Platform); err != nil {
+			verr.add("%s.platform: %v", field, err)
+		}
+	}
+	if len(c.Args) > 0 && len(c.Command) > 0 {
+		verr.add("%s: only one of args and command may be set", field)
+	}
+	validateExec(verr, field, c)
+	if c.Namespace != "" {
+		if err := identifiers.Validate(c.Namespace); err != nil {
+			verr.add("%s.namespace: %v", field, err)
+		}
+	}
+	switch c.Network {
+	case "", networkHost, networkBridge:
+	default:
+		verr.add("%s.network: unknown network %q", field, c.Network)
+	}
+	if _, err := parsePullPolicy(c.PullPolicy); err != nil {
+		verr.add("%s.pull-policy: %v", field, err)
+	}
+	if _, err := parseRestartPolicy(c.RestartPolicy); err != nil {
+		verr.add("%s.restart-policy: %v", field, err)
+	}
+	if err := validateOnExit(c.OnExit); err != nil {
+		verr.add("%s.on-exit: %v", field, err)
+	}
+	if err := c.CrashLoop.validate(); err != nil {
+		verr.add("%s.crash-loop: %v", field, err)
+	}
+	for k := range c.Env {
+		if k == "" || strings.Contains(k, "=") {
+			verr.add("%s.env: invalid variable name %q", field, k)
+		}
+	}
+	for j, sf := range c.Secrets {
+		if err := sf.validate(); err != nil {
+			verr.add("%s.secrets[%d]: %v", field, j, err)
+		}
+	}
+	if c.TmpfsRootfs < 0 {
+		verr.add("%s.tmpfs-rootfs: size must not be negative", field)
+	}
+	if c.TmpfsRootfs > 0 && c.ReadOnlyRootfs {
+		verr.add("%s.tmpfs-rootfs: can not be set with read-only-rootfs", field)
+	}
+	if c.TmpfsRootfs > 0 && c.Resources != nil && c.Resources.Disk > 0 {
+		verr.add("%s.tmpfs-rootfs: can not be set with a disk limit, the tmpfs size limits the writable layer", field)
+	}
+	for j, t := range c.Tmpfs {
+		if m := parseTmpfs(t); !filepath.IsAbs(m.Destination) {
+			verr.add("%s.tmpfs[%d]: destination %q must be an absolute path", field, j, m.Destination)
+		}
+	}
+	for j, m := range c.Mounts {
+		mfield := fmt.Sprintf("%s.mounts[%d]", field, j)
+		if !filepath.IsAbs(m.Destination) {
+			verr.add("%s: destination %q must be an absolute path", mfield, m.Destination)
+		}
+		switch m.Type {
+		case "", "bind":
+			if !filepath.IsAbs(m.Source) {
+				verr.add("%s: source %q must be an absolute path", mfield, m.Source)
+			}
+		case "tmpfs":
+		case mountNFS:
+			if m.Server == "" {
+				verr.add("%s: server is required for nfs mounts", mfield)
+			}
+			if !filepath.IsAbs(m.Source) {
+				verr.add("%s: export %q must be an absolute path", mfield, m.Source)
+			}
+		case mountGCSFuse:
+			if bucket := strings.SplitN(m.Source, "/", 2)[0]; bucket == "" || strings.Contains(m.Source, "..") {
+				verr.add("%s: source %q must be a bucket name, optionally followed by /directory", mfield, m.Source)
+			}
+		case mountDisk:
+			// Resolved by validateDisks.
+		default:
+			verr.add("%s: unknown mount type %q", mfield, m.Type)
+		}
+	}
+	for j, p := range c.Ports {
+		pfield := fmt.Sprintf("%s.ports[%d]", field, j)
+		if p.Port < 1 || p.Port > 65535 {
+			verr.add("%s: port %d out of range", pfield, p.Port)
+		}
+		if p.Protocol != "" && p.Protocol != "tcp" && p.Protocol != "udp" {
+			verr.add("%s: unknown protocol %q", pfield, p.Protocol)
+		}
+		if p.HostPort < 0 || p.HostPort > 65535 {
+			verr.add("%s: host-port %d out of range", pfield, p.HostPort)
+		}
+	}
+	for j, s := range c.HostPorts {
+		if _, err := parseHostPort(s); err != nil {
+			verr.add("%s.host-ports[%d]: %v", field, j, err)
+		}
+	}
+	if _, ok := runtimes[c.Runtime]; !ok && c.Runtime != "" && !strings.HasPrefix(c.Runtime, "io.containerd.") {
+		verr.add("%s.runtime: unknown runtime %q", field, c.Runtime)
+	}
+	if c.Schedule != "" {
+		if _, err := cron.ParseStandard(c.Schedule); err != nil {
+			verr.add("%s.schedule: %v", field, err)
+		}
+	}
+	if err := validateKind(*c); err != nil {
+		verr.add("%s.kind: %v", field, err)
+	}
+	if err := validateTimeout(*c); err != nil {
+		verr.add("%s.timeout: %v", field, err)
+	}
+	c.Hooks.validate(verr, field, c)
+	if err := c.GPU.validate(); err != nil {
+		verr.add("%s.gpu: %v", field, err)
+	}
+	if err := c.Security.validate(); err != nil {
+		verr.add("%s.security: %v", field, err)
+	}
+	if strings.Count(c.User, ":") > 1 || strings.HasPrefix(c.User, ":") || strings.HasSuffix(c.User, ":") {
+		verr.add("%s.user: invalid user %q", field, c.User)
+	}
+	if err := c.HealthCheck.validate(); err != nil {
+		verr.add("%s.health-check: %v", field, err)
+	}
+	for j, d := range c.Devices {
+		if _, _, _, err := parseDevice(d); err != nil {
+			verr.add("%s.devices[%d]: %v", field, j, err)
+		}
+	}
+	if c.Hostname != "" {
+		if err := validateHostname(c.Hostname); err != nil {
+			verr.add("%s.hostname: %v", field, err)
+		}
+	}
+	if err := c.DNS.validate(); err != nil {
+		verr.add("%s.dns: %v", field, err)
+	}
+	if err := c.Logging.validate(); err != nil {
+		verr.add("%s.logging: %v", field, err)
+	}
+	for j, h := range c.ExtraHosts {
+		if _, _, err := parseExtraHost(h); err != nil {
+			verr.add("%s.extra-hosts[%d]: %v", field, j, err)
+		}
+	}
+	if err := validateUlimits(c.Ulimits); err != nil {
+		verr.add("%s.ulimits: %v", field, err)
+	}
+	if err := validateSysctls(c.Sysctls, c.Network != networkBridge && c.netns == ""); err != nil {
+		verr.add("%s.sysctls: %v", field, err)
+	}
+	if r := c.Resources; r != nil {
+		if r.Memory < 0 {
+			verr.add("%s.resources: memory must not be negative", field)
+		}
+		if r.CPUQuota < 0 {
+			verr.add("%s.resources: cpu-quota must not be negative", field)
+		}
+		if r.CPUQuota > 0 && r.CPUPeriod != 0 && r.CPUPeriod < 1000 {
+			verr.add("%s.resources: cpu-period must be at least 1000", field)
+		}
+		if r.Pids < 0 {
+			verr.add("%s.resources: pids must not be negative", field)
+		}
+		if r.Disk < 0 {
+			verr.add("%s.resources: disk must not be negative", field)
+		}
+		if r.IngressBandwidth < 0 || r.EgressBandwidth < 0 {
+			verr.add("%s.resources: bandwidth must not be negative", field)
+		}
+		if (r.IngressBandwidth > 0 || r.EgressBandwidth > 0) && (c.Network != networkBridge || c.netns != "") {
+			verr.add("%s.resources: bandwidth can only be limited on the bridge network", field)
+		}
+		validateBlockIO(verr, field, r.BlockIO)
+	}
+}
+
+// baseSpec returns the spec described by the attributes without the
+// project's containers or the legacy container-* attributes applied. In
+// order of precedence the spec is read from caaos-spec, caaos-compose,
+// containers or container-id/container-args, which are treated as a single
+// container named "main". A nil spec means no containers are set.
+func (a *attributesJSON) baseSpec() (*Spec, error) {
+	spec := &Spec{}
+	switch {
+	case a.Spec != "":
+		var err error
+		spec, err = parseSpec(a.Spec)
+		if err != nil {
+			return nil, err
+		}
+	case a.Compose != "":
+		var err error
+		spec, err = parseCompose(a.Compose)
+		if err != nil {
+			return nil, err
+		}
+	case a.Containers != "":
+		if err := json.Unmarshal([]byte(a.Containers), &spec.Containers); err != nil {
+			return nil, fmt.Errorf("error parsing containers: %v", err)
+		}
+	case a.ContainerID != "":
+		var args []string
+		if a.ContainerArgs != "" {
+			var err error
+			args, err = shlex.Split(a.ContainerArgs)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing arguments: %v", err)
+			}
+		}
+		spec.Containers = []ContainerSpec{{Name: "main", Image: a.ContainerID, Digest: a.ContainerDigest, Args: args}}
+	default:
+		return nil, nil
+	}
+	return spec, nil
+}
+
+// spec returns the containers defined by the attributes, merged with the
+// project's containers if any, with the legacy container-* attributes
+// applied and validated. A nil spec means no containers are set.
+func (a *attributesJSON) spec() (*Spec, error) {
+	spec, err := a.baseSpec()
+	if err != nil {
+		return nil, err
+	}
+	if a.project != nil {
+		pspec, err := a.project.baseSpec()
+		if err != nil {
+			return nil, fmt.Errorf("project attributes: %v", err)
+		}
+		spec = mergeSpecs(pspec, spec)
+	}
+	if spec == nil {
+		return nil, nil
+	}
+
+	env, err := parseEnv(a.ContainerEnv)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing container-env: %v", err)
+	}
+	var resources *ResourcesSpec
+	if a.ContainerResources != "" {
+		if err := json.Unmarshal([]byte(a.ContainerResources), &resources); err != nil {
+			return nil, fmt.Errorf("error parsing container-resources: %v", err)
+		}
+	}
+	var mounts []MountSpec
+	if a.ContainerMounts != "" {
+		if err := json.Unmarshal([]byte(a.ContainerMounts), &mounts); err != nil {
+			return nil, fmt.Errorf("error parsing container-mounts: %v", err)
+		}
+	}
+
+	lists := [][]ContainerSpec{spec.InitContainers, spec.Containers}
+	for _, c := range spec.Containers {
+		lists = append(lists, c.Sidecars)
+	}
+	for _, list := range lists {
+		if err := a.applyDefaults(list, env, mounts, resources); err != nil {
+			return nil, err
+		}
+	}
+	return spec, spec.validate()
+}
+
+// applyDefaults applies the settings from flat attributes to each container
+// that does not override them.
+func (a *attributesJSON) applyDefaults(list []ContainerSpec, env map[string]string, mounts []MountSpec, resources *ResourcesSpec) error {
+	for i := range list {
+		if list[i].RestartPolicy == "" {
+			list[i].RestartPolicy = a.RestartPolicy
+		}
+		if list[i].PullPolicy == "" {
+			list[i].PullPolicy = a.PullPolicy
+		}
+		if list[i].Network == "" {
+			list[i].Network = a.ContainerNetwork
+		}
+		if a.EnableGPU && list[i].GPU == nil {
+			list[i].GPU = &GPUSpec{}
+		}
+		if a.Privileged {
+			if list[i].Security == nil {
+				list[i].Security = &SecuritySpec{}
+			}
+			list[i].Security.Privileged = true
+		}
+		if list[i].Resources == nil {
+			list[i].Resources = resources
+		}
+		list[i].Env = mergeEnv(env, list[i].Env)
+		list[i].Mounts = append(mounts[:len(mounts):len(mounts)], list[i].Mounts...)
+		if err := expandEnv(list[i].Env, a.all); err != nil {
+			return fmt.Errorf("container %q: %v", list[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// specOpts returns the OCI spec options derived from the container spec.
+func (c ContainerSpec) specOpts() []oci.SpecOpts {
+	opts := c.Security.specOpts()
+	if len(c.Args) > 0 {
+		opts = append(opts, oci.WithProcessArgs(c.Args...))
+	}
+	if len(c.Env) > 0 {
+		var env []string
+		for k, v := range c.Env {
+			// Secrets are resolved when the container starts.
+			if !hasSecretRef(v) {
+				env = append(env, k+"="+v)
+			}
+		}
+		sort.Strings(env)
+		opts = append(opts, oci.WithEnv(env))
+	}
+	if mounts := c.allMounts(); len(mounts) > 0 {
+		opts = append(opts, oci.WithMounts(ociMounts(mounts)))
+	}
+	if c.ReadOnlyRootfs {
+		opts = append(opts, oci.WithRootFSReadonly())
+	}
+	if r := c.Resources; r != nil {
+		opts = append(opts, withResources(r))
+		if len(r.BlockIO) > 0 {
+			opts = append(opts, withBlockIO(r.BlockIO))
+		}
+	}
+	if c.User != "" {
+		opts = append(opts, oci.WithUser(c.User), oci.WithAdditionalGIDs(c.User))
+	}
+	if len(c.Groups) > 0 {
+		opts = append(opts, oci.WithAppendAdditionalGroups(c.Groups...))
+	}
+	if len(c.Ulimits) > 0 {
+		opts = append(opts, withUlimits(c.Ulimits))
+	}
+	if len(c.Sysctls) > 0 {
+		opts = append(opts, withSysctls(c.Sysctls))
+	}
+	opts = append(opts, withDevices(c.Devices)...)
+	opts = append(opts, c.GPU.specOpts()...)
+	switch {
+	case c.netns != "":
+		opts = append(opts, withNetNS(c.netns))
+	case c.Network != networkBridge:
+		opts = append(opts, oci.WithHostNamespace(specs.NetworkNamespace))
+	}
+	return opts
+}
+
+// defaultCPUPeriod is the kernel's default CFS period in microseconds.
+const defaultCPUPeriod = 100000
+
+func withResources(r *ResourcesSpec) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *specs.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+		if r.Memory > 0 {
+			if s.Linux.Resources.Memory == nil {
+				s.Linux.Resources.Memory = &specs.LinuxMemory{}
+			}
+			limit := r.Memory
+			s.Linux.Resources.Memory.Limit = &limit
+		}
+		if r.CPUShares > 0 || r.CPUQuota > 0 {
+			if s.Linux.Resources.CPU == nil {
+				s.Linux.Resources.CPU = &specs.LinuxCPU{}
+			}
+		}
+		if r.CPUShares > 0 {
+			shares := r.CPUShares
+			s.Linux.Resources.CPU.Shares = &shares
+		}
+		if r.CPUQuota > 0 {
+			quota := r.CPUQuota
+			period := r.CPUPeriod
+			if period == 0 {
+				period = defaultCPUPeriod
+			}
+			s.Linux.Resources.CPU.Quota = &quota
+			s.Linux.Resources.CPU.Period = &period
+		}
+		if r.Pids > 0 {
+			s.Linux.Resources.Pids = &specs.LinuxPids{Limit: r.Pids}
+		}
+		return nil
+	}
+}
+
+// verifyDigest returns an error if want is set and does not match the digest
+// that img resolved to, protecting against tags being moved.
+func verifyDigest(img containerd.Image, want string) error {
+	if want == "" {
+		return nil
+	}
+	if got := img.Target().Digest.String(); got != want {
+		return fmt.Errorf("image %s resolved to digest %s, expected %s; refusing to run", img.Name(), got, want)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSpec(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"yaml", "containers:\n- name: app\n  image: gcr.io/p/app:1\n  args: [serve, --port=80]\n", false},
+		{"json", `{"containers":[{"name":"app","image":"gcr.io/p/app:1"}]}`, false},
+		{"unknown field", "containers:\n- name: app\n  imgae: gcr.io/p/app:1\n", true},
+		{"unknown top level field", "container:\n- name: app\n", true},
+		{"not yaml", "containers: [", true},
+		{"wrong type", "containers:\n  name: app\n", true},
+	} {
+		spec, err := parseSpec(tc.data)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: parseSpec = %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (len(spec.Containers) != 1 || spec.Containers[0].Image != "gcr.io/p/app:1") {
+			t.Errorf("%s: parseSpec = %+v, want one gcr.io/p/app:1 container", tc.name, spec)
+		}
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		spec string
+		// wantErrs are parts of the errors expected, in order, none if
+		// the spec is valid.
+		wantErrs []string
+	}{
+		{"minimal", "containers:\n- image: gcr.io/p/app:1\n", nil},
+		{"full", `
+init-containers:
+- name: migrate
+  image: gcr.io/p/migrate:1
+containers:
+- name: db
+  image: gcr.io/p/db:1
+  restart-policy: always
+  mounts:
+  - source: /mnt/disks/data
+    destination: /data
+- name: app
+  image: gcr.io/p/app@sha256:0123456789012345678901234567890123456789012345678901234567890123
+  depends-on: [db]
+  restart-policy: on-failure:3
+  pull-policy: never
+  env:
+    MODE: prod
+  ports:
+  - port: 80
+    host-port: 8080
+- name: backup
+  image: gcr.io/p/backup:1
+  schedule: "0 3 * * *"
+`, nil},
+		{"missing image", "containers:\n- name: app\n", []string{"containers[0]: image is required"}},
+		{"duplicate names", "containers:\n- name: app\n  image: a\n- name: app\n  image: b\n", []string{`containers[1]: duplicate container name "app"`}},
+		{"invalid name", "containers:\n- name: My_App!\n  image: a\n", []string{"containers[0].name"}},
+		{"args and command", "containers:\n- image: a\n  args: [a]\n  command: [b]\n", []string{"only one of args and command"}},
+		{"policies", "containers:\n- image: a\n  restart-policy: sometimes\n  pull-policy: often\n", []string{"pull-policy", "restart-policy"}},
+		{"relative mount", "containers:\n- image: a\n  mounts:\n  - source: data\n    destination: /data\n", []string{`source "data" must be an absolute path`}},
+		{"unknown mount type", "containers:\n- image: a\n  mounts:\n  - type: overlay\n    destination: /data\n", []string{`unknown mount type "overlay"`}},
+		{"port out of range", "containers:\n- image: a\n  ports:\n  - port: 70000\n", []string{"port 70000 out of range"}},
+		{"unknown network", "containers:\n- image: a\n  network: overlay\n", []string{`unknown network "overlay"`}},
+		{"bad schedule", "containers:\n- image: a\n  schedule: whenever\n", []string{"containers[0].schedule"}},
+		{"scheduled init container", "init-containers:\n- image: a\n  schedule: \"@daily\"\ncontainers:\n- image: b\n", []string{"init containers can not have a schedule"}},
+		{"unknown dependency", "containers:\n- name: app\n  image: a\n  depends-on: [db]\n", []string{`unknown container "db"`}},
+		{"self dependency", "containers:\n- name: app\n  image: a\n  depends-on: [app]\n", []string{`unknown container "app"`, "dependency cycle"}},
+		{"dependency cycle", "containers:\n- name: a\n  image: a\n  depends-on: [b]\n- name: b\n  image: b\n  depends-on: [a]\n", []string{"dependency cycle"}},
+		{"negative resources", "containers:\n- image: a\n  resources:\n    memory: -1\n    pids: -1\n", []string{"memory must not be negative", "pids must not be negative"}},
+		{"sidecar namespace", "containers:\n- name: app\n  image: a\n  namespace: team\n  sidecars:\n  - image: b\n    namespace: other\n", []string{"sidecars must run in their container's namespace"}},
+		{"all errors reported", "containers:\n- name: app\n- name: app\n  image: a\n  network: overlay\n", []string{"image is required", "duplicate container name", "unknown network"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec, err := parseSpec(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = spec.validate()
+			if len(tc.wantErrs) == 0 {
+				if err != nil {
+					t.Errorf("validate = %v", err)
+				}
+				return
+			}
+			verr, ok := err.(validationError)
+			if !ok {
+				t.Fatalf("validate = %v, want a validationError", err)
+			}
+			if len(verr) != len(tc.wantErrs) {
+				t.Fatalf("validate = %v, want %d errors", err, len(tc.wantErrs))
+			}
+			for i, want := range tc.wantErrs {
+				if !strings.Contains(verr[i], want) {
+					t.Errorf("error %d = %q, want it to contain %q", i, verr[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSpecValidateDefaultNames(t *testing.T) {
+	spec, err := parseSpec("init-containers:\n- image: a\ncontainers:\n- image: b\n  sidecars:\n  - image: c\n- name: web\n  image: d\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.validate(); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{spec.InitContainers[0].Name, spec.Containers[0].Name, spec.Containers[0].Sidecars[0].Name, spec.Containers[1].Name}
+	if want := []string{"init-0", "container-0", "container-0-sidecar-0", "web"}; !equalStrings(got, want) {
+		t.Errorf("names = %v, want %v", got, want)
+	}
+}
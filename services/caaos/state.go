@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+)
+
+// stateFile records the running containers so that they can be reattached
+// to if the agent restarts.
+const stateFile = "/var/lib/caaos/state.json"
+
+// persistedContainer is a running container recorded in the state file.
+type persistedContainer struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	// SpecHash is the hash of the spec the container was started from.
+	SpecHash  string    `json:"spec-hash"`
+	Host      string    `json:"host"`
+	Digest    string    `json:"digest"`
+	StartTime time.Time `json:"start-time"`
+}
+
+type agentDiskState struct {
+	// SpecHash is the hash of the last applied spec.
+	SpecHash string `json:"spec-hash"`
+	// Containers is keyed by containerd container ID.
+	Containers map[string]persistedContainer `json:"containers"`
+	// Handoff is set by an agent that reexeced leaving its containers
+	// running.
+	Handoff *handoffState `json:"handoff,omitempty"`
+}
+
+// stateStore keeps agentDiskState in sync with the state file.
+type stateStore struct {
+	path string
+
+	mx sync.Mutex
+	st agentDiskState
+}
+
+var persisted = &stateStore{path: stateFile, st: agentDiskState{Containers: map[string]persistedContainer{}}}
+
+// load reads the state file, a missing file is an empty state.
+func (s *stateStore) load() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st agentDiskState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+	if st.Containers == nil {
+		st.Containers = map[string]persistedContainer{}
+	}
+	s.st = st
+	return nil
+}
+
+// save writes the state file, s.mx must be held.
+func (s *stateStore) save() {
+	b, err := json.Marshal(s.st)
+	if err != nil {
+		logger.Error("Error encoding state:", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		logger.Error("Error saving state:", err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		logger.Error("Error saving state:", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		logger.Error("Error saving state:", err)
+	}
+}
+
+func (s *stateStore) setSpecHash(hash string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.st.SpecHash = hash
+	s.save()
+}
+
+func (s *stateStore) addContainer(id string, pc persistedContainer) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.st.Containers[id] = pc
+	s.save()
+}
+
+func (s *stateStore) removeContainer(id string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.st.Containers, id)
+	s.save()
+}
+
+func (s *stateStore) container(id string) (persistedContainer, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	pc, ok := s.st.Containers[id]
+	return pc, ok
+}
+
+// namespaces returns the namespaces of the recorded containers.
+func (s *stateStore) namespaces() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	var nss []string
+	for _, pc := range s.st.Containers {
+		if pc.Namespace != "" {
+			nss = append(nss, pc.Namespace)
+		}
+	}
+	return nss
+}
+
+// specHash returns a hash of the parsed spec, specs that only differ in
+// formatting have the same hash.
+func specHash(spec *Spec) string {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// adoptSet holds the containers left running by a previous agent that can
+// be reattached to, each is taken at most once.
+type adoptSet struct {
+	mx         sync.Mutex
+	containers map[string]string
+	persisted  map[string]persistedContainer
+}
+
+func newAdoptSet(containers map[string]persistedContainer) *adoptSet {
+	a := &adoptSet{containers: map[string]string{}, persisted: containers}
+	for id, pc := range containers {
+		a.containers[pc.Name] = id
+	}
+	return a
+}
+
+// take returns the ID of the container to reattach to for name, if any.
+func (a *adoptSet) take(name string) (string, persistedContainer, bool) {
+	if a == nil {
+		return "", persistedContainer{}, false
+	}
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	id, ok := a.containers[name]
+	delete(a.containers, name)
+	return id, a.persisted[id], ok
+}
+
+// remaining returns the containers that were never taken, keyed by ID.
+func (a *adoptSet) remaining() map[string]persistedContainer {
+	if a == nil {
+		return nil
+	}
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	left := map[string]persistedContainer{}
+	for _, id := range a.containers {
+		left[id] = a.persisted[id]
+	}
+	return left
+}
+
+// empty reports whether there is nothing to adopt.
+func (a *adoptSet) empty() bool {
+	if a == nil {
+		return true
+	}
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return len(a.containers) == 0
+}
+
+// adoptContainer reattaches to a container left running by a previous
+// agent and supervises it like runContainer. adopted is false if the
+// container could not be reattached to.
+func (r *runner) adoptContainer(ctx context.Context, logger *Logger, c ContainerSpec, id string, pc persistedContainer) (code uint32, adopted bool, err error) {
+	env := r.environment()
+	cctx := detach(ctx)
+	container, err := r.containerRunner().LoadContainer(cctx, id)
+	if err != nil {
+		return 0, false, err
+	}
+	fail := func(err error) (uint32, bool, error) {
+		env.state.removeContainer(id)
+		removeContainer(cctx, container)
+		return 0, false, err
+	}
+	out := r.containerLog(logger, c)
+	task, err := container.Task(cctx, cio.NewAttach(cio.WithStreams(nil, out.Stdout(), out.Stderr())))
+	if err != nil {
+		out.Close()
+		return fail(err)
+	}
+	// Subscribing first means an exit is either seen by the status check
+	// or sent as an event.
+	statusC, unsubscribeExit := r.taskSupervisor().Exit(cctx, task)
+	defer unsubscribeExit()
+	status, err := task.Status(cctx)
+	if err == nil && status.Status != containerd.Running && status.Status != containerd.Stopped {
+		err = fmt.Errorf("task is %s", status.Status)
+	}
+	if err != nil {
+		out.Close()
+		return fail(err)
+	}
+
+	defer func() {
+		if err != errHandoff {
+			container.Delete(cctx, containerd.WithSnapshotCleanup)
+			removeTmpfsRootfs(id)
+			os.RemoveAll(filepath.Join(env.secretsDir, id))
+		}
+	}()
+	defer out.Close()
+	if c.Network == networkBridge && c.netns == "" {
+		pid := task.Pid()
+		defer func() {
+			if err == errHandoff {
+				return
+			}
+			if err := env.removeNetwork(cctx, id, pid, c.Ports); err != nil {
+				logger.Error("Error removing network:", err)
+			}
+		}()
+	}
+
+	st := &containerStatus{
+		Name:      c.Name,
+		Image:     c.Image,
+		Digest:    pc.Digest,
+		ID:        id,
+		State:     stateRunning,
+		StartTime: pc.StartTime,
+	}
+	if status.Status == containerd.Stopped {
+		code, err = r.exitedWhileDown(cctx, logger, c, task, status, st)
+		return code, true, err
+	}
+	logger.With("event", "adopt").Info("reattached to running container", id)
+	// Replaces the rules of the previous agent, in case the policy or nft
+	// state changed.
+	removeEgress, err := applyEgress(cctx, logger, c, container, pc.Host)
+	if err != nil {
+		logger.Error("Error reapplying egress rules, stopping container:", err)
+		task.Delete(cctx, containerd.WithProcessKill)
+		return 0, true, err
+	}
+	defer func() {
+		if err != errHandoff {
+			removeEgress()
+		}
+	}()
+	code, err = r.waitTask(ctx, logger, c, container, task, statusC, pc.Host, st)
+	return code, true, err
+}
+
+// exitedWhileDown records the exit of an adopted container whose task
+// exited while no agent was running, the exit is then handled like any
+// other by the container's restart policy.
+func (r *runner) exitedWhileDown(ctx context.Context, logger *Logger, c ContainerSpec, task containerd.Task, status containerd.Status, st *containerStatus) (uint32, error) {
+	env := r.environment()
+	code := status.ExitStatus
+	logger.With("event", "exit", "exit_code", code).Warnf("container %s exited with %d at %s while the agent was down", st.ID, code, status.ExitTime.Format(time.RFC3339))
+	env.audit.record(auditRecord{Action: auditStopped, Container: c.Name, Image: c.Image, Digest: st.Digest, SpecHash: r.specHash, ExitCode: &code})
+	env.lifecycle.publish(lifecycleEvent{Type: eventExited, Container: c.Name, ID: st.ID, Image: c.Image, Digest: st.Digest, ExitCode: &code, Reason: "exited while the agent was down"})
+	st.exited(code)
+	st.EndTime = &status.ExitTime
+	st.publish(ctx, logger)
+	env.state.removeContainer(st.ID)
+	if _, err := task.Delete(ctx); err != nil {
+		logger.Error(err)
+	}
+	return code, nil
+}
+
+// removeContainer kills and deletes the container's task, if any, then
+// deletes the container and its snapshot.
+func removeContainer(ctx context.Context, container containerd.Container) error {
+	if task, err := container.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil {
+			return err
+		}
+	}
+	defer removeTmpfsRootfs(container.ID())
+	defer removeEgress(ctx, container.ID())
+	return container.Delete(ctx, containerd.WithSnapshotCleanup)
+}
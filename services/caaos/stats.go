@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsInterval is how often /v1/stats samples the running containers.
+const statsInterval = time.Second
+
+// containerStats is one sample of a container's usage sent by /v1/stats.
+// Network counters are omitted for containers on the host network.
+type containerStats struct {
+	Name            string  `json:"name"`
+	CPUPercent      float64 `json:"cpu-percent"`
+	MemoryBytes     uint64  `json:"memory-bytes"`
+	MemoryLimit     uint64  `json:"memory-limit-bytes,omitempty"`
+	NetRxBytes      *uint64 `json:"net-rx-bytes,omitempty"`
+	NetTxBytes      *uint64 `json:"net-tx-bytes,omitempty"`
+	BlockReadBytes  uint64  `json:"block-read-bytes"`
+	BlockWriteBytes uint64  `json:"block-write-bytes"`
+	Pids            uint64  `json:"pids"`
+	cpuNanoseconds  uint64
+	time            time.Time
+}
+
+// sampleStats reads the usage of every running container.
+func sampleStats(ctx context.Context) map[string]*containerStats {
+	stats := map[string]*containerStats{}
+	for name, t := range running.all() {
+		u, err := taskUsage(t.context(ctx), t.task)
+		if err != nil {
+			continue
+		}
+		s := &containerStats{
+			Name:            name,
+			MemoryBytes:     u.MemoryBytes,
+			MemoryLimit:     u.MemoryLimit,
+			BlockReadBytes:  u.IOReadBytes,
+			BlockWriteBytes: u.IOWriteBytes,
+			Pids:            u.Pids,
+			cpuNanoseconds:  u.CPUNanoseconds,
+			time:            u.Time,
+		}
+		if rx, tx, err := netUsage(t.task.Pid()); err == nil {
+			s.NetRxBytes, s.NetTxBytes = &rx, &tx
+		}
+		stats[name] = s
+	}
+	return stats
+}
+
+// netUsage returns the bytes received and sent on the interfaces of the
+// network namespace of pid, other than loopback. It fails for processes
+// in the agent's network namespace.
+func netUsage(pid uint32) (rx, tx uint64, err error) {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	if self, err := os.Readlink("/proc/self/ns/net"); err == nil && self == ns {
+		return 0, 0, fmt.Errorf("process %d uses the host network", pid)
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// The first two lines are headers, then "iface: rx_bytes ... tx_bytes ..."
+		// with the transmit counters starting at the ninth field.
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			continue
+		}
+		r, _ := strconv.ParseUint(fields[0], 10, 64)
+		t, _ := strconv.ParseUint(fields[8], 10, 64)
+		rx += r
+		tx += t
+	}
+	return rx, tx, s.Err()
+}
+
+// handleStats serves GET /v1/stats[?stream=true], a JSON array with the
+// usage of each running container. CPU usage is measured over
+// statsInterval. With stream set an array is sent every statsInterval, one
+// per line, until the client disconnects.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stream := r.URL.Query().Get("stream") == "true"
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	prev := sampleStats(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur := sampleStats(ctx)
+		out := []*containerStats{}
+		for name, s := range cur {
+			if !tenants.visible(ctx, name) {
+				continue
+			}
+			if p, ok := prev[name]; ok && s.time.After(p.time) && s.cpuNanoseconds >= p.cpuNanoseconds {
+				s.CPUPercent = float64(s.cpuNanoseconds-p.cpuNanoseconds) / float64(s.time.Sub(p.time).Nanoseconds()) * 100
+			}
+			out = append(out, s)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		if err := enc.Encode(out); err != nil || !stream {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		prev = cur
+	}
+}
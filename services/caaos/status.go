@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	stateRunning  = "running"
+	stateExited   = "exited"
+	stateRejected = "rejected"
+	// stateCrashLoop is named after the Kubernetes status.
+	stateCrashLoop = "CrashLoopBackOff"
+)
+
+// containerStatus is published to the guest attribute caaos/status-<name> so
+// that orchestration tools can poll for the result of a container.
+type containerStatus struct {
+	Name      string     `json:"name"`
+	Image     string     `json:"image"`
+	Digest    string     `json:"digest,omitempty"`
+	ID        string     `json:"id,omitempty"`
+	State     string     `json:"state"`
+	ExitCode  *uint32    `json:"exit-code,omitempty"`
+	StartTime time.Time  `json:"start-time"`
+	EndTime   *time.Time `json:"end-time,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Health    string     `json:"health,omitempty"`
+	OOMKilled bool       `json:"oom-killed,omitempty"`
+	// Usage is only reported by the health endpoints, not in guest
+	// attributes.
+	Usage *containerUsage `json:"usage,omitempty"`
+}
+
+// publish records the status for /readyz and writes it to guest
+// attributes, errors are logged but otherwise ignored as guest attributes
+// may not be enabled.
+func (s *containerStatus) publish(ctx context.Context, logger *Logger) {
+	agent.setContainer(*s)
+	b, err := json.Marshal(s)
+	if err != nil {
+		logger.Error("Error encoding status:", err)
+		return
+	}
+	if err := setGuestAttribute(ctx, "status-"+s.Name, string(b)); err != nil {
+		logger.Error("Error publishing status:", err)
+	}
+}
+
+// exited records the exit of the container.
+func (s *containerStatus) exited(code uint32) {
+	now := time.Now()
+	s.State = stateExited
+	s.ExitCode = &code
+	s.EndTime = &now
+}
+
+// rejected records that the container was not allowed to run.
+func (s *containerStatus) rejected(err error) {
+	now := time.Now()
+	s.State = stateRejected
+	s.EndTime = &now
+	s.Error = err.Error()
+}
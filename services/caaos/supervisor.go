@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	restartNever     = "never"
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 5 * time.Minute
+)
+
+// restartPolicy mirrors Docker's restart policies, a maxRetries of 0 means
+// retry forever.
+type restartPolicy struct {
+	mode       string
+	maxRetries int
+}
+
+// parseRestartPolicy parses a policy of the form "never", "always[:N]" or
+// "on-failure[:N]". An empty policy is the same as "never".
+func parseRestartPolicy(s string) (restartPolicy, error) {
+	if s == "" {
+		return restartPolicy{mode: restartNever}, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	p := restartPolicy{mode: strings.ToLower(parts[0])}
+	switch p.mode {
+	case restartNever, restartAlways, restartOnFailure:
+	default:
+		return p, fmt.Errorf("unknown restart policy %q", s)
+	}
+	if len(parts) == 2 {
+		if p.mode == restartNever {
+			return p, fmt.Errorf("restart policy %q does not take a retry count", s)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid retry count in restart policy %q", s)
+		}
+		p.maxRetries = n
+	}
+	return p, nil
+}
+
+// shouldRestart reports whether a container that exited with code (or err)
+// should be restarted after the given number of restarts.
+func (p restartPolicy) shouldRestart(code uint32, err error, restarts int) bool {
+	if p.maxRetries > 0 && restarts >= p.maxRetries {
+		return false
+	}
+	switch p.mode {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return err != nil || code != 0
+	}
+	return false
+}
+
+// supervise runs the container, restarting it according to policy with
+// exponential backoff until the policy says to stop, the container is in a
+// crash loop or ctx is canceled.
+func (r *runner) supervise(ctx context.Context, logger *Logger, c ContainerSpec, policy restartPolicy) {
+	env := r.environment()
+	backoff := initialBackoff
+	loop := newCrashLoop(c.CrashLoop)
+	for restarts := 0; ; restarts++ {
+		start := time.Now()
+		code, err := r.runContainer(ctx, logger, c)
+		if err == errHandoff {
+			return
+		}
+		if err != nil {
+			logger.Error("Error:", err)
+		}
+		if ctx.Err() == nil && env.checkpoints.takeCheckpointed(c.Name) {
+			logger.Info("Container was checkpointed, not restarting it")
+			return
+		}
+		if ctx.Err() == nil && env.checkpoints.hasRestore(c.Name) {
+			logger.Info("Restarting container to restore it from a checkpoint")
+			continue
+		}
+		if ctx.Err() != nil || !policy.shouldRestart(code, err, restarts) {
+			return
+		}
+		if (err != nil || code != 0) && loop.failed(time.Now()) {
+			r.crashLooping(ctx, logger, c, loop)
+			return
+		}
+
+		reason := fmt.Sprintf("exit code %d", code)
+		if err != nil {
+			reason = err.Error()
+		}
+		// Reset the backoff if the container ran for a while.
+		if time.Since(start) > maxBackoff {
+			backoff = initialBackoff
+		}
+		env.lifecycle.publish(lifecycleEvent{Type: eventRestarting, Container: c.Name, Image: c.Image, Reason: reason})
+		logger.With("event", "restart", "reason", reason).Infof("Restarting container in %s (restart %d, policy %q)", backoff, restarts+1, policy.mode)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// startSignal is closed the first time a container starts.
+type startSignal struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func (r *runner) markStarted(name string) {
+	if s, ok := r.started[name]; ok {
+		s.once.Do(func() { close(s.c) })
+	}
+}
+
+// waitForDependencies blocks until every container in c.DependsOn has
+// started, it returns false if ctx is canceled first.
+func (r *runner) waitForDependencies(ctx context.Context, logger *Logger, c ContainerSpec) bool {
+	for _, d := range c.DependsOn {
+		s, ok := r.started[d]
+		if !ok {
+			continue
+		}
+		logger.Debugf("waiting for %s to start", d)
+		select {
+		case <-s.c:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// closeWhenAll closes ch once the signals for all containers that are not
+// scheduled are closed, unless ctx is canceled first.
+func closeWhenAll(ctx context.Context, containers []ContainerSpec, signals map[string]*startSignal, ch chan struct{}) {
+	for _, c := range containers {
+		if c.Schedule != "" {
+			continue
+		}
+		select {
+		case <-signals[c.Name].c:
+		case <-ctx.Done():
+			return
+		}
+	}
+	close(ch)
+}
+
+// runSpec runs the init containers in order, stopping if any of them fail,
+// then runs all other containers concurrently, respecting depends-on, until
+// they have all exited.
+func (r *runner) runSpec(ctx context.Context, spec *Spec) {
+	if err := prepareDisks(ctx, spec.Disks); err != nil {
+		logger.Error("Error preparing disks, not starting containers:", err)
+		return
+	}
+	// Init containers have already run if containers are being adopted.
+	initContainers := spec.InitContainers
+	if !r.adopt.empty() {
+		logger.Info("Reattaching to running containers, skipping init containers")
+		initContainers = nil
+	}
+	for _, c := range initContainers {
+		clogger := containerLogger(c.Name)
+		clogger.Info("running init container")
+		code, err := r.runContainer(ctx, clogger, c)
+		if err != nil {
+			clogger.Error("Error:", err)
+			logger.Errorf("Init container %s failed, not starting containers", c.Name)
+			return
+		}
+		if code != 0 {
+			logger.Errorf("Init container %s exited with %d, not starting containers", c.Name, code)
+			return
+		}
+	}
+
+	r.started = map[string]*startSignal{}
+	for _, c := range spec.Containers {
+		r.started[c.Name] = &startSignal{c: make(chan struct{})}
+	}
+
+	if r.ready != nil {
+		go closeWhenAll(ctx, spec.Containers, r.started, r.ready)
+	}
+	if r.health != nil && r.healthy != nil {
+		go closeWhenAll(ctx, spec.Containers, r.health.healthy, r.healthy)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range spec.Containers {
+		wg.Add(1)
+		go func(c ContainerSpec) {
+			defer wg.Done()
+			clogger := containerLogger(c.Name)
+			if !r.waitForDependencies(ctx, clogger, c) {
+				return
+			}
+			if c.Schedule != "" {
+				r.runScheduled(ctx, clogger, c)
+				return
+			}
+			if c.Kind == kindJob {
+				r.runJob(ctx, clogger, c)
+				if ctx.Err() == nil {
+					r.runExitAction(ctx, clogger.With("event", "on-exit"), c, c.OnExit, "-on-exit")
+				}
+				return
+			}
+			policy, err := parseRestartPolicy(c.RestartPolicy)
+			if err != nil {
+				clogger.Error("Error:", err)
+				return
+			}
+			r.supervise(ctx, clogger, c, policy)
+			clogger.Infof("Finished running %s", c.Image)
+			if ctx.Err() == nil {
+				r.runExitAction(ctx, clogger.With("event", "on-exit"), c, c.OnExit, "-on-exit")
+			}
+		}(c)
+	}
+	wg.Wait()
+	// Containers that were never taken, e.g. a scheduled container's run,
+	// would otherwise be left running.
+	removeStale(detach(ctx), r.client, r.adopt.remaining())
+}
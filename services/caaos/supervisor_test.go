@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    restartPolicy
+		wantErr bool
+	}{
+		{"", restartPolicy{mode: restartNever}, false},
+		{"never", restartPolicy{mode: restartNever}, false},
+		{"always", restartPolicy{mode: restartAlways}, false},
+		{"Always:3", restartPolicy{mode: restartAlways, maxRetries: 3}, false},
+		{"on-failure", restartPolicy{mode: restartOnFailure}, false},
+		{"on-failure:0", restartPolicy{mode: restartOnFailure}, false},
+		{"on-failure:5", restartPolicy{mode: restartOnFailure, maxRetries: 5}, false},
+		{"never:1", restartPolicy{}, true},
+		{"always:-1", restartPolicy{}, true},
+		{"always:x", restartPolicy{}, true},
+		{"unless-stopped", restartPolicy{}, true},
+	} {
+		got, err := parseRestartPolicy(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseRestartPolicy(%q) = %+v, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseRestartPolicy(%q) = %+v, %v, want %+v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	failed := errors.New("failed to start")
+	for _, tc := range []struct {
+		policy   string
+		code     uint32
+		err      error
+		restarts int
+		want     bool
+	}{
+		{"never", 1, nil, 0, false},
+		{"always", 0, nil, 0, true},
+		{"always", 0, nil, 100, true},
+		{"always:2", 0, nil, 1, true},
+		{"always:2", 0, nil, 2, false},
+		{"on-failure", 0, nil, 0, false},
+		{"on-failure", 1, nil, 0, true},
+		{"on-failure", 0, failed, 0, true},
+		{"on-failure:1", 1, nil, 1, false},
+	} {
+		p, err := parseRestartPolicy(tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.shouldRestart(tc.code, tc.err, tc.restarts); got != tc.want {
+			t.Errorf("%q.shouldRestart(%d, %v, %d) = %v, want %v", tc.policy, tc.code, tc.err, tc.restarts, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// NamespaceSpec grants users other than root access to the containers of a
+// containerd namespace through the control socket.
+type NamespaceSpec struct {
+	// UIDs and GIDs are matched against the user and primary group of the
+	// process connecting to the socket.
+	UIDs []uint32 `json:"uids"`
+	GIDs []uint32 `json:"gids"`
+}
+
+// namespace returns the containerd namespace the container runs in.
+func (c ContainerSpec) namespace() string {
+	if c.Namespace != "" {
+		return c.Namespace
+	}
+	return *namespaceFlag
+}
+
+// specNamespaces returns the namespaces the containers of spec run in,
+// always including the agent's own.
+func specNamespaces(spec *Spec) []string {
+	seen := map[string]bool{*namespaceFlag: true}
+	if spec != nil {
+		for _, c := range append(append([]ContainerSpec{}, spec.InitContainers...), spec.Containers...) {
+			seen[c.namespace()] = true
+			for _, sc := range c.Sidecars {
+				seen[sc.namespace()] = true
+			}
+		}
+	}
+	var nss []string
+	for ns := range seen {
+		nss = append(nss, ns)
+	}
+	sort.Strings(nss)
+	return nss
+}
+
+// controlPaths are the control API paths, followed by a container name,
+// that users granted a namespace may use for its containers. An empty name
+// lists only the containers the user has access to.
+var controlPaths = []string{"/v1/logs/", "/v1/exec/", "/v1/checkpoint/", "/v1/restore/", "/v1/history/"}
+
+// tenantAccess decides what peers of the control socket may see and do.
+// Root has access to everything, other users only to the containers of the
+// namespaces the spec grants them.
+type tenantAccess struct {
+	mx     sync.Mutex
+	owners map[string]string
+	grants map[string]NamespaceSpec
+}
+
+var tenants = &tenantAccess{}
+
+// configure applies the grants of spec. The control socket is opened to
+// all users only while some namespace grants access, connections are then
+// checked by their peer credentials.
+func (t *tenantAccess) configure(spec *Spec) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.owners = map[string]string{}
+	t.grants = nil
+	if spec != nil {
+		for _, c := range append(append([]ContainerSpec{}, spec.InitContainers...), spec.Containers...) {
+			t.owners[c.Name] = c.namespace()
+			for _, sc := range c.Sidecars {
+				t.owners[sc.Name] = sc.namespace()
+			}
+		}
+		t.grants = spec.Namespaces
+	}
+	if err := os.Chmod(controlSocket, t.socketModeLocked()); err != nil && !os.IsNotExist(err) {
+		logger.Error("Error setting control socket permissions:", err)
+	}
+}
+
+func (t *tenantAccess) socketMode() os.FileMode {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.socketModeLocked()
+}
+
+func (t *tenantAccess) socketModeLocked() os.FileMode {
+	if len(t.grants) > 0 {
+		return 0666
+	}
+	return 0600
+}
+
+// allowed reports whether cred may access container name.
+func (t *tenantAccess) allowed(cred *unix.Ucred, name string) bool {
+	if cred == nil || cred.Uid == 0 {
+		return true
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	ns, ok := t.owners[name]
+	if !ok {
+		return false
+	}
+	g := t.grants[ns]
+	for _, uid := range g.UIDs {
+		if uid == cred.Uid {
+			return true
+		}
+	}
+	for _, gid := range g.GIDs {
+		if gid == cred.Gid {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether the client of the request with ctx may see
+// container name, requests not made on the control socket see everything.
+func (t *tenantAccess) visible(ctx context.Context, name string) bool {
+	return t.allowed(peer(ctx), name)
+}
+
+// authorize refuses requests from users other than root for anything but
+// the containers they have access to.
+func (t *tenantAccess) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred := peer(r.Context())
+		if cred == nil || cred.Uid == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok := r.URL.Path == "/v1/stats" || r.URL.Path == "/v1/events" || r.URL.Path == "/v1/history/"
+		for _, p := range controlPaths {
+			if name := strings.TrimPrefix(r.URL.Path, p); name != r.URL.Path && name != "" {
+				ok = t.allowed(cred, name)
+			}
+		}
+		if !ok {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type peerKey struct{}
+
+// withPeer adds the credentials of the process at the other end of the
+// unix socket c to ctx.
+// A peer that can't be identified is treated as a user with no grants.
+func withPeer(ctx context.Context, c net.Conn) context.Context {
+	cred := &unix.Ucred{Uid: ^uint32(0), Gid: ^uint32(0)}
+	if uc, ok := c.(*net.UnixConn); ok {
+		if raw, err := uc.SyscallConn(); err == nil {
+			raw.Control(func(fd uintptr) {
+				if uc, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED); err == nil {
+					cred = uc
+				}
+			})
+		}
+	}
+	return context.WithValue(ctx, peerKey{}, cred)
+}
+
+// peer returns the credentials of the control socket client, nil for
+// requests on other servers.
+func peer(ctx context.Context) *unix.Ucred {
+	cred, _ := ctx.Value(peerKey{}).(*unix.Ucred)
+	return cred
+}
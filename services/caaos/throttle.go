@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tc      = "/bin/tc"
+	nsenter = "/bin/nsenter"
+
+	// minBurst is the smallest burst in bytes of a bandwidth limit, enough
+	// for a few full-size packets.
+	minBurst = 16 * 1024
+)
+
+// BlockIOSpec throttles the container's IO to a block device, enforced with
+// io.max on cgroup v2.
+type BlockIOSpec struct {
+	// Device is the path of a whole disk, not a partition, e.g.
+	// /dev/disk/by-id/google-data.
+	Device    string `json:"device"`
+	ReadBPS   uint64 `json:"read-bps"`
+	WriteBPS  uint64 `json:"write-bps"`
+	ReadIOPS  uint64 `json:"read-iops"`
+	WriteIOPS uint64 `json:"write-iops"`
+}
+
+func validateBlockIO(verr *validationError, field string, limits []BlockIOSpec) {
+	for i, l := range limits {
+		if !filepath.IsAbs(l.Device) {
+			verr.add("%s.resources.block-io[%d]: device must be an absolute path", field, i)
+		}
+		if l.ReadBPS == 0 && l.WriteBPS == 0 && l.ReadIOPS == 0 && l.WriteIOPS == 0 {
+			verr.add("%s.resources.block-io[%d]: no limit set", field, i)
+		}
+	}
+}
+
+// withBlockIO adds the throttles to the spec, looking up the devices'
+// numbers when the container is created.
+func withBlockIO(limits []BlockIOSpec) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *specs.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+		if s.Linux.Resources.BlockIO == nil {
+			s.Linux.Resources.BlockIO = &specs.LinuxBlockIO{}
+		}
+		b := s.Linux.Resources.BlockIO
+		for _, l := range limits {
+			var st unix.Stat_t
+			if err := unix.Stat(l.Device, &st); err != nil {
+				return fmt.Errorf("error reading block-io device %s: %v", l.Device, err)
+			}
+			if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+				return fmt.Errorf("block-io device %s is not a block device", l.Device)
+			}
+			major, minor := int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev)))
+			add := func(list *[]specs.LinuxThrottleDevice, rate uint64) {
+				if rate == 0 {
+					return
+				}
+				d := specs.LinuxThrottleDevice{Rate: rate}
+				d.Major, d.Minor = major, minor
+				*list = append(*list, d)
+			}
+			add(&b.ThrottleReadBpsDevice, l.ReadBPS)
+			add(&b.ThrottleWriteBpsDevice, l.WriteBPS)
+			add(&b.ThrottleReadIOPSDevice, l.ReadIOPS)
+			add(&b.ThrottleWriteIOPSDevice, l.WriteIOPS)
+		}
+		return nil
+	}
+}
+
+// throttleNetwork limits the bandwidth of the bridge network interface in
+// the network namespace of the task with the given pid, in bits per second.
+// Egress is shaped with a token bucket, ingress is policed as the kernel
+// can't queue received packets.
+func throttleNetwork(ctx context.Context, pid uint32, ingress, egress int64) error {
+	ns := "--net=" + netnsPath(pid)
+	if egress > 0 {
+		rate := strconv.FormatInt(egress, 10) + "bit"
+		if err := runCmd(ctx, nsenter, []string{ns, tc, "qdisc", "replace", "dev", "eth0", "root", "tbf", "rate", rate, "burst", strconv.FormatInt(burst(egress), 10), "latency", "50ms"}); err != nil {
+			return fmt.Errorf("error limiting egress bandwidth: %v", err)
+		}
+	}
+	if ingress > 0 {
+		rate := strconv.FormatInt(ingress, 10) + "bit"
+		if err := runCmd(ctx, nsenter, []string{ns, tc, "qdisc", "replace", "dev", "eth0", "ingress"}); err != nil {
+			return fmt.Errorf("error limiting ingress bandwidth: %v", err)
+		}
+		if err := runCmd(ctx, nsenter, []string{ns, tc, "filter", "replace", "dev", "eth0", "parent", "ffff:", "prio", "1", "matchall", "action", "police", "rate", rate, "burst", strconv.FormatInt(burst(ingress), 10), "drop"}); err != nil {
+			return fmt.Errorf("error limiting ingress bandwidth: %v", err)
+		}
+	}
+	return nil
+}
+
+// burst returns the bucket size in bytes for a rate in bits per second,
+// 10ms worth of traffic.
+func burst(rate int64) int64 {
+	if b := rate / 8 / 100; b > minBurst {
+		return b
+	}
+	return minBurst
+}
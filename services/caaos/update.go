@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	updateMarker = "/var/lib/caaos/update.json"
+	// rolledBackFile lists the versions that were rolled back, which are
+	// not installed again.
+	rolledBackFile        = "/var/lib/caaos/update-rolled-back.json"
+	defaultUpdateInterval = 6 * time.Hour
+	// updateHealthTimeout is how long a new binary has to become healthy
+	// before it is rolled back.
+	updateHealthTimeout = 2 * time.Minute
+	// maxUpdateAttempts is how many times a new binary may be started
+	// without becoming healthy before it is rolled back.
+	maxUpdateAttempts = 3
+	maxUpdateSize     = 256 << 20
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// releaseManifest is served at a release channel URL.
+type releaseManifest struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+	// Signature is the base64 encoded signature of releasePayload, which
+	// binds the version to the binary so that an old release can't be
+	// served as a new one.
+	Signature string `json:"signature"`
+}
+
+// releasePayload returns the signed content of a release.
+func releasePayload(version, sha256 string) []byte {
+	return []byte("caaos-release\n" + version + "\n" + sha256 + "\n")
+}
+
+// parseVersion parses a version from git describe, v1.2.3 or v1.2.3-4-gabcdef
+// for a build 4 commits after v1.2.3.
+func parseVersion(s string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), "-")
+	var nums []string
+	switch {
+	case len(parts) == 1:
+		nums = strings.Split(parts[0], ".")
+	case len(parts) == 3 && strings.HasPrefix(parts[2], "g"):
+		nums = append(strings.Split(parts[0], "."), parts[1])
+	default:
+		return nil, false
+	}
+	v := make([]int, len(nums))
+	for i, n := range nums {
+		var err error
+		if v[i], err = strconv.Atoi(n); err != nil {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// newerVersion reports whether version a is newer than b, a must parse. A
+// b that doesn't parse, e.g. the default dev or a git hash of an untagged
+// build, is older than any release.
+func newerVersion(a, b string) (bool, error) {
+	va, ok := parseVersion(a)
+	if !ok {
+		return false, fmt.Errorf("can't compare version %q", a)
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return true, nil
+	}
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			return x > y, nil
+		}
+	}
+	return false, nil
+}
+
+// updater periodically checks a release channel and replaces the running
+// binary with a newer signed release. Once a new binary is in place the
+// agent reexecs it, leaving its containers running.
+type updater struct {
+	exe    string
+	key    crypto.PublicKey
+	client *http.Client
+	exit   func()
+
+	mx       sync.Mutex
+	channel  string
+	interval time.Duration
+}
+
+// newUpdater returns an updater that verifies releases with the PEM encoded
+// public key in keyFile and calls exit after installing one.
+func newUpdater(keyFile string, exit func()) (*updater, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", keyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &updater{
+		exe:      exe,
+		key:      key,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		exit:     exit,
+		interval: defaultUpdateInterval,
+	}, nil
+}
+
+// configure sets the release channel URL, an empty channel disables
+// updates.
+func (u *updater) configure(channel string, interval time.Duration) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	u.channel = channel
+	if interval > 0 {
+		u.interval = interval
+	}
+}
+
+// run checks for updates every interval, with up to 10% jitter so that a
+// fleet does not update at once, until ctx is canceled.
+func (u *updater) run(ctx context.Context) {
+	for {
+		u.mx.Lock()
+		channel, interval := u.channel, u.interval
+		u.mx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval + time.Duration(rand.Int63n(int64(interval/10)+1))):
+		}
+		if channel == "" {
+			continue
+		}
+		installed, err := u.check(ctx, channel)
+		if err != nil {
+			logger.Error("Error checking for update:", err)
+			continue
+		}
+		if installed {
+			u.exit()
+			return
+		}
+	}
+}
+
+// check installs the release on channel if it is newer than the running
+// one and was not rolled back before.
+func (u *updater) check(ctx context.Context, channel string) (bool, error) {
+	b, err := u.get(ctx, channel, 1<<20)
+	if err != nil {
+		return false, err
+	}
+	var m releaseManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return false, fmt.Errorf("error parsing release manifest: %v", err)
+	}
+	if m.Version == "" || m.Version == version {
+		return false, nil
+	}
+	newer, err := newerVersion(m.Version, version)
+	if err != nil {
+		return false, err
+	}
+	if !newer {
+		logger.Warnf("Not updating to %s, it is older than %s", m.Version, version)
+		return false, nil
+	}
+	if rolledBack(m.Version) {
+		logger.Debugf("Not updating to %s, it was rolled back", m.Version)
+		return false, nil
+	}
+	logger.With("event", "update").Infof("updating from %s to %s", version, m.Version)
+
+	bin, err := u.get(ctx, m.URL, maxUpdateSize)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(bin)
+	if hex.EncodeToString(sum[:]) != m.SHA256 {
+		return false, errors.New("release binary does not match sha256")
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return false, fmt.Errorf("error decoding release signature: %v", err)
+	}
+	if err := verifySignature(u.key, releasePayload(m.Version, m.SHA256), sig); err != nil {
+		return false, fmt.Errorf("release %s: %v", m.Version, err)
+	}
+	return true, u.install(bin, m.Version)
+}
+
+func (u *updater) get(ctx context.Context, url string, max int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, max))
+}
+
+// updateState records an installed but not yet healthy release.
+type updateState struct {
+	Version  string `json:"version"`
+	Previous string `json:"previous"`
+	Attempts int    `json:"attempts"`
+}
+
+// install keeps the running binary as <exe>.old and atomically renames the
+// new binary into place.
+func (u *updater) install(bin []byte, newVersion string) error {
+	tmp := u.exe + ".new"
+	if err := ioutil.WriteFile(tmp, bin, 0755); err != nil {
+		return err
+	}
+	old := u.exe + ".old"
+	os.Remove(old)
+	if err := os.Link(u.exe, old); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := writeUpdateState(&updateState{Version: newVersion, Previous: old}); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, u.exe); err != nil {
+		os.Remove(updateMarker)
+		os.Remove(tmp)
+		return err
+	}
+	logger.With("event", "update").Infof("installed %s, restarting", newVersion)
+	return nil
+}
+
+func writeUpdateState(st *updateState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(updateMarker), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(updateMarker, b, 0644)
+}
+
+// checkPendingUpdate is called at startup. If this binary was just
+// installed it is rolled back once it has been started maxUpdateAttempts
+// times, or if healthy is not called within updateHealthTimeout. The
+// returned function marks the update healthy.
+func checkPendingUpdate() (healthy func()) {
+	nop := func() {}
+	b, err := ioutil.ReadFile(updateMarker)
+	if err != nil {
+		return nop
+	}
+	var st updateState
+	if err := json.Unmarshal(b, &st); err != nil {
+		logger.Error("Error reading update state:", err)
+		os.Remove(updateMarker)
+		return nop
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		logger.Error(err)
+		return nop
+	}
+
+	st.Attempts++
+	if st.Attempts > maxUpdateAttempts {
+		rollback(exe, &st)
+	}
+	if err := writeUpdateState(&st); err != nil {
+		logger.Error("Error writing update state:", err)
+	}
+
+	timer := time.AfterFunc(updateHealthTimeout, func() {
+		logger.Errorf("%s did not become healthy within %s", st.Version, updateHealthTimeout)
+		rollback(exe, &st)
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			timer.Stop()
+			os.Remove(updateMarker)
+			os.Remove(st.Previous)
+			logger.With("event", "update").Infof("update to %s is healthy", st.Version)
+		})
+	}
+}
+
+// rollback restores the previous binary, records the version as rolled
+// back and exits so that init starts the previous binary.
+func rollback(exe string, st *updateState) {
+	logger.With("event", "rollback").Errorf("rolling back update to %s", st.Version)
+	if err := os.Rename(st.Previous, exe); err != nil {
+		logger.Error("Error restoring previous binary:", err)
+	}
+	versions := readRolledBack()
+	versions = append(versions, st.Version)
+	if b, err := json.Marshal(versions); err == nil {
+		if err := ioutil.WriteFile(rolledBackFile, b, 0644); err != nil {
+			logger.Error("Error recording rolled back version:", err)
+		}
+	}
+	os.Remove(updateMarker)
+	os.Exit(1)
+}
+
+func readRolledBack() []string {
+	var versions []string
+	if b, err := ioutil.ReadFile(rolledBackFile); err == nil {
+		json.Unmarshal(b, &versions)
+	}
+	return versions
+}
+
+func rolledBack(v string) bool {
+	for _, r := range readRolledBack() {
+		if r == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		want   []int
+		wantOK bool
+	}{
+		{"v1.2.3", []int{1, 2, 3}, true},
+		{"1.2", []int{1, 2}, true},
+		{"v1.2.3-4-gabcdef", []int{1, 2, 3, 4}, true},
+		{"dev", nil, false},
+		{"abcdef1", nil, false},
+		{"v1.2.3-rc1", nil, false},
+		{"v1.x.3", nil, false},
+		{"v1.2.3-4-abcdef", nil, false},
+	} {
+		got, ok := parseVersion(tc.in)
+		if ok != tc.wantOK || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", tc.in, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		a, b    string
+		want    bool
+		wantErr bool
+	}{
+		{"v1.2.4", "v1.2.3", true, false},
+		{"v1.2.3", "v1.2.4", false, false},
+		{"v1.2.3", "v1.2.3", false, false},
+		{"v1.10.0", "v1.9.0", true, false},
+		{"v1.2.3-1-gabcdef", "v1.2.3", true, false},
+		{"v1.2.3", "v1.2.3-1-gabcdef", false, false},
+		{"v1.3", "v1.2.9", true, false},
+		{"v1.2.0", "v1.2", false, false},
+		// Builds without a release version update to any release.
+		{"v0.0.1", "dev", true, false},
+		{"v1.0.0", "abcdef1", true, false},
+		{"latest", "v1.0.0", false, true},
+	} {
+		got, err := newerVersion(tc.a, tc.b)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("newerVersion(%q, %q) = %v, %v, want %v, error %v", tc.a, tc.b, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
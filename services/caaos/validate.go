@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// dryRunReport is the result of checking a spec without running it.
+type dryRunReport struct {
+	Valid      bool              `json:"valid"`
+	Errors     []string          `json:"errors,omitempty"`
+	Containers []dryRunContainer `json:"containers,omitempty"`
+}
+
+type dryRunContainer struct {
+	Name     string   `json:"name"`
+	Image    string   `json:"image"`
+	Digest   string   `json:"digest,omitempty"`
+	Platform string   `json:"platform,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+	// Warnings are parts of the OCI spec that are only filled in when the
+	// container starts on the instance.
+	Warnings []string    `json:"warnings,omitempty"`
+	Spec     *specs.Spec `json:"oci-spec,omitempty"`
+}
+
+func (r *dryRunReport) addError(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// numericUser matches users that need no lookup in the image.
+var numericUser = regexp.MustCompile(`^[0-9]+:[0-9]+$`)
+
+// dryRun checks attributes in user data format, either an object of
+// attributes or a caaos-spec, the way the agent would before deploying
+// them: the spec is parsed and validated, each image's manifest is
+// resolved and checked against the image policies, and the OCI spec the
+// container would run with is rendered. No images are pulled and no
+// containers are created. client is used to find preloaded images, without
+// it they are not checked.
+func dryRun(ctx context.Context, client *containerd.Client, data []byte) *dryRunReport {
+	report := &dryRunReport{}
+	attrs := map[string]string{}
+	mergeUserData(attrs, data)
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		report.addError(err)
+		return report
+	}
+	md, err := parseAttributes(b)
+	if err != nil {
+		report.addError(err)
+		return report
+	}
+	spec, err := md.spec()
+	if verr, ok := err.(validationError); ok {
+		report.Errors = append(report.Errors, verr...)
+		return report
+	}
+	if err != nil {
+		report.addError(err)
+		return report
+	}
+	if spec == nil || len(spec.Containers) == 0 {
+		report.addError(fmt.Errorf("no containers are set"))
+		return report
+	}
+	if err := validateIntegrityLevel(md.Integrity); err != nil {
+		report.addError(fmt.Errorf("require-integrity: %v", err))
+	}
+	if _, err := parseUpdateStrategy(md.UpdateStrategy); err != nil {
+		report.addError(fmt.Errorf("update-strategy: %v", err))
+	}
+	creds, err := parseRegistryAuth(md.RegistryAuth)
+	if err != nil {
+		report.addError(err)
+	}
+	registries, err := parseRegistryConfig(md)
+	if err != nil {
+		report.addError(err)
+		return report
+	}
+	imgPolicy, err := parseImagePolicy(ctx, md)
+	if err != nil {
+		report.addError(err)
+	}
+	sigPolicy, err := parseSignaturePolicy(md.SignaturePolicy)
+	if err != nil {
+		report.addError(err)
+	}
+
+	resolver := newResolver(ctx, creds, registries)
+	dir, err := ioutil.TempDir("", "caaos-dry-run-")
+	if err != nil {
+		report.addError(err)
+		return report
+	}
+	defer os.RemoveAll(dir)
+	store, err := local.NewStore(dir)
+	if err != nil {
+		report.addError(err)
+		return report
+	}
+
+	list := append(append([]ContainerSpec{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range spec.Containers {
+		list = append(list, c.Sidecars...)
+	}
+	for _, c := range list {
+		dc := dryRunContainer{Name: c.Name, Image: c.Image, Platform: c.Platform}
+		if err := dryRunContainerSpec(ctx, client, resolver, store, imgPolicy, sigPolicy, c, &dc); err != nil {
+			dc.Errors = append(dc.Errors, err.Error())
+		}
+		report.Containers = append(report.Containers, dc)
+	}
+
+	report.Valid = len(report.Errors) == 0
+	for _, c := range report.Containers {
+		if len(c.Errors) > 0 {
+			report.Valid = false
+		}
+	}
+	return report
+}
+
+func dryRunContainerSpec(ctx context.Context, client *containerd.Client, resolver remotes.Resolver, store content.Store, imgPolicy *imagePolicy, sigPolicy *signaturePolicy, c ContainerSpec, dc *dryRunContainer) error {
+	if err := imgPolicy.evaluate(logger.With("container", c.Name), c, sigPolicy != nil); err != nil {
+		return err
+	}
+
+	var img oci.Image
+	var target ocispec.Descriptor
+	if isArchiveImage(c.Image) {
+		dc.Warnings = append(dc.Warnings, "image archives are only checked when the container starts")
+		return nil
+	}
+	if ref, ok := imageRef(c.Image); ok {
+		if client == nil {
+			dc.Warnings = append(dc.Warnings, "preloaded images are only checked on the instance")
+			return nil
+		}
+		r := &runner{client: client}
+		i, err := r.localImage(ctx, ref, c.Platform)
+		if err != nil {
+			return fmt.Errorf("preloaded image %s: %v", ref, err)
+		}
+		img, target = i, i.Target()
+	} else {
+		ri, err := resolveImage(ctx, resolver, store, c.Image, c.Platform)
+		if err != nil {
+			return err
+		}
+		img, target = ri, ri.target
+	}
+	dc.Digest = target.Digest.String()
+	if c.Digest != "" && c.Digest != dc.Digest {
+		return fmt.Errorf("image %s resolved to digest %s, expected %s", c.Image, dc.Digest, c.Digest)
+	}
+	if sigPolicy != nil {
+		ref, _ := imageRef(c.Image)
+		if err := sigPolicy.verify(ctx, resolver, ref, target.Digest); err != nil {
+			return fmt.Errorf("image signature verification failed: %v", err)
+		}
+	}
+
+	// Users, groups, devices and GPUs are looked up in the image's root
+	// filesystem or on the host when the container starts.
+	rc := c
+	var user oci.SpecOpts
+	if c.User != "" {
+		if numericUser.MatchString(c.User) {
+			user = oci.WithUser(c.User)
+		} else {
+			dc.Warnings = append(dc.Warnings, fmt.Sprintf("user %q is looked up in the image when the container starts", c.User))
+		}
+	}
+	if len(c.Groups) > 0 {
+		dc.Warnings = append(dc.Warnings, "groups are looked up in the image when the container starts")
+	}
+	if len(c.Devices) > 0 || c.GPU != nil {
+		dc.Warnings = append(dc.Warnings, "devices and GPUs are added when the container starts")
+	}
+	if len(c.Secrets) > 0 {
+		dc.Warnings = append(dc.Warnings, "secrets are mounted when the container starts")
+	}
+	rc.User, rc.Groups, rc.Devices, rc.GPU = "", nil, nil, nil
+
+	opts := []oci.SpecOpts{oci.WithImageConfig(img)}
+	if len(c.Command) > 0 {
+		opts = []oci.SpecOpts{oci.WithImageConfigArgs(img, c.Command)}
+	}
+	opts = append(opts, rc.specOpts()...)
+	if user != nil {
+		opts = append(opts, user)
+	}
+	s, err := oci.GenerateSpec(namespaces.WithNamespace(ctx, *namespaceFlag), nil, &containers.Container{ID: c.Name}, opts...)
+	if err != nil {
+		return fmt.Errorf("error rendering OCI spec: %v", err)
+	}
+	dc.Spec = s
+	return nil
+}
+
+// resolvedImage is an image whose manifest and config, but no layers, have
+// been fetched into a content store.
+type resolvedImage struct {
+	target ocispec.Descriptor
+	config ocispec.Descriptor
+	store  content.Store
+}
+
+func (i *resolvedImage) Config(context.Context) (ocispec.Descriptor, error) { return i.config, nil }
+func (i *resolvedImage) ContentStore() content.Store                        { return i.store }
+
+// resolveImage fetches the manifest and config of ref for platform, or the
+// host's platform if it is empty.
+func resolveImage(ctx context.Context, resolver remotes.Resolver, store content.Store, ref, platform string) (*resolvedImage, error) {
+	matcher := platforms.Default()
+	if platform != "" {
+		p, err := platforms.Parse(platform)
+		if err != nil {
+			return nil, err
+		}
+		matcher = platforms.Only(p)
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %v", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	children := images.LimitManifests(images.FilterPlatforms(images.ChildrenHandler(store), matcher), matcher, 1)
+	skipLayers := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		descs, err := children(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		var out []ocispec.Descriptor
+		for _, d := range descs {
+			if !images.IsLayerType(d.MediaType) {
+				out = append(out, d)
+			}
+		}
+		return out, nil
+	})
+	if err := images.Dispatch(ctx, images.Handlers(remotes.FetchHandler(store, fetcher), skipLayers), nil, desc); err != nil {
+		return nil, fmt.Errorf("error fetching manifest of %s: %v", ref, err)
+	}
+	config, err := images.Config(ctx, store, desc, matcher)
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %v", ref, err)
+	}
+	return &resolvedImage{target: desc, config: config, store: store}, nil
+}
+
+// handleSpec serves POST /v1/spec?dry-run=true, checking the spec in the
+// request body with dryRun. Specs are only applied from metadata, so
+// dry-run is required.
+func handleSpec(ctx context.Context, client *containerd.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Query().Get("dry-run") != "true" {
+			http.Error(w, "specs are applied from metadata, only dry-run=true is supported", http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report := dryRun(ctx, client, b)
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Valid {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+}
+
+// runValidate implements caaos validate [file], checking a spec read from
+// file, or stdin, without containerd. It returns the exit code.
+func runValidate(args []string) int {
+	var b []byte
+	var err error
+	switch len(args) {
+	case 0:
+		b, err = ioutil.ReadAll(os.Stdin)
+	case 1:
+		b, err = ioutil.ReadFile(args[0])
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: caaos validate [file]")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// The report is written to stdout, keep it free of log records.
+	logConfig.Lock()
+	logConfig.out = os.Stderr
+	logConfig.Unlock()
+	report := dryRun(context.Background(), nil, b)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// watcherConfig configures a Watcher.
+type watcherConfig struct {
+	// backoff is the delay before retrying a failed watch, doubled on
+	// each failure up to maxBackoff.
+	backoff, maxBackoff time.Duration
+	// offline returns the cached attributes, sent once the provider has
+	// failed for offlineDelay without ever succeeding. It may be nil.
+	offline      func() *attributesJSON
+	offlineDelay time.Duration
+	// onError and onReceived, if set, are called after each failed and
+	// successful watch.
+	onError    func(error)
+	onReceived func()
+}
+
+// agentWatcherConfig returns the configuration of the agent's watcher, from
+// the flags, reporting to the agent's status and boot report.
+func agentWatcherConfig() watcherConfig {
+	return watcherConfig{
+		backoff:      *mdBackoffFlag,
+		maxBackoff:   *mdMaxBackoffFlag,
+		offline:      offlineAttributes,
+		offlineDelay: *offlineDelayFlag,
+		onError: func(err error) {
+			agent.metadataError(err)
+			// The metadata server may be unreachable as the host turned
+			// out to be IPv6-only.
+			configureIPv6()
+		},
+		onReceived: func() {
+			agent.metadataReceived()
+			boot.mark(phaseMetadata)
+		},
+	}
+}
+
+// Watcher watches a MetadataProvider and sends each new set of attributes
+// on its Updates channel. All of its state is its own, so several can run
+// at once.
+type Watcher struct {
+	provider MetadataProvider
+	cfg      watcherConfig
+	updates  chan *attributesJSON
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// Until attributes are first received, the cached spec is sent once
+	// the provider has failed for -offline-fallback-delay.
+	received, fellBack bool
+	unreachableSince   time.Time
+}
+
+func newWatcher(provider MetadataProvider, cfg watcherConfig) *Watcher {
+	return &Watcher{provider: provider, cfg: cfg, updates: make(chan *attributesJSON)}
+}
+
+// Updates returns the channel new attributes are sent on.
+func (w *Watcher) Updates() <-chan *attributesJSON {
+	return w.updates
+}
+
+// Start watches until ctx is canceled or Stop is called.
+func (w *Watcher) Start(ctx context.Context) {
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		w.run(ctx)
+	}()
+}
+
+// Stop stops watching and waits for the watch to end.
+func (w *Watcher) Stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.cancel()
+	<-w.done
+}
+
+func (w *Watcher) run(ctx context.Context) {
+	backoff := w.cfg.backoff
+	for first := true; ; first = false {
+		logger.Info("Waiting for metadata...")
+		// Only the first call is traced, later calls wait for a change.
+		var span trace.Span
+		if first {
+			_, span = startSpan(ctx, "metadata.fetch", attribute.String("provider", w.provider.Name()))
+		}
+		md, err := w.provider.Watch(ctx)
+		if span != nil {
+			endSpan(span, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			sleep := backoff + jitter(backoff/2)
+			logger.Errorf("Error grabing metadata, retrying in %s: %v", sleep.Round(time.Millisecond), err)
+			if w.cfg.onError != nil {
+				w.cfg.onError(err)
+			}
+			if md := w.fallback(); md != nil && !w.send(ctx, md) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sleep):
+			}
+			if backoff *= 2; backoff > w.cfg.maxBackoff {
+				backoff = w.cfg.maxBackoff
+			}
+			continue
+		}
+		backoff = w.cfg.backoff
+		w.received = true
+		if w.cfg.onReceived != nil {
+			w.cfg.onReceived()
+		}
+		if !w.send(ctx, md) {
+			return
+		}
+	}
+}
+
+// fallback returns the cached attributes the first time the provider has
+// failed for offlineDelay without ever succeeding.
+func (w *Watcher) fallback() *attributesJSON {
+	if w.received || w.fellBack || w.cfg.offline == nil {
+		return nil
+	}
+	if w.unreachableSince.IsZero() {
+		w.unreachableSince = time.Now()
+	}
+	if time.Since(w.unreachableSince) < w.cfg.offlineDelay {
+		return nil
+	}
+	w.fellBack = true
+	return w.cfg.offline()
+}
+
+// send sends md on the updates channel, returning false if ctx was
+// canceled first.
+func (w *Watcher) send(ctx context.Context, md *attributesJSON) bool {
+	select {
+	case w.updates <- md:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeProvider returns the results sent on its channel from Watch.
+type fakeProvider struct {
+	results chan fakeResult
+}
+
+type fakeResult struct {
+	md  *attributesJSON
+	err error
+}
+
+func (*fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) Watch(ctx context.Context) (*attributesJSON, error) {
+	select {
+	case r := <-p.results:
+		return r.md, r.err
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+func receive(t *testing.T, w *Watcher) *attributesJSON {
+	t.Helper()
+	select {
+	case md := <-w.Updates():
+		return md
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update from the watcher")
+		return nil
+	}
+}
+
+func TestWatcherRetries(t *testing.T) {
+	p := &fakeProvider{results: make(chan fakeResult)}
+	errs, received := make(chan error, 10), make(chan struct{}, 10)
+	w := newWatcher(p, watcherConfig{
+		backoff:    time.Millisecond,
+		maxBackoff: 2 * time.Millisecond,
+		onError:    func(err error) { errs <- err },
+		onReceived: func() { received <- struct{}{} },
+	})
+	w.Start(context.Background())
+	defer w.Stop()
+
+	fail := errors.New("unreachable")
+	for i := 0; i < 3; i++ {
+		p.results <- fakeResult{err: fail}
+		if err := <-errs; err != fail {
+			t.Errorf("onError got %v, want %v", err, fail)
+		}
+	}
+	p.results <- fakeResult{md: &attributesJSON{Spec: "a"}}
+	if md := receive(t, w); md.Spec != "a" {
+		t.Errorf("update spec = %q, want a", md.Spec)
+	}
+	<-received
+	p.results <- fakeResult{md: &attributesJSON{Spec: "b"}}
+	if md := receive(t, w); md.Spec != "b" {
+		t.Errorf("update spec = %q, want b", md.Spec)
+	}
+}
+
+func TestWatcherOfflineFallback(t *testing.T) {
+	p := &fakeProvider{results: make(chan fakeResult)}
+	cached := &attributesJSON{Spec: "cached"}
+	offline := 0
+	w := newWatcher(p, watcherConfig{
+		backoff:      time.Millisecond,
+		maxBackoff:   time.Millisecond,
+		offlineDelay: 20 * time.Millisecond,
+		offline: func() *attributesJSON {
+			offline++
+			return cached
+		},
+	})
+	w.Start(context.Background())
+	defer w.Stop()
+
+	// The provider keeps failing until the cached attributes are sent,
+	// they are only sent once.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case p.results <- fakeResult{err: errors.New("unreachable")}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	if md := receive(t, w); md != cached {
+		t.Fatalf("update = %+v, want the cached attributes", md)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	p.results <- fakeResult{md: &attributesJSON{Spec: "live"}}
+	if md := receive(t, w); md.Spec != "live" {
+		t.Errorf("update spec = %q, want live", md.Spec)
+	}
+	if offline != 1 {
+		t.Errorf("offline called %d times, want 1", offline)
+	}
+}
+
+func TestWatcherStop(t *testing.T) {
+	p := &fakeProvider{results: make(chan fakeResult)}
+	w := newWatcher(p, watcherConfig{backoff: time.Millisecond, maxBackoff: time.Millisecond})
+	w.Start(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return while the provider was waiting")
+	}
+}
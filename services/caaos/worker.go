@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+const (
+	defaultWorkerName = "worker"
+	// taskTokenHeader carries the worker task token on Cloud Tasks HTTP
+	// tasks, set it in the task's headers.
+	taskTokenHeader = "X-Caaos-Task-Token"
+	maxTaskSize     = 1 << 20
+	// ackDeadline is the ack deadline in seconds a running message is
+	// extended to, as soon as it is received and then every
+	// ackExtendInterval, well before the deadline set by the previous
+	// extension.
+	ackDeadline       = 300
+	ackExtendInterval = ackDeadline * time.Second / 3
+)
+
+// worker runs containers described by queue messages: pulled from a Pub/Sub
+// subscription or pushed by Cloud Tasks HTTP tasks to /v1/tasks. Each
+// message is a container in the caaos-spec format, run once as a job. Pub/Sub
+// messages are acked once the container exits 0 and redelivered otherwise.
+type worker struct {
+	client *containerd.Client
+	sinks  []logSink
+
+	mx           sync.Mutex
+	r            *runner
+	slots        chan struct{}
+	subscription string
+	cancel       context.CancelFunc
+	tokenSecret  string
+	token        []byte
+	hostAccess   bool
+}
+
+func newWorker(client *containerd.Client, sinks []logSink) *worker {
+	return &worker{client: client, sinks: sinks}
+}
+
+// configure applies the worker-* attributes, the worker is off unless
+// worker-subscription or worker-task-token-secret is set.
+func (w *worker) configure(ctx context.Context, md *attributesJSON) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if md.WorkerSubscription == "" && md.WorkerTaskTokenSecret == "" {
+		w.stopLocked()
+		w.r, w.token, w.tokenSecret = nil, nil, ""
+		return
+	}
+	w.hostAccess = md.WorkerAllowHostAccess
+
+	r, err := newTaskRunner(ctx, w.client, md, w.sinks)
+	if err != nil {
+		logger.Error("Error configuring worker, not running tasks:", err)
+		return
+	}
+	w.r = r
+	concurrency := md.WorkerConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if w.slots == nil || cap(w.slots) != concurrency {
+		w.stopLocked()
+		w.slots = make(chan struct{}, concurrency)
+	}
+	if md.WorkerSubscription != w.subscription || w.cancel == nil {
+		w.stopLocked()
+		w.subscription = md.WorkerSubscription
+		if w.subscription != "" {
+			var sctx context.Context
+			sctx, w.cancel = context.WithCancel(ctx)
+			go w.pull(sctx, w.subscription, w.slots)
+		}
+	}
+	if md.WorkerTaskTokenSecret != w.tokenSecret {
+		w.tokenSecret, w.token = md.WorkerTaskTokenSecret, nil
+		if w.tokenSecret != "" {
+			if w.token, err = accessSecret(ctx, w.tokenSecret); err != nil {
+				logger.Error("Error reading the worker task token, Cloud Tasks disabled:", err)
+			}
+		}
+	}
+}
+
+// stopLocked stops pulling, running tasks are left to finish.
+func (w *worker) stopLocked() {
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+	w.subscription = ""
+}
+
+// newTaskRunner returns a runner for containers outside of a spec using the
+// registry, pull and policy settings of md.
+func newTaskRunner(ctx context.Context, client *containerd.Client, md *attributesJSON, sinks []logSink) (*runner, error) {
+	creds, err := parseRegistryAuth(md.RegistryAuth)
+	if err != nil {
+		return nil, err
+	}
+	registries, err := parseRegistryConfig(md)
+	if err != nil {
+		return nil, err
+	}
+	sigPolicy, err := parseSignaturePolicy(md.SignaturePolicy)
+	if err != nil {
+		return nil, err
+	}
+	imgPolicy, err := parseImagePolicy(ctx, md)
+	if err != nil {
+		return nil, err
+	}
+	return &runner{
+		client:          client,
+		resolver:        newResolver(ctx, creds, registries),
+		logSinks:        sinks,
+		gracePeriod:     defaultGracePeriod,
+		sigPolicy:       sigPolicy,
+		imagePolicy:     imgPolicy,
+		pullConcurrency: md.PullConcurrency,
+		snapshotter:     resolveSnapshotter(ctx, client, md.snapshotter()),
+	}, nil
+}
+
+func (w *worker) runner() (*runner, bool) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.r, w.hostAccess
+}
+
+type pubsubMessage struct {
+	AckID   string `json:"ackId"`
+	Message struct {
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+}
+
+// pull takes a message each time a slot is free and runs it until ctx is
+// canceled.
+func (w *worker) pull(ctx context.Context, subscription string, slots chan struct{}) {
+	logger.Info("Running tasks from", subscription)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		var out struct {
+			ReceivedMessages []pubsubMessage `json:"receivedMessages"`
+		}
+		err := pubsubCall(ctx, subscription+":pull", map[string]interface{}{"maxMessages": 1}, &out)
+		if ctx.Err() != nil {
+			<-slots
+			return
+		}
+		if err != nil || len(out.ReceivedMessages) == 0 {
+			<-slots
+			if err != nil {
+				logger.Errorf("Error pulling from %s: %v", subscription, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(10 * time.Second):
+				}
+			}
+			continue
+		}
+		go func(m pubsubMessage) {
+			defer func() { <-slots }()
+			w.runMessage(ctx, subscription, m)
+		}(out.ReceivedMessages[0])
+	}
+}
+
+// runMessage runs the message's container, extending the ack deadline
+// while it runs, and acks it on success or makes it available for
+// redelivery on failure.
+func (w *worker) runMessage(ctx context.Context, subscription string, m pubsubMessage) {
+	// Tasks run to completion once started, canceling ctx only stops
+	// pulling.
+	rctx := detach(ctx)
+	done := make(chan struct{})
+	defer close(done)
+	extend := func() {
+		if err := pubsubCall(rctx, subscription+":modifyAckDeadline", map[string]interface{}{"ackIds": []string{m.AckID}, "ackDeadlineSeconds": ackDeadline}, nil); err != nil {
+			logger.Errorf("Error extending the ack deadline of message %s: %v", m.Message.MessageID, err)
+		}
+	}
+	// The subscription's deadline may be as short as 10s, extend it before
+	// the task starts.
+	extend()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(ackExtendInterval):
+			}
+			extend()
+		}
+	}()
+
+	data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+	if err == nil {
+		err = w.runTask(rctx, m.Message.MessageID, data)
+	}
+	method, req := ":acknowledge", map[string]interface{}{"ackIds": []string{m.AckID}}
+	if err != nil {
+		logger.Errorf("Task %s failed, it will be redelivered: %v", m.Message.MessageID, err)
+		method, req = ":modifyAckDeadline", map[string]interface{}{"ackIds": []string{m.AckID}, "ackDeadlineSeconds": 0}
+	}
+	if err := pubsubCall(rctx, subscription+method, req, nil); err != nil {
+		logger.Errorf("Error acknowledging message %s: %v", m.Message.MessageID, err)
+	}
+}
+
+// runTask runs the container described by data once, it returns an error
+// if the container could not be run or exited non zero.
+func (w *worker) runTask(ctx context.Context, id string, data []byte) error {
+	r, hostAccess := w.runner()
+	if r == nil {
+		return fmt.Errorf("worker is not configured")
+	}
+	var c ContainerSpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return fmt.Errorf("error parsing task: %v", err)
+	}
+	if !hostAccess {
+		if err := checkHostAccess(c); err != nil {
+			return err
+		}
+	}
+	name := c.Name
+	if name == "" {
+		name = defaultWorkerName
+	}
+	if !validName(name) {
+		return fmt.Errorf("invalid task name %q", name)
+	}
+	// Container names must be unique while tasks run concurrently.
+	c.Name = fmt.Sprintf("%s-%s", name, shortID(id))
+	c.Kind = kindJob
+	c.RestartPolicy = ""
+	if err := (&Spec{Containers: []ContainerSpec{c}}).validate(); err != nil {
+		return err
+	}
+
+	logger := containerLogger(c.Name).With("event", "task", "task_id", id)
+	logger.Info("running task")
+	rec := runRecord{Name: c.Name, ID: id, Image: c.Image, Kind: "task", StartTime: time.Now()}
+	runOutput.track(c.Name)
+	code, err := r.runContainer(ctx, logger, c)
+	rec.EndTime = time.Now()
+	rec.Duration = rec.EndTime.Sub(rec.StartTime).Seconds()
+	rec.ExitCode = code
+	rec.LogTail = runOutput.take(c.Name)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exited with %d", code)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if herr := appendHistory(rec); herr != nil {
+		logger.Error("Error recording run history:", herr)
+	}
+	return err
+}
+
+// checkHostAccess returns an error if c or one of its sidecars could gain
+// access to the host: tasks come from whoever can publish them, who must not
+// get root on the VM unless worker-allow-host-access is set.
+func checkHostAccess(c ContainerSpec) error {
+	var verr validationError
+	addHostAccess(&verr, "task", c)
+	if len(verr) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func addHostAccess(verr *validationError, field string, c ContainerSpec) {
+	if c.Hooks != nil {
+		verr.add("%s.hooks: not allowed in tasks", field)
+	}
+	if c.OnExit != "" {
+		verr.add("%s.on-exit: not allowed in tasks", field)
+	}
+	if s := c.Security; s != nil {
+		if s.Privileged {
+			verr.add("%s.security.privileged: not allowed in tasks", field)
+		}
+		if len(s.CapAdd) > 0 {
+			verr.add("%s.security.cap-add: not allowed in tasks", field)
+		}
+		if s.Seccomp != "" && s.Seccomp != seccompDefault {
+			verr.add("%s.security.seccomp: only %q is allowed in tasks", field, seccompDefault)
+		}
+	}
+	if len(c.Devices) > 0 {
+		verr.add("%s.devices: not allowed in tasks", field)
+	}
+	for i, m := range c.Mounts {
+		switch m.Type {
+		case "", "bind", "disk":
+			verr.add("%s.mounts[%d]: host and disk mounts are not allowed in tasks", field, i)
+		}
+	}
+	for i, s := range c.Sidecars {
+		addHostAccess(verr, fmt.Sprintf("%s.sidecars[%d]", field, i), s)
+	}
+}
+
+// shortID returns a name safe suffix of a message or task ID.
+func shortID(id string) string {
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > 16 {
+		id = id[len(id)-16:]
+	}
+	if id == "" || !validName(id) {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return id
+}
+
+// handleTask serves POST /v1/tasks for Cloud Tasks HTTP tasks, the task
+// runs while the request is open so Cloud Tasks retries it if it fails.
+// Requests are refused with 429 while all slots are busy.
+func (w *worker) handleTask(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.mx.Lock()
+	token, slots := w.token, w.slots
+	w.mx.Unlock()
+	if token == nil {
+		http.Error(rw, "tasks are not enabled", http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get(taskTokenHeader)), token) != 1 {
+		http.Error(rw, "invalid task token", http.StatusUnauthorized)
+		return
+	}
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	default:
+		http.Error(rw, "all task slots are busy", http.StatusTooManyRequests)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxTaskSize))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := req.Header.Get("X-CloudTasks-TaskName")
+	if err := w.runTask(req.Context(), id, data); err != nil {
+		logger.Errorf("Task %s failed: %v", id, err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}